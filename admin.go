@@ -0,0 +1,143 @@
+package slidingsync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
+)
+
+// AdminUser is the response to GET /admin/v1/users/{userID}
+type AdminUser struct {
+	UserID       string             `json:"user_id"`
+	Devices      []sync2.Device     `json:"devices"`
+	Conns        []sync3.ConnInfo   `json:"conns"`
+	Pollers      []sync2.PollerInfo `json:"pollers"`
+	HasUserCache bool               `json:"has_user_cache"`
+}
+
+type adminHandler struct {
+	h2     *handler2.Handler
+	h3     *handler.SyncLiveHandler
+	secret []byte
+}
+
+// NewAdminHandler returns the admin HTTP API, which lets operators inspect and act on what the
+// proxy is doing for a given user. Every request must have an `Authorization: Bearer <secret>`
+// header. The API should be served on a separate listener to the client-facing API.
+func NewAdminHandler(h2 *handler2.Handler, h3 *handler.SyncLiveHandler, secret string) http.Handler {
+	a := &adminHandler{
+		h2:     h2,
+		h3:     h3,
+		secret: []byte(secret),
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/v1/users/{userID}", a.wrap(a.getUser)).Methods("GET")
+	r.HandleFunc("/admin/v1/users/{userID}/devices/{deviceID}/close_conns", a.wrap(a.closeConns)).Methods("POST")
+	// the conn_id is optional as most clients do not set one
+	r.HandleFunc("/admin/v1/users/{userID}/devices/{deviceID}/lists/{listKey}/explain", a.wrap(a.explainList)).Methods("GET").Queries("conn_id", "{connID}")
+	r.HandleFunc("/admin/v1/users/{userID}/devices/{deviceID}/lists/{listKey}/explain", a.wrap(a.explainList)).Methods("GET")
+	r.HandleFunc("/admin/v1/users/{userID}/devices/{deviceID}/restart_poller", a.wrap(a.restartPoller)).Methods("POST")
+	r.HandleFunc("/admin/v1/users/{userID}/evict_cache", a.wrap(a.evictUserCache)).Methods("POST")
+	r.HandleFunc("/admin/v1/rooms/{roomID}/invalidate", a.wrap(a.invalidateRoom)).Methods("POST")
+	return r
+}
+
+// wrap authenticates the request and writes the response or error as JSON.
+func (a *adminHandler) wrap(fn func(vars map[string]string) (interface{}, *internal.HandlerError)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if len(a.secret) == 0 || subtle.ConstantTimeCompare([]byte(token), a.secret) != 1 {
+			herr := &internal.HandlerError{
+				StatusCode: 401,
+				Err:        fmt.Errorf("missing or invalid admin secret"),
+				ErrCode:    "M_UNKNOWN_TOKEN",
+			}
+			w.WriteHeader(herr.StatusCode)
+			w.Write(herr.JSON())
+			return
+		}
+		res, herr := fn(mux.Vars(req))
+		if herr != nil {
+			logger.Warn().Err(herr).Str("path", req.URL.Path).Msg("admin request failed")
+			w.WriteHeader(herr.StatusCode)
+			w.Write(herr.JSON())
+			return
+		}
+		logger.Info().Str("method", req.Method).Str("path", req.URL.Path).Msg("admin request")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func (a *adminHandler) getUser(vars map[string]string) (interface{}, *internal.HandlerError) {
+	userID := vars["userID"]
+	devices, err := a.h3.V2Store.DevicesTable.SelectDevicesForUser(userID)
+	if err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        fmt.Errorf("failed to load devices: %w", err),
+		}
+	}
+	return AdminUser{
+		UserID:       userID,
+		Devices:      devices,
+		Conns:        a.h3.ConnsForUser(userID),
+		Pollers:      a.h2.Pollers(userID),
+		HasUserCache: a.h3.HasUserCache(userID),
+	}, nil
+}
+
+func (a *adminHandler) closeConns(vars map[string]string) (interface{}, *internal.HandlerError) {
+	closed := a.h3.CloseConns(vars["userID"], vars["deviceID"])
+	return map[string]int{"closed": closed}, nil
+}
+
+func (a *adminHandler) explainList(vars map[string]string) (interface{}, *internal.HandlerError) {
+	connID := sync3.ConnID{
+		UserID:   vars["userID"],
+		DeviceID: vars["deviceID"],
+		CID:      vars["connID"],
+	}
+	ex, ok := a.h3.ExplainList(connID, vars["listKey"])
+	if !ok {
+		return nil, &internal.HandlerError{
+			StatusCode: 404,
+			Err:        fmt.Errorf("no list %q on connection %s", vars["listKey"], connID.String()),
+			ErrCode:    "M_NOT_FOUND",
+		}
+	}
+	return ex, nil
+}
+
+func (a *adminHandler) restartPoller(vars map[string]string) (interface{}, *internal.HandlerError) {
+	if err := a.h2.RestartPoller(vars["userID"], vars["deviceID"]); err != nil {
+		return nil, &internal.HandlerError{
+			StatusCode: 400,
+			Err:        err,
+		}
+	}
+	return struct{}{}, nil
+}
+
+func (a *adminHandler) evictUserCache(vars map[string]string) (interface{}, *internal.HandlerError) {
+	evicted, closed := a.h3.EvictUserCache(vars["userID"])
+	return map[string]interface{}{
+		"evicted": evicted,
+		"closed":  closed,
+	}, nil
+}
+
+func (a *adminHandler) invalidateRoom(vars map[string]string) (interface{}, *internal.HandlerError) {
+	a.h2.InvalidateRoom(vars["roomID"])
+	return struct{}{}, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -23,7 +24,11 @@ import (
 
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
 )
 
 var GitCommit string
@@ -56,13 +61,31 @@ const (
 	EnvIdleTimeoutSecs        = "SYNCV3_DB_IDLE_TIMEOUT_SECS"
 	EnvHTTPTimeoutSecs        = "SYNCV3_HTTP_TIMEOUT_SECS"
 	EnvHTTPInitialTimeoutSecs = "SYNCV3_HTTP_INITIAL_TIMEOUT_SECS"
+	EnvDBReplica              = "SYNCV3_DB_REPLICA"
+	EnvEventsSecret           = "SYNCV3_EVENTS_SECRET"
+	EnvPreviousEventsSecrets  = "SYNCV3_PREV_EVENTS_SECRETS"
+	EnvPreviousSecrets        = "SYNCV3_PREV_SECRETS"
+	EnvCacheRooms             = "SYNCV3_CACHE_ROOMS"
+	EnvLazyStartup            = "SYNCV3_LAZY_STARTUP"
+	EnvAdminBindAddr          = "SYNCV3_ADMIN_BINDADDR"
+	EnvAdminSecret            = "SYNCV3_ADMIN_SECRET"
+	EnvRateLimit              = "SYNCV3_RATE_LIMIT"
+	EnvRateBurst              = "SYNCV3_RATE_BURST"
+	EnvMaxConnIDs             = "SYNCV3_MAX_CONN_IDS"
+	EnvMaxLists               = "SYNCV3_MAX_LISTS"
+	EnvMaxRangeWidth          = "SYNCV3_MAX_RANGE_WIDTH"
+	EnvMaxResponseRooms       = "SYNCV3_MAX_RESPONSE_ROOMS"
+	EnvMaxResponseBytes       = "SYNCV3_MAX_RESPONSE_BYTES"
+	EnvShutdownTimeoutSecs    = "SYNCV3_SHUTDOWN_TIMEOUT_SECS"
+	EnvProxySend              = "SYNCV3_PROXY_SEND"
+	EnvRoomNameTranslations   = "SYNCV3_ROOM_NAME_TRANSLATIONS"
 )
 
 var helpMsg = fmt.Sprintf(`
 Environment var
 %s     Required. The destination homeserver to talk to (CS API HTTPS URL) e.g 'https://matrix-client.matrix.org' (Supports unix socket: /path/to/socket)
 %s         Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
-%s     Required. A secret to use to encrypt access tokens. Must remain the same for the lifetime of the database.
+%s     Required. A secret to use to encrypt access tokens. To change it, move the old secret to SYNCV3_PREV_SECRETS.
 %s   Default: 0.0.0.0:8008.  The interface and port to listen on. (Supports unix socket: /path/to/socket)
 %s   Default: unset. Path to a certificate file to serve to HTTPS clients. Specifying this enables TLS on the bound address.
 %s    Default: unset. Path to a key file for the certificate. Must be provided along with the certificate file.
@@ -77,8 +100,28 @@ Environment var
 %s Default: 3600. The maximum amount of time a database connection may be idle, in seconds. 0 means no limit.
 %s Default: 300. The timeout in seconds for normal HTTP requests.
 %s Default: 1800. The timeout in seconds for initial sync requests.
+%s Default: unset. The postgres connection string for a read replica of SYNCV3_DB. If set, heavy read-only queries are sent to the replica once it has caught up.
+%s Default: unset. A secret used to encrypt event JSON at rest. Existing events are encrypted in the background on startup. To change it, move the old secret to SYNCV3_PREV_EVENTS_SECRETS.
+%s Default: unset. Comma-separated secrets which were previously used as SYNCV3_EVENTS_SECRET. Events encrypted with them can still be read.
+%s  Default: unset. Comma-separated secrets which were previously used as SYNCV3_SECRET. Access tokens encrypted with them are re-encrypted with SYNCV3_SECRET on startup, after which they can be removed.
+%s   Default: 0. The maximum number of rooms to hold in memory, excluding rooms with connected users. Other rooms are loaded from the database when needed. 0 means no limit.
+%s  Default: unset. Set to '1' to serve requests immediately on startup, loading rooms as users connect instead of all at once. Progress is reported at /ready.
+%s Default: unset. The bind addr for the admin API e.g ':8009'. If not set, does not listen. Requires SYNCV3_ADMIN_SECRET.
+%s  Default: unset. The secret admin API requests must send as 'Authorization: Bearer <secret>'.
+%s    Default: 0. The number of requests per second each user can make, e.g '0.5'. Further requests are rejected with M_LIMIT_EXCEEDED. 0 means no limit.
+%s    Default: 0. The number of requests each user can make at once before SYNCV3_RATE_LIMIT applies. 0 means SYNCV3_RATE_LIMIT rounded up.
+%s  Default: 0. The number of conn_ids each device can have at once. 0 means no limit.
+%s     Default: 0. The number of lists each request can have. 0 means no limit.
+%s Default: 0. The number of rooms each list range can cover. 0 means no limit.
+%s Default: 0. The number of rooms to send in a response. The rest are sent in the next response, nearest the top of the lists first. 0 means no limit.
+%s Default: 0. The approximate number of bytes of room data to send in a response. The rest are sent in the next response. 0 means no limit.
+%s Default: 25. On SIGINT or SIGTERM, the number of seconds to wait for requests to return and pollers to stop before exiting.
+%s    Default: unset. Set to '1' to forward requests to send events and state to SYNCV3_SERVER, so senders receive their events with transaction IDs without delay. Clients must send these requests to the proxy.
+%s Default: unset. Path to a JSON file of room name translations by language e.g '{"de":{"empty_room":"Leerer Raum","empty_room_was":"Leerer Raum (war %%s)","and":" und ","and_others":"%%s und %%d andere","disambiguate":"%%s (%%s)"}}'. Clients choose a language with the 'language' request field or the Accept-Language header. Unset strings are in English.
 `, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvOTLP, EnvOTLPUsername, EnvOTLPPassword,
-	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs)
+	EnvSentryDsn, EnvLogLevel, EnvMaxConns, EnvIdleTimeoutSecs, EnvHTTPTimeoutSecs, EnvHTTPInitialTimeoutSecs, EnvDBReplica, EnvEventsSecret, EnvPreviousEventsSecrets, EnvPreviousSecrets,
+	EnvCacheRooms, EnvLazyStartup, EnvAdminBindAddr, EnvAdminSecret, EnvRateLimit, EnvRateBurst, EnvMaxConnIDs, EnvMaxLists, EnvMaxRangeWidth,
+	EnvMaxResponseRooms, EnvMaxResponseBytes, EnvShutdownTimeoutSecs, EnvProxySend, EnvRoomNameTranslations)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -96,6 +139,10 @@ func main() {
 		executeMigrations()
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		executeFsck()
+		return
+	}
 
 	args := map[string]string{
 		EnvServer:                 os.Getenv(EnvServer),
@@ -116,6 +163,24 @@ func main() {
 		EnvIdleTimeoutSecs:        defaulting(os.Getenv(EnvIdleTimeoutSecs), "3600"),
 		EnvHTTPTimeoutSecs:        defaulting(os.Getenv(EnvHTTPTimeoutSecs), "300"),
 		EnvHTTPInitialTimeoutSecs: defaulting(os.Getenv(EnvHTTPInitialTimeoutSecs), "1800"),
+		EnvDBReplica:              os.Getenv(EnvDBReplica),
+		EnvEventsSecret:           os.Getenv(EnvEventsSecret),
+		EnvPreviousEventsSecrets:  os.Getenv(EnvPreviousEventsSecrets),
+		EnvPreviousSecrets:        os.Getenv(EnvPreviousSecrets),
+		EnvCacheRooms:             defaulting(os.Getenv(EnvCacheRooms), "0"),
+		EnvLazyStartup:            os.Getenv(EnvLazyStartup),
+		EnvAdminBindAddr:          os.Getenv(EnvAdminBindAddr),
+		EnvAdminSecret:            os.Getenv(EnvAdminSecret),
+		EnvRateLimit:              defaulting(os.Getenv(EnvRateLimit), "0"),
+		EnvRateBurst:              defaulting(os.Getenv(EnvRateBurst), "0"),
+		EnvMaxConnIDs:             defaulting(os.Getenv(EnvMaxConnIDs), "0"),
+		EnvMaxLists:               defaulting(os.Getenv(EnvMaxLists), "0"),
+		EnvMaxRangeWidth:          defaulting(os.Getenv(EnvMaxRangeWidth), "0"),
+		EnvMaxResponseRooms:       defaulting(os.Getenv(EnvMaxResponseRooms), "0"),
+		EnvMaxResponseBytes:       defaulting(os.Getenv(EnvMaxResponseBytes), "0"),
+		EnvShutdownTimeoutSecs:    defaulting(os.Getenv(EnvShutdownTimeoutSecs), "25"),
+		EnvProxySend:              os.Getenv(EnvProxySend),
+		EnvRoomNameTranslations:   os.Getenv(EnvRoomNameTranslations),
 	}
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
 	for _, requiredEnvVar := range requiredEnvVars {
@@ -131,6 +196,11 @@ func main() {
 		fmt.Printf("\nboth %s and %s must be set together\n", EnvTLSCert, EnvTLSKey)
 		os.Exit(1)
 	}
+	if args[EnvAdminBindAddr] != "" && args[EnvAdminSecret] == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s must be set when %s is set\n", EnvAdminSecret, EnvAdminBindAddr)
+		os.Exit(1)
+	}
 	// pprof
 	if args[EnvPPROF] != "" {
 		go func() {
@@ -194,6 +264,12 @@ func main() {
 		}
 	}
 
+	if args[EnvRoomNameTranslations] != "" {
+		if err := loadRoomNameTranslations(args[EnvRoomNameTranslations]); err != nil {
+			panic("invalid value for " + EnvRoomNameTranslations + ": " + err.Error())
+		}
+	}
+
 	maxConnsInt, err := strconv.Atoi(args[EnvMaxConns])
 	if err != nil {
 		panic("invalid value for " + EnvMaxConns + ": " + args[EnvMaxConns])
@@ -210,6 +286,42 @@ func main() {
 	if err != nil {
 		panic("invalid value for " + EnvHTTPInitialTimeoutSecs + ": " + args[EnvHTTPInitialTimeoutSecs])
 	}
+	cacheRooms, err := strconv.Atoi(args[EnvCacheRooms])
+	if err != nil {
+		panic("invalid value for " + EnvCacheRooms + ": " + args[EnvCacheRooms])
+	}
+	rateLimit, err := strconv.ParseFloat(args[EnvRateLimit], 64)
+	if err != nil {
+		panic("invalid value for " + EnvRateLimit + ": " + args[EnvRateLimit])
+	}
+	rateBurst, err := strconv.Atoi(args[EnvRateBurst])
+	if err != nil {
+		panic("invalid value for " + EnvRateBurst + ": " + args[EnvRateBurst])
+	}
+	maxConnIDs, err := strconv.Atoi(args[EnvMaxConnIDs])
+	if err != nil {
+		panic("invalid value for " + EnvMaxConnIDs + ": " + args[EnvMaxConnIDs])
+	}
+	maxLists, err := strconv.Atoi(args[EnvMaxLists])
+	if err != nil {
+		panic("invalid value for " + EnvMaxLists + ": " + args[EnvMaxLists])
+	}
+	maxRangeWidth, err := strconv.ParseInt(args[EnvMaxRangeWidth], 10, 64)
+	if err != nil {
+		panic("invalid value for " + EnvMaxRangeWidth + ": " + args[EnvMaxRangeWidth])
+	}
+	maxResponseRooms, err := strconv.Atoi(args[EnvMaxResponseRooms])
+	if err != nil {
+		panic("invalid value for " + EnvMaxResponseRooms + ": " + args[EnvMaxResponseRooms])
+	}
+	maxResponseBytes, err := strconv.Atoi(args[EnvMaxResponseBytes])
+	if err != nil {
+		panic("invalid value for " + EnvMaxResponseBytes + ": " + args[EnvMaxResponseBytes])
+	}
+	shutdownTimeoutSecs, err := strconv.Atoi(args[EnvShutdownTimeoutSecs])
+	if err != nil {
+		panic("invalid value for " + EnvShutdownTimeoutSecs + ": " + args[EnvShutdownTimeoutSecs])
+	}
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
 		AddPrometheusMetrics:  args[EnvPrometheus] != "",
 		DBMaxConns:            maxConnsInt,
@@ -217,8 +329,37 @@ func main() {
 		MaxTransactionIDDelay: time.Second,
 		HTTPTimeout:           time.Duration(httpTimeoutSecs) * time.Second,
 		HTTPLongTimeout:       time.Duration(httpLongTimeoutSecs) * time.Second,
+		DBReplicaURI:          args[EnvDBReplica],
+		EventSecret:           args[EnvEventsSecret],
+		PreviousEventSecrets:  splitSecrets(args[EnvPreviousEventsSecrets]),
+		PreviousSecrets:       splitSecrets(args[EnvPreviousSecrets]),
+		GlobalCacheMaxRooms:   cacheRooms,
+		LazyStartup:           args[EnvLazyStartup] == "1",
+		Limits: handler.Limits{
+			RequestsPerSecond: rateLimit,
+			RequestBurst:      rateBurst,
+			MaxConnsPerDevice: maxConnIDs,
+			MaxLists:          maxLists,
+			MaxRangeWidth:     maxRangeWidth,
+		},
+		ResponseBudget: sync3.ResponseBudget{
+			MaxRooms: maxResponseRooms,
+			MaxBytes: maxResponseBytes,
+		},
 	})
 
+	syncHandler := h3.(*handler.SyncLiveHandler)
+
+	if args[EnvAdminBindAddr] != "" {
+		adminHandler := syncv3.NewAdminHandler(h2, syncHandler, args[EnvAdminSecret])
+		go func() {
+			fmt.Printf("Starting admin listener on %s\n", args[EnvAdminBindAddr])
+			if err := http.ListenAndServe(args[EnvAdminBindAddr], adminHandler); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	go h2.StartV2Pollers()
 	go h2.Store.Cleaner(time.Hour)
 	if args[EnvOTLP] != "" {
@@ -233,13 +374,18 @@ func main() {
 		h3 = sentryHandler.Handle(h3)
 	}
 
-	syncv3.RunSyncV3Server(h3, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
-	WaitForShutdown(args[EnvSentryDsn] != "")
+	var sendHandler http.Handler
+	if args[EnvProxySend] == "1" {
+		sendHandler = http.HandlerFunc(syncHandler.ServeSend)
+	}
+	httpServer := syncv3.RunSyncV3Server(h3, http.HandlerFunc(syncHandler.ServeReady), sendHandler, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
+	WaitForShutdown(args[EnvSentryDsn] != "", httpServer, h2, syncHandler, time.Duration(shutdownTimeoutSecs)*time.Second)
 }
 
 // WaitForShutdown blocks until the process receives a SIGINT or SIGTERM signal
-// (see `man 7 signal`). It performs any last cleanup tasks and then exits.
-func WaitForShutdown(sentryInUse bool) {
+// (see `man 7 signal`). It drains connections and pollers, performs any last
+// cleanup tasks and then exits. Draining stops after the timeout.
+func WaitForShutdown(sentryInUse bool, httpServer *http.Server, pollHandler *handler2.Handler, syncHandler *handler.SyncLiveHandler, timeout time.Duration) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	select {
@@ -248,6 +394,23 @@ func WaitForShutdown(sentryInUse bool) {
 	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
 
 	fmt.Printf("Shutdown signal received...")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	fmt.Printf("Draining connections...")
+	syncHandler.Drain()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		fmt.Printf("Failed to drain all connections: %s", err)
+		httpServer.Close()
+	}
+
+	fmt.Printf("Snapshotting connections...")
+	syncHandler.SnapshotConnections()
+
+	fmt.Printf("Draining pollers...")
+	if err := pollHandler.Drain(ctx); err != nil {
+		fmt.Printf("Failed to drain all pollers: %s", err)
+	}
 
 	if sentryInUse {
 		fmt.Printf("Flushing sentry events...")
@@ -305,6 +468,60 @@ func executeMigrations() {
 	}
 }
 
+// executeFsck checks the database for inconsistencies, optionally repairing them. The proxy
+// should not be running at the same time, as it caches much of this data in memory.
+func executeFsck() {
+	if os.Getenv(EnvDB) == "" {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s is not set\n", EnvDB)
+		os.Exit(1)
+	}
+	fsckFlags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fsckFlags.Bool("repair", false, "Repair any violations found. Rooms with broken snapshots are deleted and refetched from the homeserver.")
+	fsckFlags.Parse(os.Args[2:])
+
+	store := state.NewStorage(os.Getenv(EnvDB))
+	violations, err := store.Fsck(*repair)
+	store.Teardown()
+	if err != nil {
+		log.Fatalf("fsck: %v", err)
+	}
+	for _, v := range violations {
+		fmt.Println(v.String())
+	}
+	fmt.Printf("fsck: found %d violations\n", len(violations))
+	if len(violations) == 0 {
+		return
+	}
+	if *repair {
+		fmt.Printf("fsck: repaired %d violations\n", len(violations))
+		return
+	}
+	fmt.Printf("fsck: run with -repair to fix them\n")
+	os.Exit(1)
+}
+
+// splitSecrets parses a comma-separated list of secrets, ignoring surrounding whitespace.
+func splitSecrets(in string) []string {
+	var secrets []string
+	for _, secret := range strings.Split(in, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+func loadRoomNameTranslations(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return internal.LoadRoomNameTranslations(f)
+}
+
 const gitRevLen = 7 // 7 matches the displayed characters on github.com
 func init() {
 	// Try to get the revision sliding-sync was build from.
@@ -8,6 +8,7 @@ require (
 	github.com/getsentry/sentry-go v0.24.1
 	github.com/gorilla/mux v1.8.0
 	github.com/jmoiron/sqlx v1.3.3
+	github.com/klauspost/compress v1.16.7
 	github.com/lib/pq v1.10.9
 	github.com/matrix-org/complement v0.0.0-20231102222540-7efd8fce6d58
 	github.com/matrix-org/gomatrixserverlib v0.0.0-20230921171121-0466775328c7
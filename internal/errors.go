@@ -21,6 +21,8 @@ type HandlerError struct {
 	StatusCode int
 	Err        error
 	ErrCode    string
+	// RetryAfterMs is how long the client should wait before retrying, for M_LIMIT_EXCEEDED errors.
+	RetryAfterMs int64
 }
 
 func (e *HandlerError) Error() string {
@@ -32,14 +34,16 @@ func (e *HandlerError) Unwrap() error {
 }
 
 type jsonError struct {
-	Err  string `json:"error"`
-	Code string `json:"errcode,omitempty"`
+	Err          string `json:"error"`
+	Code         string `json:"errcode,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
 }
 
 func (e HandlerError) JSON() []byte {
 	je := jsonError{
-		Err:  e.Error(),
-		Code: e.ErrCode,
+		Err:          e.Error(),
+		Code:         e.ErrCode,
+		RetryAfterMs: e.RetryAfterMs,
 	}
 	b, _ := json.Marshal(je)
 	return b
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// PushRules is the content of m.push_rules global account data. It is used to work out locally
+// whether events notify or highlight the user, when the upstream server hasn't told us.
+// See https://spec.matrix.org/v1.10/client-server-api/#push-rules
+type PushRules struct {
+	Global PushRuleset `json:"global"`
+}
+
+type PushRuleset struct {
+	Override  []PushRule `json:"override"`
+	Content   []PushRule `json:"content"`
+	Room      []PushRule `json:"room"`
+	Sender    []PushRule `json:"sender"`
+	Underride []PushRule `json:"underride"`
+}
+
+type PushRule struct {
+	RuleID     string            `json:"rule_id"`
+	Enabled    bool              `json:"enabled"`
+	Conditions []PushCondition   `json:"conditions"`
+	Actions    []json.RawMessage `json:"actions"`
+	// only for content rules
+	Pattern string `json:"pattern"`
+
+	pattern *regexp.Regexp
+}
+
+type PushCondition struct {
+	Kind    string          `json:"kind"`
+	Key     string          `json:"key"`
+	Pattern string          `json:"pattern"`
+	Value   json.RawMessage `json:"value"`
+	// only for room_member_count e.g "2", "<=10"
+	Is string `json:"is"`
+
+	pattern *regexp.Regexp
+}
+
+// PushContext is information about the room and user needed to evaluate push rules.
+type PushContext struct {
+	UserID      string
+	DisplayName string // the user's display name in the room, if any
+	MemberCount int    // the number of joined users in the room
+	// SenderCanNotify returns true if the sender has permission to send this kind of notification
+	// e.g "room" for @room. If nil, senders never have permission.
+	SenderCanNotify func(sender, key string) bool
+}
+
+// NewPushRules parses the content of m.push_rules account data.
+func NewPushRules(content []byte) (*PushRules, error) {
+	var rules PushRules
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, err
+	}
+	for _, kind := range [][]PushRule{rules.Global.Override, rules.Global.Content, rules.Global.Underride} {
+		for i := range kind {
+			rule := &kind[i]
+			if rule.Pattern != "" {
+				rule.pattern = globToRegexp(rule.Pattern, true)
+			}
+			for j := range rule.Conditions {
+				cond := &rule.Conditions[j]
+				if cond.Kind == "event_match" {
+					cond.pattern = globToRegexp(cond.Pattern, cond.Key == "content.body")
+				}
+			}
+		}
+	}
+	return &rules, nil
+}
+
+// Evaluate the push rules against this event, returning whether the event notifies and highlights
+// the user. Events never highlight without notifying.
+func (r *PushRules) Evaluate(event json.RawMessage, pctx PushContext) (notify, highlight bool) {
+	ev := gjson.ParseBytes(event)
+	if ev.Get("sender").Str == pctx.UserID {
+		return false, false
+	}
+	for _, rule := range r.Global.Override {
+		if rule.Enabled && rule.conditionsMatch(ev, pctx) {
+			return rule.actions()
+		}
+	}
+	body := ev.Get("content.body")
+	for _, rule := range r.Global.Content {
+		if rule.Enabled && rule.pattern != nil && body.Type == gjson.String && rule.pattern.MatchString(body.Str) {
+			return rule.actions()
+		}
+	}
+	roomID := ev.Get("room_id").Str
+	for _, rule := range r.Global.Room {
+		if rule.Enabled && rule.RuleID == roomID {
+			return rule.actions()
+		}
+	}
+	sender := ev.Get("sender").Str
+	for _, rule := range r.Global.Sender {
+		if rule.Enabled && rule.RuleID == sender {
+			return rule.actions()
+		}
+	}
+	for _, rule := range r.Global.Underride {
+		if rule.Enabled && rule.conditionsMatch(ev, pctx) {
+			return rule.actions()
+		}
+	}
+	return false, false
+}
+
+func (r *PushRule) conditionsMatch(ev gjson.Result, pctx PushContext) bool {
+	for _, cond := range r.Conditions {
+		if !cond.matches(ev, pctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *PushRule) actions() (notify, highlight bool) {
+	for _, action := range r.Actions {
+		a := gjson.ParseBytes(action)
+		switch {
+		case a.Str == "notify":
+			notify = true
+		case a.Get("set_tweak").Str == "highlight":
+			v := a.Get("value")
+			highlight = !v.Exists() || v.Bool()
+		}
+	}
+	return notify, notify && highlight
+}
+
+func (c *PushCondition) matches(ev gjson.Result, pctx PushContext) bool {
+	switch c.Kind {
+	case "event_match":
+		val := ev.Get(c.Key)
+		return c.pattern != nil && val.Type == gjson.String && c.pattern.MatchString(val.Str)
+	case "event_property_is":
+		val := ev.Get(c.Key)
+		return val.Exists() && sameJSONValue(val, gjson.ParseBytes(c.Value))
+	case "event_property_contains":
+		want := gjson.ParseBytes(c.Value)
+		found := false
+		ev.Get(c.Key).ForEach(func(_, v gjson.Result) bool {
+			found = sameJSONValue(v, want)
+			return !found
+		})
+		return found
+	case "contains_display_name":
+		body := ev.Get("content.body")
+		if pctx.DisplayName == "" || body.Type != gjson.String {
+			return false
+		}
+		re, err := regexp.Compile(`(?is)(^|\W)` + regexp.QuoteMeta(pctx.DisplayName) + `(\W|$)`)
+		return err == nil && re.MatchString(body.Str)
+	case "room_member_count":
+		return memberCountMatches(c.Is, pctx.MemberCount)
+	case "sender_notification_permission":
+		return pctx.SenderCanNotify != nil && pctx.SenderCanNotify(ev.Get("sender").Str, c.Key)
+	}
+	// unknown conditions never match
+	return false
+}
+
+func sameJSONValue(a, b gjson.Result) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case gjson.String:
+		return a.Str == b.Str
+	case gjson.Number:
+		return a.Raw == b.Raw
+	case gjson.True, gjson.False, gjson.Null:
+		return true
+	}
+	return false
+}
+
+func memberCountMatches(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	want, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == want
+	case "<":
+		return count < want
+	case ">":
+		return count > want
+	case "<=":
+		return count <= want
+	case ">=":
+		return count >= want
+	}
+	return false
+}
+
+// globToRegexp converts a push rule glob into a case-insensitive regexp. If wordBoundary is set,
+// the glob matches whole words anywhere in the value, else it must match the entire value.
+func globToRegexp(glob string, wordBoundary bool) *regexp.Regexp {
+	expr := regexp.QuoteMeta(glob)
+	expr = strings.ReplaceAll(expr, `\*`, `.*?`)
+	expr = strings.ReplaceAll(expr, `\?`, `.`)
+	if wordBoundary {
+		expr = `(^|\W)` + expr + `(\W|$)`
+	} else {
+		expr = `^` + expr + `$`
+	}
+	re, err := regexp.Compile(`(?is)` + expr)
+	if err != nil {
+		return nil
+	}
+	return re
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testPushRules = `{
+	"global": {
+		"override": [
+			{"rule_id": ".m.rule.master", "default": true, "enabled": false, "conditions": [], "actions": []},
+			{"rule_id": ".m.rule.suppress_notices", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_match", "key": "content.msgtype", "pattern": "m.notice"}
+			], "actions": []},
+			{"rule_id": ".m.rule.is_user_mention", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_property_contains", "key": "content.m\\.mentions.user_ids", "value": "@alice:localhost"}
+			], "actions": ["notify", {"set_tweak": "highlight"}]},
+			{"rule_id": ".m.rule.contains_display_name", "default": true, "enabled": true, "conditions": [
+				{"kind": "contains_display_name"}
+			], "actions": ["notify", {"set_tweak": "highlight"}]},
+			{"rule_id": ".m.rule.is_room_mention", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_property_is", "key": "content.m\\.mentions.room", "value": true},
+				{"kind": "sender_notification_permission", "key": "room"}
+			], "actions": ["notify", {"set_tweak": "highlight"}]}
+		],
+		"content": [
+			{"rule_id": "lunch", "default": false, "enabled": true, "pattern": "lunch*", "actions": ["notify", {"set_tweak": "highlight", "value": false}]}
+		],
+		"room": [
+			{"rule_id": "!muted:localhost", "default": false, "enabled": true, "actions": []}
+		],
+		"sender": [
+			{"rule_id": "@boss:localhost", "default": false, "enabled": true, "actions": ["notify", {"set_tweak": "highlight"}]}
+		],
+		"underride": [
+			{"rule_id": ".m.rule.room_one_to_one", "default": true, "enabled": true, "conditions": [
+				{"kind": "room_member_count", "is": "2"},
+				{"kind": "event_match", "key": "type", "pattern": "m.room.message"}
+			], "actions": ["notify", {"set_tweak": "sound", "value": "default"}]},
+			{"rule_id": ".m.rule.message", "default": true, "enabled": true, "conditions": [
+				{"kind": "event_match", "key": "type", "pattern": "m.room.message"}
+			], "actions": ["notify"]}
+		]
+	}
+}`
+
+func TestPushRulesEvaluate(t *testing.T) {
+	rules, err := NewPushRules([]byte(testPushRules))
+	if err != nil {
+		t.Fatalf("NewPushRules: %s", err)
+	}
+	pctx := PushContext{
+		UserID:      "@alice:localhost",
+		DisplayName: "Alice",
+		MemberCount: 5,
+		SenderCanNotify: func(sender, key string) bool {
+			return sender == "@mod:localhost" && key == "room"
+		},
+	}
+	testCases := []struct {
+		name          string
+		event         string
+		memberCount   int
+		wantNotify    bool
+		wantHighlight bool
+	}{
+		{
+			name:       "message",
+			event:      `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			wantNotify: true,
+		},
+		{
+			name:  "own message",
+			event: `{"type":"m.room.message","room_id":"!a:localhost","sender":"@alice:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+		},
+		{
+			name:  "notice",
+			event: `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.notice","body":"hello"}}`,
+		},
+		{
+			name:  "non-message event",
+			event: `{"type":"m.reaction","room_id":"!a:localhost","sender":"@bob:localhost","content":{}}`,
+		},
+		{
+			name:          "user mention",
+			event:         `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hi","m.mentions":{"user_ids":["@alice:localhost"]}}}`,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:          "display name",
+			event:         `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hi alice!"}}`,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "display name inside another word",
+			event:      `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hi malice"}}`,
+			wantNotify: true,
+		},
+		{
+			name:          "room mention with permission",
+			event:         `{"type":"m.room.message","room_id":"!a:localhost","sender":"@mod:localhost","content":{"msgtype":"m.text","body":"hi","m.mentions":{"room":true}}}`,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:       "room mention without permission",
+			event:      `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hi","m.mentions":{"room":true}}}`,
+			wantNotify: true,
+		},
+		{
+			name:       "content rule with highlight disabled",
+			event:      `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"anyone for LUNCHTIME?"}}`,
+			wantNotify: true,
+		},
+		{
+			name:  "muted room",
+			event: `{"type":"m.room.message","room_id":"!muted:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+		},
+		{
+			name:          "sender rule",
+			event:         `{"type":"m.room.message","room_id":"!a:localhost","sender":"@boss:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:        "one to one",
+			event:       `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 2,
+			wantNotify:  true,
+		},
+	}
+	for _, tc := range testCases {
+		pctx := pctx
+		if tc.memberCount > 0 {
+			pctx.MemberCount = tc.memberCount
+		}
+		notify, highlight := rules.Evaluate(json.RawMessage(tc.event), pctx)
+		if notify != tc.wantNotify || highlight != tc.wantHighlight {
+			t.Errorf("%s: got notify=%v highlight=%v, want notify=%v highlight=%v", tc.name, notify, highlight, tc.wantNotify, tc.wantHighlight)
+		}
+	}
+}
+
+func TestPushRulesMemberCount(t *testing.T) {
+	testCases := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{is: "2", count: 2, want: true},
+		{is: "==2", count: 3, want: false},
+		{is: "<10", count: 9, want: true},
+		{is: ">10", count: 10, want: false},
+		{is: "<=10", count: 10, want: true},
+		{is: ">=10", count: 9, want: false},
+		{is: "!=2", count: 3, want: false},
+		{is: "lots", count: 3, want: false},
+	}
+	for _, tc := range testCases {
+		if got := memberCountMatches(tc.is, tc.count); got != tc.want {
+			t.Errorf("memberCountMatches(%q, %d): got %v want %v", tc.is, tc.count, got, tc.want)
+		}
+	}
+}
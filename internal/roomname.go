@@ -152,8 +152,11 @@ type Hero struct {
 }
 
 // CalculateRoomName calculates the room name. Returns the name and if the name was actually calculated
-// based on room heroes.
-func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name string, calculated bool) {
+// based on room heroes. Calculated names are composed using the translations, or EnglishRoomNames if nil.
+func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int, translations *RoomNameTranslations) (name string, calculated bool) {
+	if translations == nil {
+		translations = &EnglishRoomNames
+	}
 	// If the room has an m.room.name state event with a non-empty name field, use the name given by that field.
 	if heroInfo.NameEvent != "" {
 		return heroInfo.NameEvent, false
@@ -163,7 +166,7 @@ func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name str
 		return heroInfo.CanonicalAlias, false
 	}
 	// If none of the above conditions are met, a name should be composed based on the members of the room.
-	disambiguatedNames := disambiguate(heroInfo.Heroes)
+	disambiguatedNames := disambiguate(heroInfo.Heroes, translations)
 	totalNumOtherUsers := int(heroInfo.JoinCount + heroInfo.InviteCount - 1)
 	isAlone := totalNumOtherUsers <= 0
 
@@ -171,7 +174,7 @@ func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name str
 	// the client should use the rules BELOW to indicate that the room was empty. For example, "Empty Room (was Alice)",
 	// "Empty Room (was Alice and 1234 others)", or "Empty Room" if there are no heroes.
 	if len(heroInfo.Heroes) == 0 && isAlone {
-		return "Empty Room", false
+		return translations.EmptyRoom, false
 	}
 
 	// If the number of m.heroes for the room are greater or equal to m.joined_member_count + m.invited_member_count - 1,
@@ -181,9 +184,9 @@ func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name str
 		if len(disambiguatedNames) == 1 {
 			return disambiguatedNames[0], true
 		}
-		calculatedRoomName := strings.Join(disambiguatedNames[:len(disambiguatedNames)-1], ", ") + " and " + disambiguatedNames[len(disambiguatedNames)-1]
+		calculatedRoomName := strings.Join(disambiguatedNames[:len(disambiguatedNames)-1], ", ") + translations.And + disambiguatedNames[len(disambiguatedNames)-1]
 		if isAlone {
-			return fmt.Sprintf("Empty Room (was %s)", calculatedRoomName), true
+			return fmt.Sprintf(translations.EmptyRoomWas, calculatedRoomName), true
 		}
 		return calculatedRoomName, true
 	}
@@ -194,7 +197,7 @@ func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name str
 		numEntries = maxNumNamesPerRoom
 	}
 	calculatedRoomName := fmt.Sprintf(
-		"%s and %d others", strings.Join(disambiguatedNames[:numEntries], ", "), totalNumOtherUsers-numEntries,
+		translations.AndOthers, strings.Join(disambiguatedNames[:numEntries], ", "), totalNumOtherUsers-numEntries,
 	)
 
 	// If there are fewer heroes than m.joined_member_count + m.invited_member_count - 1,
@@ -207,10 +210,10 @@ func CalculateRoomName(heroInfo *RoomMetadata, maxNumNamesPerRoom int) (name str
 	// If m.joined_member_count + m.invited_member_count is less than or equal to 1 (indicating the member is alone),
 	// the client should use the rules above to indicate that the room was empty. For example, "Empty Room (was Alice)",
 	// "Empty Room (was Alice and 1234 others)", or "Empty Room" if there are no heroes.
-	return fmt.Sprintf("Empty Room (was %s)", calculatedRoomName), true
+	return fmt.Sprintf(translations.EmptyRoomWas, calculatedRoomName), true
 }
 
-func disambiguate(heroes []Hero) []string {
+func disambiguate(heroes []Hero, translations *RoomNameTranslations) []string {
 	displayNames := make(map[string][]int)
 	for i, h := range heroes {
 		name := h.Name
@@ -232,7 +235,7 @@ func disambiguate(heroes []Hero) []string {
 			if name == "" {
 				name = h.ID
 			}
-			disambiguatedNames[i] = fmt.Sprintf("%s (%s)", name, h.ID)
+			disambiguatedNames[i] = fmt.Sprintf(translations.Disambiguate, name, h.ID)
 		}
 	}
 	return disambiguatedNames
@@ -252,7 +252,7 @@ func TestCalculateRoomName(t *testing.T) {
 			Heroes:         tc.heroes,
 			JoinCount:      tc.joinedCount,
 			InviteCount:    tc.invitedCount,
-		}, tc.maxNumNamesPerRoom)
+		}, tc.maxNumNamesPerRoom, nil)
 		if gotName != tc.wantRoomName {
 			t.Errorf("got %s want %s for test case: %+v", gotName, tc.wantRoomName, tc)
 		}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RoomNameTranslations are the strings used by CalculateRoomName to compose names for rooms without
+// an m.room.name or m.room.canonical_alias. The formats use fmt verbs, which can be indexed e.g
+// "%[2]d" if a language needs the arguments in a different order.
+type RoomNameTranslations struct {
+	// The name of a room with no other members and no heroes e.g "Empty Room".
+	EmptyRoom string `json:"empty_room"`
+	// The name of a room which everyone else has left, given the names of the heroes e.g "Empty Room (was %s)".
+	EmptyRoomWas string `json:"empty_room_was"`
+	// Joins the last two names of the heroes e.g " and ".
+	And string `json:"and"`
+	// Given the names of the heroes and the number of other members e.g "%s and %d others".
+	AndOthers string `json:"and_others"`
+	// Given the display name and user ID of heroes who share a display name e.g "%s (%s)".
+	Disambiguate string `json:"disambiguate"`
+}
+
+// EnglishRoomNames are the translations used when the client does not ask for a language, or asks
+// for a language which has no translations.
+var EnglishRoomNames = RoomNameTranslations{
+	EmptyRoom:    "Empty Room",
+	EmptyRoomWas: "Empty Room (was %s)",
+	And:          " and ",
+	AndOthers:    "%s and %d others",
+	Disambiguate: "%s (%s)",
+}
+
+var (
+	roomNameTranslationsMu sync.RWMutex
+	roomNameTranslations   = map[string]*RoomNameTranslations{
+		"en": &EnglishRoomNames,
+	}
+)
+
+// Validate checks that each format renders with the arguments CalculateRoomName gives it. Arguments
+// which a language does not need can be left out by using indexed verbs e.g "%[1]s and others".
+func (t *RoomNameTranslations) Validate() error {
+	formats := []struct {
+		field  string
+		format string
+		args   []interface{}
+	}{
+		{"empty_room_was", t.EmptyRoomWas, []interface{}{"Alice"}},
+		{"and_others", t.AndOthers, []interface{}{"Alice", 2}},
+		{"disambiguate", t.Disambiguate, []interface{}{"Alice", "@alice:localhost"}},
+	}
+	for _, f := range formats {
+		if f.format == "" {
+			continue // defaults to English
+		}
+		// fmt reports bad verbs and missing or extra arguments inline e.g "%!s(MISSING)"
+		if rendered := fmt.Sprintf(f.format, f.args...); strings.Contains(rendered, "%!") {
+			return fmt.Errorf("%s: %q renders as %q", f.field, f.format, rendered)
+		}
+	}
+	return nil
+}
+
+// RegisterRoomNameTranslations adds or replaces the translations for a language tag e.g "de" or
+// "pt-br". Missing strings are taken from EnglishRoomNames. The translations should have been
+// checked with Validate.
+func RegisterRoomNameTranslations(language string, translations RoomNameTranslations) {
+	defaults := func(s *string, dft string) {
+		if *s == "" {
+			*s = dft
+		}
+	}
+	defaults(&translations.EmptyRoom, EnglishRoomNames.EmptyRoom)
+	defaults(&translations.EmptyRoomWas, EnglishRoomNames.EmptyRoomWas)
+	defaults(&translations.And, EnglishRoomNames.And)
+	defaults(&translations.AndOthers, EnglishRoomNames.AndOthers)
+	defaults(&translations.Disambiguate, EnglishRoomNames.Disambiguate)
+	roomNameTranslationsMu.Lock()
+	defer roomNameTranslationsMu.Unlock()
+	roomNameTranslations[strings.ToLower(language)] = &translations
+}
+
+// LoadRoomNameTranslations registers the translations in a JSON object of language tag to
+// RoomNameTranslations e.g {"de":{"empty_room":"Leerer Raum"}}. Nothing is registered if any of the
+// translations are invalid.
+func LoadRoomNameTranslations(r io.Reader) error {
+	var languages map[string]RoomNameTranslations
+	if err := json.NewDecoder(r).Decode(&languages); err != nil {
+		return fmt.Errorf("failed to decode room name translations: %s", err)
+	}
+	for language, translations := range languages {
+		if err := translations.Validate(); err != nil {
+			return fmt.Errorf("invalid room name translations for %s: %s", language, err)
+		}
+	}
+	for language, translations := range languages {
+		RegisterRoomNameTranslations(language, translations)
+	}
+	return nil
+}
+
+// RoomNameTranslationsFor returns the translations for the most preferred language which has them.
+// The languages are in the format of an Accept-Language header e.g "de-CH, de;q=0.9, en;q=0.8". A
+// language falls back to its primary tag, so "de-CH" uses the "de" translations if there are none
+// for "de-CH". Returns EnglishRoomNames if no language has translations.
+func RoomNameTranslationsFor(languages string) *RoomNameTranslations {
+	roomNameTranslationsMu.RLock()
+	defer roomNameTranslationsMu.RUnlock()
+	for _, language := range parseLanguages(languages) {
+		if translations, ok := roomNameTranslations[language]; ok {
+			return translations
+		}
+		if primary, _, found := strings.Cut(language, "-"); found {
+			if translations, ok := roomNameTranslations[primary]; ok {
+				return translations
+			}
+		}
+	}
+	return &EnglishRoomNames
+}
+
+// parseLanguages returns the lower-cased language tags in the list, most preferred first.
+func parseLanguages(languages string) []string {
+	type weightedLanguage struct {
+		tag    string
+		weight float64
+	}
+	var weighted []weightedLanguage
+	for _, part := range strings.Split(languages, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if w, err := strconv.ParseFloat(q, 64); err == nil {
+				weight = w
+			}
+		}
+		if weight <= 0 {
+			continue
+		}
+		weighted = append(weighted, weightedLanguage{tag: tag, weight: weight})
+	}
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].weight > weighted[j].weight
+	})
+	tags := make([]string, len(weighted))
+	for i := range weighted {
+		tags[i] = weighted[i].tag
+	}
+	return tags
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCalculateRoomNameTranslations(t *testing.T) {
+	err := LoadRoomNameTranslations(strings.NewReader(`{
+		"de": {
+			"empty_room": "Leerer Raum",
+			"empty_room_was": "Leerer Raum (war %s)",
+			"and": " und ",
+			"and_others": "%s und %d andere"
+		},
+		"fr": {
+			"and_others": "%[1]s et %[2]d autres"
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadRoomNameTranslations: %s", err)
+	}
+	testCases := []struct {
+		languages    string
+		heroes       []Hero
+		joinedCount  int
+		wantRoomName string
+	}{
+		{
+			languages:    "de",
+			joinedCount:  1,
+			wantRoomName: "Leerer Raum",
+		},
+		{
+			languages:    "de-CH, en;q=0.5",
+			heroes:       []Hero{{ID: "@alice:localhost", Name: "Alice"}, {ID: "@bob:localhost", Name: "Bob"}},
+			joinedCount:  3,
+			wantRoomName: "Alice und Bob",
+		},
+		{
+			languages:    "de",
+			heroes:       []Hero{{ID: "@alice:localhost", Name: "Alice"}, {ID: "@bob:localhost", Name: "Bob"}},
+			joinedCount:  1,
+			wantRoomName: "Leerer Raum (war Alice und Bob)",
+		},
+		{
+			// strings which are not translated are in English
+			languages:    "de",
+			heroes:       []Hero{{ID: "@alice:localhost", Name: "Alice"}, {ID: "@alice2:localhost", Name: "Alice"}},
+			joinedCount:  3,
+			wantRoomName: "Alice (@alice:localhost) und Alice (@alice2:localhost)",
+		},
+		{
+			languages:    "fr",
+			heroes:       []Hero{{ID: "@alice:localhost", Name: "Alice"}},
+			joinedCount:  5,
+			wantRoomName: "Alice et 3 autres",
+		},
+		{
+			// the most preferred language with translations is used
+			languages:    "es, fr;q=0.8, de;q=0.9",
+			joinedCount:  1,
+			wantRoomName: "Leerer Raum",
+		},
+		{
+			languages:    "es",
+			joinedCount:  1,
+			wantRoomName: "Empty Room",
+		},
+		{
+			languages:    "",
+			joinedCount:  1,
+			wantRoomName: "Empty Room",
+		},
+	}
+	for _, tc := range testCases {
+		gotName, _ := CalculateRoomName(&RoomMetadata{
+			Heroes:    tc.heroes,
+			JoinCount: tc.joinedCount,
+		}, 5, RoomNameTranslationsFor(tc.languages))
+		if gotName != tc.wantRoomName {
+			t.Errorf("%q: got %s want %s", tc.languages, gotName, tc.wantRoomName)
+		}
+	}
+}
+
+func TestLoadRoomNameTranslationsInvalid(t *testing.T) {
+	testCases := []string{
+		`{"nl": {"empty_room_was": "Lege kamer"}}`,
+		`{"nl": {"and_others": "%s en %s anderen"}}`,
+		`{"nl": {"and_others": "%s en anderen"}}`,
+		`{"nl": {"disambiguate": "%s (%s) %s"}}`,
+		`{"nl": {"disambiguate": "%[3]s"}}`,
+	}
+	for _, tc := range testCases {
+		if err := LoadRoomNameTranslations(strings.NewReader(tc)); err == nil {
+			t.Errorf("LoadRoomNameTranslations(%s): want error", tc)
+		}
+	}
+	if got := RoomNameTranslationsFor("nl"); got != &EnglishRoomNames {
+		t.Errorf("invalid translations were registered: %+v", got)
+	}
+	// indexed verbs can leave out arguments
+	if err := LoadRoomNameTranslations(strings.NewReader(`{"nl": {"and_others": "%[1]s en anderen"}}`)); err != nil {
+		t.Errorf("LoadRoomNameTranslations: %s", err)
+	}
+}
@@ -16,6 +16,7 @@ type V2Listener interface {
 	OnTransactionID(p *V2TransactionID)
 	OnAccountData(p *V2AccountData)
 	OnInvite(p *V2InviteRoom)
+	OnKnock(p *V2KnockRoom)
 	OnLeftRoom(p *V2LeaveRoom)
 	OnUnreadCounts(p *V2UnreadCounts)
 	OnInitialSyncComplete(p *V2InitialSyncComplete)
@@ -89,6 +90,13 @@ type V2InviteRoom struct {
 
 func (*V2InviteRoom) Type() string { return "V2InviteRoom" }
 
+type V2KnockRoom struct {
+	UserID string
+	RoomID string
+}
+
+func (*V2KnockRoom) Type() string { return "V2KnockRoom" }
+
 type V2InitialSyncComplete struct {
 	UserID   string
 	DeviceID string
@@ -178,6 +186,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnAccountData(pl)
 	case *V2InviteRoom:
 		v.receiver.OnInvite(pl)
+	case *V2KnockRoom:
+		v.receiver.OnKnock(pl)
 	case *V2LeaveRoom:
 		v.receiver.OnLeftRoom(pl)
 	case *V2UnreadCounts:
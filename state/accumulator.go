@@ -23,24 +23,28 @@ import (
 // Accumulate function for timeline events. v2 sync must be called with a large enough timeline.limit
 // for this to work!
 type Accumulator struct {
-	db            *sqlx.DB
-	roomsTable    *RoomsTable
-	eventsTable   *EventTable
-	snapshotTable *SnapshotTable
-	spacesTable   *SpacesTable
-	invitesTable  *InvitesTable
-	entityName    string
+	db             *sqlx.DB
+	roomsTable     *RoomsTable
+	eventsTable    *EventTable
+	snapshotTable  *SnapshotTable
+	spacesTable    *SpacesTable
+	invitesTable   *InvitesTable
+	knocksTable    *KnocksTable
+	relationsTable *RelationsTable
+	entityName     string
 }
 
 func NewAccumulator(db *sqlx.DB) *Accumulator {
 	return &Accumulator{
-		db:            db,
-		roomsTable:    NewRoomsTable(db),
-		eventsTable:   NewEventTable(db),
-		snapshotTable: NewSnapshotsTable(db),
-		spacesTable:   NewSpacesTable(db),
-		invitesTable:  NewInvitesTable(db),
-		entityName:    "server",
+		db:             db,
+		roomsTable:     NewRoomsTable(db),
+		eventsTable:    NewEventTable(db),
+		snapshotTable:  NewSnapshotsTable(db),
+		spacesTable:    NewSpacesTable(db),
+		invitesTable:   NewInvitesTable(db),
+		knocksTable:    NewKnocksTable(db),
+		relationsTable: NewRelationsTable(db),
+		entityName:     "server",
 	}
 }
 
@@ -293,6 +297,9 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 		if err = a.invitesTable.RemoveSupersededInvites(txn, roomID, events); err != nil {
 			return fmt.Errorf("RemoveSupersededInvites: %w", err)
 		}
+		if err = a.knocksTable.RemoveSupersededKnocks(txn, roomID, events); err != nil {
+			return fmt.Errorf("RemoveSupersededKnocks: %w", err)
+		}
 
 		if err = a.spacesTable.HandleSpaceUpdates(txn, events); err != nil {
 			return fmt.Errorf("HandleSpaceUpdates: %s", err)
@@ -472,6 +479,16 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 		}
 	}
 
+	var relations []Relation
+	for _, ev := range postInsertEvents {
+		if r := NewRelationFromEvent(ev); r != nil {
+			relations = append(relations, *r)
+		}
+	}
+	if err = a.relationsTable.BulkInsert(txn, relations); err != nil {
+		return AccumulateResult{}, fmt.Errorf("failed to insert relations: %w", err)
+	}
+
 	// if we are going to redact things, we need the room version to know the redaction algorithm
 	// so pull it out once now.
 	var roomVersion string
@@ -491,6 +508,13 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 		if err = a.eventsTable.Redact(txn, roomVersion, redactTheseEventIDs); err != nil {
 			return AccumulateResult{}, err
 		}
+		redactedEventIDs := make([]string, 0, len(redactTheseEventIDs))
+		for eventID := range redactTheseEventIDs {
+			redactedEventIDs = append(redactedEventIDs, eventID)
+		}
+		if err = a.relationsTable.DeleteByEventIDs(txn, redactedEventIDs); err != nil {
+			return AccumulateResult{}, fmt.Errorf("failed to delete relations of redacted events: %w", err)
+		}
 	}
 
 	for _, ev := range postInsertEvents {
@@ -552,6 +576,9 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, userID, roomID string, timeline s
 	if err = a.invitesTable.RemoveSupersededInvites(txn, roomID, postInsertEvents); err != nil {
 		return AccumulateResult{}, fmt.Errorf("RemoveSupersededInvites: %w", err)
 	}
+	if err = a.knocksTable.RemoveSupersededKnocks(txn, roomID, postInsertEvents); err != nil {
+		return AccumulateResult{}, fmt.Errorf("RemoveSupersededKnocks: %w", err)
+	}
 
 	if err = a.spacesTable.HandleSpaceUpdates(txn, postInsertEvents); err != nil {
 		return AccumulateResult{}, fmt.Errorf("HandleSpaceUpdates: %s", err)
@@ -0,0 +1,93 @@
+package state
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ConnSnapshot is a serialised sliding sync connection, which allows the connection to be
+// restored after the proxy restarts.
+type ConnSnapshot struct {
+	UserID   string `db:"user_id"`
+	DeviceID string `db:"device_id"`
+	ConnID   string `db:"conn_id"`
+	// the highest position sent to the client when the snapshot was taken
+	Pos       int64  `db:"pos"`
+	Data      []byte `db:"data"`
+	Timestamp int64  `db:"ts"`
+}
+
+// ConnSnapshotsTable stores the most recent snapshot of each connection. Snapshots contain
+// events, so are encrypted with the event cipher if one is configured.
+type ConnSnapshotsTable struct {
+	db     *sqlx.DB
+	cipher *EventCipher
+}
+
+func NewConnSnapshotsTable(db *sqlx.DB) *ConnSnapshotsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_conn_snapshots (
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		conn_id TEXT NOT NULL,
+		pos BIGINT NOT NULL,
+		data BYTEA NOT NULL,
+		ts BIGINT NOT NULL,
+		UNIQUE(user_id, device_id, conn_id)
+	);
+	`)
+	return &ConnSnapshotsTable{db: db}
+}
+
+// Upsert a snapshot for a connection. Snapshots are only replaced by snapshots at the same or
+// a later position, so it is safe to call this concurrently for the same connection.
+func (t *ConnSnapshotsTable) Upsert(snapshot ConnSnapshot) error {
+	if snapshot.Timestamp == 0 {
+		snapshot.Timestamp = time.Now().UnixMilli()
+	}
+	data, err := t.cipher.Encrypt(snapshot.Data)
+	if err != nil {
+		return fmt.Errorf("ConnSnapshotsTable.Upsert: %w", err)
+	}
+	snapshot.Data = data
+	_, err = t.db.NamedExec(`
+		INSERT INTO syncv3_conn_snapshots (user_id, device_id, conn_id, pos, data, ts)
+		VALUES (:user_id, :device_id, :conn_id, :pos, :data, :ts)
+		ON CONFLICT (user_id, device_id, conn_id) DO UPDATE SET pos=EXCLUDED.pos, data=EXCLUDED.data, ts=EXCLUDED.ts
+		WHERE syncv3_conn_snapshots.pos <= EXCLUDED.pos`, snapshot)
+	return err
+}
+
+// Select the snapshot for this connection if it was taken before the given time. Returns nil
+// if there is no such snapshot.
+func (t *ConnSnapshotsTable) Select(userID, deviceID, connID string, before time.Time) (*ConnSnapshot, error) {
+	var snapshot ConnSnapshot
+	err := t.db.Get(&snapshot, `SELECT user_id, device_id, conn_id, pos, data, ts FROM syncv3_conn_snapshots
+		WHERE user_id=$1 AND device_id=$2 AND conn_id=$3 AND ts < $4`, userID, deviceID, connID, before.UnixMilli())
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.Data, err = t.cipher.Decrypt(snapshot.Data); err != nil {
+		return nil, fmt.Errorf("ConnSnapshotsTable.Select: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// Delete the snapshot for this connection, if one exists.
+func (t *ConnSnapshotsTable) Delete(userID, deviceID, connID string) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_conn_snapshots WHERE user_id=$1 AND device_id=$2 AND conn_id=$3`, userID, deviceID, connID)
+	return err
+}
+
+// Clean removes snapshots taken before the boundary time. These connections will have expired.
+func (t *ConnSnapshotsTable) Clean(boundaryTime time.Time) error {
+	_, err := t.db.Exec(`DELETE FROM syncv3_conn_snapshots WHERE ts <= $1`, boundaryTime.UnixMilli())
+	return err
+}
@@ -0,0 +1,127 @@
+package state
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestConnSnapshotsTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@alice:TestConnSnapshotsTable"
+	deviceID := "alice_phone"
+	connID := "conn"
+	table := NewConnSnapshotsTable(db)
+	now := time.Now()
+
+	// empty table select
+	got, err := table.Select(userID, deviceID, connID, now)
+	assertNoError(t, err)
+	if got != nil {
+		t.Fatalf("Select: got %+v want nil", got)
+	}
+
+	// basic insert and select
+	assertNoError(t, table.Upsert(ConnSnapshot{
+		UserID:    userID,
+		DeviceID:  deviceID,
+		ConnID:    connID,
+		Pos:       5,
+		Data:      []byte(`{"pos":5}`),
+		Timestamp: now.Add(-time.Second).UnixMilli(),
+	}))
+	got, err = table.Select(userID, deviceID, connID, now)
+	assertNoError(t, err)
+	if got == nil || got.Pos != 5 || !bytes.Equal(got.Data, []byte(`{"pos":5}`)) {
+		t.Fatalf("Select: got %+v want pos 5", got)
+	}
+
+	// snapshots taken after the cutoff are not returned
+	got, err = table.Select(userID, deviceID, connID, now.Add(-time.Minute))
+	assertNoError(t, err)
+	if got != nil {
+		t.Fatalf("Select before snapshot: got %+v want nil", got)
+	}
+
+	// older snapshots do not replace newer ones
+	assertNoError(t, table.Upsert(ConnSnapshot{
+		UserID: userID, DeviceID: deviceID, ConnID: connID, Pos: 3, Data: []byte(`{"pos":3}`),
+		Timestamp: now.Add(-time.Second).UnixMilli(),
+	}))
+	got, err = table.Select(userID, deviceID, connID, now)
+	assertNoError(t, err)
+	if got == nil || got.Pos != 5 {
+		t.Fatalf("Select after stale upsert: got %+v want pos 5", got)
+	}
+
+	// newer snapshots do
+	assertNoError(t, table.Upsert(ConnSnapshot{
+		UserID: userID, DeviceID: deviceID, ConnID: connID, Pos: 7, Data: []byte(`{"pos":7}`),
+		Timestamp: now.Add(-time.Second).UnixMilli(),
+	}))
+	got, err = table.Select(userID, deviceID, connID, now)
+	assertNoError(t, err)
+	if got == nil || got.Pos != 7 {
+		t.Fatalf("Select after upsert: got %+v want pos 7", got)
+	}
+
+	// delete
+	assertNoError(t, table.Delete(userID, deviceID, connID))
+	got, err = table.Select(userID, deviceID, connID, now)
+	assertNoError(t, err)
+	if got != nil {
+		t.Fatalf("Select after delete: got %+v want nil", got)
+	}
+
+	// clean removes old snapshots only
+	assertNoError(t, table.Upsert(ConnSnapshot{
+		UserID: userID, DeviceID: deviceID, ConnID: "old", Pos: 1, Data: []byte(`{}`),
+		Timestamp: now.Add(-time.Hour).UnixMilli(),
+	}))
+	assertNoError(t, table.Upsert(ConnSnapshot{
+		UserID: userID, DeviceID: deviceID, ConnID: "new", Pos: 1, Data: []byte(`{}`),
+		Timestamp: now.Add(-time.Second).UnixMilli(),
+	}))
+	assertNoError(t, table.Clean(now.Add(-time.Minute)))
+	got, err = table.Select(userID, deviceID, "old", now)
+	assertNoError(t, err)
+	if got != nil {
+		t.Fatalf("Select after clean: got %+v want nil", got)
+	}
+	got, err = table.Select(userID, deviceID, "new", now)
+	assertNoError(t, err)
+	if got == nil {
+		t.Fatalf("Select after clean: newer snapshot was removed")
+	}
+}
+
+func TestConnSnapshotsTableEncrypted(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	userID := "@alice:TestConnSnapshotsTableEncrypted"
+	deviceID := "alice_phone"
+	connID := "conn"
+	table := NewConnSnapshotsTable(db)
+	cipher, err := NewEventCipher("secret_TestConnSnapshotsTableEncrypted")
+	assertNoError(t, err)
+	table.cipher = cipher
+	now := time.Now()
+	data := []byte(`{"server_responses":[{"rooms":{}}]}`)
+
+	assertNoError(t, table.Upsert(ConnSnapshot{
+		UserID: userID, DeviceID: deviceID, ConnID: connID, Pos: 1, Data: data,
+		Timestamp: now.Add(-time.Second).UnixMilli(),
+	}))
+	// the stored snapshot is not plaintext
+	var stored []byte
+	assertNoError(t, db.QueryRow(`SELECT data FROM syncv3_conn_snapshots WHERE user_id=$1`, userID).Scan(&stored))
+	if !IsEncryptedEvent(stored) {
+		t.Fatalf("stored snapshot is not encrypted: %s", string(stored))
+	}
+	got, err := table.Select(userID, deviceID, connID, now)
+	assertNoError(t, err)
+	if got == nil || !bytes.Equal(got.Data, data) {
+		t.Fatalf("Select: got %+v want %s", got, string(data))
+	}
+}
@@ -0,0 +1,143 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+)
+
+func TestEventCipher(t *testing.T) {
+	plaintext := []byte(`{"type":"m.room.message","content":{"body":"secret"}}`)
+	oldCipher, err := NewEventCipher("old")
+	assertNoError(t, err)
+	ciphertext, err := oldCipher.Encrypt(plaintext)
+	assertNoError(t, err)
+	if !IsEncryptedEvent(ciphertext) || bytes.Contains(ciphertext, []byte("secret")) {
+		t.Fatalf("Encrypt did not encrypt: %s", string(ciphertext))
+	}
+	got, err := oldCipher.Decrypt(ciphertext)
+	assertNoError(t, err)
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt: got %s want %s", string(got), string(plaintext))
+	}
+	// plaintext passes through, even without a cipher
+	var nilCipher *EventCipher
+	for _, c := range []*EventCipher{oldCipher, nilCipher} {
+		got, err = c.Decrypt(plaintext)
+		assertNoError(t, err)
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("Decrypt plaintext: got %s want %s", string(got), string(plaintext))
+		}
+	}
+	if _, err = nilCipher.Decrypt(ciphertext); err == nil {
+		t.Errorf("Decrypt without a cipher succeeded")
+	}
+
+	// rotate the key: old events are still readable but need re-encrypting
+	rotatedCipher, err := NewEventCipher("new", "old")
+	assertNoError(t, err)
+	got, err = rotatedCipher.Decrypt(ciphertext)
+	assertNoError(t, err)
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt after rotation: got %s want %s", string(got), string(plaintext))
+	}
+	if !rotatedCipher.NeedsReencryption(ciphertext) || !rotatedCipher.NeedsReencryption(plaintext) {
+		t.Errorf("NeedsReencryption: returned false for old event")
+	}
+	newCiphertext, err := rotatedCipher.Encrypt(plaintext)
+	assertNoError(t, err)
+	if rotatedCipher.NeedsReencryption(newCiphertext) {
+		t.Errorf("NeedsReencryption: returned true for new event")
+	}
+	// once the old key is removed, old events can no longer be read
+	newCipher, err := NewEventCipher("new")
+	assertNoError(t, err)
+	if _, err = newCipher.Decrypt(ciphertext); err == nil {
+		t.Errorf("Decrypt with removed key succeeded")
+	}
+}
+
+func TestStorageEncryptsEvents(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageEncryptsEvents:localhost"
+	alice := "@alice_TestStorageEncryptsEvents:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	// written before encryption is enabled
+	plaintextEvent := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "plaintext"})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{plaintextEvent}})
+	assertNoError(t, err)
+
+	oldCipher, err := NewEventCipher("old_TestStorageEncryptsEvents")
+	assertNoError(t, err)
+	store.UseEventCipher(oldCipher)
+	encryptedEvent := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "encrypted"})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{encryptedEvent}})
+	assertNoError(t, err)
+
+	assertStoredEvent := func(ev json.RawMessage, wantEncrypted bool) {
+		t.Helper()
+		eventID := gjson.GetBytes(ev, "event_id").Str
+		var raw []byte
+		assertNoError(t, store.DB.QueryRow(`SELECT event FROM syncv3_events WHERE event_id=$1`, eventID).Scan(&raw))
+		if IsEncryptedEvent(raw) != wantEncrypted {
+			t.Errorf("event %s: encrypted=%v want %v", eventID, IsEncryptedEvent(raw), wantEncrypted)
+		}
+		events, err := store.EventsTable.SelectByIDs(nil, true, []string{eventID})
+		assertNoError(t, err)
+		if !bytes.Equal(events[0].JSON, ev) {
+			t.Errorf("event %s: got %s want %s", eventID, string(events[0].JSON), string(ev))
+		}
+	}
+	assertStoredEvent(plaintextEvent, false)
+	assertStoredEvent(encryptedEvent, true)
+
+	// the timeline is readable regardless of how each event is stored
+	latest, err := store.LatestEventsInRooms(alice, []string{roomID}, 999999999, 10)
+	assertNoError(t, err)
+	timeline := latest[roomID].Timeline
+	if len(timeline) != 2 || !bytes.Equal(timeline[0], plaintextEvent) || !bytes.Equal(timeline[1], encryptedEvent) {
+		t.Errorf("LatestEventsInRooms: got %v", timeline)
+	}
+
+	// Re-encrypting touches every event in the database, so put them all back to plaintext afterwards
+	// for the other tests which share this database.
+	defer func() {
+		var events []Event
+		assertNoError(t, store.DB.Select(&events, `SELECT event_nid, event FROM syncv3_events WHERE substring(event FROM 1 FOR 4) = 'enc:'`))
+		for _, ev := range events {
+			plaintext, err := store.EventsTable.cipher.Decrypt(ev.JSON)
+			assertNoError(t, err)
+			store.DB.MustExec(`UPDATE syncv3_events SET event=$1 WHERE event_nid=$2`, plaintext, ev.NID)
+		}
+	}()
+
+	// rotate the secret and re-encrypt everything
+	rotatedCipher, err := NewEventCipher("new_TestStorageEncryptsEvents", "old_TestStorageEncryptsEvents")
+	assertNoError(t, err)
+	store.UseEventCipher(rotatedCipher)
+	total, err := store.ReencryptEvents(1)
+	assertNoError(t, err)
+	if total < 2 {
+		t.Errorf("ReencryptEvents: rewrote %d events, want at least 2", total)
+	}
+	// now only the new secret is needed
+	newCipher, err := NewEventCipher("new_TestStorageEncryptsEvents")
+	assertNoError(t, err)
+	store.UseEventCipher(newCipher)
+	assertStoredEvent(plaintextEvent, true)
+	assertStoredEvent(encryptedEvent, true)
+	total, err = store.ReencryptEvents(100)
+	assertNoError(t, err)
+	if total != 0 {
+		t.Errorf("ReencryptEvents: rewrote %d events on second run, want 0", total)
+	}
+}
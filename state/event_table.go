@@ -108,6 +108,8 @@ type membershipEvent struct {
 // EventTable stores events. A unique numeric ID is associated with each event.
 type EventTable struct {
 	db *sqlx.DB
+	// optional: if set, event JSON is encrypted before being written and decrypted after being read.
+	cipher *EventCipher
 }
 
 // NewEventTable makes a new EventTable
@@ -142,7 +144,7 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 
 	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
 	`)
-	return &EventTable{db}
+	return &EventTable{db: db}
 }
 
 func (t *EventTable) SelectHighestNID() (highest int64, err error) {
@@ -174,7 +176,20 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 		}
 		events[i].JSON = js
 	}
-	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(events))
+	toInsert := events
+	if t.cipher != nil {
+		// don't clobber the caller's plaintext JSON
+		toInsert = make([]Event, len(events))
+		for i := range events {
+			toInsert[i] = events[i]
+			js, err := t.cipher.Encrypt(events[i].JSON)
+			if err != nil {
+				return nil, err
+			}
+			toInsert[i].JSON = js
+		}
+	}
+	chunks := sqlutil.Chunkify(9, MaxPostgresParameters, EventChunker(toInsert))
 	var eventID string
 	var eventNID int64
 	for _, chunk := range chunks {
@@ -210,9 +225,27 @@ func (t *EventTable) selectAny(txn *sqlx.Tx, numWanted int, queryStr string, pqA
 			return nil, internal.NewDataError("events table query %s got %d events wanted %d. err=%s", queryStr, len(events), numWanted, err)
 		}
 	}
+	if err == nil {
+		err = t.decryptEvents(events)
+	}
 	return
 }
 
+// decryptEvents decrypts the JSON of events selected from the database, in-place.
+func (t *EventTable) decryptEvents(events []Event) error {
+	for i := range events {
+		if len(events[i].JSON) == 0 {
+			continue // stripped event
+		}
+		js, err := t.cipher.Decrypt(events[i].JSON)
+		if err != nil {
+			return fmt.Errorf("event %d: %w", events[i].NID, err)
+		}
+		events[i].JSON = js
+	}
+	return nil
+}
+
 // SelectByNIDs fetches events from the events table by their nids. The returned events
 // are ordered by ascending nid; the order of the input nids is ignored. If verifyAll
 // is true, we return an error if the number of events returned doesn't match the number
@@ -345,6 +378,9 @@ FROM room_ids,
 	if err == sql.ErrNoRows {
 		err = nil
 	}
+	if err == nil {
+		err = t.decryptEvents(events)
+	}
 	return
 }
 
@@ -409,7 +445,11 @@ func (t *EventTable) Redact(txn *sqlx.Tx, roomVer string, redacteeEventIDToRedac
 		if err != nil {
 			return fmt.Errorf("RedactEventJSON[%s]: setting redacted_because %w", eventsToRedact[i].ID, err)
 		}
-		_, err = txn.Exec(`UPDATE syncv3_events SET event=$1 WHERE event_id=$2`, eventsToRedact[i].JSON, eventsToRedact[i].ID)
+		js, err := t.cipher.Encrypt(eventsToRedact[i].JSON)
+		if err != nil {
+			return fmt.Errorf("RedactEventJSON[%s]: %w", eventsToRedact[i].ID, err)
+		}
+		_, err = txn.Exec(`UPDATE syncv3_events SET event=$1 WHERE event_id=$2`, js, eventsToRedact[i].ID)
 		if err != nil {
 			return fmt.Errorf("cannot update event %s: %w", eventsToRedact[i].ID, err)
 		}
@@ -426,6 +466,9 @@ func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowe
 	if err != nil {
 		return nil, err
 	}
+	if err = t.decryptEvents(events); err != nil {
+		return nil, err
+	}
 
 	// Look to see if there is an event missing its predecessor in the timeline.
 	// Note: events[0] is the newest event, as the query is ORDERed BY event_nid DESC.
@@ -439,6 +482,31 @@ func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowe
 	return events, err
 }
 
+// selectLatestEventByTypeInRooms is like selectLatestEventByTypeInAllRooms but only for the given rooms.
+func (t *EventTable) selectLatestEventByTypeInRooms(txn *sqlx.Tx, roomIDs []string) ([]Event, error) {
+	result := []Event{}
+	rows, err := txn.Query(
+		`SELECT room_id, event_nid, event FROM syncv3_events WHERE event_nid in (
+			SELECT MAX(event_nid) FROM syncv3_events WHERE room_id = ANY($1) GROUP BY room_id, event_type
+		)`, pq.StringArray(roomIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.RoomID, &ev.NID, &ev.JSON); err != nil {
+			return nil, err
+		}
+		result = append(result, ev)
+	}
+	if err = t.decryptEvents(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, error) {
 	result := []Event{}
 	// TODO: this query ends up doing a sequential scan on the events table. We have
@@ -465,6 +533,9 @@ func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, e
 		}
 		result = append(result, ev)
 	}
+	if err = t.decryptEvents(result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
@@ -478,12 +549,16 @@ func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lo
 		ORDER BY event_nid ASC`,
 		lowerExclusive, upperInclusive, eventType, stateKey,
 	)
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	return events, t.decryptEvents(events)
 }
 
 // Select all events between the bounds matching the type, state_key given, in the rooms specified only.
 // Used to work out which rooms the user was joined to at a given point in time.
-func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
+// If txn is nil, the query is executed outside of a transaction on the primary.
+func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(txn *sqlx.Tx, roomIDs []string, eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
 	var events []Event
 	query, args, err := sqlx.In(
 		`SELECT event_nid, room_id, event FROM syncv3_events
@@ -494,10 +569,15 @@ func (t *EventTable) SelectEventsWithTypeStateKeyInRooms(roomIDs []string, event
 		return nil, err
 	}
 
-	err = t.db.Select(&events,
-		t.db.Rebind(query), args...,
-	)
-	return events, err
+	if txn != nil {
+		err = txn.Select(&events, txn.Rebind(query), args...)
+	} else {
+		err = t.db.Select(&events, t.db.Rebind(query), args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return events, t.decryptEvents(events)
 }
 
 // Select all events matching the given event type in a room. Used to implement the room member stream (paginated room lists)
@@ -538,7 +618,10 @@ func (t *EventTable) SelectCreateEvent(txn *sqlx.Tx, roomID string) (json.RawMes
 	var evJSON []byte
 	// there is only 1 create event
 	err := txn.QueryRow(`SELECT event FROM syncv3_events WHERE room_id=$1 AND event_type='m.room.create' AND state_key=''`, roomID).Scan(&evJSON)
-	return evJSON, err
+	if err != nil {
+		return nil, err
+	}
+	return t.cipher.Decrypt(evJSON)
 }
 
 type EventChunker []Event
@@ -494,7 +494,7 @@ func TestEventTableSelectEventsWithTypeStateKey(t *testing.T) {
 		t.Fatalf("SelectEventsWithTypeStateKey missed rooms: %v", wantRooms)
 	}
 
-	gotEvents, err = table.SelectEventsWithTypeStateKeyInRooms([]string{roomA, roomB, roomD}, "m.room.member", userID, 0, latest)
+	gotEvents, err = table.SelectEventsWithTypeStateKeyInRooms(nil, []string{roomA, roomB, roomD}, "m.room.member", userID, 0, latest)
 	if err != nil {
 		t.Fatalf("SelectEventsWithTypeStateKeyInRooms: %s", err)
 	}
@@ -0,0 +1,446 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// The checks performed by Storage.Fsck.
+const (
+	// Every event NID in a snapshot exists and belongs to the snapshot's room.
+	FsckCheckSnapshotEvents = "snapshot_events"
+	// A room's current snapshot exists, belongs to the room and contains the room's latest state event.
+	FsckCheckCurrentSnapshot = "current_snapshot"
+	// Timeline events point to before-state snapshots in the same room, in NID order.
+	FsckCheckBeforeSnapshot = "before_snapshot"
+	// There are no outstanding invites for users whose current membership is no longer an invite.
+	FsckCheckStaleInvite = "stale_invite"
+	// The space graph matches the m.space.child / m.space.parent events in current room state.
+	FsckCheckSpaces = "spaces"
+)
+
+// FsckViolation is a single broken invariant found by Storage.Fsck.
+type FsckViolation struct {
+	Check  string
+	RoomID string
+	// UserID is only set for violations which concern a single user, e.g stale invites.
+	UserID string
+	Detail string
+
+	// the space relation to remove or insert when repairing a spaces violation
+	spaceRelation *SpaceRelation
+	spaceIsExtra  bool
+}
+
+func (v FsckViolation) String() string {
+	if v.UserID != "" {
+		return fmt.Sprintf("[%s] room=%s user=%s: %s", v.Check, v.RoomID, v.UserID, v.Detail)
+	}
+	return fmt.Sprintf("[%s] room=%s: %s", v.Check, v.RoomID, v.Detail)
+}
+
+// Fsck checks invariants across the proxy's tables and returns any violations found. This is
+// intended to be run offline, as the proxy holds much of this data in memory and will not notice
+// any changes made underneath it.
+//
+// If repair is true, violations are fixed in the same transaction:
+//   - rooms with broken snapshots are deleted, along with their relations, unread counts and
+//     receipts. The since tokens of all users with memberships in those rooms are reset so the
+//     rooms are fetched again from the upstream homeserver.
+//   - stale invites are deleted.
+//   - the space graph is rewritten to match current room state.
+func (s *Storage) Fsck(repair bool) (violations []FsckViolation, err error) {
+	checks := []func(txn *sqlx.Tx) ([]FsckViolation, error){
+		s.fsckSnapshotEvents,
+		s.fsckCurrentSnapshots,
+		s.fsckBeforeSnapshots,
+		s.fsckStaleInvites,
+		s.fsckSpaces,
+	}
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		for _, check := range checks {
+			vs, err := check(txn)
+			if err != nil {
+				return err
+			}
+			violations = append(violations, vs...)
+		}
+		if !repair || len(violations) == 0 {
+			return nil
+		}
+		return s.fsckRepair(txn, violations)
+	})
+	return
+}
+
+func (s *Storage) fsckSnapshotEvents(txn *sqlx.Tx) ([]FsckViolation, error) {
+	rows, err := txn.Query(`
+	SELECT syncv3_snapshots.room_id, snapshot_id, nid, COALESCE(syncv3_events.room_id, '')
+	FROM syncv3_snapshots
+		CROSS JOIN LATERAL unnest(events || membership_events) AS nid
+		LEFT JOIN syncv3_events ON syncv3_events.event_nid = nid
+	WHERE syncv3_events.event_nid IS NULL OR syncv3_events.room_id <> syncv3_snapshots.room_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check snapshot events: %w", err)
+	}
+	defer rows.Close()
+	var violations []FsckViolation
+	for rows.Next() {
+		var roomID, eventRoomID string
+		var snapID, nid int64
+		if err := rows.Scan(&roomID, &snapID, &nid, &eventRoomID); err != nil {
+			return nil, err
+		}
+		detail := fmt.Sprintf("snapshot %d references event NID %d which does not exist", snapID, nid)
+		if eventRoomID != "" {
+			detail = fmt.Sprintf("snapshot %d references event NID %d which is in room %s", snapID, nid, eventRoomID)
+		}
+		violations = append(violations, FsckViolation{
+			Check:  FsckCheckSnapshotEvents,
+			RoomID: roomID,
+			Detail: detail,
+		})
+	}
+	return violations, rows.Err()
+}
+
+func (s *Storage) fsckCurrentSnapshots(txn *sqlx.Tx) ([]FsckViolation, error) {
+	var violations []FsckViolation
+	// the current snapshot must exist and be for this room
+	rows, err := txn.Query(`
+	SELECT syncv3_rooms.room_id, current_snapshot_id, COALESCE(syncv3_snapshots.room_id, '')
+	FROM syncv3_rooms
+		LEFT JOIN syncv3_snapshots ON syncv3_snapshots.snapshot_id = current_snapshot_id
+	WHERE syncv3_snapshots.snapshot_id IS NULL OR syncv3_snapshots.room_id <> syncv3_rooms.room_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check current snapshots exist: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID, snapRoomID string
+		var snapID int64
+		if err := rows.Scan(&roomID, &snapID, &snapRoomID); err != nil {
+			return nil, err
+		}
+		detail := fmt.Sprintf("current snapshot %d does not exist", snapID)
+		if snapRoomID != "" {
+			detail = fmt.Sprintf("current snapshot %d is for room %s", snapID, snapRoomID)
+		}
+		violations = append(violations, FsckViolation{
+			Check:  FsckCheckCurrentSnapshot,
+			RoomID: roomID,
+			Detail: detail,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// State events are only ever replaced by events with higher NIDs, so the highest NID
+	// referenced by any snapshot in the room is the latest state event, and must be in the
+	// current snapshot.
+	rows, err = txn.Query(`
+	WITH latest_state(room_id, nid) AS (
+		SELECT room_id, MAX(nid) FROM syncv3_snapshots
+			CROSS JOIN LATERAL unnest(events || membership_events) AS nid
+		GROUP BY room_id
+	)
+	SELECT syncv3_rooms.room_id, current_snapshot_id, latest_state.nid
+	FROM syncv3_rooms
+		JOIN latest_state ON latest_state.room_id = syncv3_rooms.room_id
+		JOIN syncv3_snapshots ON syncv3_snapshots.snapshot_id = current_snapshot_id
+			AND syncv3_snapshots.room_id = syncv3_rooms.room_id
+	WHERE NOT (latest_state.nid = ANY(events || membership_events))`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check current snapshots are latest: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID string
+		var snapID, nid int64
+		if err := rows.Scan(&roomID, &snapID, &nid); err != nil {
+			return nil, err
+		}
+		violations = append(violations, FsckViolation{
+			Check:  FsckCheckCurrentSnapshot,
+			RoomID: roomID,
+			Detail: fmt.Sprintf("current snapshot %d does not contain the latest state event NID %d", snapID, nid),
+		})
+	}
+	return violations, rows.Err()
+}
+
+func (s *Storage) fsckBeforeSnapshots(txn *sqlx.Tx) ([]FsckViolation, error) {
+	var violations []FsckViolation
+	// before snapshots must exist and be for the event's room
+	rows, err := txn.Query(`
+	SELECT syncv3_events.room_id, event_id, before_state_snapshot_id, COALESCE(syncv3_snapshots.room_id, '')
+	FROM syncv3_events
+		LEFT JOIN syncv3_snapshots ON syncv3_snapshots.snapshot_id = before_state_snapshot_id
+	WHERE before_state_snapshot_id <> 0
+		AND (syncv3_snapshots.snapshot_id IS NULL OR syncv3_snapshots.room_id <> syncv3_events.room_id)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check before snapshots exist: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID, eventID, snapRoomID string
+		var snapID int64
+		if err := rows.Scan(&roomID, &eventID, &snapID, &snapRoomID); err != nil {
+			return nil, err
+		}
+		detail := fmt.Sprintf("event %s has before snapshot %d which does not exist", eventID, snapID)
+		if snapRoomID != "" {
+			detail = fmt.Sprintf("event %s has before snapshot %d which is for room %s", eventID, snapID, snapRoomID)
+		}
+		violations = append(violations, FsckViolation{
+			Check:  FsckCheckBeforeSnapshot,
+			RoomID: roomID,
+			Detail: detail,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Snapshots are created in the same order as the timeline events which cause them, so
+	// walking the timeline should never move backwards through snapshots.
+	rows, err = txn.Query(`
+	SELECT room_id, event_id, before_state_snapshot_id, prev_snapshot_id FROM (
+		SELECT room_id, event_id, before_state_snapshot_id,
+			LAG(before_state_snapshot_id) OVER (PARTITION BY room_id ORDER BY event_nid) AS prev_snapshot_id
+		FROM syncv3_events WHERE before_state_snapshot_id <> 0
+	) AS chain
+	WHERE before_state_snapshot_id < prev_snapshot_id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check before snapshot ordering: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID, eventID string
+		var snapID, prevSnapID int64
+		if err := rows.Scan(&roomID, &eventID, &snapID, &prevSnapID); err != nil {
+			return nil, err
+		}
+		violations = append(violations, FsckViolation{
+			Check:  FsckCheckBeforeSnapshot,
+			RoomID: roomID,
+			Detail: fmt.Sprintf("event %s has before snapshot %d but the preceding event has later snapshot %d", eventID, snapID, prevSnapID),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// replaced state events must be earlier events in the same room
+	rows, err = txn.Query(`
+	SELECT syncv3_events.room_id, syncv3_events.event_id, syncv3_events.event_replaces_nid
+	FROM syncv3_events
+		LEFT JOIN syncv3_events AS replaced ON replaced.event_nid = syncv3_events.event_replaces_nid
+	WHERE syncv3_events.event_replaces_nid <> 0 AND (
+		replaced.event_nid IS NULL OR replaced.room_id <> syncv3_events.room_id
+		OR replaced.event_nid >= syncv3_events.event_nid
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check replaced events: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID, eventID string
+		var replacesNID int64
+		if err := rows.Scan(&roomID, &eventID, &replacesNID); err != nil {
+			return nil, err
+		}
+		violations = append(violations, FsckViolation{
+			Check:  FsckCheckBeforeSnapshot,
+			RoomID: roomID,
+			Detail: fmt.Sprintf("event %s replaces NID %d which is not an earlier event in this room", eventID, replacesNID),
+		})
+	}
+	return violations, rows.Err()
+}
+
+func (s *Storage) fsckStaleInvites(txn *sqlx.Tx) ([]FsckViolation, error) {
+	rows, err := txn.Query(`
+	SELECT syncv3_invites.room_id, syncv3_invites.user_id, syncv3_events.membership
+	FROM syncv3_invites
+		JOIN syncv3_rooms USING (room_id)
+		JOIN syncv3_snapshots ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
+		JOIN syncv3_events ON (
+				event_nid = ANY (membership_events)
+			AND state_key = syncv3_invites.user_id
+			AND NOT (membership = 'invite' OR membership = '_invite')
+		)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check stale invites: %w", err)
+	}
+	defer rows.Close()
+	var violations []FsckViolation
+	for rows.Next() {
+		var roomID, userID, membership string
+		if err := rows.Scan(&roomID, &userID, &membership); err != nil {
+			return nil, err
+		}
+		violations = append(violations, FsckViolation{
+			Check:  FsckCheckStaleInvite,
+			RoomID: roomID,
+			UserID: userID,
+			Detail: fmt.Sprintf("user has an invite but their current membership is %s", membership),
+		})
+	}
+	return violations, rows.Err()
+}
+
+func (s *Storage) fsckSpaces(txn *sqlx.Tx) ([]FsckViolation, error) {
+	var events []Event
+	err := txn.Select(&events, `
+	SELECT event_nid, event_id, syncv3_events.room_id, event_type, state_key, event
+	FROM syncv3_rooms
+		JOIN syncv3_snapshots ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
+		JOIN syncv3_events ON event_nid = ANY (events)
+	WHERE event_type = 'm.space.child' OR event_type = 'm.space.parent'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select space events: %w", err)
+	}
+	if err = s.EventsTable.decryptEvents(events); err != nil {
+		return nil, fmt.Errorf("failed to decrypt space events: %w", err)
+	}
+	want := make(map[string]SpaceRelation)
+	for _, ev := range events {
+		r, isDeleted := NewSpaceRelationFromEvent(ev)
+		if r == nil || isDeleted {
+			continue
+		}
+		want[r.Key()] = *r
+	}
+	var relations []SpaceRelation
+	err = txn.Select(&relations, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select space relations: %w", err)
+	}
+	got := make(map[string]SpaceRelation, len(relations))
+	for _, r := range relations {
+		got[r.Key()] = r
+	}
+
+	var violations []FsckViolation
+	for key, w := range want {
+		w := w
+		g, exists := got[key]
+		if exists && g == w {
+			continue
+		}
+		detail := fmt.Sprintf("missing space relation %s", key)
+		if exists {
+			detail = fmt.Sprintf("space relation %s has ordering=%q suggested=%v, want ordering=%q suggested=%v", key, g.Ordering, g.IsSuggested, w.Ordering, w.IsSuggested)
+		}
+		violations = append(violations, FsckViolation{
+			Check:         FsckCheckSpaces,
+			RoomID:        spaceRelationRoomID(w),
+			Detail:        detail,
+			spaceRelation: &w,
+		})
+	}
+	for key, g := range got {
+		g := g
+		if _, exists := want[key]; exists {
+			continue
+		}
+		violations = append(violations, FsckViolation{
+			Check:         FsckCheckSpaces,
+			RoomID:        spaceRelationRoomID(g),
+			Detail:        fmt.Sprintf("space relation %s is not in current room state", key),
+			spaceRelation: &g,
+			spaceIsExtra:  true,
+		})
+	}
+	// map iteration order is random, keep the output stable
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].Detail < violations[j].Detail
+	})
+	return violations, nil
+}
+
+// spaceRelationRoomID returns the room whose state contains the event for this relation.
+func spaceRelationRoomID(r SpaceRelation) string {
+	if r.Relation == RelationMSpaceParent {
+		return r.Child
+	}
+	return r.Parent
+}
+
+func (s *Storage) fsckRepair(txn *sqlx.Tx, violations []FsckViolation) error {
+	brokenRooms := make(map[string]struct{})
+	for _, v := range violations {
+		switch v.Check {
+		case FsckCheckSnapshotEvents, FsckCheckCurrentSnapshot, FsckCheckBeforeSnapshot:
+			brokenRooms[v.RoomID] = struct{}{}
+		}
+	}
+	roomIDs := make([]string, 0, len(brokenRooms))
+	for roomID := range brokenRooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	if len(roomIDs) > 0 {
+		logger.Info().Strs("room_ids", roomIDs).Msg("Fsck: deleting rooms with broken snapshots")
+		// Make everyone who has been in these rooms initial sync again, else we will never
+		// learn about the rooms again.
+		res, err := txn.Exec(`
+		UPDATE syncv3_sync2_devices SET since='' WHERE user_id IN (
+			SELECT DISTINCT state_key FROM syncv3_events WHERE room_id = ANY($1) AND event_type = 'm.room.member'
+		)`, pq.StringArray(roomIDs))
+		if err != nil {
+			return fmt.Errorf("failed to reset since tokens: %w", err)
+		}
+		ra, _ := res.RowsAffected()
+		logger.Info().Int64("num_devices", ra).Msg("Fsck: reset since tokens")
+		// delete everything which refers to the room's events, else we would serve it for events
+		// which no longer exist.
+		tables := []string{
+			"syncv3_relations", "syncv3_unread", "syncv3_receipts", "syncv3_receipts_private",
+			"syncv3_snapshots", "syncv3_events", "syncv3_rooms",
+		}
+		for _, table := range tables {
+			if _, err = txn.Exec(`DELETE FROM `+table+` WHERE room_id = ANY($1)`, pq.StringArray(roomIDs)); err != nil {
+				return fmt.Errorf("failed to delete from %s: %w", table, err)
+			}
+		}
+		_, err = txn.Exec(`
+		DELETE FROM syncv3_spaces WHERE (relation = $1 AND parent = ANY($3)) OR (relation = $2 AND child = ANY($3))`,
+			RelationMSpaceChild, RelationMSpaceParent, pq.StringArray(roomIDs))
+		if err != nil {
+			return fmt.Errorf("failed to delete space relations: %w", err)
+		}
+	}
+
+	var addSpaces, removeSpaces []SpaceRelation
+	for _, v := range violations {
+		if _, broken := brokenRooms[v.RoomID]; broken {
+			continue
+		}
+		switch v.Check {
+		case FsckCheckStaleInvite:
+			_, err := txn.Exec(`DELETE FROM syncv3_invites WHERE user_id = $1 AND room_id = $2`, v.UserID, v.RoomID)
+			if err != nil {
+				return fmt.Errorf("failed to delete stale invite: %w", err)
+			}
+		case FsckCheckSpaces:
+			if v.spaceIsExtra {
+				removeSpaces = append(removeSpaces, *v.spaceRelation)
+			} else {
+				addSpaces = append(addSpaces, *v.spaceRelation)
+			}
+		}
+	}
+	if err := s.Accumulator.spacesTable.BulkInsert(txn, addSpaces); err != nil {
+		return fmt.Errorf("failed to insert space relations: %w", err)
+	}
+	if err := s.Accumulator.spacesTable.BulkDelete(txn, removeSpaces); err != nil {
+		return fmt.Errorf("failed to delete space relations: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package state
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestFsck(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	devicesTable := sync2.NewDevicesTable(store.DB)
+	alice := "@alice_TestFsck:localhost"
+	bob := "@bob_TestFsck:localhost"
+	spaceRoomID := "!space_TestFsck:localhost"
+	childRoomID := "!child_TestFsck:localhost"
+	brokenRoomID := "!broken_TestFsck:localhost"
+
+	_, err := store.Initialise(spaceRoomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice, "type": "m.space"}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.space.child", childRoomID, alice, map[string]interface{}{"via": []string{"localhost"}}),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	_, err = store.Initialise(brokenRoomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
+		testutils.NewJoinEvent(t, bob),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) error {
+		return devicesTable.InsertDevice(txn, bob, "BOB_DEVICE")
+	})
+	if err != nil {
+		t.Fatalf("InsertDevice: %s", err)
+	}
+	if err = devicesTable.UpdateDeviceSince(bob, "BOB_DEVICE", "since_TestFsck"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+
+	assertViolations(t, store, false, map[string]map[string]int{})
+
+	// now corrupt the database:
+	// - alice has an invite to a room she is joined to
+	// - the space graph is missing the child and has a bogus relation
+	// - the broken room points to a snapshot which doesn't exist
+	if err = store.InvitesTable.InsertInvite(alice, spaceRoomID, []json.RawMessage{}); err != nil {
+		t.Fatalf("InsertInvite: %s", err)
+	}
+	store.DB.MustExec(`DELETE FROM syncv3_spaces WHERE parent=$1`, spaceRoomID)
+	store.DB.MustExec(`INSERT INTO syncv3_spaces(parent, child, relation, suggested, ordering) VALUES($1, '!bogus_TestFsck:localhost', $2, false, '')`,
+		spaceRoomID, RelationMSpaceChild)
+	store.DB.MustExec(`UPDATE syncv3_rooms SET current_snapshot_id=0 WHERE room_id=$1`, brokenRoomID)
+	// rows which refer to the broken room must be deleted with it
+	store.DB.MustExec(`INSERT INTO syncv3_relations(event_nid, event_id, room_id, relates_to, rel_type, sender) VALUES(-1, '$rel_TestFsck', $1, '$root_TestFsck', 'm.thread', $2)`,
+		brokenRoomID, bob)
+	store.DB.MustExec(`INSERT INTO syncv3_unread(room_id, user_id, notification_count, highlight_count) VALUES($1, $2, 1, 0)`, brokenRoomID, bob)
+	store.DB.MustExec(`INSERT INTO syncv3_receipts(room_id, user_id, thread_id, event_id, ts) VALUES($1, $2, '', '$root_TestFsck', 1)`, brokenRoomID, bob)
+
+	want := map[string]map[string]int{
+		spaceRoomID: {
+			FsckCheckStaleInvite: 1,
+			FsckCheckSpaces:      2,
+		},
+		brokenRoomID: {
+			FsckCheckCurrentSnapshot: 1,
+		},
+	}
+	assertViolations(t, store, false, want)
+	// repairing returns the violations it fixed
+	assertViolations(t, store, true, want)
+	assertViolations(t, store, false, map[string]map[string]int{})
+
+	invites, err := store.InvitesTable.SelectAllInvitesForUser(alice)
+	if err != nil {
+		t.Fatalf("SelectAllInvitesForUser: %s", err)
+	}
+	if len(invites) != 0 {
+		t.Errorf("stale invite was not removed: %v", invites)
+	}
+	var children map[string][]SpaceRelation
+	err = sqlutil.WithTransaction(store.DB, func(txn *sqlx.Tx) (err error) {
+		children, err = store.Accumulator.spacesTable.SelectChildren(txn, []string{spaceRoomID})
+		return
+	})
+	if err != nil {
+		t.Fatalf("SelectChildren: %s", err)
+	}
+	if len(children[spaceRoomID]) != 1 || children[spaceRoomID][0].Child != childRoomID {
+		t.Errorf("space graph was not repaired, got children %+v", children[spaceRoomID])
+	}
+	var numRooms int
+	if err = store.DB.Get(&numRooms, `SELECT count(*) FROM syncv3_rooms WHERE room_id=$1`, brokenRoomID); err != nil {
+		t.Fatalf("failed to count rooms: %s", err)
+	}
+	if numRooms != 0 {
+		t.Errorf("broken room was not deleted")
+	}
+	for _, table := range []string{"syncv3_relations", "syncv3_unread", "syncv3_receipts"} {
+		var numRows int
+		if err = store.DB.Get(&numRows, `SELECT count(*) FROM `+table+` WHERE room_id=$1`, brokenRoomID); err != nil {
+			t.Fatalf("failed to count %s: %s", table, err)
+		}
+		if numRows != 0 {
+			t.Errorf("%s rows for the broken room were not deleted", table)
+		}
+	}
+	var since string
+	if err = store.DB.Get(&since, `SELECT since FROM syncv3_sync2_devices WHERE user_id=$1`, bob); err != nil {
+		t.Fatalf("failed to select since token: %s", err)
+	}
+	if since != "" {
+		t.Errorf("since token for %s was not reset, got %q", bob, since)
+	}
+}
+
+// assertViolations runs fsck and checks the number of violations of each check for the given
+// rooms. Other tests share this database, so violations in other rooms are ignored.
+func assertViolations(t *testing.T, store *Storage, repair bool, want map[string]map[string]int) {
+	t.Helper()
+	violations, err := store.Fsck(repair)
+	if err != nil {
+		t.Fatalf("Fsck(repair=%v): %s", repair, err)
+	}
+	got := make(map[string]map[string]int)
+	for _, v := range violations {
+		if !strings.HasSuffix(v.RoomID, "_TestFsck:localhost") {
+			continue
+		}
+		if got[v.RoomID] == nil {
+			got[v.RoomID] = make(map[string]int)
+		}
+		got[v.RoomID][v.Check]++
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Fsck(repair=%v): got violations %v want %v", repair, violations, want)
+	}
+	for roomID, wantChecks := range want {
+		for check, count := range wantChecks {
+			if got[roomID][check] != count {
+				t.Errorf("Fsck(repair=%v): room %s check %s got %d violations want %d", repair, roomID, check, got[roomID][check], count)
+			}
+		}
+	}
+}
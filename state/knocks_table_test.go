@@ -0,0 +1,76 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+func TestKnocksTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewKnocksTable(db)
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	knockStateA := []json.RawMessage{[]byte(`{"foo":"bar"}`)}
+	knockStateB := []json.RawMessage{[]byte(`{"foo":"bar"}`), []byte(`{"baz":"quuz"}`)}
+
+	if err := table.InsertKnock(alice, roomA, knockStateA); err != nil {
+		t.Fatalf("failed to InsertKnock: %s", err)
+	}
+	if err := table.InsertKnock(alice, roomB, knockStateB); err != nil {
+		t.Fatalf("failed to InsertKnock: %s", err)
+	}
+	if err := table.InsertKnock(bob, roomA, knockStateA); err != nil {
+		t.Fatalf("failed to InsertKnock: %s", err)
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{roomA: knockStateA, roomB: knockStateB})
+
+	// knocking again replaces the knock state
+	if err := table.InsertKnock(alice, roomA, knockStateB); err != nil {
+		t.Fatalf("failed to InsertKnock: %s", err)
+	}
+	knockState, err := table.SelectKnockState(alice, roomA)
+	if err != nil {
+		t.Fatalf("failed to SelectKnockState: %s", err)
+	}
+	if !reflect.DeepEqual(knockState, knockStateB) {
+		t.Errorf("SelectKnockState: got %v want %v", knockState, knockStateB)
+	}
+
+	// retracting the knock removes it
+	if err = table.RemoveKnock(alice, roomB); err != nil {
+		t.Fatalf("failed to RemoveKnock: %s", err)
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{roomA: knockStateB})
+
+	// Alice is let into room A and Bob knocks again, so only Alice's knock is superseded
+	newEvents := []Event{
+		{Type: "m.room.member", StateKey: alice, Membership: "invite", RoomID: roomA},
+		{Type: "m.room.member", StateKey: bob, Membership: "_knock", RoomID: roomA},
+	}
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return table.RemoveSupersededKnocks(txn, roomA, newEvents)
+	})
+	if err != nil {
+		t.Fatalf("failed to RemoveSupersededKnocks: %s", err)
+	}
+	assertKnocks(t, table, alice, map[string][]json.RawMessage{})
+	assertKnocks(t, table, bob, map[string][]json.RawMessage{roomA: knockStateA})
+}
+
+func assertKnocks(t *testing.T, table *KnocksTable, userID string, expected map[string][]json.RawMessage) {
+	t.Helper()
+	knocks, err := table.SelectAllKnocksForUser(userID)
+	if err != nil {
+		t.Fatalf("failed to SelectAllKnocksForUser: %s", err)
+	}
+	if !reflect.DeepEqual(knocks, expected) {
+		t.Fatalf("SelectAllKnocksForUser(%s): got %v want %v", userID, knocks, expected)
+	}
+}
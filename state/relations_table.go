@@ -0,0 +1,156 @@
+package state
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	RelTypeReplace    = "m.replace"
+	RelTypeThread     = "m.thread"
+	RelTypeReference  = "m.reference"
+	RelTypeAnnotation = "m.annotation"
+)
+
+// Relation is an event with an `m.relates_to` which points at another event.
+type Relation struct {
+	NID       int64  `db:"event_nid"`
+	EventID   string `db:"event_id"`
+	RoomID    string `db:"room_id"`
+	RelatesTo string `db:"relates_to"`
+	RelType   string `db:"rel_type"`
+	Sender    string `db:"sender"`
+}
+
+// NewRelationFromEvent returns the relation for an event with a `content.m.relates_to`, else nil.
+// Replies are not relations in this sense as they use `m.in_reply_to` without a `rel_type`.
+func NewRelationFromEvent(ev Event) *Relation {
+	event := gjson.ParseBytes(ev.JSON)
+	relatesTo := event.Get(`content.m\.relates_to`)
+	relType := relatesTo.Get("rel_type").Str
+	eventID := relatesTo.Get("event_id").Str
+	if relType == "" || eventID == "" {
+		return nil
+	}
+	return &Relation{
+		NID:       ev.NID,
+		EventID:   ev.ID,
+		RoomID:    ev.RoomID,
+		RelatesTo: eventID,
+		RelType:   relType,
+		Sender:    event.Get("sender").Str,
+	}
+}
+
+// ThreadSummary is the aggregation of all m.thread relations to a thread root.
+type ThreadSummary struct {
+	RelatesTo string `db:"relates_to"`
+	Count     int    `db:"count"`
+	LatestNID int64  `db:"latest_nid"`
+	// true if the user asked about has sent an event in this thread
+	Participated bool `db:"participated"`
+}
+
+// RelationsTable indexes events which relate to other events, so bundled aggregations can be
+// calculated without scanning the timeline.
+type RelationsTable struct{}
+
+func NewRelationsTable(db *sqlx.DB) *RelationsTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_relations (
+		event_nid BIGINT PRIMARY KEY,
+		event_id TEXT NOT NULL,
+		room_id TEXT NOT NULL,
+		relates_to TEXT NOT NULL, -- the event ID being related to
+		rel_type TEXT NOT NULL,
+		sender TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_relations_relates_to_idx ON syncv3_relations(relates_to, rel_type);
+	-- a single row tracking the progress of Storage.BackfillRelations
+	CREATE TABLE IF NOT EXISTS syncv3_relations_backfill (
+		up_to_nid BIGINT NOT NULL, -- events up to and including this NID have been indexed
+		target_nid BIGINT NOT NULL -- events after this NID were indexed as they were accumulated
+	);
+	`)
+	return &RelationsTable{}
+}
+
+// SelectBackfillPosition returns the progress of the relations backfill, or ok=false if it has
+// not started.
+func (t *RelationsTable) SelectBackfillPosition(txn *sqlx.Tx) (upToNID, targetNID int64, ok bool, err error) {
+	err = txn.QueryRow(`SELECT up_to_nid, target_nid FROM syncv3_relations_backfill`).Scan(&upToNID, &targetNID)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, nil
+	}
+	return upToNID, targetNID, err == nil, err
+}
+
+// InsertBackfillPosition starts the relations backfill, which will index events up to and including
+// targetNID.
+func (t *RelationsTable) InsertBackfillPosition(txn *sqlx.Tx, targetNID int64) error {
+	_, err := txn.Exec(`INSERT INTO syncv3_relations_backfill (up_to_nid, target_nid) VALUES (0, $1)`, targetNID)
+	return err
+}
+
+// UpdateBackfillPosition records that events up to and including upToNID have been backfilled.
+func (t *RelationsTable) UpdateBackfillPosition(txn *sqlx.Tx, upToNID int64) error {
+	_, err := txn.Exec(`UPDATE syncv3_relations_backfill SET up_to_nid = $1`, upToNID)
+	return err
+}
+
+// Insert relations, ignoring any which already exist.
+func (t *RelationsTable) BulkInsert(txn *sqlx.Tx, relations []Relation) error {
+	if len(relations) == 0 {
+		return nil
+	}
+	chunks := sqlutil.Chunkify(6, MaxPostgresParameters, RelationChunker(relations))
+	for _, chunk := range chunks {
+		_, err := txn.NamedExec(`
+		INSERT INTO syncv3_relations (event_nid, event_id, room_id, relates_to, rel_type, sender)
+        VALUES (:event_nid, :event_id, :room_id, :relates_to, :rel_type, :sender) ON CONFLICT (event_nid) DO NOTHING`, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteByEventIDs removes the relations of the given relating events. Redaction strips
+// `m.relates_to` so redacted events no longer relate to anything.
+func (t *RelationsTable) DeleteByEventIDs(txn *sqlx.Tx, eventIDs []string) error {
+	_, err := txn.Exec(`DELETE FROM syncv3_relations WHERE event_id = ANY($1)`, pq.StringArray(eventIDs))
+	return err
+}
+
+// SelectRelations returns all relations of the given type to the given events, in NID order.
+// Avoid calling this for unbounded relation types like threads and annotations.
+func (t *RelationsTable) SelectRelations(txn *sqlx.Tx, relatesTo []string, relType string) (relations []Relation, err error) {
+	err = txn.Select(&relations, `
+	SELECT event_nid, event_id, room_id, relates_to, rel_type, sender FROM syncv3_relations
+	WHERE relates_to = ANY($1) AND rel_type = $2 ORDER BY event_nid ASC`, pq.StringArray(relatesTo), relType)
+	return
+}
+
+// SelectThreadSummaries returns a summary for each of the given events which is a thread root.
+// Participation is calculated for `userID`.
+func (t *RelationsTable) SelectThreadSummaries(txn *sqlx.Tx, relatesTo []string, userID string) (summaries []ThreadSummary, err error) {
+	err = txn.Select(&summaries, `
+	SELECT relates_to, COUNT(*) AS count, MAX(event_nid) AS latest_nid, bool_or(sender = $3) AS participated
+	FROM syncv3_relations WHERE relates_to = ANY($1) AND rel_type = $2 GROUP BY relates_to`,
+		pq.StringArray(relatesTo), RelTypeThread, userID)
+	return
+}
+
+type RelationChunker []Relation
+
+func (c RelationChunker) Len() int {
+	return len(c)
+}
+func (c RelationChunker) Subslice(i, j int) sqlutil.Chunker {
+	return c[i:j]
+}
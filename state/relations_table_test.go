@@ -0,0 +1,139 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+)
+
+func TestBundledAggregations(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestBundledAggregations:localhost"
+	alice := "@alice_TestBundledAggregations:localhost"
+	bob := "@bob_TestBundledAggregations:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewJoinEvent(t, bob),
+	})
+	assertNoError(t, err)
+
+	root := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "root"})
+	rootID := gjson.GetBytes(root, "event_id").Str
+	relatesTo := func(relType string) map[string]interface{} {
+		return map[string]interface{}{
+			"rel_type": relType,
+			"event_id": rootID,
+		}
+	}
+	edit1 := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "* edit 1", "m.relates_to": relatesTo(RelTypeReplace)})
+	edit2 := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "* edit 2", "m.relates_to": relatesTo(RelTypeReplace)})
+	// edits by other users are ignored
+	bobEdit := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "* bob edit", "m.relates_to": relatesTo(RelTypeReplace)})
+	thread1 := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "thread 1", "m.relates_to": relatesTo(RelTypeThread)})
+	thread2 := testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "thread 2", "m.relates_to": relatesTo(RelTypeThread)})
+	reference := testutils.NewEvent(t, "m.key.verification.done", bob, map[string]interface{}{"m.relates_to": relatesTo(RelTypeReference)})
+	reaction := testutils.NewEvent(t, "m.reaction", bob, map[string]interface{}{"m.relates_to": map[string]interface{}{
+		"rel_type": RelTypeAnnotation, "event_id": rootID, "key": "👍",
+	}})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		root, edit1, thread1, edit2, bobEdit, thread2, reference, reaction,
+	}})
+	assertNoError(t, err)
+
+	aggregations, err := store.BundledAggregations(alice, map[string]string{rootID: alice})
+	assertNoError(t, err)
+	assertAggregation(t, aggregations[rootID], "m\\.replace.event_id", gjson.GetBytes(edit2, "event_id").Str)
+	assertAggregation(t, aggregations[rootID], "m\\.thread.latest_event.event_id", gjson.GetBytes(thread2, "event_id").Str)
+	assertAggregation(t, aggregations[rootID], "m\\.thread.count", "2")
+	// alice sent the root, so she has participated
+	assertAggregation(t, aggregations[rootID], "m\\.thread.current_user_participated", "true")
+	assertAggregation(t, aggregations[rootID], "m\\.reference.chunk.#", "1")
+	assertAggregation(t, aggregations[rootID], "m\\.reference.chunk.0.event_id", gjson.GetBytes(reference, "event_id").Str)
+	assertAggregation(t, aggregations[rootID], "m\\.annotation", "")
+
+	// redacting the latest edit falls back to the previous one
+	redaction := testutils.NewEvent(t, "m.room.redaction", alice, map[string]interface{}{"redacts": gjson.GetBytes(edit2, "event_id").Str})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{redaction}})
+	assertNoError(t, err)
+	aggregations, err = store.BundledAggregations(bob, map[string]string{rootID: alice})
+	assertNoError(t, err)
+	assertAggregation(t, aggregations[rootID], "m\\.replace.event_id", gjson.GetBytes(edit1, "event_id").Str)
+	assertAggregation(t, aggregations[rootID], "m\\.thread.current_user_participated", "true")
+
+	// events which nothing relates to have no aggregations
+	aggregations, err = store.BundledAggregations(alice, map[string]string{gjson.GetBytes(thread1, "event_id").Str: bob})
+	assertNoError(t, err)
+	if len(aggregations) != 0 {
+		t.Errorf("BundledAggregations: got %v want nothing", aggregations)
+	}
+
+	// live events are bundled for no user in particular
+	rootEvents, err := store.EventsTable.SelectByIDs(nil, true, []string{rootID})
+	assertNoError(t, err)
+	events, aggregations, err := store.EventNIDsWithBundledAggregations([]int64{rootEvents[0].NID})
+	assertNoError(t, err)
+	if len(events) != 1 || gjson.GetBytes(events[0], "event_id").Str != rootID {
+		t.Fatalf("EventNIDsWithBundledAggregations: got events %v want the root", events)
+	}
+	assertAggregation(t, aggregations[rootID], "m\\.thread.count", "2")
+	assertAggregation(t, aggregations[rootID], "m\\.thread.current_user_participated", "false")
+}
+
+func assertAggregation(t *testing.T, aggregation json.RawMessage, path, want string) {
+	t.Helper()
+	got := gjson.GetBytes(aggregation, path).String()
+	if got != want {
+		t.Errorf("aggregation %s: got %q want %q (aggregation %s)", path, got, want, string(aggregation))
+	}
+}
+
+func TestBackfillRelations(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestBackfillRelations:localhost"
+	alice := "@alice_TestBackfillRelations:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+	root := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "root"})
+	rootID := gjson.GetBytes(root, "event_id").Str
+	thread := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "thread", "m.relates_to": map[string]interface{}{
+		"rel_type": RelTypeThread, "event_id": rootID,
+	}})
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{root, thread}})
+	assertNoError(t, err)
+
+	// pretend these events were stored before relations were indexed
+	_, err = store.DB.Exec(`DELETE FROM syncv3_relations WHERE room_id = $1`, roomID)
+	assertNoError(t, err)
+	_, err = store.DB.Exec(`DELETE FROM syncv3_relations_backfill`)
+	assertNoError(t, err)
+	aggregations, err := store.BundledAggregations(alice, map[string]string{rootID: alice})
+	assertNoError(t, err)
+	if len(aggregations) != 0 {
+		t.Fatalf("BundledAggregations: got %v before backfilling, want nothing", aggregations)
+	}
+
+	total, err := store.BackfillRelations(1)
+	assertNoError(t, err)
+	if total < 1 {
+		t.Errorf("BackfillRelations: got %d relations want at least 1", total)
+	}
+	aggregations, err = store.BundledAggregations(alice, map[string]string{rootID: alice})
+	assertNoError(t, err)
+	assertAggregation(t, aggregations[rootID], "m\\.thread.count", "1")
+
+	// the backfill only runs once
+	total, err = store.BackfillRelations(1)
+	assertNoError(t, err)
+	if total != 0 {
+		t.Errorf("BackfillRelations: got %d relations on the second run want 0", total)
+	}
+}
@@ -0,0 +1,52 @@
+package state
+
+import (
+	"database/sql"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReadReplica routes heavy read-only queries to a postgres replica. Replicas lag behind the
+// primary, so a query anchored at some event NID is only sent to the replica if the replica
+// has already seen that NID. If it hasn't, the query falls back to the primary: a client must
+// never see a position which the replica has not caught up to.
+type ReadReplica struct {
+	db *sqlx.DB
+	// the highest event NID we have seen on the replica. Only ever increases, so if a query
+	// is anchored at or below this value we can skip asking the replica how far it has got.
+	caughtUpTo atomic.Int64
+}
+
+func NewReadReplica(db *sqlx.DB) *ReadReplica {
+	return &ReadReplica{
+		db: db,
+	}
+}
+
+// HasCaughtUpTo returns true if the replica has replicated all events up to and including
+// the given event NID.
+func (r *ReadReplica) HasCaughtUpTo(nid int64) bool {
+	if nid <= r.caughtUpTo.Load() {
+		return true
+	}
+	var highest sql.NullInt64
+	if err := r.db.QueryRow(`SELECT MAX(event_nid) FROM syncv3_events`).Scan(&highest); err != nil {
+		logger.Warn().Err(err).Msg("ReadReplica: failed to query replica position, falling back to primary")
+		return false
+	}
+	if !highest.Valid {
+		return false
+	}
+	for {
+		curr := r.caughtUpTo.Load()
+		if highest.Int64 <= curr || r.caughtUpTo.CompareAndSwap(curr, highest.Int64) {
+			break
+		}
+	}
+	return nid <= highest.Int64
+}
+
+func (r *ReadReplica) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,62 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func TestReadReplicaFallsBackToPrimary(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	// point the replica at the same database: it is trivially caught up with everything written so far
+	replicaDB, err := sqlx.Open("postgres", postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open replica db: %s", err)
+	}
+	store.UseReadReplica(replicaDB)
+
+	roomID := "!TestReadReplicaFallsBackToPrimary:localhost"
+	alice := "@alice_TestReadReplicaFallsBackToPrimary:localhost"
+	_, err = store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "hello"}),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	latest, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	if !store.replica.HasCaughtUpTo(latest) {
+		t.Errorf("HasCaughtUpTo(%d) returned false, want true", latest)
+	}
+	if store.readDB(latest) != replicaDB {
+		t.Errorf("readDB(%d) did not return the replica", latest)
+	}
+	// positions the replica has not seen must be served by the primary
+	if store.replica.HasCaughtUpTo(latest + 1000) {
+		t.Errorf("HasCaughtUpTo(%d) returned true, want false", latest+1000)
+	}
+	if store.readDB(latest+1000) != store.DB {
+		t.Errorf("readDB(%d) did not return the primary", latest+1000)
+	}
+	// queries routed via the replica still work
+	events, err := store.LatestEventsInRooms(alice, []string{roomID}, latest, 10)
+	if err != nil {
+		t.Fatalf("LatestEventsInRooms: %s", err)
+	}
+	if len(events[roomID].Timeline) == 0 {
+		t.Errorf("LatestEventsInRooms returned no events")
+	}
+}
@@ -40,6 +40,12 @@ func (t *RoomsTable) SelectRoomInfos(txn *sqlx.Tx) (infos []RoomInfo, err error)
 	return
 }
 
+func (t *RoomsTable) SelectRoomInfosInRooms(txn *sqlx.Tx, roomIDs []string) (infos []RoomInfo, err error) {
+	err = txn.Select(&infos, `SELECT room_id, is_encrypted, upgraded_room_id, predecessor_room_id, type FROM syncv3_rooms
+	WHERE room_id = ANY($1)`, pq.StringArray(roomIDs))
+	return
+}
+
 func (t *RoomsTable) Upsert(txn *sqlx.Tx, info RoomInfo, snapshotID, latestNID int64) (err error) {
 	// This is a bit of a wonky query to ensure that you cannot set is_encrypted=false after it has been
 	// set to true.
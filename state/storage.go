@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
@@ -20,6 +21,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
@@ -59,19 +61,24 @@ func (e *LatestEvents) DiscardIgnoredMessages(shouldIgnore func(sender string) b
 }
 
 type Storage struct {
-	Accumulator       *Accumulator
-	EventsTable       *EventTable
-	ToDeviceTable     *ToDeviceTable
-	UnreadTable       *UnreadTable
-	AccountDataTable  *AccountDataTable
-	InvitesTable      *InvitesTable
-	TransactionsTable *TransactionsTable
-	DeviceDataTable   *DeviceDataTable
-	ReceiptTable      *ReceiptTable
-	DB                *sqlx.DB
-	MaxTimelineLimit  int
-	shutdownCh        chan struct{}
-	shutdown          bool
+	Accumulator        *Accumulator
+	EventsTable        *EventTable
+	ToDeviceTable      *ToDeviceTable
+	UnreadTable        *UnreadTable
+	AccountDataTable   *AccountDataTable
+	InvitesTable       *InvitesTable
+	KnocksTable        *KnocksTable
+	TransactionsTable  *TransactionsTable
+	DeviceDataTable    *DeviceDataTable
+	ReceiptTable       *ReceiptTable
+	RelationsTable     *RelationsTable
+	ConnSnapshotsTable *ConnSnapshotsTable
+	DB                 *sqlx.DB
+	MaxTimelineLimit   int
+	shutdownCh         chan struct{}
+	shutdown           bool
+	// optional: if set, heavy read-only queries are routed here when it has caught up.
+	replica *ReadReplica
 }
 
 func NewStorage(postgresURI string) *Storage {
@@ -86,35 +93,183 @@ func NewStorage(postgresURI string) *Storage {
 
 func NewStorageWithDB(db *sqlx.DB, addPrometheusMetrics bool) *Storage {
 	acc := &Accumulator{
-		db:            db,
-		roomsTable:    NewRoomsTable(db),
-		eventsTable:   NewEventTable(db),
-		snapshotTable: NewSnapshotsTable(db),
-		spacesTable:   NewSpacesTable(db),
-		invitesTable:  NewInvitesTable(db),
-		entityName:    "server",
+		db:             db,
+		roomsTable:     NewRoomsTable(db),
+		eventsTable:    NewEventTable(db),
+		snapshotTable:  NewSnapshotsTable(db),
+		spacesTable:    NewSpacesTable(db),
+		invitesTable:   NewInvitesTable(db),
+		knocksTable:    NewKnocksTable(db),
+		relationsTable: NewRelationsTable(db),
+		entityName:     "server",
 	}
 
 	return &Storage{
-		Accumulator:       acc,
-		ToDeviceTable:     NewToDeviceTable(db),
-		UnreadTable:       NewUnreadTable(db),
-		EventsTable:       acc.eventsTable,
-		AccountDataTable:  NewAccountDataTable(db),
-		InvitesTable:      acc.invitesTable,
-		TransactionsTable: NewTransactionsTable(db),
-		DeviceDataTable:   NewDeviceDataTable(db),
-		ReceiptTable:      NewReceiptTable(db),
-		DB:                db,
-		MaxTimelineLimit:  50,
-		shutdownCh:        make(chan struct{}),
+		Accumulator:        acc,
+		ToDeviceTable:      NewToDeviceTable(db),
+		UnreadTable:        NewUnreadTable(db),
+		EventsTable:        acc.eventsTable,
+		AccountDataTable:   NewAccountDataTable(db),
+		InvitesTable:       acc.invitesTable,
+		KnocksTable:        acc.knocksTable,
+		TransactionsTable:  NewTransactionsTable(db),
+		DeviceDataTable:    NewDeviceDataTable(db),
+		ReceiptTable:       NewReceiptTable(db),
+		RelationsTable:     acc.relationsTable,
+		ConnSnapshotsTable: NewConnSnapshotsTable(db),
+		DB:                 db,
+		MaxTimelineLimit:   50,
+		shutdownCh:         make(chan struct{}),
 	}
 }
 
+// UseReadReplica routes heavy read-only queries (room state, timelines and visibility
+// calculations) to the given database, which must be a replica of the primary.
+func (s *Storage) UseReadReplica(db *sqlx.DB) {
+	s.replica = NewReadReplica(db)
+}
+
+// UseEventCipher encrypts event JSON and connection snapshots with the given cipher before they
+// are written to the database. Events which were stored in plaintext remain readable.
+func (s *Storage) UseEventCipher(c *EventCipher) {
+	s.EventsTable.cipher = c
+	s.ConnSnapshotsTable.cipher = c
+}
+
+// ReencryptEvents rewrites stored events which are not encrypted with the current event key, in
+// batches of `batchSize`. This encrypts events stored before encryption was enabled, and events
+// encrypted with old keys after the secret has been rotated. Returns the number of events rewritten.
+// It is safe to run this whilst the proxy is running: rows which change underneath it are skipped.
+func (s *Storage) ReencryptEvents(batchSize int) (total int64, err error) {
+	c := s.EventsTable.cipher
+	if c == nil {
+		return 0, fmt.Errorf("ReencryptEvents: no event secret is configured")
+	}
+	prefix := c.currentPrefix()
+	var fromNID int64
+	for {
+		var events []Event
+		// Only pull out the rows which need to change, which lets postgres do the filtering.
+		err = s.DB.Select(&events, `
+		SELECT event_nid, event FROM syncv3_events
+		WHERE event_nid > $1 AND substring(event FROM 1 FOR $2) <> $3
+		ORDER BY event_nid ASC LIMIT $4`, fromNID, len(prefix), prefix, batchSize)
+		if err != nil {
+			return total, fmt.Errorf("ReencryptEvents: failed to select events: %w", err)
+		}
+		if len(events) == 0 {
+			return total, nil
+		}
+		var rewritten int64
+		err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+			for _, ev := range events {
+				plaintext, err := c.Decrypt(ev.JSON)
+				if err != nil {
+					return fmt.Errorf("event %d: %w", ev.NID, err)
+				}
+				ciphertext, err := c.Encrypt(plaintext)
+				if err != nil {
+					return fmt.Errorf("event %d: %w", ev.NID, err)
+				}
+				// the event may have been redacted since we read it, in which case leave it alone
+				// and let the next run pick it up.
+				res, err := txn.Exec(`UPDATE syncv3_events SET event=$1 WHERE event_nid=$2 AND event=$3`, ciphertext, ev.NID, ev.JSON)
+				if err != nil {
+					return fmt.Errorf("event %d: %w", ev.NID, err)
+				}
+				ra, _ := res.RowsAffected()
+				rewritten += ra
+			}
+			return nil
+		})
+		if err != nil {
+			return total, fmt.Errorf("ReencryptEvents: %w", err)
+		}
+		total += rewritten
+		fromNID = events[len(events)-1].NID
+		logger.Info().Int64("total", total).Int64("nid", fromNID).Msg("ReencryptEvents: progress")
+	}
+}
+
+// BackfillRelations indexes the relations of events which were stored before the relations table
+// existed, in batches of `batchSize`. Events stored since then are indexed as they are accumulated.
+// Progress is saved, so this only does work until the backfill has finished. Returns the number of
+// relations indexed. It is safe to run this whilst the proxy is running.
+func (s *Storage) BackfillRelations(batchSize int) (total int64, err error) {
+	var upToNID, targetNID int64
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		var ok bool
+		upToNID, targetNID, ok, err = s.RelationsTable.SelectBackfillPosition(txn)
+		if err != nil || ok {
+			return err
+		}
+		// the accumulator is already indexing new events, so only older events need backfilling
+		targetNID, err = s.EventsTable.SelectHighestNID()
+		if err != nil {
+			return err
+		}
+		return s.RelationsTable.InsertBackfillPosition(txn, targetNID)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("BackfillRelations: failed to load position: %w", err)
+	}
+	for upToNID < targetNID {
+		var events []Event
+		err = s.DB.Select(&events, `
+		SELECT event_nid, event_id, room_id, event FROM syncv3_events
+		WHERE event_nid > $1 AND event_nid <= $2 ORDER BY event_nid ASC LIMIT $3`, upToNID, targetNID, batchSize)
+		if err != nil {
+			return total, fmt.Errorf("BackfillRelations: failed to select events: %w", err)
+		}
+		nextNID := targetNID
+		if len(events) > 0 {
+			nextNID = events[len(events)-1].NID
+		}
+		if err = s.EventsTable.decryptEvents(events); err != nil {
+			return total, fmt.Errorf("BackfillRelations: %w", err)
+		}
+		var relations []Relation
+		for _, ev := range events {
+			if r := NewRelationFromEvent(ev); r != nil {
+				relations = append(relations, *r)
+			}
+		}
+		err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+			if err := s.RelationsTable.BulkInsert(txn, relations); err != nil {
+				return err
+			}
+			return s.RelationsTable.UpdateBackfillPosition(txn, nextNID)
+		})
+		if err != nil {
+			return total, fmt.Errorf("BackfillRelations: %w", err)
+		}
+		total += int64(len(relations))
+		upToNID = nextNID
+		logger.Info().Int64("total", total).Int64("nid", upToNID).Int64("target_nid", targetNID).Msg("BackfillRelations: progress")
+	}
+	return total, nil
+}
+
+// readDB returns the database to use for read-only queries anchored at the given event
+// NID. This is the read replica if one is configured and it has caught up to the NID,
+// otherwise it is the primary.
+func (s *Storage) readDB(pos int64) *sqlx.DB {
+	if s.replica == nil || !s.replica.HasCaughtUpTo(pos) {
+		return s.Accumulator.db
+	}
+	return s.replica.db
+}
+
 func (s *Storage) LatestEventNID() (int64, error) {
 	return s.Accumulator.eventsTable.SelectHighestNID()
 }
 
+// NumRooms returns the number of rooms the proxy knows about.
+func (s *Storage) NumRooms() (count int, err error) {
+	err = s.DB.Get(&count, `SELECT count(*) FROM syncv3_rooms`)
+	return
+}
+
 func (s *Storage) AccountData(userID, roomID string, eventTypes []string) (data []AccountData, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		data, err = s.AccountDataTable.Select(txn, userID, eventTypes, roomID)
@@ -305,6 +460,71 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 	return nil
 }
 
+// MetadataForRooms loads the current metadata for the given rooms. Rooms which the proxy does not
+// know about are not included in the result. Used to reload rooms which are not held in memory.
+func (s *Storage) MetadataForRooms(roomIDs []string) (result map[string]internal.RoomMetadata, err error) {
+	result = make(map[string]internal.RoomMetadata, len(roomIDs))
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		roomInfos, err := s.Accumulator.roomsTable.SelectRoomInfosInRooms(txn, roomIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select room infos: %s", err)
+		}
+		var spaceRoomIDs []string
+		for _, info := range roomInfos {
+			metadata := internal.NewRoomMetadata(info.ID)
+			metadata.Encrypted = info.IsEncrypted
+			metadata.UpgradedRoomID = info.UpgradedRoomID
+			metadata.PredecessorRoomID = info.PredecessorRoomID
+			metadata.RoomType = info.Type
+			// name, avatar, alias, member counts and heroes
+			if err = s.ResetMetadataState(metadata); err != nil {
+				return err
+			}
+			result[info.ID] = *metadata
+			if metadata.IsSpace() {
+				spaceRoomIDs = append(spaceRoomIDs, info.ID)
+			}
+		}
+
+		events, err := s.Accumulator.eventsTable.selectLatestEventByTypeInRooms(txn, roomIDs)
+		if err != nil {
+			return err
+		}
+		for _, ev := range events {
+			metadata, ok := result[ev.RoomID]
+			if !ok {
+				continue
+			}
+			parsed := gjson.ParseBytes(ev.JSON)
+			ts := parsed.Get("origin_server_ts").Uint()
+			if ts > metadata.LastMessageTimestamp {
+				metadata.LastMessageTimestamp = ts
+			}
+			metadata.LatestEventsByType[parsed.Get("type").Str] = internal.EventMetadata{
+				NID:       ev.NID,
+				Timestamp: ts,
+			}
+			result[ev.RoomID] = metadata
+		}
+
+		spaceRoomToRelations, err := s.Accumulator.spacesTable.SelectChildren(txn, spaceRoomIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select space children: %s", err)
+		}
+		for roomID, relations := range spaceRoomToRelations {
+			metadata := result[roomID]
+			for _, r := range relations {
+				if r.Relation == RelationMSpaceChild {
+					metadata.ChildSpaceRooms[r.Child] = struct{}{}
+				}
+			}
+			result[roomID] = metadata
+		}
+		return nil
+	})
+	return
+}
+
 // ResetMetadataState updates the given metadata in-place to reflect the current state
 // of the room. This is only safe to call from the subscriber goroutine; it is not safe
 // to call from the connection goroutines.
@@ -329,7 +549,48 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 	if err != nil {
 		return fmt.Errorf("ResetMetadataState[%s]: %w", metadata.RoomID, err)
 	}
+	if err = s.EventsTable.decryptEvents(events); err != nil {
+		return fmt.Errorf("ResetMetadataState[%s]: %w", metadata.RoomID, err)
+	}
+
+	setMetadataState(metadata, events)
+
+	// For now, don't bother reloading PredecessorID and UpgradedRoomID.
+	// These shouldn't be changing during a room's lifetime in normal operation.
 
+	// We haven't updated LatestEventsByType because that's not part of the timeline.
+	return nil
+}
+
+// MetadataAfterEventPosition sets the name, avatar, canonical alias, encryption, join/invite counts
+// and heroes in this room's metadata from the state after the given event position, rather than
+// the current state. Used to show rooms as they were when the user left them.
+func (s *Storage) MetadataAfterEventPosition(ctx context.Context, metadata *internal.RoomMetadata, pos int64) error {
+	roomToEvents, err := s.RoomStateAfterEventPosition(ctx, []string{metadata.RoomID}, pos, map[string][]string{
+		"m.room.name":            {""},
+		"m.room.avatar":          {""},
+		"m.room.canonical_alias": {""},
+		"m.room.encryption":      {""},
+		"m.room.member":          nil,
+	})
+	if err != nil {
+		return fmt.Errorf("MetadataAfterEventPosition[%s]: %w", metadata.RoomID, err)
+	}
+	events := roomToEvents[metadata.RoomID]
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].NID < events[j].NID
+	})
+	metadata.NameEvent = ""
+	metadata.AvatarEvent = ""
+	metadata.CanonicalAlias = ""
+	metadata.Encrypted = false
+	setMetadataState(metadata, events)
+	return nil
+}
+
+// setMetadataState sets the fields of metadata which are derived from these state events, which
+// must be in NID order.
+func setMetadataState(metadata *internal.RoomMetadata, events []Event) {
 	heroMemberships := circularSlice[*Event]{max: 6}
 	metadata.JoinCount = 0
 	metadata.InviteCount = 0
@@ -346,16 +607,21 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 		case "m.room.encryption":
 			metadata.Encrypted = true
 		case "m.room.member":
-			heroMemberships.append(&events[i])
-			switch ev.Membership {
+			membership := ev.Membership
+			if membership == "" {
+				membership = gjson.GetBytes(ev.JSON, "content.membership").Str
+			}
+			switch membership {
 			case "join":
 				fallthrough
 			case "_join":
 				metadata.JoinCount++
+				heroMemberships.append(&events[i])
 			case "invite":
 				fallthrough
 			case "_invite":
 				metadata.InviteCount++
+				heroMemberships.append(&events[i])
 			}
 		case "m.space.child":
 			metadata.ChildSpaceRooms[ev.StateKey] = struct{}{}
@@ -372,12 +638,30 @@ func (s *Storage) ResetMetadataState(metadata *internal.RoomMetadata) error {
 		}
 		metadata.Heroes = append(metadata.Heroes, hero)
 	}
+}
 
-	// For now, don't bother reloading PredecessorID and UpgradedRoomID.
-	// These shouldn't be changing during a room's lifetime in normal operation.
-
-	// We haven't updated LatestEventsByType because that's not part of the timeline.
-	return nil
+// RoomMembershipsAfterEventPosition returns the joined and invited users in each room after the
+// given event position.
+func (s *Storage) RoomMembershipsAfterEventPosition(ctx context.Context, roomIDs []string, pos int64) (joined, invited map[string][]string, err error) {
+	roomToEvents, err := s.RoomStateAfterEventPosition(ctx, roomIDs, pos, map[string][]string{
+		"m.room.member": nil,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	joined = make(map[string][]string, len(roomIDs))
+	invited = make(map[string][]string)
+	for roomID, events := range roomToEvents {
+		for _, ev := range events {
+			switch gjson.GetBytes(ev.JSON, "content.membership").Str {
+			case "join":
+				joined[roomID] = append(joined[roomID], ev.StateKey)
+			case "invite":
+				invited[roomID] = append(invited[roomID], ev.StateKey)
+			}
+		}
+	}
+	return joined, invited, nil
 }
 
 // FetchMemberships looks up the latest snapshot for the given room and determines the
@@ -456,6 +740,9 @@ func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventT
 		if err := rows.Scan(&ev.RoomID, &ev.Type, &ev.StateKey, &ev.JSON); err != nil {
 			return nil, err
 		}
+		if ev.JSON, err = s.EventsTable.cipher.Decrypt(ev.JSON); err != nil {
+			return nil, err
+		}
 		result[ev.RoomID] = append(result[ev.RoomID], ev)
 	}
 	return result, nil
@@ -492,6 +779,130 @@ func (s *Storage) EventNIDs(eventNIDs []int64) ([]json.RawMessage, error) {
 	return e, nil
 }
 
+// BundledAggregations returns the bundled aggregations (the value of `unsigned.m.relations`)
+// for the given events, keyed by event ID. Events which have not been related to are omitted.
+// `eventIDToSender` maps each event to its sender, as only edits by the original sender are
+// bundled. `userID` is used to calculate `current_user_participated` for threads.
+func (s *Storage) BundledAggregations(userID string, eventIDToSender map[string]string) (aggregations map[string]json.RawMessage, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		aggregations, err = s.bundledAggregations(txn, userID, eventIDToSender)
+		return err
+	})
+	return
+}
+
+// EventNIDsWithBundledAggregations is EventNIDs, along with the bundled aggregations for the events
+// as seen by no particular user, so `current_user_participated` is only correct for users who
+// have not sent an event in the thread. Both are read in the same transaction.
+func (s *Storage) EventNIDsWithBundledAggregations(eventNIDs []int64) (events []json.RawMessage, aggregations map[string]json.RawMessage, err error) {
+	err = sqlutil.WithTransaction(s.DB, func(txn *sqlx.Tx) error {
+		rows, err := s.EventsTable.SelectByNIDs(txn, true, eventNIDs)
+		if err != nil {
+			return err
+		}
+		events = make([]json.RawMessage, len(rows))
+		eventIDToSender := make(map[string]string, len(rows))
+		for i := range rows {
+			events[i] = rows[i].JSON
+			eventIDToSender[rows[i].ID] = gjson.GetBytes(rows[i].JSON, "sender").Str
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		aggregations, err = s.bundledAggregations(txn, "", eventIDToSender)
+		return err
+	})
+	return
+}
+
+func (s *Storage) bundledAggregations(txn *sqlx.Tx, userID string, eventIDToSender map[string]string) (map[string]json.RawMessage, error) {
+	eventIDs := make([]string, 0, len(eventIDToSender))
+	for eventID := range eventIDToSender {
+		eventIDs = append(eventIDs, eventID)
+	}
+	edits, err := s.RelationsTable.SelectRelations(txn, eventIDs, RelTypeReplace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select edits: %w", err)
+	}
+	latestEdits := make(map[string]int64)
+	for _, edit := range edits {
+		// edits are in NID order so the last one wins
+		if edit.Sender == eventIDToSender[edit.RelatesTo] {
+			latestEdits[edit.RelatesTo] = edit.NID
+		}
+	}
+	threads, err := s.RelationsTable.SelectThreadSummaries(txn, eventIDs, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select thread summaries: %w", err)
+	}
+	references, err := s.RelationsTable.SelectRelations(txn, eventIDs, RelTypeReference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select references: %w", err)
+	}
+	nids := make([]int64, 0, len(latestEdits)+len(threads))
+	for _, nid := range latestEdits {
+		nids = append(nids, nid)
+	}
+	for _, thread := range threads {
+		nids = append(nids, thread.LatestNID)
+	}
+	eventsByNID := make(map[int64]json.RawMessage)
+	if len(nids) > 0 {
+		events, err := s.EventsTable.SelectByNIDs(txn, false, nids)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select related events: %w", err)
+		}
+		for _, ev := range events {
+			eventsByNID[ev.NID] = ev.JSON
+		}
+	}
+
+	result := make(map[string]json.RawMessage)
+	set := func(eventID, path string, value interface{}) error {
+		aggregation, ok := result[eventID]
+		if !ok {
+			aggregation = json.RawMessage(`{}`)
+		}
+		aggregation, err := sjson.SetBytes(aggregation, path, value)
+		if err != nil {
+			return fmt.Errorf("failed to set %s on %s: %w", path, eventID, err)
+		}
+		result[eventID] = aggregation
+		return nil
+	}
+	for eventID, nid := range latestEdits {
+		if ev := eventsByNID[nid]; ev != nil {
+			if err = set(eventID, `m\.replace`, ev); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, thread := range threads {
+		ev := eventsByNID[thread.LatestNID]
+		if ev == nil {
+			continue
+		}
+		err = set(thread.RelatesTo, `m\.thread`, map[string]interface{}{
+			"latest_event":              ev,
+			"count":                     thread.Count,
+			"current_user_participated": thread.Participated || eventIDToSender[thread.RelatesTo] == userID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	chunks := make(map[string][]map[string]string)
+	for _, ref := range references {
+		chunks[ref.RelatesTo] = append(chunks[ref.RelatesTo], map[string]string{"event_id": ref.EventID})
+	}
+	for eventID, chunk := range chunks {
+		if err = set(eventID, `m\.reference.chunk`, chunk); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
 func (s *Storage) StateSnapshot(snapID int64) (state []json.RawMessage, err error) {
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		snapshotRow, err := s.Accumulator.snapshotTable.Select(txn, snapID)
@@ -519,7 +930,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 	defer span.End()
 	roomToEvents = make(map[string][]Event, len(roomIDs))
 	roomIndex := make(map[string]int, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithTransaction(s.readDB(pos), func(txn *sqlx.Tx) error {
 		// we have 2 ways to pull the latest events:
 		//  - superfast rooms table (which races as it can be updated before the new state hits the dispatcher)
 		//  - slower events table query
@@ -672,6 +1083,9 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 				if err := rows.Scan(&ev.NID, &ev.RoomID, &ev.Type, &ev.StateKey, &ev.JSON); err != nil {
 					return err
 				}
+				if ev.JSON, err = s.EventsTable.cipher.Decrypt(ev.JSON); err != nil {
+					return err
+				}
 				i := roomIndex[ev.RoomID]
 				if latestEvents[i].ReplacesNID == ev.NID {
 					// this event is replaced by the last event
@@ -721,7 +1135,7 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 		limit = s.MaxTimelineLimit
 	}
 	result := make(map[string]*LatestEvents, len(roomIDs))
-	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+	err = sqlutil.WithTransaction(s.readDB(to), func(txn *sqlx.Tx) error {
 		for roomID, r := range roomIDToRange {
 			var earliestEventNID int64
 			var latestEventNID int64
@@ -762,6 +1176,79 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 	return result, err
 }
 
+// UnreadEvents returns the events after the user's latest read receipt
+// - in the given rooms
+// - that the user has permission to see
+// - with NIDs <= `to`.
+// Up to `limit` events are chosen per room, the most recent event first. Threaded receipts are
+// ignored. Sending an event counts as reading the room up to that event. Rooms are omitted if the
+// user's read receipt is for an event we haven't seen, as we can't tell which events are unread.
+func (s *Storage) UnreadEvents(userID string, roomIDs []string, to int64, limit int) (map[string][]Event, error) {
+	roomIDToRange, err := s.visibleEventNIDsBetweenForRooms(userID, roomIDs, 0, to)
+	if err != nil {
+		return nil, err
+	}
+	receiptsByRoom, err := s.ReceiptTable.SelectReceiptsForUser(roomIDs, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select receipts: %w", err)
+	}
+	var receiptEventIDs []string
+	for _, receipts := range receiptsByRoom {
+		for _, r := range receipts {
+			if r.ThreadID == "" || r.ThreadID == "main" {
+				receiptEventIDs = append(receiptEventIDs, r.EventID)
+			}
+		}
+	}
+	result := make(map[string][]Event, len(roomIDs))
+	for _, roomID := range roomIDs {
+		result[roomID] = nil
+	}
+	err = sqlutil.WithTransaction(s.readDB(to), func(txn *sqlx.Tx) error {
+		receiptNIDs, err := s.EventsTable.SelectNIDsByIDs(txn, receiptEventIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select receipt NIDs: %w", err)
+		}
+		for roomID, r := range roomIDToRange {
+			from := r[0] - 1
+			hasReceipt, knownReceipt := false, false
+			for _, receipt := range receiptsByRoom[roomID] {
+				if receipt.ThreadID != "" && receipt.ThreadID != "main" {
+					continue
+				}
+				hasReceipt = true
+				nid, ok := receiptNIDs[receipt.EventID]
+				if !ok {
+					continue
+				}
+				knownReceipt = true
+				if nid > from {
+					from = nid
+				}
+			}
+			if hasReceipt && !knownReceipt {
+				delete(result, roomID)
+				continue
+			}
+			if from >= r[1] {
+				continue // the user has read everything
+			}
+			events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, from, r[1], limit)
+			if err != nil {
+				return fmt.Errorf("room %s failed to SelectLatestEventsBetween: %s", roomID, err)
+			}
+			for _, ev := range events {
+				if gjson.GetBytes(ev.JSON, "sender").Str == userID {
+					break
+				}
+				result[roomID] = append(result[roomID], ev)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
 // Remove state snapshots which cannot be accessed by clients. The latest MaxTimelineEvents
 // snapshots must be kept, +1 for the current state. This handles the worst case where all
 // MaxTimelineEvents are state events and hence each event makes a new snapshot. We can safely
@@ -819,29 +1306,32 @@ func (s *Storage) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch
 // visibleEventNIDsBetweenForRooms determines which events a given user has permission to see.
 // It accepts a nid range [from, to]. For each given room, it calculates the NID range
 // [A1, B1] within [from, to] in which the user has permission to see events.
-func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []string, from, to int64) (map[string][2]int64, error) {
-	// load *THESE* joined rooms for this user at from (inclusive)
-	var membershipEvents []Event
-	var err error
-	if from != 0 {
-		// if from==0 then this query will return nothing, so optimise it out
-		membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(roomIDs, "m.room.member", userID, 0, from)
+func (s *Storage) visibleEventNIDsBetweenForRooms(userID string, roomIDs []string, from, to int64) (result map[string][2]int64, err error) {
+	err = sqlutil.WithTransaction(s.readDB(to), func(txn *sqlx.Tx) error {
+		// load *THESE* joined rooms for this user at from (inclusive)
+		var membershipEvents []Event
+		if from != 0 {
+			// if from==0 then this query will return nothing, so optimise it out
+			membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(txn, roomIDs, "m.room.member", userID, 0, from)
+			if err != nil {
+				return fmt.Errorf("VisibleEventNIDsBetweenForRooms.SelectEventsWithTypeStateKeyInRooms: %s", err)
+			}
+		}
+		joinTimingsAtFromByRoomID, err := s.determineJoinedRoomsFromMemberships(membershipEvents)
 		if err != nil {
-			return nil, fmt.Errorf("VisibleEventNIDsBetweenForRooms.SelectEventsWithTypeStateKeyInRooms: %s", err)
+			return fmt.Errorf("failed to work out joined rooms for %s at pos %d: %s", userID, from, err)
 		}
-	}
-	joinTimingsAtFromByRoomID, err := s.determineJoinedRoomsFromMemberships(membershipEvents)
-	if err != nil {
-		return nil, fmt.Errorf("failed to work out joined rooms for %s at pos %d: %s", userID, from, err)
-	}
 
-	// load membership deltas for *THESE* rooms for this user
-	membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(roomIDs, "m.room.member", userID, from, to)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load membership events: %s", err)
-	}
+		// load membership deltas for *THESE* rooms for this user
+		membershipEvents, err = s.Accumulator.eventsTable.SelectEventsWithTypeStateKeyInRooms(txn, roomIDs, "m.room.member", userID, from, to)
+		if err != nil {
+			return fmt.Errorf("failed to load membership events: %s", err)
+		}
 
-	return s.visibleEventNIDsWithData(joinTimingsAtFromByRoomID, membershipEvents, userID, from, to)
+		result, err = s.visibleEventNIDsWithData(joinTimingsAtFromByRoomID, membershipEvents, userID, from, to)
+		return err
+	})
+	return
 }
 
 // Work out the NID ranges to pull events from for this user. Given a from and to event nid stream position,
@@ -1088,6 +1578,10 @@ Loop:
 				logger.Warn().Err(err).Msg("failed to clean txn ID table")
 				sentry.CaptureException(err)
 			}
+			if err = s.ConnSnapshotsTable.Clean(boundaryTime); err != nil {
+				logger.Warn().Err(err).Msg("failed to clean conn snapshots table")
+				sentry.CaptureException(err)
+			}
 			// we also want to clean up stale state snapshots which are inaccessible, to
 			// keep the size of the syncv3_snapshots table low.
 			if err = s.RemoveInaccessibleStateSnapshots(); err != nil {
@@ -1150,6 +1644,47 @@ func (s *Storage) JoinedRoomsAfterPosition(userID string, pos int64) (
 	return s.determineJoinedRoomsFromMemberships(membershipEvents)
 }
 
+// LeftRoomsAfterPosition returns the rooms which the user was joined to but has since left or been
+// banned from as of pos, together with timing info for the user's leave from each room. Rooms which
+// were only ever invited to are not included.
+func (s *Storage) LeftRoomsAfterPosition(userID string, pos int64) (
+	leaveTimingByRoomID map[string]internal.EventMetadata, err error,
+) {
+	membershipEvents, err := s.Accumulator.eventsTable.SelectEventsWithTypeStateKey("m.room.member", userID, 0, pos)
+	if err != nil {
+		return nil, fmt.Errorf("LeftRoomsAfterPosition.SelectEventsWithTypeStateKey: %s", err)
+	}
+	return determineLeftRoomsFromMemberships(membershipEvents), nil
+}
+
+// determineLeftRoomsFromMemberships is like determineJoinedRoomsFromMemberships, but returns the
+// rooms which were left after being joined. The same preconditions apply.
+func determineLeftRoomsFromMemberships(membershipEvents []Event) map[string]internal.EventMetadata {
+	joined := make(map[string]bool)
+	leaveTimingByRoomID := make(map[string]internal.EventMetadata)
+	for _, ev := range membershipEvents {
+		parsed := gjson.ParseBytes(ev.JSON)
+		switch parsed.Get("content.membership").Str {
+		case "join":
+			joined[ev.RoomID] = true
+			delete(leaveTimingByRoomID, ev.RoomID)
+		case "invite", "knock":
+			// the room is no longer archived, even if we subsequently reject the invite
+			delete(leaveTimingByRoomID, ev.RoomID)
+		case "leave", "ban":
+			// only remember the leave which stopped us seeing events, not e.g leave->ban
+			if joined[ev.RoomID] {
+				joined[ev.RoomID] = false
+				leaveTimingByRoomID[ev.RoomID] = internal.EventMetadata{
+					NID:       ev.NID,
+					Timestamp: parsed.Get("origin_server_ts").Uint(),
+				}
+			}
+		}
+	}
+	return leaveTimingByRoomID
+}
+
 // determineJoinedRoomsFromMemberships scans a slice of membership events from multiple
 // rooms, to determine which rooms a user is currently joined to. Those events MUST be
 // - sorted by ascending NIDs, and
@@ -1198,6 +1733,11 @@ func (s *Storage) Teardown() {
 	if err != nil {
 		panic("Storage.Teardown: " + err.Error())
 	}
+	if s.replica != nil {
+		if err = s.replica.Close(); err != nil {
+			panic("Storage.Teardown: replica: " + err.Error())
+		}
+	}
 }
 
 // circularSlice is a slice which can be appended to which will wraparound at `max`.
@@ -182,6 +182,18 @@ func TestStorageJoinedRoomsAfterPosition(t *testing.T) {
 			t.Fatalf("JoinedRoomsAfterPosition at %v for %s got %v want %v", latestPos, alice, gotRoomID, joinedRoomID)
 		}
 	}
+	aliceLeaveTimingsByRoomID, err := store.LeftRoomsAfterPosition(alice, latestPos)
+	if err != nil {
+		t.Fatalf("failed to LeftRoomsAfterPosition: %s", err)
+	}
+	if len(aliceLeaveTimingsByRoomID) != 2 {
+		t.Fatalf("LeftRoomsAfterPosition at %v for %s got %v, want rooms %s and %s", latestPos, alice, aliceLeaveTimingsByRoomID, leftRoomID, banRoomID)
+	}
+	for _, roomID := range []string{leftRoomID, banRoomID} {
+		if aliceLeaveTimingsByRoomID[roomID].NID == 0 {
+			t.Fatalf("LeftRoomsAfterPosition at %v for %s got %v, missing leave timing for %s", latestPos, alice, aliceLeaveTimingsByRoomID, roomID)
+		}
+	}
 	bobJoinTimingsByRoomID, err := store.JoinedRoomsAfterPosition(bob, latestPos)
 	if err != nil {
 		t.Fatalf("failed to JoinedRoomsAfterPosition: %s", err)
@@ -580,6 +592,83 @@ func TestStorageLatestEventsInRoomsPrevBatch(t *testing.T) {
 	}
 }
 
+func TestStorageUnreadEvents(t *testing.T) {
+	store := NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestStorageUnreadEvents:localhost"
+	alice := "@alice_TestStorageUnreadEvents:localhost"
+	bob := "@bob_TestStorageUnreadEvents:localhost"
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewJoinEvent(t, alice),
+	})
+	if err != nil {
+		t.Fatalf("failed to initialise: %s", err)
+	}
+	timeline := []json.RawMessage{
+		testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "1"}),
+		testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{"body": "2"}),
+		testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "3"}),
+		testutils.NewEvent(t, "m.room.message", bob, map[string]interface{}{"body": "4"}),
+	}
+	_, err = store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: timeline})
+	if err != nil {
+		t.Fatalf("failed to accumulate: %s", err)
+	}
+	latestPos, err := store.LatestEventNID()
+	if err != nil {
+		t.Fatalf("LatestEventNID: %s", err)
+	}
+	assertUnreadEvents := func(want []json.RawMessage) {
+		t.Helper()
+		got, err := store.UnreadEvents(alice, []string{roomID}, latestPos, 10)
+		if err != nil {
+			t.Fatalf("UnreadEvents: %s", err)
+		}
+		if _, ok := got[roomID]; !ok {
+			t.Fatalf("UnreadEvents: room missing from result")
+		}
+		if len(got[roomID]) != len(want) {
+			t.Fatalf("UnreadEvents: got %d events want %d", len(got[roomID]), len(want))
+		}
+		for i := range want {
+			gotID := gjson.GetBytes(got[roomID][i].JSON, "event_id").Str
+			wantID := gjson.GetBytes(want[i], "event_id").Str
+			if gotID != wantID {
+				t.Errorf("UnreadEvents: event %d got %s want %s", i, gotID, wantID)
+			}
+		}
+	}
+	sendReceipt := func(ev json.RawMessage) {
+		t.Helper()
+		eventID := gjson.GetBytes(ev, "event_id").Str
+		_, err := store.ReceiptTable.Insert(roomID, json.RawMessage(fmt.Sprintf(
+			`{"type":"m.receipt","content":{"%s":{"m.read":{"%s":{"ts":1234}}}}}`, eventID, alice,
+		)))
+		if err != nil {
+			t.Fatalf("failed to insert receipt: %s", err)
+		}
+	}
+
+	// alice sending an event counts as reading up to that point
+	assertUnreadEvents([]json.RawMessage{timeline[3], timeline[2]})
+	sendReceipt(timeline[2])
+	assertUnreadEvents([]json.RawMessage{timeline[3]})
+	sendReceipt(timeline[3])
+	assertUnreadEvents(nil)
+
+	// we can't tell what is unread if we haven't seen the event the receipt is for
+	sendReceipt(json.RawMessage(`{"event_id":"$unknown"}`))
+	got, err := store.UnreadEvents(alice, []string{roomID}, latestPos, 10)
+	if err != nil {
+		t.Fatalf("UnreadEvents: %s", err)
+	}
+	if _, ok := got[roomID]; ok {
+		t.Fatalf("UnreadEvents: got %v for a receipt on an unknown event, want the room omitted", got[roomID])
+	}
+}
+
 func TestGlobalSnapshot(t *testing.T) {
 	alice := "@TestGlobalSnapshot_alice:localhost"
 	bob := "@TestGlobalSnapshot_bob:localhost"
@@ -684,6 +773,19 @@ func TestGlobalSnapshot(t *testing.T) {
 	for roomID, want := range wantMetadata {
 		assertRoomMetadata(t, snapshot.GlobalMetadata[roomID], want)
 	}
+
+	// loading individual rooms should give the same metadata
+	metadata, err := store.MetadataForRooms([]string{roomAlice, roomBob, roomAliceBob, roomSpace, "!unknown"})
+	assertNoError(t, err)
+	if len(metadata) != len(wantMetadata) {
+		t.Errorf("MetadataForRooms: got %d rooms, want %d", len(metadata), len(wantMetadata))
+	}
+	for roomID, want := range wantMetadata {
+		assertRoomMetadata(t, metadata[roomID], want)
+		if !reflect.DeepEqual(metadata[roomID].LatestEventsByType, snapshot.GlobalMetadata[roomID].LatestEventsByType) {
+			t.Errorf("MetadataForRooms[%s].LatestEventsByType: got %v want %v", roomID, metadata[roomID].LatestEventsByType, snapshot.GlobalMetadata[roomID].LatestEventsByType)
+		}
+	}
 }
 
 func TestAllJoinedMembers(t *testing.T) {
@@ -34,6 +34,8 @@ func NewTransactionsTable(db *sqlx.DB) *TransactionsTable {
 	return &TransactionsTable{db}
 }
 
+// Insert transaction IDs for events sent by this device. Transaction IDs which are already known are
+// ignored, as the same event can be seen by the poller after being sent through the proxy.
 func (t *TransactionsTable) Insert(userID, deviceID string, eventIDToTxnID map[string]string) error {
 	ts := time.Now()
 	rows := make([]txnRow, 0, len(eventIDToTxnID))
@@ -48,7 +50,8 @@ func (t *TransactionsTable) Insert(userID, deviceID string, eventIDToTxnID map[s
 	}
 	result, err := t.db.NamedQuery(`
 		INSERT INTO syncv3_txns (user_id, device_id, event_id, txn_id, ts)
-        VALUES (:user_id, :device_id, :event_id, :txn_id, :ts)`, rows)
+        VALUES (:user_id, :device_id, :event_id, :txn_id, :ts)
+		ON CONFLICT (user_id, device_id, event_id) DO NOTHING`, rows)
 	if err == nil {
 		result.Close()
 	}
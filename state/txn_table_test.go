@@ -60,6 +60,12 @@ func TestTransactionTable(t *testing.T) {
 		eventB: txnIDB,
 	})
 
+	// inserting a known txn ID is a no-op
+	err = table.Insert(userID, deviceID, map[string]string{
+		eventA: txnIDA,
+	})
+	assertNoError(t, err)
+
 	// different user select
 	gotTxns, err = table.Select("@another", "another_device", []string{eventA, eventB})
 	assertNoError(t, err)
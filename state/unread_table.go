@@ -44,6 +44,13 @@ func (t *UnreadTable) SelectAllNonZeroCountsForUser(userID string, callback func
 	return nil
 }
 
+// SelectRoomsWithCountsForUser returns the room IDs which the upstream server has sent unread counts
+// for, including rooms where the counts are zero.
+func (t *UnreadTable) SelectRoomsWithCountsForUser(userID string) (roomIDs []string, err error) {
+	err = t.db.Select(&roomIDs, `SELECT room_id FROM syncv3_unread WHERE user_id=$1`, userID)
+	return
+}
+
 func (t *UnreadTable) SelectUnreadCounters(userID, roomID string) (highlightCount, notificationCount int, err error) {
 	err = t.db.QueryRow(
 		`SELECT notification_count, highlight_count FROM syncv3_unread WHERE user_id=$1 AND room_id=$2`, userID, roomID,
@@ -1,6 +1,8 @@
 package state
 
 import (
+	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -58,6 +60,14 @@ func TestUnreadTable(t *testing.T) {
 	if len(wantNotifs) != 0 {
 		t.Errorf("SelectAllNonZeroCountsForUser missed notif rooms: %+v", wantNotifs)
 	}
+
+	roomIDs, err := table.SelectRoomsWithCountsForUser(userID)
+	assertNoError(t, err)
+	sort.Strings(roomIDs)
+	wantRoomIDs := []string{roomA, roomB, roomC}
+	if !reflect.DeepEqual(roomIDs, wantRoomIDs) {
+		t.Errorf("SelectRoomsWithCountsForUser: got %v want %v", roomIDs, wantRoomIDs)
+	}
 }
 
 func assertUnread(t *testing.T, table *UnreadTable, userID, roomID string, wantHighight, wantNotif int) {
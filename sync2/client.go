@@ -1,6 +1,7 @@
 package sync2
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -29,6 +30,9 @@ type Client interface {
 	// homeserver supports Matrix >= 1.1.)
 	WhoAmI(ctx context.Context, accessToken string) (userID, deviceID string, err error)
 	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	// SendEvent forwards a PUT request to the /send or /state endpoints, returning the response
+	// status code and body.
+	SendEvent(ctx context.Context, accessToken, requestURI string, body []byte) (statusCode int, respBody []byte, err error)
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -113,6 +117,28 @@ func (v *HTTPClient) WhoAmI(ctx context.Context, accessToken string) (string, st
 	return response.Get("user_id").Str, response.Get("device_id").Str, nil
 }
 
+// SendEvent forwards a PUT request to the /send or /state endpoints. requestURI is the escaped
+// path and query of the request, which is forwarded as-is.
+func (v *HTTPClient) SendEvent(ctx context.Context, accessToken, requestURI string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", v.DestinationServer+requestURI, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	respBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, respBody, nil
+}
+
 // DoSyncV2 performs a sync v2 request. Returns the sync response and the response status code
 // or an error. Set isFirst=true on the first sync to force a timeout=0 sync to ensure snapiness.
 func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
@@ -205,6 +231,7 @@ type SyncResponse struct {
 type SyncRoomsResponse struct {
 	Join   map[string]SyncV2JoinResponse   `json:"join"`
 	Invite map[string]SyncV2InviteResponse `json:"invite"`
+	Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 }
 
@@ -237,6 +264,11 @@ type SyncV2InviteResponse struct {
 	InviteState EventsResponse `json:"invite_state"`
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type SyncV2KnockResponse struct {
+	KnockState EventsResponse `json:"knock_state"`
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type SyncV2LeaveResponse struct {
 	State struct {
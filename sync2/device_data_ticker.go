@@ -55,6 +55,11 @@ func (t *DeviceDataTicker) Remember(pid PollerID) {
 	}
 }
 
+// Flush emits all remembered user/device IDs now rather than on the next tick.
+func (t *DeviceDataTicker) Flush() {
+	t.emitUpdate()
+}
+
 func (t *DeviceDataTicker) emitUpdate() {
 	var p pubsub.V2DeviceData
 	p.UserIDToDeviceIDs = make(map[string][]string)
@@ -131,6 +131,33 @@ func TestDeviceTickerForgetsAfterEmitting(t *testing.T) {
 	}
 }
 
+func TestDeviceTickerFlush(t *testing.T) {
+	ticker := NewDeviceDataTicker(time.Hour)
+	var payloads syncSlice[*pubsub.V2DeviceData]
+	ticker.SetCallback(func(payload *pubsub.V2DeviceData) {
+		payloads.append(payload)
+	})
+	go ticker.Run()
+	defer ticker.Stop()
+	ticker.Remember(PollerID{
+		UserID:   "a",
+		DeviceID: "b",
+	})
+	ticker.Flush()
+	result := payloads.clone()
+	if len(result) != 1 {
+		t.Fatalf("got %d payloads, want 1", len(result))
+	}
+	assertPayloadEqual(t, result[0].UserIDToDeviceIDs, map[string][]string{
+		"a": {"b"},
+	})
+	// nothing is emitted if nothing has been remembered since
+	ticker.Flush()
+	if result = payloads.clone(); len(result) != 1 {
+		t.Fatalf("got %d payloads after flushing again, want 1", len(result))
+	}
+}
+
 func assertPayloadEqual(t *testing.T, got, want map[string][]string) {
 	t.Helper()
 	if len(got) != len(want) {
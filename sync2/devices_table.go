@@ -47,6 +47,13 @@ func (t *DevicesTable) UpdateDeviceSince(userID, deviceID, since string) error {
 	return err
 }
 
+// SelectDevicesForUser returns every device for this user, ordered by device ID.
+func (t *DevicesTable) SelectDevicesForUser(userID string) (devices []Device, err error) {
+	err = t.db.Select(&devices, `SELECT user_id, device_id, since FROM syncv3_sync2_devices
+	WHERE user_id = $1 ORDER BY device_id`, userID)
+	return
+}
+
 // FindOldDevices fetches the user_id and device_id of all devices which haven't /synced
 // for at least as long as the given inactivityPeriod. Such devices are returned in
 // no particular order.
@@ -252,3 +252,38 @@ func TestDevicesTable_FindOldDevices(t *testing.T) {
 		t.Errorf("Got %+v, but expected %v+", oldDevices, expectedDevices)
 	}
 }
+
+func TestDevicesTable_SelectDevicesForUser(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	devices := NewDevicesTable(db)
+	alice := "@alice:TestDevicesTable_SelectDevicesForUser"
+	bob := "@bob:TestDevicesTable_SelectDevicesForUser"
+
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		for _, d := range []Device{{alice, "phone", ""}, {alice, "laptop", ""}, {bob, "phone", ""}} {
+			if err := devices.InsertDevice(txn, d.UserID, d.DeviceID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("InsertDevice: %s", err)
+	}
+	if err = devices.UpdateDeviceSince(alice, "phone", "s1"); err != nil {
+		t.Fatalf("UpdateDeviceSince: %s", err)
+	}
+
+	got, err := devices.SelectDevicesForUser(alice)
+	if err != nil {
+		t.Fatalf("SelectDevicesForUser: %s", err)
+	}
+	want := []Device{
+		{UserID: alice, DeviceID: "laptop", Since: ""},
+		{UserID: alice, DeviceID: "phone", Since: "s1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SelectDevicesForUser: got %+v want %+v", got, want)
+	}
+}
@@ -121,6 +121,22 @@ func (h *Handler) Teardown() {
 	}
 }
 
+// Drain stops all pollers, waiting for the responses they are processing to be accumulated, then
+// stores their since tokens so polling resumes from the same place on startup. Pending device data
+// updates are sent immediately.
+func (h *Handler) Drain(ctx context.Context) error {
+	sinceTokens, err := h.pMap.Drain(ctx)
+	for pid, since := range sinceTokens {
+		if since == "" {
+			continue
+		}
+		h.UpdateDeviceSince(ctx, pid.UserID, pid.DeviceID, since)
+	}
+	h.deviceDataTicker.Flush()
+	logger.Info().Int("num_pollers", len(sinceTokens)).Err(err).Msg("drained pollers")
+	return err
+}
+
 func (h *Handler) StartV2Pollers() {
 	tokens, err := h.v2Store.TokensTable.TokenForEachDevice(nil)
 	if err != nil {
@@ -538,6 +554,20 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 	return nil
 }
 
+func (h *Handler) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+	err := h.Store.KnocksTable.InsertKnock(userID, roomID, knockState)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2KnockRoom{
+		UserID: userID,
+		RoomID: roomID,
+	})
+	return nil
+}
+
 func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv json.RawMessage) error {
 	// remove any invites for this user if they are rejecting an invite
 	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
@@ -546,6 +576,13 @@ func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEv
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return err
 	}
+	// likewise for knocks which were rejected or retracted
+	err = h.Store.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return err
+	}
 
 	// Remove room from the typing deviceHandler map, this ensures we always
 	// have a device handling typing notifications for a given room.
@@ -629,6 +666,30 @@ func (h *Handler) ExpireOldPollers() {
 	}
 }
 
+// Pollers describes the pollers for this user.
+func (h *Handler) Pollers(userID string) []sync2.PollerInfo {
+	return h.pMap.PollersForUser(userID)
+}
+
+// RestartPoller restarts the poller for this device. Blocks until the new poller has synced.
+func (h *Handler) RestartPoller(userID, deviceID string) error {
+	pid := sync2.PollerID{
+		UserID:   userID,
+		DeviceID: deviceID,
+	}
+	err := h.pMap.RestartPoller(pid, logger.With().Str("user_id", userID).Str("device_id", deviceID).Logger())
+	h.updateMetrics()
+	return err
+}
+
+// InvalidateRoom asks the v3 side to reload this room from the database, as if its state had been
+// replaced by a v2 sync.
+func (h *Handler) InvalidateRoom(roomID string) {
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InvalidateRoom{
+		RoomID: roomID,
+	})
+}
+
 func fnvHash(event json.RawMessage) uint64 {
 	h := fnv.New64a()
 	h.Write(event)
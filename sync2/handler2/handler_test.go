@@ -52,6 +52,18 @@ func (p *mockPollerMap) ExpirePollers([]sync2.PollerID) int {
 	return 0
 }
 
+func (p *mockPollerMap) PollersForUser(userID string) []sync2.PollerInfo {
+	return nil
+}
+
+func (p *mockPollerMap) RestartPoller(pid sync2.PollerID, logger zerolog.Logger) error {
+	return nil
+}
+
+func (p *mockPollerMap) Drain(ctx context.Context) (map[sync2.PollerID]string, error) {
+	return nil, nil
+}
+
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) (bool, error) {
 	p.calls = append(p.calls, pollInfo{
 		pid:         pid,
@@ -58,6 +58,9 @@ type V2DataReceiver interface {
 	// Sent when there is a room in the `invite` section of the v2 response.
 	// Return an error to stop the since token advancing.
 	OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error // invitestate in db
+	// Sent when there is a room in the `knock` section of the v2 response.
+	// Return an error to stop the since token advancing.
+	OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error
 	// Sent when there is a room in the `leave` section of the v2 response.
 	// Return an error to stop the since token advancing.
 	OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
@@ -77,6 +80,21 @@ type IPollerMap interface {
 	// ExpirePollers requests that the given pollers are terminated as if their access
 	// tokens had expired. Returns the number of pollers successfully terminated.
 	ExpirePollers(ids []PollerID) int
+	// PollersForUser describes every poller for this user, including terminated pollers.
+	PollersForUser(userID string) []PollerInfo
+	// RestartPoller terminates this poller and starts a new one in its place, resuming from the
+	// latest since token. Returns an error if the poller is not running.
+	RestartPoller(pid PollerID, logger zerolog.Logger) error
+	// Drain terminates every poller and waits for them to stop, returning their latest since tokens.
+	Drain(ctx context.Context) (map[PollerID]string, error)
+}
+
+// PollerInfo describes a poller, for the admin API.
+type PollerInfo struct {
+	UserID     string `json:"user_id"`
+	DeviceID   string `json:"device_id"`
+	Since      string `json:"since"`
+	Terminated bool   `json:"terminated"`
 }
 
 // PollerMap is a map of device ID to Poller
@@ -92,6 +110,9 @@ type PollerMap struct {
 	gappyStateSizeVec           *prometheus.HistogramVec
 	numOutstandingSyncReqsGauge prometheus.Gauge
 	totalNumPollsCounter        prometheus.Counter
+	// the poll loops which are running, and whether new pollers can be started
+	pollLoops *sync.WaitGroup
+	draining  bool
 }
 
 // NewPollerMap makes a new PollerMap. Guarantees that the V2DataReceiver will be called on the same
@@ -120,10 +141,11 @@ type PollerMap struct {
 // NOT to-device messages,or since tokens.
 func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 	pm := &PollerMap{
-		v2Client: v2Client,
-		pollerMu: &sync.Mutex{},
-		Pollers:  make(map[PollerID]*poller),
-		executor: make(chan func(), 0),
+		v2Client:  v2Client,
+		pollerMu:  &sync.Mutex{},
+		Pollers:   make(map[PollerID]*poller),
+		executor:  make(chan func(), 0),
+		pollLoops: &sync.WaitGroup{},
 	}
 	if enablePrometheus {
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -197,6 +219,42 @@ func (h *PollerMap) Terminate() {
 	close(h.executor)
 }
 
+// Drain terminates every poller and waits for their poll loops to exit. Outstanding sync requests
+// are aborted, but responses which are already being processed are processed fully, so their data
+// is accumulated before Drain returns. No more pollers can be started afterwards.
+//
+// Returns the latest since token of each poller which was running, even if ctx is done before
+// every poll loop has exited.
+func (h *PollerMap) Drain(ctx context.Context) (map[PollerID]string, error) {
+	h.pollerMu.Lock()
+	h.draining = true
+	var pollers []*poller
+	for _, p := range h.Pollers {
+		if !p.terminated.Load() {
+			pollers = append(pollers, p)
+		}
+		p.drain()
+	}
+	h.pollerMu.Unlock()
+
+	var err error
+	done := make(chan struct{})
+	go func() {
+		h.pollLoops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("PollerMap.Drain: poll loops still running: %w", ctx.Err())
+	}
+	sinceTokens := make(map[PollerID]string, len(pollers))
+	for _, p := range pollers {
+		sinceTokens[PollerID{UserID: p.userID, DeviceID: p.deviceID}] = p.Since()
+	}
+	return sinceTokens, err
+}
+
 func (h *PollerMap) NumPollers() (count int) {
 	h.pollerMu.Lock()
 	defer h.pollerMu.Unlock()
@@ -222,6 +280,42 @@ func (h *PollerMap) DeviceIDs(userID string) []string {
 	return devices
 }
 
+func (h *PollerMap) PollersForUser(userID string) []PollerInfo {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	var infos []PollerInfo
+	for _, p := range h.Pollers {
+		if p.userID != userID {
+			continue
+		}
+		infos = append(infos, PollerInfo{
+			UserID:     p.userID,
+			DeviceID:   p.deviceID,
+			Since:      p.Since(),
+			Terminated: p.terminated.Load(),
+		})
+	}
+	return infos
+}
+
+// RestartPoller terminates this poller and starts a new one in its place. The old poller stops once
+// its outstanding sync request returns, so both pollers may process one response; this is safe as
+// the v2 data receiver de-duplicates events. Blocks like EnsurePolling.
+func (h *PollerMap) RestartPoller(pid PollerID, logger zerolog.Logger) error {
+	h.pollerMu.Lock()
+	p, ok := h.Pollers[pid]
+	if !ok || p.terminated.Load() {
+		h.pollerMu.Unlock()
+		return fmt.Errorf("no poller is running for %s %s", pid.UserID, pid.DeviceID)
+	}
+	p.replaced.Store(true)
+	p.Terminate()
+	h.pollerMu.Unlock()
+	logger.Info().Str("since", p.Since()).Msg("PollerMap.RestartPoller: restarting poller")
+	_, err := h.EnsurePolling(pid, p.accessToken, p.Since(), false, logger)
+	return err
+}
+
 func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 	h.pollerMu.Lock()
 	numTerminated := 0
@@ -255,6 +349,10 @@ func (h *PollerMap) ExpirePollers(pids []PollerID) int {
 // to-device msgs to decrypt E2EE rooms.
 func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) (bool, error) {
 	h.pollerMu.Lock()
+	if h.draining {
+		h.pollerMu.Unlock()
+		return false, fmt.Errorf("PollerMap.EnsurePolling: pollers are draining")
+	}
 	if !h.executorRunning {
 		h.executorRunning = true
 		go h.execute()
@@ -294,7 +392,12 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	poller.gappyStateSizeVec = h.gappyStateSizeVec
 	poller.numOutstandingSyncReqs = h.numOutstandingSyncReqsGauge
 	poller.totalNumPolls = h.totalNumPollsCounter
-	go poller.Poll(v2since)
+	poller.since.Store(v2since)
+	h.pollLoops.Add(1)
+	go func() {
+		defer h.pollLoops.Done()
+		poller.Poll(v2since)
+	}()
 	h.Pollers[pid] = poller
 
 	h.pollerMu.Unlock()
@@ -358,6 +461,17 @@ func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteS
 	return
 }
 
+func (h *PollerMap) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) (err error) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executor <- func() {
+		err = h.callbacks.OnKnock(ctx, userID, roomID, knockState)
+		wg.Done()
+	}
+	wg.Wait()
+	return
+}
+
 func (h *PollerMap) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -439,7 +553,16 @@ type poller struct {
 
 	// flag set to true when poll() returns due to expired access tokens
 	terminated *atomic.Bool
+	// flag set when the poller is terminated to be replaced by a new poller for the same device, in
+	// which case OnTerminated is not called as the device is still being polled.
+	replaced *atomic.Bool
+	// set when the poller is drained, along with the func to abort the outstanding sync request
+	drainMu    *sync.Mutex
+	drained    bool
+	cancelSync context.CancelFunc
 	wg         *sync.WaitGroup
+	// the latest since token, which may not have been stored in the database yet
+	since *atomic.Value
 
 	// stats about poll response data, for logging purposes
 	lastLogged              time.Time
@@ -471,6 +594,9 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 		client:              client,
 		receiver:            receiver,
 		terminated:          &atomic.Bool{},
+		replaced:            &atomic.Bool{},
+		drainMu:             &sync.Mutex{},
+		since:               &atomic.Value{},
 		logger:              logger,
 		wg:                  &wg,
 		initialToDeviceOnly: initialToDeviceOnly,
@@ -482,10 +608,40 @@ func (p *poller) WaitUntilInitialSync() {
 	p.wg.Wait()
 }
 
+// Since returns the latest since token for this poller.
+func (p *poller) Since() string {
+	since, _ := p.since.Load().(string)
+	return since
+}
+
 func (p *poller) Terminate() {
 	p.terminated.CompareAndSwap(false, true)
 }
 
+// drain terminates the poller and aborts the outstanding sync request, unlike Terminate which
+// waits for it to return.
+func (p *poller) drain() {
+	p.Terminate()
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	p.drained = true
+	if p.cancelSync != nil {
+		p.cancelSync()
+	}
+}
+
+// syncContext returns a context for a sync request, which is cancelled if the poller is drained.
+func (p *poller) syncContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	p.drainMu.Lock()
+	defer p.drainMu.Unlock()
+	if p.drained {
+		cancel()
+	}
+	p.cancelSync = cancel
+	return ctx, cancel
+}
+
 type pollLoopState struct {
 	firstTime       bool
 	failCount       int
@@ -514,6 +670,11 @@ func (p *poller) Poll(since string) {
 			logger.Error().Str("user", p.userID).Str("device", p.deviceID).Msgf("%s. Traceback:\n%s", panicErr, debug.Stack())
 			internal.GetSentryHubFromContextOrDefault(ctx).RecoverWithContext(ctx, panicErr)
 		}
+		if p.replaced.Load() {
+			// the new poller has taken over e.g typing notifications for this device, so
+			// don't tear them down.
+			return
+		}
 		p.receiver.OnTerminated(ctx, PollerID{
 			UserID:   p.userID,
 			DeviceID: p.deviceID,
@@ -574,7 +735,9 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Inc()
 	}
-	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	syncCtx, cancelSync := p.syncContext(spanCtx)
+	resp, statusCode, err := p.client.DoSyncV2(syncCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	cancelSync()
 	if p.numOutstandingSyncReqs != nil {
 		p.numOutstandingSyncReqs.Dec()
 	}
@@ -642,6 +805,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	wasFirst := s.firstTime
 
 	s.since = resp.NextBatch
+	p.since.Store(s.since)
 	// Persist the since token if it either was more than one minute ago since we
 	// last stored it OR the response contains to-device messages
 	if timeSince(s.lastStoredSince) > time.Minute || len(resp.ToDevice.Events) > 0 {
@@ -919,6 +1083,12 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) erro
 			lastErrs = append(lastErrs, fmt.Errorf("OnInvite[%s]: %w", roomID, err))
 		}
 	}
+	for roomID, roomData := range res.Rooms.Knock {
+		err := p.receiver.OnKnock(ctx, p.userID, roomID, roomData.KnockState.Events)
+		if err != nil {
+			lastErrs = append(lastErrs, fmt.Errorf("OnKnock[%s]: %w", roomID, err))
+		}
+	}
 
 	p.totalReceipts += receiptCalls
 	p.totalStateCalls += stateCalls
@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -80,6 +82,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 		Rooms: struct {
 			Join   map[string]SyncV2JoinResponse   `json:"join"`
 			Invite map[string]SyncV2InviteResponse `json:"invite"`
+			Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 		}{
 			Join: map[string]SyncV2JoinResponse{
@@ -163,6 +166,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 		Rooms: struct {
 			Join   map[string]SyncV2JoinResponse   `json:"join"`
 			Invite map[string]SyncV2InviteResponse `json:"invite"`
+			Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 		}{
 			Join: map[string]SyncV2JoinResponse{
@@ -338,6 +342,126 @@ func TestPollerMap_ExpirePollers(t *testing.T) {
 	}
 }
 
+func TestPollerMap_RestartPoller(t *testing.T) {
+	var numRequests atomic.Int64
+	sinceCh := make(chan string, 100)
+	receiver, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		select {
+		case sinceCh <- since:
+		default:
+		}
+		time.Sleep(10 * time.Millisecond)
+		return &SyncResponse{
+			NextBatch: fmt.Sprintf("since_%d", numRequests.Add(1)),
+		}, 200, nil
+	})
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(receiver)
+	defer pm.Terminate()
+
+	pid := PollerID{UserID: "alice", DeviceID: "a_device"}
+	if err := pm.RestartPoller(pid, logger); err == nil {
+		t.Fatalf("RestartPoller: expected an error for a poller which does not exist")
+	}
+	if _, err := pm.EnsurePolling(pid, "a_token", "", true, logger); err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	infos := pm.PollersForUser("alice")
+	if len(infos) != 1 || infos[0].DeviceID != "a_device" || infos[0].Since == "" || infos[0].Terminated {
+		t.Fatalf("PollersForUser: got %+v want 1 running poller with a since token", infos)
+	}
+	if infos := pm.PollersForUser("bob"); len(infos) != 0 {
+		t.Fatalf("PollersForUser: got %+v for bob want none", infos)
+	}
+
+	if err := pm.RestartPoller(pid, logger); err != nil {
+		t.Fatalf("RestartPoller: %s", err)
+	}
+	// the new poller never makes an initial sync
+	for len(sinceCh) > 0 {
+		<-sinceCh
+	}
+	if since := <-sinceCh; since == "" {
+		t.Errorf("restarted poller made an initial sync")
+	}
+	if infos := pm.PollersForUser("alice"); len(infos) != 1 || infos[0].Terminated {
+		t.Fatalf("PollersForUser after restart: got %+v want 1 running poller", infos)
+	}
+}
+
+func TestPollerMap_RestartPollerKeepsTypingHandler(t *testing.T) {
+	receiver, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		time.Sleep(10 * time.Millisecond)
+		return &SyncResponse{NextBatch: since + "_next"}, 200, nil
+	})
+	// the v2 handler tracks which device handles typing notifications for a room, and forgets the
+	// device when its poller terminates.
+	pid := PollerID{UserID: "alice", DeviceID: "a_device"}
+	var typingMu sync.Mutex
+	typingHandler := map[string]PollerID{"!room": pid}
+	receiver.onTerminated = func(ctx context.Context, pollerID PollerID) {
+		typingMu.Lock()
+		defer typingMu.Unlock()
+		for roomID, devID := range typingHandler {
+			if devID == pollerID {
+				delete(typingHandler, roomID)
+			}
+		}
+	}
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(receiver)
+	defer pm.Terminate()
+
+	if _, err := pm.EnsurePolling(pid, "a_token", "", true, logger); err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	if err := pm.RestartPoller(pid, logger); err != nil {
+		t.Fatalf("RestartPoller: %s", err)
+	}
+	// give the old poller time to return from its outstanding sync request
+	time.Sleep(100 * time.Millisecond)
+	typingMu.Lock()
+	defer typingMu.Unlock()
+	if got := typingHandler["!room"]; got != pid {
+		t.Fatalf("typing handler after restart: got %+v want %+v", got, pid)
+	}
+}
+
+func TestPollerMap_Drain(t *testing.T) {
+	receiver, client := newMocks(nil)
+	client.fnWithContext = func(ctx context.Context, authHeader, since string) (*SyncResponse, int, error) {
+		if since == "" {
+			return &SyncResponse{NextBatch: "since_1"}, 200, nil
+		}
+		// long-poll until the request is aborted
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(receiver)
+	defer pm.Terminate()
+
+	pid := PollerID{UserID: "alice", DeviceID: "a_device"}
+	if _, err := pm.EnsurePolling(pid, "a_token", "", true, logger); err != nil {
+		t.Fatalf("EnsurePolling: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	sinceTokens, err := pm.Drain(ctx)
+	if err != nil {
+		t.Fatalf("Drain: %s", err)
+	}
+	if want := map[PollerID]string{pid: "since_1"}; !reflect.DeepEqual(sinceTokens, want) {
+		t.Errorf("Drain: got since tokens %v want %v", sinceTokens, want)
+	}
+	if n := pm.NumPollers(); n != 0 {
+		t.Errorf("got %d pollers after draining, want 0", n)
+	}
+	if _, err := pm.EnsurePolling(PollerID{UserID: "bob", DeviceID: "b_device"}, "b_token", "", false, logger); err == nil {
+		t.Errorf("EnsurePolling: expected an error after draining")
+	}
+}
+
 // Check that a call to Poll starts polling and accumulating, and terminates on 401s.
 func TestPollerPollFromNothing(t *testing.T) {
 	nextSince := "next"
@@ -358,6 +482,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 				Rooms: struct {
 					Join   map[string]SyncV2JoinResponse   `json:"join"`
 					Invite map[string]SyncV2InviteResponse `json:"invite"`
+					Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 					Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 				}{
 					Join: map[string]SyncV2JoinResponse{
@@ -449,6 +574,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 			Rooms: struct {
 				Join   map[string]SyncV2JoinResponse   `json:"join"`
 				Invite map[string]SyncV2InviteResponse `json:"invite"`
+				Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
 			}{
 				Join: map[string]SyncV2JoinResponse{
@@ -947,6 +1073,31 @@ func TestPollerResendsOnCallbackError(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "OnKnock",
+			// generate a response which will trigger the right callback
+			syncResponse: &SyncResponse{
+				Rooms: SyncRoomsResponse{
+					Knock: map[string]SyncV2KnockResponse{
+						"!foo:bar": {
+							KnockState: EventsResponse{
+								Events: []json.RawMessage{
+									[]byte(`{"type":"foo_room","content":{"bar":53}}`),
+								},
+							},
+						},
+					},
+				},
+			},
+			// generate a receiver which errors for the right callback
+			generateReceiver: func() V2DataReceiver {
+				return &overrideDataReceiver{
+					onKnock: func(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+						return fmt.Errorf("onKnock error")
+					},
+				}
+			},
+		},
 		{
 			name: "OnLeftRoom",
 			// generate a response which will trigger the right callback
@@ -1263,14 +1414,22 @@ func waitForInitialSync(t *testing.T, poller *poller) {
 
 type mockClient struct {
 	fn func(authHeader, since string) (*SyncResponse, int, error)
+	// optional: called instead of fn, for tests which need the request context
+	fnWithContext func(ctx context.Context, authHeader, since string) (*SyncResponse, int, error)
 }
 
 func (c *mockClient) Versions(ctx context.Context) ([]string, error) {
 	return []string{"v1.1"}, nil
 }
 func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
+	if c.fnWithContext != nil {
+		return c.fnWithContext(ctx, authHeader, since)
+	}
 	return c.fn(authHeader, since)
 }
+func (c *mockClient) SendEvent(ctx context.Context, accessToken, requestURI string, body []byte) (int, []byte, error) {
+	return 0, nil, fmt.Errorf("not implemented")
+}
 func (c *mockClient) WhoAmI(ctx context.Context, authHeader string) (string, string, error) {
 	return "@alice:localhost", "device_123", nil
 }
@@ -1321,6 +1480,7 @@ type overrideDataReceiver struct {
 	onAccountData       func(ctx context.Context, userID, roomID string, events []json.RawMessage) error
 	onReceipt           func(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage)
 	onInvite            func(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) error
+	onKnock             func(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error
 	onLeftRoom          func(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error
 	onE2EEData          func(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) error
 	onTerminated        func(ctx context.Context, pollerID PollerID)
@@ -1381,6 +1541,12 @@ func (s *overrideDataReceiver) OnInvite(ctx context.Context, userID, roomID stri
 	}
 	return s.onInvite(ctx, userID, roomID, inviteState)
 }
+func (s *overrideDataReceiver) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) error {
+	if s.onKnock == nil {
+		return nil
+	}
+	return s.onKnock(ctx, userID, roomID, knockState)
+}
 func (s *overrideDataReceiver) OnLeftRoom(ctx context.Context, userID, roomID string, leaveEvent json.RawMessage) error {
 	if s.onLeftRoom == nil {
 		return nil
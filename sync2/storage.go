@@ -29,10 +29,10 @@ func NewStore(postgresURI, secret string) *Storage {
 	return NewStoreWithDB(db, secret)
 }
 
-func NewStoreWithDB(db *sqlx.DB, secret string) *Storage {
+func NewStoreWithDB(db *sqlx.DB, secret string, previousSecrets ...string) *Storage {
 	return &Storage{
 		DevicesTable: NewDevicesTable(db),
-		TokensTable:  NewTokensTable(db, secret),
+		TokensTable:  NewTokensTable(db, secret, previousSecrets...),
 		DB:           db,
 	}
 }
@@ -31,10 +31,15 @@ type TokensTable struct {
 	// https://cheatsheetseries.owasp.org/cheatsheets/Cryptographic_Storage_Cheat_Sheet.html#separation-of-keys-and-data
 	// We cannot use bcrypt/scrypt as we need the plaintext to do sync requests!
 	key256 []byte
+	// Keys derived from secrets which have since been rotated out. These are only used to decrypt
+	// tokens which have not yet been re-encrypted with key256.
+	previousKeys [][]byte
 }
 
 // NewTokensTable creates the syncv3_sync2_tokens table if it does not already exist.
-func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
+// Tokens are encrypted with the secret. Any previous secrets are only used to decrypt tokens
+// encrypted before the secret was rotated, see ReencryptTokens.
+func NewTokensTable(db *sqlx.DB, secret string, previousSecrets ...string) *TokensTable {
 	db.MustExec(`
 	CREATE TABLE IF NOT EXISTS syncv3_sync2_tokens (
 		token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token)
@@ -45,16 +50,25 @@ func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
 		last_seen TIMESTAMP WITH TIME ZONE NOT NULL
 	);`)
 
-	// derive the key from the secret
-	hash := sha256.New()
-	hash.Write([]byte(secret))
+	previousKeys := make([][]byte, 0, len(previousSecrets))
+	for _, previousSecret := range previousSecrets {
+		previousKeys = append(previousKeys, deriveKey(previousSecret))
+	}
 
 	return &TokensTable{
-		db:     db,
-		key256: hash.Sum(nil),
+		db:           db,
+		key256:       deriveKey(secret),
+		previousKeys: previousKeys,
 	}
 }
 
+// deriveKey derives an AES-256 key from a secret.
+func deriveKey(secret string) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(secret))
+	return hash.Sum(nil)
+}
+
 func (t *TokensTable) encrypt(token string) string {
 	block, err := aes.NewCipher(t.key256)
 	if err != nil {
@@ -70,13 +84,35 @@ func (t *TokensTable) encrypt(token string) string {
 	}
 	return hex.EncodeToString(nonce) + " " + hex.EncodeToString(gcm.Seal(nil, nonce, []byte(token), nil))
 }
+
+// decrypt a token with the current key, falling back to previous keys.
 func (t *TokensTable) decrypt(nonceAndEncToken string) (string, error) {
-	return decrypt(nonceAndEncToken, t.key256)
+	token, _, err := t.decryptWithAnyKey(nonceAndEncToken)
+	return token, err
+}
+
+// decryptWithAnyKey is like decrypt, but also reports whether the current key was used.
+func (t *TokensTable) decryptWithAnyKey(nonceAndEncToken string) (token string, isCurrent bool, err error) {
+	token, err = decrypt(nonceAndEncToken, t.key256)
+	if err == nil {
+		return token, true, nil
+	}
+	for _, key := range t.previousKeys {
+		var prevErr error
+		token, prevErr = decrypt(nonceAndEncToken, key)
+		if prevErr == nil {
+			return token, false, nil
+		}
+	}
+	return "", false, err
 }
 
 // Pulled out to a free function to use in the device ID migration.
 func decrypt(nonceAndEncToken string, key []byte) (string, error) {
 	segs := strings.Split(nonceAndEncToken, " ")
+	if len(segs) != 2 {
+		return "", fmt.Errorf("decrypt: malformed encrypted token")
+	}
 	nonce := segs[0]
 	nonceBytes, err := hex.DecodeString(nonce)
 	if err != nil {
@@ -258,3 +294,45 @@ func (t *TokensTable) Delete(accessTokenHash string) error {
 	}
 	return nil
 }
+
+// ReencryptTokens re-encrypts every token which was encrypted with a previous secret using the
+// current secret, so that the previous secrets can be removed. Tokens which cannot be decrypted
+// with any secret are left untouched. Returns the number of tokens which were re-encrypted.
+// It is safe to call this whilst the proxy is running.
+func (t *TokensTable) ReencryptTokens() (total int, err error) {
+	if len(t.previousKeys) == 0 {
+		return 0, nil
+	}
+	var rows []struct {
+		TokenHash      string `db:"token_hash"`
+		TokenEncrypted string `db:"token_encrypted"`
+	}
+	err = t.db.Select(&rows, `SELECT token_hash, token_encrypted FROM syncv3_sync2_tokens`)
+	if err != nil {
+		return 0, fmt.Errorf("ReencryptTokens: failed to select tokens: %w", err)
+	}
+	for _, row := range rows {
+		token, isCurrent, err := t.decryptWithAnyKey(row.TokenEncrypted)
+		if err != nil {
+			logger.Warn().Str("token_hash", row.TokenHash).Err(err).Msg("ReencryptTokens: failed to decrypt token with any secret")
+			continue
+		}
+		if isCurrent {
+			continue
+		}
+		// only update the row if it hasn't changed underneath us
+		result, err := t.db.Exec(
+			`UPDATE syncv3_sync2_tokens SET token_encrypted = $1 WHERE token_hash = $2 AND token_encrypted = $3`,
+			t.encrypt(token), row.TokenHash, row.TokenEncrypted,
+		)
+		if err != nil {
+			return total, fmt.Errorf("ReencryptTokens: failed to update token: %w", err)
+		}
+		ra, err := result.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("ReencryptTokens: %w", err)
+		}
+		total += int(ra)
+	}
+	return total, nil
+}
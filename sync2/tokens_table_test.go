@@ -132,6 +132,69 @@ func TestDeletingTokens(t *testing.T) {
 	}
 }
 
+func TestTokensTableSecretRotation(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	oldTokens := NewTokensTable(db, "old_secret_TestTokensTableSecretRotation")
+	accessToken := "token_TestTokensTableSecretRotation"
+
+	var token *Token
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+		token, err = oldTokens.Insert(txn, accessToken, "@alice:rotation", "device", time.Time{})
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to Insert token: %s", err)
+	}
+	defer oldTokens.Delete(token.AccessTokenHash)
+	selectEncryptedToken := func() string {
+		t.Helper()
+		var encToken string
+		err := db.QueryRow(`SELECT token_encrypted FROM syncv3_sync2_tokens WHERE token_hash=$1`, token.AccessTokenHash).Scan(&encToken)
+		if err != nil {
+			t.Fatalf("Failed to select token: %s", err)
+		}
+		return encToken
+	}
+
+	t.Log("Rotate the secret: the token should still be decryptable using the previous secret.")
+	rotatedTokens := NewTokensTable(db, "new_secret_TestTokensTableSecretRotation", "old_secret_TestTokensTableSecretRotation")
+	got, err := rotatedTokens.decrypt(selectEncryptedToken())
+	if err != nil {
+		t.Fatalf("Failed to decrypt token with previous secret: %s", err)
+	}
+	assertEqual(t, got, accessToken, "decrypted token mismatch")
+
+	t.Log("Without the previous secret, the token cannot be decrypted.")
+	newTokens := NewTokensTable(db, "new_secret_TestTokensTableSecretRotation")
+	if _, err = newTokens.decrypt(selectEncryptedToken()); err == nil {
+		t.Fatalf("Decrypted token without the previous secret")
+	}
+
+	t.Log("Re-encrypt tokens: now the previous secret is no longer needed.")
+	total, err := rotatedTokens.ReencryptTokens()
+	if err != nil {
+		t.Fatalf("ReencryptTokens: %s", err)
+	}
+	if total != 1 {
+		t.Errorf("ReencryptTokens: re-encrypted %d tokens, want 1", total)
+	}
+	got, err = newTokens.decrypt(selectEncryptedToken())
+	if err != nil {
+		t.Fatalf("Failed to decrypt re-encrypted token: %s", err)
+	}
+	assertEqual(t, got, accessToken, "decrypted token mismatch")
+
+	t.Log("Re-encrypting again is a no-op.")
+	total, err = rotatedTokens.ReencryptTokens()
+	if err != nil {
+		t.Fatalf("ReencryptTokens: %s", err)
+	}
+	if total != 0 {
+		t.Errorf("ReencryptTokens: re-encrypted %d tokens on second run, want 0", total)
+	}
+}
+
 func assertEqualTokens(t *testing.T, table *TokensTable, got *Token, accessToken, userID, deviceID string, lastSeen time.Time) {
 	t.Helper()
 	assertEqual(t, got.AccessToken, accessToken, "Token.AccessToken mismatch")
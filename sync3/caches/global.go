@@ -28,7 +28,8 @@ type EventData struct {
 	// poller B with a transaction_id. If this happens, we make a temporary note of the
 	// transaction_id in the syncv3_txns table, but do not edit the persisted event.
 	// This means that this field is not authoritative; we only include it here as a
-	// hint to avoid unnecessary waits for V2TransactionID payloads.
+	// hint to avoid unnecessary waits for V2TransactionID payloads. It is also set for
+	// events sent through the proxy, see Dispatcher.RememberTransactionID.
 	TransactionID string
 
 	// the number of joined users in this room. Use this value and don't try to work it out as you
@@ -64,10 +65,12 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
 // counts, if the room is encrypted, etc. Basically anything that is the same for all users of the system. This
 // information is populated at startup from the database and then kept up-to-date by hooking into the
-// Dispatcher for new events.
+// Dispatcher for new events. The number of rooms held in memory can be bounded with SetMaxRooms.
 type GlobalCache struct {
 	// LoadJoinedRoomsOverride allows tests to mock out the behaviour of LoadJoinedRooms.
 	LoadJoinedRoomsOverride func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, latestNIDs map[string]int64, err error)
+	// LoadLeftRoomsOverride allows tests to mock out the behaviour of LoadLeftRooms.
+	LoadLeftRoomsOverride func(userID string) (leftRooms map[string]*internal.RoomMetadata, leaveTimings map[string]internal.EventMetadata, err error)
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// there are lots of overlapping keys as many users (threads) can be joined to the same room (key)
@@ -75,6 +78,17 @@ type GlobalCache struct {
 	roomIDToMetadata   map[string]*internal.RoomMetadata
 	roomIDToMetadataMu *sync.RWMutex
 
+	// optional limit on the number of rooms held in roomIDToMetadata, see SetMaxRooms. If lru is nil,
+	// every room is held in memory.
+	maxRooms     int
+	isRoomActive func(roomID string) bool
+	lru          *roomLRU
+	evictCh      chan struct{}
+	metrics      *globalCacheMetrics
+	// true if rooms missing from roomIDToMetadata should be loaded from the database when they are
+	// used, either because they were evicted or because the cache was started lazily.
+	loadOnDemand bool
+
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
 	store *state.Storage
 }
@@ -94,31 +108,46 @@ func (c *GlobalCache) OnRegistered(_ context.Context) error {
 // LoadRooms loads the current room metadata for the given room IDs. Races unless you call this in a dispatcher loop.
 // Always returns copies of the room metadata so ownership can be passed to other threads.
 func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[string]*internal.RoomMetadata {
-	c.roomIDToMetadataMu.RLock()
-	defer c.roomIDToMetadataMu.RUnlock()
-	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
-	for i := range roomIDs {
-		roomID := roomIDs[i]
-		result[roomID] = c.copyRoom(roomID)
-	}
-	return result
+	return c.loadRooms(ctx, roomIDs)
 }
 
 // LoadRoomsFromMap is like LoadRooms, except it is given a map with room IDs as keys
 // and returns rooms in a map. The output map is non-nil and contains exactly the same
 // set of keys as the input map. The values in the input map are completely ignored.
 func (c *GlobalCache) LoadRoomsFromMap(ctx context.Context, joinTimingsByRoomID map[string]internal.EventMetadata) map[string]*internal.RoomMetadata {
+	return c.loadRooms(ctx, internal.Keys(joinTimingsByRoomID))
+}
+
+// loadRooms is the implementation of LoadRooms and LoadRoomsFromMap. Rooms which have been evicted
+// or not loaded yet are loaded from the database.
+func (c *GlobalCache) loadRooms(ctx context.Context, roomIDs []string) map[string]*internal.RoomMetadata {
+	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
+	var evicted []string
 	c.roomIDToMetadataMu.RLock()
-	defer c.roomIDToMetadataMu.RUnlock()
-	result := make(map[string]*internal.RoomMetadata, len(joinTimingsByRoomID))
-	for roomID, _ := range joinTimingsByRoomID {
+	for _, roomID := range roomIDs {
+		if c.loadOnDemand && c.roomIDToMetadata[roomID] == nil {
+			evicted = append(evicted, roomID)
+			continue
+		}
 		result[roomID] = c.copyRoom(roomID)
 	}
+	if !c.loadOnDemand {
+		c.roomIDToMetadataMu.RUnlock()
+		return result
+	}
+	c.touch(internal.Keys(result)...)
+	c.roomIDToMetadataMu.RUnlock()
+	c.trackLookups(len(result), len(evicted))
+	if len(evicted) > 0 {
+		for roomID, metadata := range c.reload(ctx, evicted) {
+			result[roomID] = metadata
+		}
+	}
 	return result
 }
 
 // copyRoom returns a copy of the internal.RoomMetadata stored for this room.
-// This is an internal implementation detail of LoadRooms and LoadRoomsFromMap.
+// This is an internal implementation detail of loadRooms.
 // If the room is not present in the global cache, returns a stub metadata entry.
 // The caller MUST acquire a read lock on roomIDToMetadataMu before calling this.
 func (c *GlobalCache) copyRoom(roomID string) *internal.RoomMetadata {
@@ -130,6 +159,28 @@ func (c *GlobalCache) copyRoom(roomID string) *internal.RoomMetadata {
 	return sr.DeepCopy()
 }
 
+// LoadLeftRooms loads the metadata for all rooms the user has left as of pos, together with timing
+// info for the user's leave from each room. The name, avatar, heroes and counts in the metadata are
+// from the room state when the user left, so changes made after the leave are not shown.
+func (c *GlobalCache) LoadLeftRooms(ctx context.Context, userID string, pos int64) (
+	leftRooms map[string]*internal.RoomMetadata, leaveTimingByRoomID map[string]internal.EventMetadata, err error,
+) {
+	if c.LoadLeftRoomsOverride != nil {
+		return c.LoadLeftRoomsOverride(userID)
+	}
+	leaveTimingByRoomID, err = c.store.LeftRoomsAfterPosition(userID, pos)
+	if err != nil {
+		return nil, nil, err
+	}
+	leftRooms = c.LoadRoomsFromMap(ctx, leaveTimingByRoomID)
+	for roomID, metadata := range leftRooms {
+		if err = c.store.MetadataAfterEventPosition(ctx, metadata, leaveTimingByRoomID[roomID].NID); err != nil {
+			return nil, nil, err
+		}
+	}
+	return leftRooms, leaveTimingByRoomID, nil
+}
+
 // LoadJoinedRooms loads all current joined room metadata for the user given, together
 // with timing info for the user's latest join (excluding profile changes) to the room.
 // Returns the absolute database position (the latest event NID across the whole DB),
@@ -251,20 +302,44 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 		internal.Assert("last message timestamp exists", metadata.LastMessageTimestamp > 1, debugContext)
 		c.roomIDToMetadata[roomID] = &metadata
 	}
+	if c.lru != nil {
+		// keep the most recently active rooms, nobody is connected yet.
+		sort.SliceStable(roomIDs, func(i, j int) bool {
+			return roomIDToMetadata[roomIDs[i]].LastMessageTimestamp < roomIDToMetadata[roomIDs[j]].LastMessageTimestamp
+		})
+		if len(roomIDs) > c.maxRooms {
+			for _, roomID := range roomIDs[:len(roomIDs)-c.maxRooms] {
+				delete(c.roomIDToMetadata, roomID)
+			}
+			roomIDs = roomIDs[len(roomIDs)-c.maxRooms:]
+		}
+		c.lru.touch(roomIDs...)
+		if c.metrics != nil {
+			c.metrics.numRooms.Set(float64(c.lru.len()))
+		}
+	}
 	return nil
 }
 
+// StartupLazy is an alternative to Startup which loads nothing up front. Rooms are loaded from the
+// database the first time they are used instead.
+func (c *GlobalCache) StartupLazy() {
+	c.loadOnDemand = true
+}
+
 // =================================================
 // Listener function called by dispatcher below
 // =================================================
 
 func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage) {
 	evType := gjson.ParseBytes(ephEvent).Get("type").Str
+	c.ensureLoaded(ctx, roomID)
 	c.roomIDToMetadataMu.Lock()
 	defer c.roomIDToMetadataMu.Unlock()
 	metadata := c.roomIDToMetadata[roomID]
 	if metadata == nil {
 		metadata = internal.NewRoomMetadata(roomID)
+		c.touch(roomID)
 	}
 
 	switch evType {
@@ -282,11 +357,13 @@ func (c *GlobalCache) OnNewEvent(
 	ctx context.Context, ed *EventData,
 ) {
 	// update global state
+	c.ensureLoaded(ctx, ed.RoomID)
 	c.roomIDToMetadataMu.Lock()
 	defer c.roomIDToMetadataMu.Unlock()
 	metadata := c.roomIDToMetadata[ed.RoomID]
 	if metadata == nil {
 		metadata = internal.NewRoomMetadata(ed.RoomID)
+		c.touch(ed.RoomID)
 	}
 	switch ed.EventType {
 	case "m.room.name":
@@ -383,7 +460,10 @@ func (c *GlobalCache) OnInvalidateRoom(ctx context.Context, roomID string) {
 
 	metadata, ok := c.roomIDToMetadata[roomID]
 	if !ok {
-		logger.Warn().Str("room_id", roomID).Msg("OnInvalidateRoom: room not in global cache")
+		if !c.loadOnDemand {
+			logger.Warn().Str("room_id", roomID).Msg("OnInvalidateRoom: room not in global cache")
+		}
+		// rooms which aren't in memory are loaded from the current state when they are next used
 		return
 	}
 
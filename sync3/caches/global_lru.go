@@ -0,0 +1,258 @@
+package caches
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// roomLRU tracks how recently each room in the GlobalCache was used. The front of the list is the
+// most recently used room.
+type roomLRU struct {
+	mu    *sync.Mutex
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newRoomLRU() *roomLRU {
+	return &roomLRU{
+		mu:    &sync.Mutex{},
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+// touch marks the rooms as the most recently used, adding them if they are not tracked already.
+func (l *roomLRU) touch(roomIDs ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, roomID := range roomIDs {
+		if elem, ok := l.elems[roomID]; ok {
+			l.order.MoveToFront(elem)
+			continue
+		}
+		l.elems[roomID] = l.order.PushFront(roomID)
+	}
+}
+
+func (l *roomLRU) remove(roomID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elem, ok := l.elems[roomID]; ok {
+		l.order.Remove(elem)
+		delete(l.elems, roomID)
+	}
+}
+
+// coldest returns the least recently used room, or the empty string if there are no rooms.
+func (l *roomLRU) coldest() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	back := l.order.Back()
+	if back == nil {
+		return ""
+	}
+	return back.Value.(string)
+}
+
+func (l *roomLRU) len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+type globalCacheMetrics struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	evictions prometheus.Counter
+	numRooms  prometheus.Gauge
+}
+
+func newGlobalCacheMetrics() *globalCacheMetrics {
+	m := &globalCacheMetrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "global_cache_hits",
+			Help:      "Number of room lookups in the global cache which were held in memory.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "global_cache_misses",
+			Help:      "Number of room lookups in the global cache which were loaded from the database.",
+		}),
+		evictions: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "global_cache_evictions",
+			Help:      "Number of rooms evicted from the global cache.",
+		}),
+		numRooms: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "sliding_sync",
+			Subsystem: "api",
+			Name:      "global_cache_rooms",
+			Help:      "Number of rooms held in memory by the global cache.",
+		}),
+	}
+	prometheus.MustRegister(m.hits)
+	prometheus.MustRegister(m.misses)
+	prometheus.MustRegister(m.evictions)
+	prometheus.MustRegister(m.numRooms)
+	return m
+}
+
+func (m *globalCacheMetrics) unregister() {
+	prometheus.Unregister(m.hits)
+	prometheus.Unregister(m.misses)
+	prometheus.Unregister(m.evictions)
+	prometheus.Unregister(m.numRooms)
+}
+
+// SetMaxRooms bounds the number of rooms the cache holds in memory. When there are more than maxRooms
+// rooms, the least recently used rooms are evicted unless isRoomActive returns true for them. Evicted
+// rooms are reloaded from the database when they are next needed. Must be called before Startup.
+func (c *GlobalCache) SetMaxRooms(maxRooms int, isRoomActive func(roomID string) bool, enablePrometheus bool) {
+	c.maxRooms = maxRooms
+	c.isRoomActive = isRoomActive
+	c.lru = newRoomLRU()
+	c.loadOnDemand = true
+	c.evictCh = make(chan struct{}, 1)
+	if enablePrometheus {
+		c.metrics = newGlobalCacheMetrics()
+	}
+	go func() {
+		defer internal.ReportPanicsToSentry()
+		for range c.evictCh {
+			c.evict()
+		}
+	}()
+}
+
+// Teardown stops evicting rooms and removes any metrics.
+func (c *GlobalCache) Teardown() {
+	if c.evictCh != nil {
+		close(c.evictCh)
+	}
+	if c.metrics != nil {
+		c.metrics.unregister()
+	}
+}
+
+// touch marks these rooms as recently used and schedules an eviction if there are too many rooms.
+// Must hold roomIDToMetadataMu, so that rooms cannot be evicted between being used and being touched.
+func (c *GlobalCache) touch(roomIDs ...string) {
+	if c.lru == nil || len(roomIDs) == 0 {
+		return
+	}
+	c.lru.touch(roomIDs...)
+	if c.lru.len() > c.maxRooms {
+		select {
+		case c.evictCh <- struct{}{}:
+		default: // an eviction is already scheduled
+		}
+	}
+}
+
+func (c *GlobalCache) trackLookups(hits, misses int) {
+	if c.metrics == nil {
+		return
+	}
+	c.metrics.hits.Add(float64(hits))
+	c.metrics.misses.Add(float64(misses))
+}
+
+// evict the least recently used rooms until the cache is back under its limit. Active rooms are
+// marked as recently used instead, so if every room is active the cache can exceed its limit.
+func (c *GlobalCache) evict() {
+	numEvicted := 0
+	toEvict := c.lru.len() - c.maxRooms
+	// visit each room at most once
+	for visited, total := 0, c.lru.len(); toEvict > 0 && visited < total; visited++ {
+		roomID := c.lru.coldest()
+		if roomID == "" {
+			break
+		}
+		// don't hold the lock whilst checking if the room is active, as the dispatcher may be
+		// waiting on us whilst holding its own locks.
+		if c.isRoomActive != nil && c.isRoomActive(roomID) {
+			c.lru.touch(roomID)
+			continue
+		}
+		c.roomIDToMetadataMu.Lock()
+		// the room may have been used since we checked it
+		if c.lru.coldest() == roomID {
+			delete(c.roomIDToMetadata, roomID)
+			c.lru.remove(roomID)
+			numEvicted++
+			toEvict--
+		}
+		c.roomIDToMetadataMu.Unlock()
+	}
+	if c.metrics != nil {
+		c.metrics.evictions.Add(float64(numEvicted))
+		c.metrics.numRooms.Set(float64(c.lru.len()))
+	}
+	logger.Trace().Int("evicted", numEvicted).Int("rooms", c.lru.len()).Msg("GlobalCache: evicted rooms")
+}
+
+// reload rooms which are not held in memory from the database, and add them to the cache. Returns
+// copies of the metadata. Rooms which are not in the database get stub metadata which is not cached.
+func (c *GlobalCache) reload(ctx context.Context, roomIDs []string) map[string]*internal.RoomMetadata {
+	var loaded map[string]internal.RoomMetadata
+	if c.store != nil {
+		var err error
+		loaded, err = c.store.MetadataForRooms(roomIDs)
+		if err != nil {
+			logger.Err(err).Strs("rooms", roomIDs).Msg("GlobalCache: failed to reload rooms")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+	}
+	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
+	var cached []string
+	c.roomIDToMetadataMu.Lock()
+	for _, roomID := range roomIDs {
+		// the dispatcher may have loaded this room whilst we were querying the database, in which
+		// case it is more up to date than what we loaded.
+		if existing := c.roomIDToMetadata[roomID]; existing != nil {
+			result[roomID] = existing.DeepCopy()
+			cached = append(cached, roomID)
+			continue
+		}
+		metadata, ok := loaded[roomID]
+		if !ok {
+			logger.Warn().Str("room", roomID).Msg("GlobalCache.LoadRoom: no metadata for this room, returning stub")
+			result[roomID] = internal.NewRoomMetadata(roomID)
+			continue
+		}
+		c.roomIDToMetadata[roomID] = &metadata
+		result[roomID] = metadata.DeepCopy()
+		cached = append(cached, roomID)
+	}
+	c.touch(cached...)
+	c.roomIDToMetadataMu.Unlock()
+	return result
+}
+
+// ensureLoaded makes sure this room is held in memory, loading it from the database if it was evicted
+// or has not been loaded yet. Called by the dispatcher before applying updates to a room.
+func (c *GlobalCache) ensureLoaded(ctx context.Context, roomID string) {
+	if !c.loadOnDemand {
+		return
+	}
+	c.roomIDToMetadataMu.RLock()
+	_, exists := c.roomIDToMetadata[roomID]
+	if exists {
+		c.touch(roomID)
+	}
+	c.roomIDToMetadataMu.RUnlock()
+	if exists {
+		c.trackLookups(1, 0)
+		return
+	}
+	c.trackLookups(0, 1)
+	c.reload(ctx, []string{roomID})
+}
@@ -0,0 +1,77 @@
+package caches
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestGlobalCacheMaxRooms(t *testing.T) {
+	ctx := context.Background()
+	activeRoomID := "!active:localhost"
+	c := NewGlobalCache(nil)
+	c.SetMaxRooms(2, func(roomID string) bool {
+		return roomID == activeRoomID
+	}, false)
+	defer c.Teardown()
+
+	metadata := func(roomID string, ts uint64) internal.RoomMetadata {
+		m := internal.NewRoomMetadata(roomID)
+		m.LastMessageTimestamp = ts
+		return *m
+	}
+	// only the most recent rooms are kept at startup
+	c.Startup(map[string]internal.RoomMetadata{
+		"!a:localhost": metadata("!a:localhost", 1000),
+		"!b:localhost": metadata("!b:localhost", 2000),
+		"!c:localhost": metadata("!c:localhost", 3000),
+		activeRoomID:   metadata(activeRoomID, 500),
+	})
+	assertCachedRooms(t, c, []string{"!b:localhost", "!c:localhost"})
+
+	newEvent := func(roomID string) {
+		c.OnNewEvent(ctx, &EventData{
+			RoomID:    roomID,
+			EventType: "m.room.message",
+			Timestamp: uint64(time.Now().UnixMilli()),
+			NID:       1,
+		})
+	}
+	// the least recently used room is evicted
+	newEvent(activeRoomID)
+	assertCachedRooms(t, c, []string{"!c:localhost", activeRoomID})
+	newEvent("!a:localhost")
+	assertCachedRooms(t, c, []string{"!a:localhost", activeRoomID})
+	// unless it is active
+	newEvent("!b:localhost")
+	assertCachedRooms(t, c, []string{"!b:localhost", activeRoomID})
+
+	// loading an evicted room does not fail
+	rooms := c.LoadRooms(ctx, "!c:localhost")
+	if rooms["!c:localhost"] == nil {
+		t.Fatalf("LoadRooms: no metadata returned for evicted room")
+	}
+}
+
+func assertCachedRooms(t *testing.T, c *GlobalCache, want []string) {
+	t.Helper()
+	sort.Strings(want)
+	var got []string
+	// evictions happen asynchronously
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		c.roomIDToMetadataMu.RLock()
+		got = internal.Keys(c.roomIDToMetadata)
+		c.roomIDToMetadataMu.RUnlock()
+		sort.Strings(got)
+		if reflect.DeepEqual(got, want) && c.lru.len() == len(want) {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("cached rooms: got %v want %v", got, want)
+}
@@ -234,3 +234,48 @@ func TestGlobalCacheLoadState(t *testing.T) {
 		})
 	}
 }
+
+func TestGlobalCacheLoadLeftRooms(t *testing.T) {
+	ctx := context.Background()
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	roomID := "!TestGlobalCacheLoadLeftRooms:localhost"
+	alice := "@alice_TestGlobalCacheLoadLeftRooms:localhost"
+	bob := "@bob_TestGlobalCacheLoadLeftRooms:localhost"
+	charlie := "@charlie_TestGlobalCacheLoadLeftRooms:localhost"
+	accResult, err := store.Accumulate(alice, roomID, sync2.TimelineResponse{Events: []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "Old Name"}),
+		testutils.NewStateEvent(t, "m.room.member", alice, alice, map[string]interface{}{"membership": "leave"}),
+		// changes after alice left
+		testutils.NewStateEvent(t, "m.room.name", "", bob, map[string]interface{}{"name": "New Name"}),
+		testutils.NewJoinEvent(t, charlie),
+	}})
+	if err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	latest := accResult.TimelineNIDs[len(accResult.TimelineNIDs)-1]
+	globalCache := caches.NewGlobalCache(store)
+	leftRooms, leaveTimings, err := globalCache.LoadLeftRooms(ctx, alice, latest)
+	if err != nil {
+		t.Fatalf("LoadLeftRooms: %s", err)
+	}
+	if leaveTimings[roomID].NID == 0 {
+		t.Fatalf("LoadLeftRooms: missing leave timing for %s: %v", roomID, leaveTimings)
+	}
+	metadata := leftRooms[roomID]
+	if metadata == nil {
+		t.Fatalf("LoadLeftRooms: missing metadata for %s: %v", roomID, leftRooms)
+	}
+	if metadata.NameEvent != "Old Name" {
+		t.Errorf("LoadLeftRooms: got name %q want the name when alice left", metadata.NameEvent)
+	}
+	if metadata.JoinCount != 1 {
+		t.Errorf("LoadLeftRooms: got join count %d want 1", metadata.JoinCount)
+	}
+	if len(metadata.Heroes) != 1 || metadata.Heroes[0].ID != bob {
+		t.Errorf("LoadLeftRooms: got heroes %+v want only %s", metadata.Heroes, bob)
+	}
+}
@@ -0,0 +1,137 @@
+package caches
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+)
+
+// HasHighlight returns true if there are unread highlights in this room, preferring the counts
+// from the upstream server.
+func (u *UserRoomData) HasHighlight() bool {
+	if unread := u.Unread(); unread != nil {
+		return unread.HighlightCount > 0
+	}
+	return u.HighlightCount > 0
+}
+
+// isMentioned returns true if this event mentions the user via m.mentions.
+// See https://spec.matrix.org/v1.10/client-server-api/#user-and-room-mentions
+func isMentioned(content gjson.Result, userID string) bool {
+	mentions := content.Get(`m\.mentions`)
+	if !mentions.IsObject() {
+		return false
+	}
+	if mentions.Get("room").Type == gjson.True {
+		return true
+	}
+	for _, u := range mentions.Get("user_ids").Array() {
+		if u.Str == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// CalculateMentions works out whether the user has been mentioned in each room since their last read
+// receipt, up to and including loadPos, setting UserRoomData.IsMentioned. Rooms are then kept up-to-date
+// as new events and receipts arrive. Rooms which are already tracked are skipped, as are rooms whose
+// read receipt is for an event we haven't seen.
+func (c *UserCache) CalculateMentions(ctx context.Context, loadPos int64, roomIDs []string) {
+	var calcRoomIDs []string
+	c.roomToDataMu.Lock()
+	c.trackMentions = true
+	for _, roomID := range roomIDs {
+		if _, tracked := c.mentionRooms[roomID]; !tracked {
+			calcRoomIDs = append(calcRoomIDs, roomID)
+		}
+	}
+	c.roomToDataMu.Unlock()
+	if len(calcRoomIDs) == 0 {
+		return
+	}
+	roomToMentioned := c.mentions(ctx, loadPos, calcRoomIDs)
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	for roomID, mentioned := range roomToMentioned {
+		if _, tracked := c.mentionRooms[roomID]; tracked {
+			continue // raced with another calculation
+		}
+		urd, ok := c.roomToData[roomID]
+		if !ok {
+			urd = NewUserRoomData()
+		}
+		urd.IsMentioned = mentioned
+		c.roomToData[roomID] = urd
+		c.mentionRooms[roomID] = loadPos
+	}
+}
+
+// mentions works out whether the user has been mentioned in the unread events in these rooms up to
+// and including loadPos. Rooms whose read receipt is for an event we haven't seen are omitted.
+func (c *UserCache) mentions(ctx context.Context, loadPos int64, roomIDs []string) map[string]bool {
+	_, span := internal.StartSpan(ctx, "CalculateMentions")
+	defer span.End()
+	roomToEvents, err := c.store.UnreadEvents(c.UserID, roomIDs, loadPos, MaxLocalUnreadEvents)
+	if err != nil {
+		logger.Err(err).Str("user", c.UserID).Msg("failed to load unread events for mentions")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil
+	}
+	roomToMentioned := make(map[string]bool, len(roomIDs))
+	for _, roomID := range roomIDs {
+		events, ok := roomToEvents[roomID]
+		if !ok {
+			continue // we don't know which events are unread
+		}
+		mentioned := false
+		for _, ev := range events {
+			parsed := gjson.ParseBytes(ev.JSON)
+			if c.ShouldIgnore(parsed.Get("sender").Str) {
+				continue
+			}
+			if isMentioned(parsed.Get("content"), c.UserID) {
+				mentioned = true
+				break
+			}
+		}
+		roomToMentioned[roomID] = mentioned
+	}
+	return roomToMentioned
+}
+
+// updateMentions updates IsMentioned in urd for this new event, if mentions are being tracked for
+// this room. Must be called with roomToDataMu held.
+func (c *UserCache) updateMentions(urd *UserRoomData, ed *EventData) {
+	upToNID, tracked := c.mentionRooms[ed.RoomID]
+	if !tracked {
+		// start tracking rooms we join, as there is nothing unread before our join
+		if c.trackMentions && ed.EventType == "m.room.member" && ed.StateKey != nil && *ed.StateKey == c.UserID &&
+			ed.Content.Get("membership").Str == "join" && ed.NID > 0 {
+			urd.IsMentioned = false
+			c.mentionRooms[ed.RoomID] = ed.NID
+		}
+		return
+	}
+	if ed.NID <= upToNID {
+		return
+	}
+	c.mentionRooms[ed.RoomID] = ed.NID
+	if ed.Sender == c.UserID {
+		// sending an event counts as reading the room
+		urd.IsMentioned = false
+		return
+	}
+	if !c.ShouldIgnore(ed.Sender) && isMentioned(ed.Content, c.UserID) {
+		urd.IsMentioned = true
+	}
+}
+
+// forgetMentions stops tracking mentions for this room, returning the position they were tracked up
+// to, if they were being tracked. Must be called with roomToDataMu held.
+func (c *UserCache) forgetMentions(roomID string) (upToNID int64, tracked bool) {
+	upToNID, tracked = c.mentionRooms[roomID]
+	delete(c.mentionRooms, roomID)
+	return
+}
@@ -0,0 +1,96 @@
+package caches_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+type updateCollector struct {
+	mu          sync.Mutex
+	roomUpdates []caches.RoomUpdate
+}
+
+func (c *updateCollector) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roomUpdates = append(c.roomUpdates, up)
+}
+func (c *updateCollector) RoomUpdates() []caches.RoomUpdate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]caches.RoomUpdate(nil), c.roomUpdates...)
+}
+func (c *updateCollector) OnUpdate(ctx context.Context, up caches.Update) {}
+
+func TestCalculateMentions(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomID := "!mentions:localhost"
+	message := func(sender string, mentions string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","room_id":"%s","sender":"%s","content":{"msgtype":"m.text","body":"hi","m.mentions":%s}}`, roomID, sender, mentions))
+	}
+	store := &unreadStore{
+		unreadEvents: []json.RawMessage{
+			message("@bob:localhost", `{}`),
+			message("@bob:localhost", `{"user_ids":["@alice:localhost"]}`),
+		},
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	uc := caches.NewUserCache(userID, globalCache, store, &txnIDFetcher{}, &joinChecker{})
+	collector := &updateCollector{}
+	uc.Subsribe(collector)
+
+	uc.CalculateMentions(ctx, 10, []string{roomID})
+	if !uc.LoadRoomData(roomID).IsMentioned {
+		t.Fatalf("CalculateMentions: want mentioned")
+	}
+
+	// reading the room clears the mention, and tells listeners the counts have changed
+	store.unreadEvents = store.unreadEvents[:1]
+	uc.OnReceipt(ctx, internal.Receipt{RoomID: roomID, EventID: "$read", UserID: userID})
+	waitFor(t, "mentions to be recalculated", func() bool {
+		return len(collector.RoomUpdates()) >= 2
+	})
+	if uc.LoadRoomData(roomID).IsMentioned {
+		t.Fatalf("OnReceipt: want not mentioned")
+	}
+	roomUpdates := collector.RoomUpdates()
+	if len(roomUpdates) != 2 {
+		t.Fatalf("OnReceipt: got %d updates, want 2", len(roomUpdates))
+	}
+	if up, ok := roomUpdates[1].(*caches.UnreadCountUpdate); !ok || !up.HasCountDecreased || up.UserRoomMetadata().IsMentioned {
+		t.Fatalf("OnReceipt: got %+v want UnreadCountUpdate", roomUpdates[1])
+	}
+
+	newEvent := func(nid int64, ev json.RawMessage) *caches.EventData {
+		return &caches.EventData{
+			Event:     ev,
+			RoomID:    roomID,
+			EventType: gjson.GetBytes(ev, "type").Str,
+			Sender:    gjson.GetBytes(ev, "sender").Str,
+			Content:   gjson.GetBytes(ev, "content"),
+			NID:       nid,
+		}
+	}
+	// @room mentions count, but not if we've already seen the event
+	uc.OnNewEvent(ctx, newEvent(9, message("@bob:localhost", `{"room":true}`)))
+	if uc.LoadRoomData(roomID).IsMentioned {
+		t.Fatalf("OnNewEvent: old event should be ignored")
+	}
+	uc.OnNewEvent(ctx, newEvent(11, message("@bob:localhost", `{"room":true}`)))
+	if !uc.LoadRoomData(roomID).IsMentioned {
+		t.Fatalf("OnNewEvent: want mentioned")
+	}
+	// sending a message counts as reading the room
+	uc.OnNewEvent(ctx, newEvent(12, message(userID, `{}`)))
+	if uc.LoadRoomData(roomID).IsMentioned {
+		t.Fatalf("OnNewEvent: want not mentioned after sending")
+	}
+}
@@ -0,0 +1,277 @@
+package caches
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/tidwall/gjson"
+)
+
+// MaxLocalUnreadEvents is the maximum number of events per room which are evaluated when
+// calculating unread counts locally. Counts saturate at this value.
+var MaxLocalUnreadEvents = 100
+
+// The room account data event types used to manually mark rooms as unread.
+const (
+	MarkedUnreadEventType         = "m.marked_unread"
+	UnstableMarkedUnreadEventType = "com.famedly.marked_unread"
+)
+
+// UnreadCounts are the number of notifying and highlighting unread events in a room.
+type UnreadCounts struct {
+	NotificationCount int `json:"notification_count"`
+	HighlightCount    int `json:"highlight_count"`
+}
+
+// Unread returns the unread counts for this room, preferring the counts from the upstream server.
+// Returns nil if the counts are unknown.
+func (u *UserRoomData) Unread() *UnreadCounts {
+	if u.HasUnreadCounts || u.IsInvite || u.IsKnock {
+		return &UnreadCounts{
+			NotificationCount: u.NotificationCount,
+			HighlightCount:    u.HighlightCount,
+		}
+	}
+	return u.LocalUnread
+}
+
+// IsUnread returns true if the room has unread notifications, or the user has marked it as unread.
+func (u *UserRoomData) IsUnread() bool {
+	if u.IsMarkedUnread {
+		return true
+	}
+	if unread := u.Unread(); unread != nil {
+		return unread.NotificationCount > 0
+	}
+	return u.NotificationCount > 0
+}
+
+// localUnreadRoom is the information needed to keep local unread counts for a room up-to-date.
+type localUnreadRoom struct {
+	// events up to and including this NID have been counted
+	upToNID     int64
+	displayName string
+	powerLevels gjson.Result
+}
+
+func (r *localUnreadRoom) pushContext(userID string, joinCount int) internal.PushContext {
+	return internal.PushContext{
+		UserID:      userID,
+		DisplayName: r.displayName,
+		MemberCount: joinCount,
+		SenderCanNotify: func(sender, key string) bool {
+			if !r.powerLevels.Exists() {
+				return false
+			}
+			required := int64(50)
+			if v := r.powerLevels.Get("notifications").Get(key); v.Exists() {
+				required = v.Int()
+			}
+			level := r.powerLevels.Get("users_default").Int()
+			if v, ok := r.powerLevels.Get("users").Map()[sender]; ok {
+				level = v.Int()
+			}
+			return level >= required
+		},
+	}
+}
+
+func (c *UserCache) loadPushRules() *internal.PushRules {
+	c.pushRulesMu.RLock()
+	defer c.pushRulesMu.RUnlock()
+	return c.pushRules
+}
+
+// setPushRules replaces the user's push rules, which invalidates any local unread counts.
+func (c *UserCache) setPushRules(content string) {
+	rules, err := internal.NewPushRules([]byte(content))
+	if err != nil {
+		logger.Warn().Err(err).Str("user", c.UserID).Msg("failed to parse m.push_rules")
+		return
+	}
+	c.pushRulesMu.Lock()
+	c.pushRules = rules
+	c.pushRulesMu.Unlock()
+
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	for roomID, urd := range c.roomToData {
+		if urd.LocalUnread != nil {
+			urd.LocalUnread = nil
+			c.roomToData[roomID] = urd
+		}
+	}
+	c.localUnreadRooms = make(map[string]*localUnreadRoom)
+}
+
+// CalculateUnreadCounts works out unread counts for rooms which the upstream server has not told us
+// about, by evaluating the user's push rules against the events after their read receipt, up to
+// and including loadPos. Rooms which already have counts are skipped, as are rooms whose read
+// receipt is for an event we haven't seen. This is a no-op if the user has no push rules.
+func (c *UserCache) CalculateUnreadCounts(ctx context.Context, loadPos int64, roomIDs []string) {
+	if c.loadPushRules() == nil || len(roomIDs) == 0 {
+		return
+	}
+	var calcRoomIDs []string
+	c.roomToDataMu.RLock()
+	for _, roomID := range roomIDs {
+		urd, ok := c.roomToData[roomID]
+		if ok && urd.Unread() != nil {
+			continue
+		}
+		calcRoomIDs = append(calcRoomIDs, roomID)
+	}
+	c.roomToDataMu.RUnlock()
+	if len(calcRoomIDs) == 0 {
+		return
+	}
+	roomToCounts, rooms := c.unreadCounts(ctx, loadPos, calcRoomIDs)
+
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	for roomID, counts := range roomToCounts {
+		counts := counts
+		urd, ok := c.roomToData[roomID]
+		if !ok {
+			urd = NewUserRoomData()
+		}
+		if urd.Unread() != nil {
+			continue // raced with another calculation or the upstream server
+		}
+		urd.LocalUnread = &counts
+		c.roomToData[roomID] = urd
+		c.localUnreadRooms[roomID] = rooms[roomID]
+	}
+}
+
+// unreadCounts evaluates the user's push rules against the unread events in these rooms up to and
+// including loadPos. Rooms whose read receipt is for an event we haven't seen are omitted.
+func (c *UserCache) unreadCounts(ctx context.Context, loadPos int64, roomIDs []string) (map[string]UnreadCounts, map[string]*localUnreadRoom) {
+	rules := c.loadPushRules()
+	if rules == nil {
+		return nil, nil
+	}
+	_, span := internal.StartSpan(ctx, "CalculateUnreadCounts")
+	defer span.End()
+	roomToEvents, err := c.store.UnreadEvents(c.UserID, roomIDs, loadPos, MaxLocalUnreadEvents)
+	if err != nil {
+		logger.Err(err).Str("user", c.UserID).Msg("failed to load unread events")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil, nil
+	}
+	roomToState, err := c.store.RoomStateAfterEventPosition(ctx, roomIDs, loadPos, map[string][]string{
+		"m.room.member":       {c.UserID},
+		"m.room.power_levels": {""},
+	})
+	if err != nil {
+		logger.Err(err).Str("user", c.UserID).Msg("failed to load state for unread counts")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil, nil
+	}
+	metadatas := c.globalCache.LoadRooms(ctx, roomIDs...)
+
+	roomToCounts := make(map[string]UnreadCounts, len(roomIDs))
+	rooms := make(map[string]*localUnreadRoom, len(roomIDs))
+	for _, roomID := range roomIDs {
+		events, ok := roomToEvents[roomID]
+		if !ok {
+			continue // we don't know which events are unread
+		}
+		room := &localUnreadRoom{
+			upToNID: loadPos,
+		}
+		for _, ev := range roomToState[roomID] {
+			room.setState(ev.Type, ev.JSON)
+		}
+		var joinCount int
+		if metadatas[roomID] != nil {
+			joinCount = metadatas[roomID].JoinCount
+		}
+		pctx := room.pushContext(c.UserID, joinCount)
+		var counts UnreadCounts
+		for _, ev := range events {
+			if c.ShouldIgnore(gjson.GetBytes(ev.JSON, "sender").Str) {
+				continue
+			}
+			counts.add(rules.Evaluate(ev.JSON, pctx))
+		}
+		roomToCounts[roomID] = counts
+		rooms[roomID] = room
+	}
+	return roomToCounts, rooms
+}
+
+func (counts *UnreadCounts) add(notify, highlight bool) {
+	if notify {
+		counts.NotificationCount++
+	}
+	if highlight {
+		counts.HighlightCount++
+	}
+}
+
+func (r *localUnreadRoom) setState(evType string, ev json.RawMessage) {
+	switch evType {
+	case "m.room.member":
+		r.displayName = gjson.GetBytes(ev, "content.displayname").Str
+	case "m.room.power_levels":
+		r.powerLevels = gjson.GetBytes(ev, "content")
+	}
+}
+
+// updateLocalUnread updates the local unread counts in urd for this new event, if they are being
+// tracked for this room. Must be called with roomToDataMu held.
+func (c *UserCache) updateLocalUnread(urd *UserRoomData, ed *EventData) {
+	room := c.localUnreadRooms[ed.RoomID]
+	if room == nil || urd.LocalUnread == nil || urd.HasUnreadCounts || ed.NID <= room.upToNID {
+		return
+	}
+	room.upToNID = ed.NID
+	if ed.StateKey != nil && (ed.EventType == "m.room.power_levels" || (ed.EventType == "m.room.member" && *ed.StateKey == c.UserID)) {
+		room.setState(ed.EventType, ed.Event)
+	}
+	if ed.Sender == c.UserID {
+		// sending an event counts as reading the room
+		urd.LocalUnread = &UnreadCounts{}
+		return
+	}
+	rules := c.loadPushRules()
+	if rules == nil || c.ShouldIgnore(ed.Sender) {
+		return
+	}
+	notify, highlight := rules.Evaluate(ed.Event, room.pushContext(c.UserID, ed.JoinCount))
+	if !notify {
+		return
+	}
+	counts := *urd.LocalUnread
+	counts.add(notify, highlight)
+	urd.LocalUnread = &counts
+}
+
+// forgetLocalUnread discards the local unread counts for this room, so they are recalculated when
+// they are next needed. Must be called with roomToDataMu held.
+func (c *UserCache) forgetLocalUnread(roomID string) {
+	urd, ok := c.roomToData[roomID]
+	if !ok || urd.LocalUnread == nil {
+		return
+	}
+	urd.LocalUnread = nil
+	c.roomToData[roomID] = urd
+	delete(c.localUnreadRooms, roomID)
+}
+
+// OnUpstreamUnreadCounts marks these rooms as having unread counts from the upstream server, without
+// changing the counts themselves. Used on startup for rooms with zero counts.
+func (c *UserCache) OnUpstreamUnreadCounts(roomIDs []string) {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	for _, roomID := range roomIDs {
+		urd, ok := c.roomToData[roomID]
+		if !ok {
+			urd = NewUserRoomData()
+		}
+		urd.HasUnreadCounts = true
+		c.roomToData[roomID] = urd
+	}
+}
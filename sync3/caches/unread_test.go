@@ -0,0 +1,211 @@
+package caches_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+type unreadStore struct {
+	unreadEvents []json.RawMessage
+	state        []json.RawMessage
+	// if set, the read receipt is for an event we haven't seen
+	unknownReceipt bool
+}
+
+func (s *unreadStore) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
+	return
+}
+func (s *unreadStore) BundledAggregations(userID string, eventIDToSender map[string]string) (map[string]json.RawMessage, error) {
+	return nil, nil
+}
+func (s *unreadStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error) {
+	return nil, nil
+}
+func (s *unreadStore) UnreadEvents(userID string, roomIDs []string, to int64, limit int) (map[string][]state.Event, error) {
+	result := make(map[string][]state.Event)
+	if s.unknownReceipt {
+		return result, nil
+	}
+	for _, roomID := range roomIDs {
+		result[roomID] = nil
+		for _, ev := range s.unreadEvents {
+			result[roomID] = append(result[roomID], state.Event{JSON: ev})
+		}
+	}
+	return result, nil
+}
+func (s *unreadStore) RoomStateAfterEventPosition(ctx context.Context, roomIDs []string, pos int64, eventTypesToStateKeys map[string][]string) (map[string][]state.Event, error) {
+	result := make(map[string][]state.Event)
+	for _, roomID := range roomIDs {
+		for _, ev := range s.state {
+			result[roomID] = append(result[roomID], state.Event{
+				Type: gjson.GetBytes(ev, "type").Str,
+				JSON: ev,
+			})
+		}
+	}
+	return result, nil
+}
+
+const unreadTestPushRules = `{"type":"m.push_rules","content":{"global":{
+	"override": [
+		{"rule_id": ".m.rule.contains_display_name", "enabled": true, "conditions": [{"kind": "contains_display_name"}], "actions": ["notify", {"set_tweak": "highlight"}]}
+	],
+	"underride": [
+		{"rule_id": ".m.rule.message", "enabled": true, "conditions": [{"kind": "event_match", "key": "type", "pattern": "m.room.message"}], "actions": ["notify"]}
+	]
+}}}`
+
+func TestCalculateUnreadCounts(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomID := "!unread:localhost"
+	message := func(sender, body string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","room_id":"%s","sender":"%s","content":{"msgtype":"m.text","body":"%s"}}`, roomID, sender, body))
+	}
+	store := &unreadStore{
+		unreadEvents: []json.RawMessage{
+			message("@bob:localhost", "hello"),
+			message("@bob:localhost", "hi Alice"),
+			json.RawMessage(`{"type":"m.reaction","sender":"@bob:localhost","content":{}}`),
+		},
+		state: []json.RawMessage{
+			json.RawMessage(`{"type":"m.room.member","state_key":"@alice:localhost","sender":"@alice:localhost","content":{"membership":"join","displayname":"Alice"}}`),
+		},
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	metadata := internal.NewRoomMetadata(roomID)
+	metadata.LastMessageTimestamp = 1000
+	metadata.JoinCount = 5
+	globalCache.Startup(map[string]internal.RoomMetadata{roomID: *metadata})
+	uc := caches.NewUserCache(userID, globalCache, store, &txnIDFetcher{}, &joinChecker{})
+
+	// without push rules, nothing is calculated
+	uc.CalculateUnreadCounts(ctx, 10, []string{roomID})
+	assertUnread(t, uc.LoadRoomData(roomID), nil)
+
+	uc.OnAccountData(ctx, []state.AccountData{{
+		UserID: userID,
+		RoomID: state.AccountDataGlobalRoom,
+		Type:   "m.push_rules",
+		Data:   []byte(unreadTestPushRules),
+	}})
+	// nor if we don't know which events are unread
+	store.unknownReceipt = true
+	uc.CalculateUnreadCounts(ctx, 10, []string{roomID})
+	assertUnread(t, uc.LoadRoomData(roomID), nil)
+	store.unknownReceipt = false
+
+	uc.CalculateUnreadCounts(ctx, 10, []string{roomID})
+	assertUnread(t, uc.LoadRoomData(roomID), &caches.UnreadCounts{NotificationCount: 2, HighlightCount: 1})
+
+	// new events are counted, unless we've already counted them
+	newEvent := func(nid int64, ev json.RawMessage) *caches.EventData {
+		return &caches.EventData{
+			Event:     ev,
+			RoomID:    roomID,
+			EventType: gjson.GetBytes(ev, "type").Str,
+			Sender:    gjson.GetBytes(ev, "sender").Str,
+			Content:   gjson.GetBytes(ev, "content"),
+			JoinCount: 5,
+			NID:       nid,
+		}
+	}
+	uc.OnNewEvent(ctx, newEvent(9, message("@bob:localhost", "old")))
+	uc.OnNewEvent(ctx, newEvent(11, message("@bob:localhost", "alice?")))
+	assertUnread(t, uc.LoadRoomData(roomID), &caches.UnreadCounts{NotificationCount: 3, HighlightCount: 2})
+
+	// our own events mark the room as read
+	uc.OnNewEvent(ctx, newEvent(12, message(userID, "hi")))
+	assertUnread(t, uc.LoadRoomData(roomID), &caches.UnreadCounts{})
+
+	// our read receipts cause the counts to be recalculated
+	store.unreadEvents = store.unreadEvents[:1]
+	uc.OnReceipt(ctx, internal.Receipt{
+		RoomID:  roomID,
+		EventID: "$foo",
+		UserID:  userID,
+	})
+	waitFor(t, "counts to be recalculated", func() bool {
+		urd := uc.LoadRoomData(roomID)
+		unread := urd.Unread()
+		return unread != nil && *unread == caches.UnreadCounts{NotificationCount: 1}
+	})
+
+	// counts from the upstream server take precedence
+	zero := 0
+	uc.OnUnreadCounts(ctx, roomID, &zero, &zero)
+	assertUnread(t, uc.LoadRoomData(roomID), &caches.UnreadCounts{})
+	uc.OnNewEvent(ctx, newEvent(13, message("@bob:localhost", "hello")))
+	assertUnread(t, uc.LoadRoomData(roomID), &caches.UnreadCounts{})
+}
+
+func assertUnread(t *testing.T, urd caches.UserRoomData, want *caches.UnreadCounts) {
+	t.Helper()
+	got := urd.Unread()
+	if got == nil || want == nil {
+		if got != want {
+			t.Errorf("Unread: got %+v want %+v", got, want)
+		}
+		return
+	}
+	if *got != *want {
+		t.Errorf("Unread: got %+v want %+v", *got, *want)
+	}
+}
+
+func TestMarkedUnread(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomID := "!marked:localhost"
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), &unreadStore{}, &txnIDFetcher{}, &joinChecker{})
+	markedUnread := func(evType string, unread bool) state.AccountData {
+		return state.AccountData{
+			UserID: userID,
+			RoomID: roomID,
+			Type:   evType,
+			Data:   []byte(fmt.Sprintf(`{"type":"%s","content":{"unread":%v}}`, evType, unread)),
+		}
+	}
+	uc.OnAccountData(ctx, []state.AccountData{markedUnread(caches.UnstableMarkedUnreadEventType, true)})
+	if urd := uc.LoadRoomData(roomID); !urd.IsMarkedUnread || !urd.IsUnread() {
+		t.Fatalf("unstable marked unread: want unread")
+	}
+	// the stable type takes precedence
+	uc.OnAccountData(ctx, []state.AccountData{
+		markedUnread(caches.MarkedUnreadEventType, false),
+		markedUnread(caches.UnstableMarkedUnreadEventType, true),
+	})
+	if urd := uc.LoadRoomData(roomID); urd.IsMarkedUnread || urd.IsUnread() {
+		t.Fatalf("stable marked unread: want read")
+	}
+	// ...including over later updates of the unstable type
+	uc.OnAccountData(ctx, []state.AccountData{markedUnread(caches.UnstableMarkedUnreadEventType, true)})
+	if urd := uc.LoadRoomData(roomID); urd.IsMarkedUnread || urd.IsUnread() {
+		t.Fatalf("unstable marked unread after stable: want read")
+	}
+	uc.OnAccountData(ctx, []state.AccountData{markedUnread(caches.MarkedUnreadEventType, true)})
+	if urd := uc.LoadRoomData(roomID); !urd.IsMarkedUnread || !urd.IsUnread() {
+		t.Fatalf("stable marked unread: want unread")
+	}
+}
+
+// waitFor waits up to a second for cond to become true.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -38,6 +38,16 @@ func (u *InviteUpdate) Type() string {
 	return fmt.Sprintf("InviteUpdate[%s]", u.RoomID())
 }
 
+// KnockUpdate corresponds to a key-value pair from a v2 sync's `knock` section.
+type KnockUpdate struct {
+	RoomUpdate
+	KnockData InviteData
+}
+
+func (u *KnockUpdate) Type() string {
+	return fmt.Sprintf("KnockUpdate[%s]", u.RoomID())
+}
+
 // TypingEdu corresponds to a typing EDU in the `ephemeral` section of a joined room's v2 sync resposne.
 type TypingUpdate struct {
 	RoomUpdate
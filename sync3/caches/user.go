@@ -41,10 +41,13 @@ type JoinChecker interface {
 type UserRoomData struct {
 	IsDM              bool
 	IsInvite          bool
+	IsKnock           bool
 	HasLeft           bool
 	NotificationCount int
 	HighlightCount    int
 	Invite            *InviteData
+	// Knock holds the knock_state for rooms we have knocked on, which is shaped like invite_state.
+	Knock *InviteData
 
 	// TODO: should CanonicalisedName really be in RoomConMetadata? It's only set in SetRoom AFAICS
 	CanonicalisedName string // stripped leading symbols like #, all in lower case
@@ -65,6 +68,20 @@ type UserRoomData struct {
 	Tags map[string]float64
 	// JoinTiming tracks our latest join to the room, excluding profile changes.
 	JoinTiming internal.EventMetadata
+	// LeaveTiming tracks our latest leave from the room, if HasLeft is set and the leave event is known.
+	LeaveTiming internal.EventMetadata
+	// HasUnreadCounts is true if the upstream server has sent unread counts for this room, in
+	// which case NotificationCount and HighlightCount are authoritative.
+	HasUnreadCounts bool
+	// LocalUnread are the unread counts calculated by the proxy from the user's push rules, or
+	// nil if they have not been calculated. Only used when HasUnreadCounts is false.
+	LocalUnread *UnreadCounts
+	// IsMentioned is true if the user has been mentioned via m.mentions since their last read
+	// receipt. Only calculated for rooms passed to UserCache.CalculateMentions.
+	IsMentioned bool
+	// IsMarkedUnread is true if the user has manually marked this room as unread.
+	// See https://github.com/matrix-org/matrix-spec-proposals/pull/2867
+	IsMarkedUnread bool
 }
 
 func NewUserRoomData() UserRoomData {
@@ -74,6 +91,19 @@ func NewUserRoomData() UserRoomData {
 	}
 }
 
+// StrippedState returns the invite or knock data for this room, or nil if the user is neither
+// invited to nor knocking on the room. Rooms with stripped state must not be loaded from the
+// global cache, as the user cannot see the room's full state.
+func (u *UserRoomData) StrippedState() *InviteData {
+	if u.IsInvite {
+		return u.Invite
+	}
+	if u.IsKnock {
+		return u.Knock
+	}
+	return nil
+}
+
 // Subset of data from internal.RoomMetadata which we can glean from invite_state.
 // Processed in the same way as joined rooms!
 type InviteData struct {
@@ -181,8 +211,15 @@ type UserCacheListener interface {
 
 // Subset of store functions used by the user cache
 type UserCacheStore interface {
+	BundledAggregationsFetcher
 	LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error)
 	GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string)
+	UnreadEvents(userID string, roomIDs []string, to int64, limit int) (map[string][]state.Event, error)
+	RoomStateAfterEventPosition(ctx context.Context, roomIDs []string, pos int64, eventTypesToStateKeys map[string][]string) (roomToEvents map[string][]state.Event, err error)
+}
+
+type BundledAggregationsFetcher interface {
+	BundledAggregations(userID string, eventIDToSender map[string]string) (map[string]json.RawMessage, error)
 }
 
 // Tracks data specific to a given user. Specifically, this is the map of room ID to UserRoomData.
@@ -201,6 +238,19 @@ type UserCache struct {
 	joinChecker               JoinChecker
 	ignoredUsers              map[string]struct{}
 	ignoredUsersMu            *sync.RWMutex
+	pushRules                 *internal.PushRules
+	pushRulesMu               *sync.RWMutex
+	// rooms which have LocalUnread counts, guarded by roomToDataMu
+	localUnreadRooms map[string]*localUnreadRoom
+	// room ID -> NID which IsMentioned has been calculated up to, guarded by roomToDataMu
+	mentionRooms  map[string]int64
+	trackMentions bool
+	// room ID -> whether another receipt has arrived while recalculating the room after a receipt,
+	// guarded by roomToDataMu
+	receiptRooms map[string]bool
+	// rooms which have stable m.marked_unread account data, so unstable updates are ignored, guarded
+	// by roomToDataMu
+	stableMarkedUnreadRooms map[string]struct{}
 }
 
 func NewUserCache(userID string, globalCache *GlobalCache, store UserCacheStore, txnIDs TransactionIDFetcher, joinChecker JoinChecker) *UserCache {
@@ -218,6 +268,13 @@ func NewUserCache(userID string, globalCache *GlobalCache, store UserCacheStore,
 		joinChecker:    joinChecker,
 		ignoredUsers:   make(map[string]struct{}),
 		ignoredUsersMu: &sync.RWMutex{},
+		pushRulesMu:    &sync.RWMutex{},
+
+		localUnreadRooms: make(map[string]*localUnreadRoom),
+		mentionRooms:     make(map[string]int64),
+		receiptRooms:     make(map[string]bool),
+
+		stableMarkedUnreadRooms: make(map[string]struct{}),
 	}
 	return uc
 }
@@ -414,6 +471,20 @@ func (c *UserCache) newRoomUpdate(ctx context.Context, roomID string) RoomUpdate
 	}
 }
 
+// Knocks returns the rooms the user is currently knocking on.
+func (c *UserCache) Knocks() map[string]UserRoomData {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	knocks := make(map[string]UserRoomData)
+	for roomID, urd := range c.roomToData {
+		if !urd.IsKnock || urd.Knock == nil {
+			continue
+		}
+		knocks[roomID] = urd
+	}
+	return knocks
+}
+
 func (c *UserCache) Invites() map[string]UserRoomData {
 	c.roomToDataMu.Lock()
 	defer c.roomToDataMu.Unlock()
@@ -492,6 +563,69 @@ func (c *UserCache) AnnotateWithTransactionIDs(ctx context.Context, userID strin
 	return roomIDToEvents
 }
 
+// AnnotateWithBundledAggregations sets `unsigned.m.relations` on events which have been related to
+// by other events e.g edits, thread replies.
+func (c *UserCache) AnnotateWithBundledAggregations(ctx context.Context, roomIDToEvents map[string][]json.RawMessage) map[string][]json.RawMessage {
+	return AnnotateWithBundledAggregations(ctx, c.store, c.UserID, roomIDToEvents)
+}
+
+// AnnotateWithBundledAggregations sets `unsigned.m.relations` on the given events, as seen by
+// `userID`. Aggregations are fetched in a single query for all rooms.
+func AnnotateWithBundledAggregations(ctx context.Context, fetcher BundledAggregationsFetcher, userID string, roomIDToEvents map[string][]json.RawMessage) map[string][]json.RawMessage {
+	_, span := internal.StartSpan(ctx, "AnnotateWithBundledAggregations")
+	defer span.End()
+	eventIDToSender := make(map[string]string)
+	for _, events := range roomIDToEvents {
+		for _, evJSON := range events {
+			ev := gjson.ParseBytes(evJSON)
+			eventIDToSender[ev.Get("event_id").Str] = ev.Get("sender").Str
+		}
+	}
+	if len(eventIDToSender) == 0 {
+		return roomIDToEvents
+	}
+	aggregations, err := fetcher.BundledAggregations(userID, eventIDToSender)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Msg("AnnotateWithBundledAggregations: failed to load aggregations")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return roomIDToEvents
+	}
+	return ApplyBundledAggregations(ctx, aggregations, roomIDToEvents)
+}
+
+// ApplyBundledAggregations sets `unsigned.m.relations` on the given events from aggregations which
+// have already been loaded, keyed by event ID.
+func ApplyBundledAggregations(ctx context.Context, aggregations map[string]json.RawMessage, roomIDToEvents map[string][]json.RawMessage) map[string][]json.RawMessage {
+	if len(aggregations) == 0 {
+		return roomIDToEvents
+	}
+	for roomID, events := range roomIDToEvents {
+		for i, evJSON := range events {
+			ev := gjson.ParseBytes(evJSON)
+			aggregation, ok := aggregations[ev.Get("event_id").Str]
+			if !ok {
+				continue
+			}
+			if ev.Get("unsigned.redacted_because").Exists() {
+				// edits to redacted events are not bundled as the original content is gone
+				aggregation, _ = sjson.DeleteBytes(aggregation, `m\.replace`)
+				if len(gjson.ParseBytes(aggregation).Map()) == 0 {
+					continue
+				}
+			}
+			newJSON, err := sjson.SetRawBytes(evJSON, `unsigned.m\.relations`, aggregation)
+			if err != nil {
+				logger.Err(err).Str("event", ev.Get("event_id").Str).Msg("ApplyBundledAggregations: sjson failed")
+				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+				continue
+			}
+			events[i] = newJSON
+		}
+		roomIDToEvents[roomID] = events
+	}
+	return roomIDToEvents
+}
+
 // =================================================
 // Listener functions called by v2 pollers are below
 // =================================================
@@ -513,12 +647,107 @@ func (c *UserCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEven
 }
 
 func (c *UserCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
+	if receipt.UserID == c.UserID && (receipt.ThreadID == "" || receipt.ThreadID == "main") {
+		// our read position has moved, so recalculate our unread counts and mentions if we were tracking
+		// them. This hits the database, so do it in the background rather than holding up the dispatcher.
+		c.roomToDataMu.Lock()
+		_, trackingUnread := c.localUnreadRooms[receipt.RoomID]
+		_, trackingMentions := c.mentionRooms[receipt.RoomID]
+		_, recalculating := c.receiptRooms[receipt.RoomID]
+		start := false
+		if recalculating {
+			// the running recalculation will go round again
+			c.receiptRooms[receipt.RoomID] = true
+		} else if trackingUnread || trackingMentions {
+			c.receiptRooms[receipt.RoomID] = false
+			start = true
+		}
+		c.roomToDataMu.Unlock()
+		if start {
+			go c.recalculateAfterReceipt(ctx, receipt.RoomID)
+		}
+	}
 	c.emitOnRoomUpdate(ctx, &ReceiptUpdate{
 		RoomUpdate: c.newRoomUpdate(ctx, receipt.RoomID),
 		Receipt:    receipt,
 	})
 }
 
+// maxReceiptRecalculations is the number of times recalculateAfterReceipt will try to recalculate a
+// room which keeps receiving new events, before giving up and forgetting the room's counts instead.
+const maxReceiptRecalculations = 3
+
+// recalculateAfterReceipt recalculates the local unread counts and mentions in this room after the
+// user's read receipt has moved, then tells listeners. Counts are left as they are if the receipt is
+// for an event we haven't seen. Repeats until no more receipts for this room arrive in the meantime.
+func (c *UserCache) recalculateAfterReceipt(ctx context.Context, roomID string) {
+	for attempt := 1; ; attempt++ {
+		c.roomToDataMu.Lock()
+		room := c.localUnreadRooms[roomID]
+		var unreadPos int64
+		if room != nil {
+			unreadPos = room.upToNID
+		}
+		mentionsPos, trackingMentions := c.mentionRooms[roomID]
+		c.receiptRooms[roomID] = false
+		c.roomToDataMu.Unlock()
+
+		var roomToCounts map[string]UnreadCounts
+		if room != nil {
+			roomToCounts, _ = c.unreadCounts(ctx, unreadPos, []string{roomID})
+		}
+		var roomToMentioned map[string]bool
+		if trackingMentions {
+			roomToMentioned = c.mentions(ctx, mentionsPos, []string{roomID})
+		}
+
+		c.roomToDataMu.Lock()
+		changed, stale := false, false
+		urd := c.roomToData[roomID]
+		if room != nil && c.localUnreadRooms[roomID] == room {
+			if room.upToNID != unreadPos {
+				stale = true // new events were counted on top of the old counts
+			} else if counts, ok := roomToCounts[roomID]; ok && urd.LocalUnread != nil {
+				urd.LocalUnread = &counts
+				changed = true
+			}
+		}
+		if pos, ok := c.mentionRooms[roomID]; ok && trackingMentions {
+			if pos != mentionsPos {
+				stale = true
+			} else if mentioned, ok := roomToMentioned[roomID]; ok {
+				urd.IsMentioned = mentioned
+				changed = true
+			}
+		}
+		if changed {
+			c.roomToData[roomID] = urd
+		}
+		again := c.receiptRooms[roomID] || (stale && attempt < maxReceiptRecalculations)
+		if stale && !again {
+			// they will be recalculated when they are next needed
+			c.forgetLocalUnread(roomID)
+			c.forgetMentions(roomID)
+			changed = true
+		}
+		if !again {
+			delete(c.receiptRooms, roomID)
+		}
+		c.roomToDataMu.Unlock()
+
+		if changed {
+			// lists may filter or sort on these, so tell them
+			c.emitOnRoomUpdate(ctx, &UnreadCountUpdate{
+				RoomUpdate:        c.newRoomUpdate(ctx, roomID),
+				HasCountDecreased: true,
+			})
+		}
+		if !again {
+			return
+		}
+	}
+}
+
 func (c *UserCache) emitOnRoomUpdate(ctx context.Context, update RoomUpdate) {
 	c.listenersMu.RLock()
 	var listeners []UserCacheListener
@@ -556,8 +785,10 @@ func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlight
 		}
 		data.NotificationCount = *notifCount
 	}
+	data.HasUnreadCounts = true
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = data
+	c.forgetLocalUnread(roomID)
 	c.roomToDataMu.Unlock()
 
 	roomUpdate := &UnreadCountUpdate{
@@ -593,6 +824,7 @@ func (c *UserCache) OnSpaceUpdate(ctx context.Context, parentRoomID, childRoomID
 func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 	// add this to our tracked timelines if we have one
 	urd := c.LoadRoomData(eventData.RoomID)
+	wasInvite := urd.IsInvite
 	// reset the IsInvite field when the user actually joins/rejects the invite
 	if urd.IsInvite && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
 		urd.IsInvite = eventData.Content.Get("membership").Str == "invite"
@@ -600,6 +832,29 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 			urd.HighlightCount = 0
 		}
 	}
+	// likewise for knocks, when the user is let in or the knock is retracted
+	if urd.IsKnock && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		urd.IsKnock = eventData.Content.Get("membership").Str == "knock"
+		if !urd.IsKnock {
+			urd.Knock = nil
+		}
+	}
+	if eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID && eventData.NID > 0 {
+		switch eventData.Content.Get("membership").Str {
+		case "join":
+			urd.HasLeft = false
+			urd.LeaveTiming = internal.EventMetadata{}
+		case "leave", "ban":
+			// remember when we left so the room can be shown as it was at this point, ignoring leave->ban
+			// and rejected invites as we never saw anything in the room.
+			if urd.LeaveTiming.NID == 0 && !wasInvite {
+				urd.LeaveTiming = internal.EventMetadata{
+					NID:       eventData.NID,
+					Timestamp: eventData.Timestamp,
+				}
+			}
+		}
+	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
@@ -607,6 +862,8 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 		c.OnSpaceUpdate(ctx, eventData.RoomID, childRoomID, isDeleted, eventData)
 	}
 	c.roomToDataMu.Lock()
+	c.updateLocalUnread(&urd, eventData)
+	c.updateMentions(&urd, eventData)
 	c.roomToData[eventData.RoomID] = urd
 	c.roomToDataMu.Unlock()
 
@@ -626,6 +883,8 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = true
+	urd.IsKnock = false
+	urd.Knock = nil
 	urd.HasLeft = false
 	urd.HighlightCount = InvitesAreHighlightsValue
 	urd.IsDM = inviteData.IsDM
@@ -647,12 +906,45 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	c.emitOnRoomUpdate(ctx, up)
 }
 
+// OnKnock is called when the user knocks on a room. Knocked rooms are handled like invites: the
+// room is described by the stripped state in the knock, not the global cache.
+func (c *UserCache) OnKnock(ctx context.Context, roomID string, knockStateEvents []json.RawMessage) {
+	knockData := NewInviteData(ctx, c.UserID, roomID, knockStateEvents)
+	if knockData == nil {
+		return // malformed knock
+	}
+
+	urd := c.LoadRoomData(roomID)
+	if urd.IsInvite {
+		return // the knock was accepted before we processed it
+	}
+	urd.IsKnock = true
+	urd.HasLeft = false
+	urd.Knock = knockData
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = urd
+	c.roomToDataMu.Unlock()
+
+	up := &KnockUpdate{
+		RoomUpdate: &roomUpdateCache{
+			roomID: roomID,
+			// as with invites, do NOT pull from the global cache
+			globalRoomData: knockData.RoomMetadata(),
+			userRoomData:   &urd,
+		},
+		KnockData: *knockData,
+	}
+	c.emitOnRoomUpdate(ctx, up)
+}
+
 func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string, leaveEvent json.RawMessage) {
 	urd := c.LoadRoomData(roomID)
-	wasInvite := urd.IsInvite
+	wasInvite := urd.IsInvite || urd.IsKnock
 	urd.IsInvite = false
+	urd.IsKnock = false
 	urd.HasLeft = true
 	urd.Invite = nil
+	urd.Knock = nil
 	urd.HighlightCount = 0
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
@@ -698,6 +990,9 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 	roomUpdates := make(map[string][]state.AccountData)
 	// room_id -> tag_id -> order
 	tagUpdates := make(map[string]map[string]float64)
+	// room_id -> marked unread, preferring the stable event type
+	markedUnreadUpdates := make(map[string]bool)
+	hasStableMarkedUnread := make(map[string]bool)
 	for _, d := range datas {
 		up := roomUpdates[d.RoomID]
 		up = append(up, d)
@@ -737,6 +1032,17 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				tagUpdates[d.RoomID][k.Str] = v.Get("order").Float()
 				return true
 			})
+		case MarkedUnreadEventType, UnstableMarkedUnreadEventType:
+			if d.RoomID == state.AccountDataGlobalRoom || hasStableMarkedUnread[d.RoomID] {
+				continue
+			}
+			hasStableMarkedUnread[d.RoomID] = d.Type == MarkedUnreadEventType
+			markedUnreadUpdates[d.RoomID] = gjson.GetBytes(d.Data, "content.unread").Bool()
+		case "m.push_rules":
+			if d.RoomID != state.AccountDataGlobalRoom {
+				continue
+			}
+			c.setPushRules(gjson.GetBytes(d.Data, "content").Raw)
 		case "m.ignored_user_list":
 			if d.RoomID != state.AccountDataGlobalRoom {
 				continue
@@ -768,6 +1074,23 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 		}
 		c.roomToDataMu.Unlock()
 	}
+	if len(markedUnreadUpdates) > 0 {
+		c.roomToDataMu.Lock()
+		for roomID, markedUnread := range markedUnreadUpdates {
+			if hasStableMarkedUnread[roomID] {
+				c.stableMarkedUnreadRooms[roomID] = struct{}{}
+			} else if _, exists := c.stableMarkedUnreadRooms[roomID]; exists {
+				continue // the stable type takes precedence, even from an earlier update
+			}
+			urd, ok := c.roomToData[roomID]
+			if !ok {
+				urd = NewUserRoomData()
+			}
+			urd.IsMarkedUnread = markedUnread
+			c.roomToData[roomID] = urd
+		}
+		c.roomToDataMu.Unlock()
+	}
 	// bucket account data updates per-room and globally then invoke listeners
 	for roomID, updates := range roomUpdates {
 		if roomID == state.AccountDataGlobalRoom {
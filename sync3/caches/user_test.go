@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
 )
 
 type joinChecker struct{}
@@ -97,6 +98,84 @@ func TestAnnotateWithTransactionIDs(t *testing.T) {
 	}
 }
 
+func TestUserCacheLeaveTiming(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomID := "!left:localhost"
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), &unreadStore{}, &txnIDFetcher{}, &joinChecker{})
+	membership := func(nid int64, ts uint64, membership string) *caches.EventData {
+		ev := json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","content":{"membership":"%s"}}`, userID, userID, membership))
+		return &caches.EventData{
+			Event:     ev,
+			RoomID:    roomID,
+			EventType: "m.room.member",
+			StateKey:  &userID,
+			Sender:    userID,
+			Content:   gjson.GetBytes(ev, "content"),
+			NID:       nid,
+			Timestamp: ts,
+		}
+	}
+	uc.OnNewEvent(ctx, membership(1, 100, "join"))
+	uc.OnNewEvent(ctx, membership(2, 200, "leave"))
+	// a later ban doesn't change when we left
+	uc.OnNewEvent(ctx, membership(3, 300, "ban"))
+	if got := uc.LoadRoomData(roomID).LeaveTiming; got.NID != 2 || got.Timestamp != 200 {
+		t.Errorf("LeaveTiming: got %+v want NID 2", got)
+	}
+	// rejoining forgets the leave
+	uc.OnNewEvent(ctx, membership(4, 400, "join"))
+	if urd := uc.LoadRoomData(roomID); urd.HasLeft || urd.LeaveTiming.NID != 0 {
+		t.Errorf("LeaveTiming: got %+v after rejoining", urd.LeaveTiming)
+	}
+}
+
+func TestUserCacheKnock(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomID := "!knock:localhost"
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), &unreadStore{}, &txnIDFetcher{}, &joinChecker{})
+	collector := &updateCollector{}
+	uc.Subsribe(collector)
+	knockState := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.name","state_key":"","sender":"@bob:localhost","content":{"name":"Knock Knock"}}`),
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","origin_server_ts":1234,"content":{"membership":"knock"}}`, userID, userID)),
+	}
+	uc.OnKnock(ctx, roomID, knockState)
+	urd := uc.LoadRoomData(roomID)
+	if !urd.IsKnock || urd.IsInvite || urd.StrippedState() == nil {
+		t.Fatalf("OnKnock: got %+v want a knock", urd)
+	}
+	if got := urd.StrippedState().RoomMetadata(); got.NameEvent != "Knock Knock" || got.LastMessageTimestamp != 1234 {
+		t.Errorf("OnKnock: got metadata %+v", got)
+	}
+	if _, ok := uc.Knocks()[roomID]; !ok {
+		t.Errorf("Knocks: missing %s", roomID)
+	}
+	if len(collector.roomUpdates) != 1 {
+		t.Fatalf("OnKnock: got %d updates, want 1", len(collector.roomUpdates))
+	}
+	if _, ok := collector.roomUpdates[0].(*caches.KnockUpdate); !ok {
+		t.Errorf("OnKnock: got %T want KnockUpdate", collector.roomUpdates[0])
+	}
+
+	// being let in turns the knock into an invite
+	uc.OnInvite(ctx, roomID, []json.RawMessage{
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"@bob:localhost","content":{"membership":"invite"}}`, userID)),
+	})
+	urd = uc.LoadRoomData(roomID)
+	if urd.IsKnock || !urd.IsInvite || len(uc.Knocks()) != 0 {
+		t.Errorf("OnInvite: got %+v want an invite", urd)
+	}
+
+	// a rejected knock is a leave
+	uc.OnKnock(ctx, "!other:localhost", knockState)
+	uc.OnLeftRoom(ctx, "!other:localhost", json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"@bob:localhost","content":{"membership":"leave"}}`, userID)))
+	if urd = uc.LoadRoomData("!other:localhost"); urd.IsKnock || !urd.HasLeft || urd.StrippedState() != nil {
+		t.Errorf("OnLeftRoom: got %+v want left", urd)
+	}
+}
+
 func js(in interface{}) string {
 	b, _ := json.Marshal(in)
 	return string(b)
@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"runtime/debug"
 	"sync"
@@ -16,6 +17,10 @@ import (
 // /sync?pos=5 then /sync?pos=5 over and over. Likewise /sync without a ?pos=.
 var SpamProtectionInterval = 10 * time.Millisecond
 
+// The minimum amount of time between snapshots of a connection. Snapshots are taken after a
+// response is calculated, so idle connections are not snapshotted.
+var ConnSnapshotInterval = time.Minute
+
 type ConnID struct {
 	UserID   string
 	DeviceID string
@@ -38,6 +43,60 @@ type ConnHandler interface {
 	SetCancelCallback(cancel context.CancelFunc)
 }
 
+// ConnSnapshotter is implemented by ConnHandlers whose state can be serialised, which allows
+// connections to be restored after the proxy restarts.
+type ConnSnapshotter interface {
+	// Snapshot the handler state. Only called whilst no request is being processed.
+	Snapshot() (json.RawMessage, error)
+}
+
+// ConnInspector is implemented by ConnHandlers which can describe their state, for the admin API.
+type ConnInspector interface {
+	// Inspect fills in the lists and room subscriptions. Only called whilst no request is being processed.
+	Inspect(info *ConnInfo)
+	// InspectBuffer fills in the buffered update counts. Safe to call at any time.
+	InspectBuffer(info *ConnInfo)
+	// ExplainList describes the placement of rooms in this list. Returns false if there is no such
+	// list. Safe to call at any time, but may wait for a request to finish being processed.
+	ExplainList(listKey string) (ListExplanation, bool)
+}
+
+// ConnInfo describes a connection, for the admin API.
+type ConnInfo struct {
+	UserID            string              `json:"user_id"`
+	DeviceID          string              `json:"device_id"`
+	ConnID            string              `json:"conn_id"`
+	Pos               int64               `json:"pos"`
+	ClientPos         int64               `json:"client_pos"`
+	UnackedResponses  int                 `json:"unacked_responses"`
+	Lists             map[string]ListInfo `json:"lists"`
+	RoomSubscriptions []string            `json:"room_subscriptions"`
+	// the number of live updates waiting to be sent to the client, out of BufferCapacity. If the
+	// buffer overflowed, the connection will catch up from the database on the next request.
+	BufferedUpdates int  `json:"buffered_updates"`
+	BufferCapacity  int  `json:"buffer_capacity"`
+	Overflowed      bool `json:"overflowed"`
+}
+
+// ListInfo describes a list on a connection.
+type ListInfo struct {
+	Ranges SliceRanges `json:"ranges"`
+	Sort   []string    `json:"sort"`
+	Count  int         `json:"count"`
+}
+
+// ConnSnapshotFunc is called with a serialised connection and the latest position sent to the client.
+type ConnSnapshotFunc func(cid ConnID, pos int64, data []byte)
+
+// connSnapshot is the serialised form of a Conn.
+type connSnapshot struct {
+	LastClientRequest Request         `json:"last_client_request"`
+	LastClientPos     int64           `json:"last_client_pos"`
+	ServerResponses   []Response      `json:"server_responses"`
+	LastPos           int64           `json:"last_pos"`
+	Handler           json.RawMessage `json:"handler"`
+}
+
 // Conn is an abstraction of a long-poll connection. It automatically handles the position values
 // of the /sync request, including sending cached data in the event of retries. It does not handle
 // the contents of the data at all.
@@ -63,6 +122,14 @@ type Conn struct {
 	mu                         *sync.Mutex
 	cancelOutstandingRequest   func()
 	cancelOutstandingRequestMu *sync.Mutex
+
+	// optional: called periodically with a snapshot of this connection
+	onSnapshot       ConnSnapshotFunc
+	lastSnapshotTime time.Time
+
+	// a description of this connection as of the last response, see Info
+	info   ConnInfo
+	infoMu *sync.Mutex
 }
 
 func NewConn(connID ConnID, h ConnHandler) *Conn {
@@ -71,6 +138,13 @@ func NewConn(connID ConnID, h ConnHandler) *Conn {
 		handler:                    h,
 		mu:                         &sync.Mutex{},
 		cancelOutstandingRequestMu: &sync.Mutex{},
+		lastSnapshotTime:           time.Now(),
+		info: ConnInfo{
+			UserID:   connID.UserID,
+			DeviceID: connID.DeviceID,
+			ConnID:   connID.CID,
+		},
+		infoMu: &sync.Mutex{},
 	}
 }
 
@@ -244,6 +318,8 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 	if nextUnACKedResponse == nil {
 		nextUnACKedResponse = resp
 	}
+	c.maybeSnapshot()
+	c.updateInfo()
 
 	// return the oldest value
 	return nextUnACKedResponse, nil
@@ -252,3 +328,119 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request, start time.T
 func (c *Conn) SetCancelCallback(cancel context.CancelFunc) {
 	c.handler.SetCancelCallback(cancel)
 }
+
+// CancelOutstandingRequest makes the request being processed on this connection, if any, return
+// immediately with the data it has so far.
+func (c *Conn) CancelOutstandingRequest() {
+	c.cancelOutstandingRequestMu.Lock()
+	defer c.cancelOutstandingRequestMu.Unlock()
+	if c.cancelOutstandingRequest != nil {
+		c.cancelOutstandingRequest()
+	}
+}
+
+// Snapshot serialises this connection, returning the latest position sent to the client. Any
+// outstanding request is cancelled first, as the connection cannot be snapshotted whilst a request
+// is being processed.
+func (c *Conn) Snapshot() (pos int64, data []byte, err error) {
+	c.CancelOutstandingRequest()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err = c.snapshot()
+	return c.lastPos, data, err
+}
+
+// ExplainList describes why rooms are, or are not, in this list. Unlike Snapshot, outstanding
+// requests are not cancelled, nor waited for if they are waiting for live updates. Returns false if
+// there is no such list.
+func (c *Conn) ExplainList(listKey string) (ListExplanation, bool) {
+	inspector, ok := c.handler.(ConnInspector)
+	if !ok {
+		return ListExplanation{}, false
+	}
+	return inspector.ExplainList(listKey)
+}
+
+// Info describes this connection. The lists and room subscriptions are as of the last response, as
+// they cannot be inspected whilst a request is being processed.
+func (c *Conn) Info() ConnInfo {
+	c.infoMu.Lock()
+	info := c.info
+	c.infoMu.Unlock()
+	if inspector, ok := c.handler.(ConnInspector); ok {
+		inspector.InspectBuffer(&info)
+	}
+	return info
+}
+
+// updateInfo records a description of this connection for Info. Must hold mu.
+func (c *Conn) updateInfo() {
+	info := ConnInfo{
+		UserID:           c.UserID,
+		DeviceID:         c.DeviceID,
+		ConnID:           c.CID,
+		Pos:              c.lastPos,
+		ClientPos:        c.lastClientRequest.pos,
+		UnackedResponses: len(c.serverResponses),
+	}
+	if inspector, ok := c.handler.(ConnInspector); ok {
+		inspector.Inspect(&info)
+	}
+	c.infoMu.Lock()
+	c.info = info
+	c.infoMu.Unlock()
+}
+
+// maybeSnapshot passes a snapshot to onSnapshot if one has not been taken recently. Must hold mu.
+func (c *Conn) maybeSnapshot() {
+	if c.onSnapshot == nil || time.Since(c.lastSnapshotTime) < ConnSnapshotInterval {
+		return
+	}
+	c.lastSnapshotTime = time.Now()
+	data, err := c.snapshot()
+	if err != nil {
+		logger.Warn().Err(err).Str("conn", c.ConnID.String()).Msg("failed to snapshot connection")
+		return
+	}
+	// don't block the response on storing the snapshot
+	go c.onSnapshot(c.ConnID, c.lastPos, data)
+}
+
+// must hold mu
+func (c *Conn) snapshot() ([]byte, error) {
+	snapshotter, ok := c.handler.(ConnSnapshotter)
+	if !ok {
+		return nil, fmt.Errorf("handler %T cannot be snapshotted", c.handler)
+	}
+	handlerData, err := snapshotter.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(connSnapshot{
+		LastClientRequest: c.lastClientRequest,
+		LastClientPos:     c.lastClientRequest.pos,
+		ServerResponses:   c.serverResponses,
+		LastPos:           c.lastPos,
+		Handler:           handlerData,
+	})
+}
+
+// restoreConn creates a connection from the output of Conn.Snapshot. newConnHandler is called with
+// the handler's snapshot to restore the handler.
+func restoreConn(connID ConnID, data []byte, newConnHandler func(handlerData json.RawMessage) (ConnHandler, error)) (*Conn, error) {
+	var snapshot connSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal conn snapshot: %w", err)
+	}
+	h, err := newConnHandler(snapshot.Handler)
+	if err != nil {
+		return nil, err
+	}
+	c := NewConn(connID, h)
+	c.lastClientRequest = snapshot.LastClientRequest
+	c.lastClientRequest.pos = snapshot.LastClientPos
+	c.serverResponses = snapshot.ServerResponses
+	c.lastPos = snapshot.LastPos
+	c.updateInfo()
+	return c, nil
+}
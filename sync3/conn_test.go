@@ -136,6 +136,42 @@ func TestConnBlocking(t *testing.T) {
 
 }
 
+// Test that cancelling the outstanding request makes it return the data it has immediately
+func TestConnCancelOutstandingRequest(t *testing.T) {
+	connID := ConnID{
+		DeviceID: "d",
+	}
+	started := make(chan struct{})
+	c := NewConn(connID, &connHandlerMock{func(ctx context.Context, cid ConnID, req *Request, init bool) (*Response, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+		return &Response{}, nil
+	}})
+	c.CancelOutstandingRequest() // no-op with no outstanding request
+	done := make(chan *Response)
+	go func() {
+		resp, herr := c.OnIncomingRequest(context.Background(), &Request{}, time.Now())
+		if herr != nil {
+			t.Errorf("OnIncomingRequest: %s", herr)
+		}
+		done <- resp
+	}()
+	<-started
+	start := time.Now()
+	c.CancelOutstandingRequest()
+	resp := <-done
+	if time.Since(start) > time.Second {
+		t.Errorf("request took %v to return after being cancelled", time.Since(start))
+	}
+	if resp == nil {
+		t.Fatalf("got no response")
+	}
+	assertPos(t, resp.Pos, 1)
+}
+
 func TestConnRetries(t *testing.T) {
 	ctx := context.Background()
 	connID := ConnID{
@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"context"
+	"encoding/json"
 	"sync"
 	"time"
 
@@ -25,6 +26,11 @@ type ConnMap struct {
 	expiryTimedOutCounter   prometheus.Counter
 	expiryBufferFullCounter prometheus.Counter
 
+	// optional: called periodically with snapshots of each connection
+	onSnapshot ConnSnapshotFunc
+	// optional: called when a connection is closed, e.g to delete its snapshot
+	onClose func(cid ConnID)
+
 	mu *sync.Mutex
 }
 
@@ -107,6 +113,13 @@ func (m *ConnMap) Conns(userID, deviceID string) []*Conn {
 	return conns
 }
 
+// ConnsForUser returns all connections for this user, across all devices.
+func (m *ConnMap) ConnsForUser(userID string) []*Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Conn(nil), m.userIDToConn[userID]...)
+}
+
 // Conn returns a connection with this ConnID. Returns nil if no connection exists.
 func (m *ConnMap) Conn(cid ConnID) *Conn {
 	m.mu.Lock()
@@ -155,13 +168,83 @@ func (m *ConnMap) CreateConn(cid ConnID, cancel context.CancelFunc, newConnHandl
 	h := newConnHandler()
 	h.SetCancelCallback(cancel)
 	conn = NewConn(cid, h)
-	m.cache.Set(cid.String(), conn)
-	m.connIDToConn[cid.String()] = conn
-	m.userIDToConn[cid.UserID] = append(m.userIDToConn[cid.UserID], conn)
-	m.updateMetrics(len(m.connIDToConn))
+	m.addConn(conn)
 	return conn
 }
 
+// RestoreConn atomically creates a connection from the output of Conn.Snapshot, unless a connection
+// with this ConnID already exists in which case the existing connection is returned.
+func (m *ConnMap) RestoreConn(cid ConnID, cancel context.CancelFunc, data []byte, newConnHandler func(handlerData json.RawMessage) (ConnHandler, error)) (*Conn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if conn := m.getConn(cid); conn != nil {
+		// another request restored this connection first
+		return conn, nil
+	}
+	conn, err := restoreConn(cid, data, newConnHandler)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetCancelCallback(cancel)
+	m.addConn(conn)
+	return conn, nil
+}
+
+// must hold mu
+func (m *ConnMap) addConn(conn *Conn) {
+	conn.onSnapshot = m.onSnapshot
+	m.cache.Set(conn.ConnID.String(), conn)
+	m.connIDToConn[conn.ConnID.String()] = conn
+	m.userIDToConn[conn.UserID] = append(m.userIDToConn[conn.UserID], conn)
+	m.updateMetrics(len(m.connIDToConn))
+}
+
+// SetSnapshotCallback sets a function which is called at most every ConnSnapshotInterval per
+// connection with a snapshot of that connection. Only applies to connections created afterwards.
+func (m *ConnMap) SetSnapshotCallback(fn ConnSnapshotFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onSnapshot = fn
+}
+
+// SetCloseCallback sets a function which is called in a new goroutine whenever a connection is
+// closed, but not when the ConnMap is torn down.
+func (m *ConnMap) SetCloseCallback(fn func(cid ConnID)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onClose = fn
+}
+
+// CancelOutstandingRequests makes outstanding requests on every connection return immediately.
+// Returns the number of connections.
+func (m *ConnMap) CancelOutstandingRequests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, conn := range m.connIDToConn {
+		conn.CancelOutstandingRequest()
+	}
+	return len(m.connIDToConn)
+}
+
+// SnapshotConns snapshots every connection, calling fn with each snapshot. Outstanding requests are
+// cancelled in order to take the snapshot.
+func (m *ConnMap) SnapshotConns(fn ConnSnapshotFunc) {
+	m.mu.Lock()
+	conns := make([]*Conn, 0, len(m.connIDToConn))
+	for _, conn := range m.connIDToConn {
+		conns = append(conns, conn)
+	}
+	m.mu.Unlock()
+	for _, conn := range conns {
+		pos, data, err := conn.Snapshot()
+		if err != nil {
+			logger.Warn().Err(err).Str("conn", conn.ConnID.String()).Msg("failed to snapshot connection")
+			continue
+		}
+		fn(conn.ConnID, pos, data)
+	}
+}
+
 func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
 	logger.Trace().Str("user", userID).Str("device", deviceID).Msg("closing connections due to CloseConn()")
 	// gather open connections for this user|device
@@ -244,6 +327,9 @@ func (m *ConnMap) closeConn(conn *Conn) {
 	// remove user cache listeners etc
 	h.Destroy()
 	m.updateMetrics(len(m.connIDToConn))
+	if m.onClose != nil {
+		go m.onClose(conn.ConnID)
+	}
 }
 
 func (m *ConnMap) ClearUpdateQueues(userID, roomID string, nid int64) {
@@ -72,6 +72,26 @@ func TestConnMap_CloseConnsForDevice(t *testing.T) {
 	})
 }
 
+func TestConnMap_CloseCallback(t *testing.T) {
+	cm := NewConnMap(false, time.Minute)
+	closed := make(chan ConnID, 2)
+	cm.SetCloseCallback(func(cid ConnID) {
+		closed <- cid
+	})
+	cid := ConnID{UserID: alice, DeviceID: "A", CID: "room-list"}
+	_, cancel := context.WithCancel(context.Background())
+	cm.CreateConn(cid, cancel, func() ConnHandler {
+		return &mockConnHandler{}
+	})
+	cm.CloseConnsForDevice(alice, "A")
+	select {
+	case got := <-closed:
+		mustEqual(t, got, cid, "closed conn mismatch")
+	case <-time.After(time.Second):
+		t.Fatalf("close callback was not called")
+	}
+}
+
 func TestConnMap_CloseConnsForUser(t *testing.T) {
 	cm := NewConnMap(false, time.Minute)
 	otherCID := ConnID{UserID: bob, DeviceID: "A", CID: "room-list"}
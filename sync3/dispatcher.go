@@ -3,8 +3,10 @@ package sync3
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
@@ -28,21 +30,70 @@ type Receiver interface {
 	OnRegistered(ctx context.Context) error
 }
 
+// MembershipLoader loads the joined and invited users in each room after the given event position.
+type MembershipLoader func(ctx context.Context, roomIDs []string, pos int64) (joined, invited map[string][]string, err error)
+
 // Dispatches live events to caches
 type Dispatcher struct {
 	jrt              *JoinedRoomsTracker
 	userToReceiver   map[string]Receiver
 	userToReceiverMu *sync.RWMutex
+
+	// set if the dispatcher was started with StartupLazy. Only warm rooms are tracked in jrt, cold
+	// rooms are loaded with loadMemberships the first time they are needed.
+	loadMemberships MembershipLoader
+	warmRooms       map[string]struct{}
+	warmRoomsMu     *sync.Mutex
+
+	// transaction IDs of events sent through the proxy, see RememberTransactionID
+	sentTxnIDs   map[string]sentTxnID
+	sentTxnIDsMu *sync.Mutex
 }
 
+type sentTxnID struct {
+	txnID  string
+	sentAt time.Time
+}
+
+// how long to remember transaction IDs for, which should be more than enough time for a poller to
+// see the event.
+const sentTxnIDTTL = 5 * time.Minute
+
 func NewDispatcher() *Dispatcher {
 	return &Dispatcher{
 		jrt:              NewJoinedRoomsTracker(),
 		userToReceiver:   make(map[string]Receiver),
 		userToReceiverMu: &sync.RWMutex{},
+		warmRoomsMu:      &sync.Mutex{},
+		sentTxnIDs:       make(map[string]sentTxnID),
+		sentTxnIDsMu:     &sync.Mutex{},
+	}
+}
+
+// RememberTransactionID notes the transaction ID of an event sent through the proxy, which must
+// already be stored in the transactions table. When the event arrives, its EventData has this
+// transaction ID so the event is not held back waiting for one.
+func (d *Dispatcher) RememberTransactionID(eventID, txnID string) {
+	d.sentTxnIDsMu.Lock()
+	defer d.sentTxnIDsMu.Unlock()
+	now := time.Now()
+	for id, sent := range d.sentTxnIDs {
+		if now.Sub(sent.sentAt) > sentTxnIDTTL {
+			delete(d.sentTxnIDs, id)
+		}
+	}
+	d.sentTxnIDs[eventID] = sentTxnID{
+		txnID:  txnID,
+		sentAt: now,
 	}
 }
 
+func (d *Dispatcher) sentTransactionID(eventID string) string {
+	d.sentTxnIDsMu.Lock()
+	defer d.sentTxnIDsMu.Unlock()
+	return d.sentTxnIDs[eventID].txnID
+}
+
 func (d *Dispatcher) IsUserJoined(userID, roomID string) bool {
 	return d.jrt.IsUserJoined(userID, roomID)
 }
@@ -55,6 +106,65 @@ func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
 	return nil
 }
 
+// StartupLazy is an alternative to Startup which does not load any joined members. Instead, the
+// members of a room are loaded the first time an event is sent in the room, or when WarmRooms is
+// called for the room.
+// MUST BE CALLED BEFORE V2 POLL LOOPS START.
+func (d *Dispatcher) StartupLazy(loadMemberships MembershipLoader) {
+	d.loadMemberships = loadMemberships
+	d.warmRooms = make(map[string]struct{})
+}
+
+// WarmRooms loads the members of the given rooms at this position, if they are not loaded already.
+// Does nothing if the dispatcher was not started lazily. Must be called before registering a
+// receiver for a user joined to these rooms.
+func (d *Dispatcher) WarmRooms(ctx context.Context, roomIDs []string, pos int64) error {
+	if d.loadMemberships == nil {
+		return nil
+	}
+	d.warmRoomsMu.Lock()
+	defer d.warmRoomsMu.Unlock()
+	var coldRoomIDs []string
+	for _, roomID := range roomIDs {
+		if _, warm := d.warmRooms[roomID]; !warm {
+			coldRoomIDs = append(coldRoomIDs, roomID)
+		}
+	}
+	if len(coldRoomIDs) == 0 {
+		return nil
+	}
+	joined, invited, err := d.loadMemberships(ctx, coldRoomIDs, pos)
+	if err != nil {
+		return fmt.Errorf("failed to load memberships for %d rooms: %w", len(coldRoomIDs), err)
+	}
+	for _, roomID := range coldRoomIDs {
+		d.jrt.ReloadMembershipsForRoom(roomID, joined[roomID], invited[roomID])
+		d.warmRooms[roomID] = struct{}{}
+	}
+	return nil
+}
+
+// NumWarmRooms returns the number of rooms whose members have been loaded, or -1 if the dispatcher
+// was not started lazily, in which case all rooms are loaded.
+func (d *Dispatcher) NumWarmRooms() int {
+	if d.loadMemberships == nil {
+		return -1
+	}
+	d.warmRoomsMu.Lock()
+	defer d.warmRoomsMu.Unlock()
+	return len(d.warmRooms)
+}
+
+// markWarm marks a room as warm without loading its members, because it is new to the proxy.
+func (d *Dispatcher) markWarm(roomID string) {
+	if d.loadMemberships == nil {
+		return
+	}
+	d.warmRoomsMu.Lock()
+	defer d.warmRoomsMu.Unlock()
+	d.warmRooms[roomID] = struct{}{}
+}
+
 func (d *Dispatcher) Unregister(userID string) {
 	d.userToReceiverMu.Lock()
 	defer d.userToReceiverMu.Unlock()
@@ -95,6 +205,18 @@ func (d *Dispatcher) ReceiverForUser(userID string) Receiver {
 	return d.userToReceiver[userID]
 }
 
+// HasReceiversInRoom returns true if any user joined to this room has a registered receiver, e.g. a
+// UserCache for a user with an active connection.
+func (d *Dispatcher) HasReceiversInRoom(roomID string) bool {
+	userIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		if userID == DispatcherAllUsers {
+			return false
+		}
+		return d.ReceiverForUser(userID) != nil
+	})
+	return len(userIDs) > 0
+}
+
 func (d *Dispatcher) newEventData(event json.RawMessage, roomID string, latestPos int64) *caches.EventData {
 	// parse the event to pull out fields we care about
 	var stateKey *string
@@ -103,6 +225,10 @@ func (d *Dispatcher) newEventData(event json.RawMessage, roomID string, latestPo
 		stateKey = &sk.Str
 	}
 	eventType := ev.Get("type").Str
+	txnID := ev.Get("unsigned.transaction_id").Str
+	if txnID == "" {
+		txnID = d.sentTransactionID(ev.Get("event_id").Str)
+	}
 
 	return &caches.EventData{
 		Event:         event,
@@ -113,13 +239,15 @@ func (d *Dispatcher) newEventData(event json.RawMessage, roomID string, latestPo
 		NID:           latestPos,
 		Timestamp:     ev.Get("origin_server_ts").Uint(),
 		Sender:        ev.Get("sender").Str,
-		TransactionID: ev.Get("unsigned.transaction_id").Str,
+		TransactionID: txnID,
 	}
 }
 
 // Called by v2 pollers when we receive an initial state block. Very similar to OnNewEvents but
 // done in bulk for speed.
 func (d *Dispatcher) OnNewInitialRoomState(ctx context.Context, roomID string, state []json.RawMessage) {
+	// this room is new to the proxy, so there are no members to load
+	d.markWarm(roomID)
 	// sanity check
 	if _, jc := d.jrt.JoinedUsersForRoom(roomID, nil); jc > 0 {
 		logger.Warn().Int("join_count", jc).Str("room", roomID).Int("num_state", len(state)).Msg(
@@ -172,6 +300,14 @@ func (d *Dispatcher) OnNewEvent(
 ) {
 	ed := d.newEventData(event, roomID, nid)
 
+	if nid > 0 {
+		// load the members of the room before this event, so we can apply it below
+		if err := d.WarmRooms(ctx, []string{roomID}, nid-1); err != nil {
+			logger.Err(err).Str("room", roomID).Int64("nid", nid).Msg("Dispatcher: failed to load room members")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+	}
+
 	// update the tracker
 	targetUser := ""
 	membership := ""
@@ -296,4 +432,5 @@ func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData,
 func (d *Dispatcher) OnInvalidateRoom(roomID string, joins, invites []string) {
 	// Reset the joined room tracker.
 	d.jrt.ReloadMembershipsForRoom(roomID, joins, invites)
+	d.markWarm(roomID)
 }
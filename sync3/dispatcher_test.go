@@ -0,0 +1,26 @@
+package sync3
+
+import (
+	"testing"
+)
+
+func TestDispatcherRememberTransactionID(t *testing.T) {
+	d := NewDispatcher()
+	roomID := "!foo:bar"
+	ev := []byte(`{"event_id":"$a","type":"m.room.message","sender":"@alice:bar","content":{"body":"hi"}}`)
+	ed := d.newEventData(ev, roomID, 1)
+	if ed.TransactionID != "" {
+		t.Fatalf("got transaction ID %q before it was remembered", ed.TransactionID)
+	}
+	d.RememberTransactionID("$a", "txn1")
+	ed = d.newEventData(ev, roomID, 2)
+	if ed.TransactionID != "txn1" {
+		t.Fatalf("got transaction ID %q want txn1", ed.TransactionID)
+	}
+	// a transaction ID in the event itself takes precedence
+	ev = []byte(`{"event_id":"$a","type":"m.room.message","sender":"@alice:bar","content":{"body":"hi"},"unsigned":{"transaction_id":"txn2"}}`)
+	ed = d.newEventData(ev, roomID, 3)
+	if ed.TransactionID != "txn2" {
+		t.Fatalf("got transaction ID %q want txn2", ed.TransactionID)
+	}
+}
@@ -0,0 +1,89 @@
+package sync3
+
+import "sort"
+
+// ListExplanation describes why each room is, or is not, in a list, for the admin API.
+type ListExplanation struct {
+	ListKey string            `json:"list_key"`
+	Sort    []string          `json:"sort"`
+	Count   int64             `json:"count"`
+	Rooms   []RoomExplanation `json:"rooms"`
+}
+
+// RoomExplanation describes the sort keys of a room and the filter clauses which included or
+// excluded it from a list.
+type RoomExplanation struct {
+	RoomID   string `json:"room_id"`
+	Included bool   `json:"included"`
+	// The position of the room in the list, or -1 if it is not in the list.
+	Index   int            `json:"index"`
+	Clauses []FilterClause `json:"clauses"`
+
+	// sort keys
+	Name                         string `json:"name"`
+	LastInterestedEventTimestamp uint64 `json:"last_interested_event_timestamp"`
+	NotificationLevel            string `json:"notification_level"`
+	HighlightCount               int    `json:"highlight_count"`
+	NotificationCount            int    `json:"notification_count"`
+	Encrypted                    bool   `json:"encrypted"`
+}
+
+// Explain describes every room known to this connection against the list with this key. Rooms in
+// the list come first in list order, followed by excluded rooms sorted by room ID. Returns false if there is no list
+// with this key.
+func (s *InternalRequestLists) Explain(listKey string) (ListExplanation, bool) {
+	list, ok := s.lists[listKey]
+	if !ok {
+		return ListExplanation{}, false
+	}
+	ex := ListExplanation{
+		ListKey: listKey,
+		Count:   list.Len(),
+		Rooms:   make([]RoomExplanation, 0, len(s.allRooms)),
+	}
+	for _, roomID := range list.RoomIDs() {
+		ex.Rooms = append(ex.Rooms, s.explainRoom(list, roomID))
+	}
+	var excluded []string
+	for roomID := range s.allRooms {
+		if _, inList := list.IndexOf(roomID); !inList {
+			excluded = append(excluded, roomID)
+		}
+	}
+	sort.Strings(excluded)
+	for _, roomID := range excluded {
+		ex.Rooms = append(ex.Rooms, s.explainRoom(list, roomID))
+	}
+	return ex, true
+}
+
+func (s *InternalRequestLists) explainRoom(list *FilteredSortableRooms, roomID string) RoomExplanation {
+	r := s.allRooms[roomID]
+	index, inList := list.IndexOf(roomID)
+	if !inList {
+		index = -1
+	}
+	return RoomExplanation{
+		RoomID:                       roomID,
+		Included:                     inList,
+		Index:                        index,
+		Clauses:                      list.filter.Explain(r, s),
+		Name:                         r.CanonicalisedName,
+		LastInterestedEventTimestamp: r.GetLastInterestedEventTimestamp(list.listKey),
+		NotificationLevel:            notificationLevel(r),
+		HighlightCount:               r.HighlightCount,
+		NotificationCount:            r.NotificationCount,
+		Encrypted:                    r.Encrypted,
+	}
+}
+
+// notificationLevel returns the group the room is put in by the by_notification_level sort.
+func notificationLevel(r *RoomConnMetadata) string {
+	if r.HighlightCount > 0 {
+		return "highlight"
+	}
+	if r.NotificationCount > 0 {
+		return "notification"
+	}
+	return "none"
+}
@@ -12,12 +12,99 @@ import (
 // Client created request params
 type AccountDataRequest struct {
 	Core
+	// All fields are optional, with nil meaning "not specified".
+	Types     []string `json:"types"`      // only send account data of these types
+	NotTypes  []string `json:"not_types"`  // never send account data of these types
+	LazyRooms *bool    `json:"lazy_rooms"` // only send room account data when the room first enters the window
+
+	// which rooms have had their room account data sent on this connection, when lazy_rooms is set
+	sentRooms map[string]bool
 }
 
 func (r *AccountDataRequest) Name() string {
 	return "AccountDataRequest"
 }
 
+func (r *AccountDataRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*AccountDataRequest)
+	if next.Types != nil {
+		r.Types = next.Types
+	}
+	if next.NotTypes != nil {
+		r.NotTypes = next.NotTypes
+	}
+	if next.LazyRooms != nil {
+		r.LazyRooms = next.LazyRooms
+	}
+}
+
+func (r *AccountDataRequest) lazyRooms() bool {
+	return r.LazyRooms != nil && *r.LazyRooms
+}
+
+// includeType returns true if account data of this type should be sent to the client.
+func (r *AccountDataRequest) includeType(evType string) bool {
+	for _, t := range r.NotTypes {
+		if t == evType {
+			return false
+		}
+	}
+	if len(r.Types) == 0 {
+		return true
+	}
+	for _, t := range r.Types {
+		if t == evType {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AccountDataRequest) filter(events []state.AccountData) []state.AccountData {
+	if len(r.Types) == 0 && len(r.NotTypes) == 0 {
+		return events
+	}
+	filtered := make([]state.AccountData, 0, len(events))
+	for _, ev := range events {
+		if r.includeType(ev.Type) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
+// load account data for this room from the database, which is global account data if roomID is
+// state.AccountDataGlobalRoom.
+func (r *AccountDataRequest) load(extCtx Context, roomID string) ([]state.AccountData, error) {
+	var datas []state.AccountData
+	var err error
+	if len(r.Types) > 0 {
+		datas, err = extCtx.Store.AccountData(extCtx.UserID, roomID, r.Types)
+	} else if roomID == state.AccountDataGlobalRoom {
+		datas, err = extCtx.Store.AccountDatas(extCtx.UserID)
+	} else {
+		datas, err = extCtx.Store.AccountDatas(extCtx.UserID, roomID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(datas), nil
+}
+
+// markSent remembers that room account data has been sent for these rooms, if lazy_rooms is set.
+func (r *AccountDataRequest) markSent(roomIDs ...string) {
+	if !r.lazyRooms() {
+		return
+	}
+	if r.sentRooms == nil {
+		r.sentRooms = make(map[string]bool)
+	}
+	for _, roomID := range roomIDs {
+		r.sentRooms[roomID] = true
+	}
+}
+
 // Server response
 type AccountDataResponse struct {
 	Global []json.RawMessage            `json:"global,omitempty"`
@@ -46,10 +133,16 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 	roomToMsgs := map[string][]json.RawMessage{}
 	switch update := up.(type) {
 	case *caches.AccountDataUpdate:
-		globalMsgs = accountEventsAsJSON(update.AccountData)
+		globalMsgs = accountEventsAsJSON(r.filter(update.AccountData))
 	case *caches.RoomAccountDataUpdate:
-		if r.RoomInScope(update.RoomID(), extCtx) {
-			roomToMsgs[update.RoomID()] = accountEventsAsJSON(update.AccountData)
+		if !r.RoomInScope(update.RoomID(), extCtx) {
+			// the client won't see this change, so send everything again when the room next
+			// enters the window.
+			delete(r.sentRooms, update.RoomID())
+			return
+		}
+		if roomAccountData := r.filter(update.AccountData); len(roomAccountData) > 0 {
+			roomToMsgs[update.RoomID()] = accountEventsAsJSON(roomAccountData)
 		}
 	case caches.RoomUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
@@ -64,7 +157,11 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 				// for the same room, we could send dupe room account data if we didn't do this check.
 				return
 			}
-			roomAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, update.RoomID())
+			if r.sentRooms[update.RoomID()] {
+				// lazy_rooms is set and the client already has account data for this room
+				return
+			}
+			roomAccountData, err := r.load(extCtx, update.RoomID())
 			if err != nil {
 				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.RoomID()).Msg("failed to fetch room account data")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -72,6 +169,7 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 				if len(roomAccountData) > 0 { // else we can end up with `null` not `[]`
 					roomToMsgs[update.RoomID()] = accountEventsAsJSON(roomAccountData)
 				}
+				r.markSent(update.RoomID())
 			}
 		}
 	}
@@ -92,20 +190,22 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 }
 
 func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
-	roomIDs := make([]string, len(extCtx.RoomIDToTimeline))
-	i := 0
+	if extCtx.IsInitial {
+		// this is a new connection, so the client has no room account data yet
+		r.sentRooms = nil
+	}
+	roomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
 	for roomID := range extCtx.RoomIDToTimeline {
-		if r.RoomInScope(roomID, extCtx) {
-			roomIDs[i] = roomID
-			i++
+		if r.RoomInScope(roomID, extCtx) && !r.sentRooms[roomID] {
+			roomIDs = append(roomIDs, roomID)
 		}
 	}
 	extRes := &AccountDataResponse{
 		Rooms:       make(map[string][]json.RawMessage),
 		loadedRooms: make(map[string]bool),
 	}
-	// room account data needs to be sent every time the user scrolls the list to get new room IDs
-	// TODO: remember which rooms the client has been told about
+	// room account data needs to be sent every time the user scrolls the list to get new room IDs,
+	// unless lazy_rooms is set in which case it is only sent the first time.
 	if len(roomIDs) > 0 {
 		roomsAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID, roomIDs...)
 		if err != nil {
@@ -113,15 +213,16 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
 			extRes.Rooms = make(map[string][]json.RawMessage)
-			for _, ad := range roomsAccountData {
+			for _, ad := range r.filter(roomsAccountData) {
 				extRes.Rooms[ad.RoomID] = append(extRes.Rooms[ad.RoomID], ad.Data)
 				extRes.loadedRooms[ad.RoomID] = true
 			}
+			r.markSent(roomIDs...)
 		}
 	}
 	// global account data is only sent on the first connection, then we live stream
 	if extCtx.IsInitial {
-		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID)
+		globalAccountData, err := r.load(extCtx, state.AccountDataGlobalRoom)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch global account data")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
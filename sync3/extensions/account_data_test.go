@@ -112,3 +112,111 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
 	}
 }
+
+func TestLiveAccountDataTypeFilters(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+		NotTypes: []string{"m.push_rules"},
+	}
+	// types is sticky, not_types is left unchanged
+	ext.ApplyDelta(&AccountDataRequest{
+		Types: []string{"m.direct", "m.push_rules", "m.fully_read"},
+	})
+	var res Response
+	var extCtx = Context{
+		AllSubscribedRooms: []string{roomA},
+	}
+	global := &caches.AccountDataUpdate{
+		AccountData: []state.AccountData{
+			{Type: "m.direct", Data: []byte(`{"type":"m.direct"}`)},
+			{Type: "m.push_rules", Data: []byte(`{"type":"m.push_rules"}`)},
+			{Type: "im.vector.setting", Data: []byte(`{"type":"im.vector.setting"}`)},
+		},
+	}
+	room := &caches.RoomAccountDataUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomA,
+		},
+		AccountData: []state.AccountData{
+			{Type: "m.fully_read", Data: []byte(`{"type":"m.fully_read"}`)},
+			{Type: "m.tag", Data: []byte(`{"type":"m.tag"}`)},
+		},
+	}
+	ext.AppendLive(ctx, &res, extCtx, global)
+	ext.AppendLive(ctx, &res, extCtx, room)
+	if res.AccountData == nil {
+		t.Fatalf("Didn't get account data: %v", res)
+	}
+	wantGlobalAccountData := []json.RawMessage{global.AccountData[0].Data}
+	if !reflect.DeepEqual(res.AccountData.Global, wantGlobalAccountData) {
+		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
+	}
+	wantRoomAccountData := map[string][]json.RawMessage{
+		roomA: {room.AccountData[0].Data},
+	}
+	if !reflect.DeepEqual(res.AccountData.Rooms, wantRoomAccountData) {
+		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Rooms, wantRoomAccountData)
+	}
+
+	// an update with only filtered out account data produces no response
+	res = Response{}
+	ext.AppendLive(ctx, &res, extCtx, &caches.AccountDataUpdate{
+		AccountData: []state.AccountData{
+			{Type: "m.push_rules", Data: []byte(`{"type":"m.push_rules"}`)},
+		},
+	})
+	if res.AccountData != nil {
+		t.Fatalf("got account data for a filtered out type: %+v", res.AccountData)
+	}
+}
+
+func TestLiveAccountDataLazyRooms(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+		LazyRooms: &boolTrue,
+	}
+	ext.markSent(roomA)
+	var res Response
+	var extCtx = Context{
+		AllSubscribedRooms: []string{roomA},
+		RoomIDToTimeline: map[string][]string{
+			roomA: {"$event"},
+		},
+	}
+	// the room is already known to the client, so room updates do not send room account data again
+	// (or hit the database)
+	ext.AppendLive(ctx, &res, extCtx, &dummyRoomUpdate{roomID: roomA})
+	if res.AccountData != nil {
+		t.Fatalf("got room account data for a room which was already sent: %+v", res.AccountData)
+	}
+	// changes to room account data are still sent
+	ext.AppendLive(ctx, &res, extCtx, &caches.RoomAccountDataUpdate{
+		RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+		AccountData: []state.AccountData{
+			{Type: "m.tag", Data: []byte(`{"type":"m.tag"}`)},
+		},
+	})
+	if res.AccountData == nil || len(res.AccountData.Rooms[roomA]) != 1 {
+		t.Fatalf("did not get room account data change: %+v", res.AccountData)
+	}
+	// changes the client doesn't see mean the room is sent in full when it next enters the window
+	ext.AppendLive(ctx, &res, Context{}, &caches.RoomAccountDataUpdate{
+		RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+		AccountData: []state.AccountData{
+			{Type: "m.tag", Data: []byte(`{"type":"m.tag"}`)},
+		},
+	})
+	if ext.sentRooms[roomA] {
+		t.Fatalf("room is still marked as sent after a change the client did not see")
+	}
+}
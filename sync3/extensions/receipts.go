@@ -12,23 +12,78 @@ import (
 // Client created request params
 type ReceiptsRequest struct {
 	Core
+	// All fields are optional, with nil meaning "not specified".
+	OnlyOwn       *bool `json:"only_own"`        // only send the syncing user's own receipts
+	GroupByThread *bool `json:"group_by_thread"` // send threaded receipts under `threads` rather than `rooms`
 }
 
 func (r *ReceiptsRequest) Name() string {
 	return "ReceiptsRequest"
 }
 
+func (r *ReceiptsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*ReceiptsRequest)
+	if next.OnlyOwn != nil {
+		r.OnlyOwn = next.OnlyOwn
+	}
+	if next.GroupByThread != nil {
+		r.GroupByThread = next.GroupByThread
+	}
+}
+
+func (r *ReceiptsRequest) onlyOwn() bool {
+	return r.OnlyOwn != nil && *r.OnlyOwn
+}
+
+// threadOf returns the thread this receipt is grouped under in the response, which is "" for
+// receipts sent in `rooms`.
+func (r *ReceiptsRequest) threadOf(receipt internal.Receipt) string {
+	if r.GroupByThread != nil && *r.GroupByThread {
+		return receipt.ThreadID
+	}
+	return ""
+}
+
 // Server response
 type ReceiptsResponse struct {
 	// room_id -> m.receipt ephemeral event
 	Rooms map[string]json.RawMessage `json:"rooms,omitempty"`
+	// room_id -> thread_id -> m.receipt ephemeral event, only if group_by_thread is set. Receipts
+	// which are not in a thread are in Rooms.
+	Threads map[string]map[string]json.RawMessage `json:"threads,omitempty"`
 }
 
 func (r *ReceiptsResponse) HasData(isInitial bool) bool {
 	if isInitial {
 		return true
 	}
-	return len(r.Rooms) > 0
+	return len(r.Rooms) > 0 || len(r.Threads) > 0
+}
+
+// edu returns the m.receipt EDU for this room and thread, or nil if there isn't one.
+func (r *ReceiptsResponse) edu(roomID, threadID string) json.RawMessage {
+	if threadID == "" {
+		return r.Rooms[roomID]
+	}
+	return r.Threads[roomID][threadID]
+}
+
+func (r *ReceiptsResponse) setEDU(roomID, threadID string, edu json.RawMessage) {
+	if threadID == "" {
+		if r.Rooms == nil {
+			r.Rooms = make(map[string]json.RawMessage)
+		}
+		r.Rooms[roomID] = edu
+		return
+	}
+	if r.Threads == nil {
+		r.Threads = make(map[string]map[string]json.RawMessage)
+	}
+	if r.Threads[roomID] == nil {
+		r.Threads[roomID] = make(map[string]json.RawMessage)
+	}
+	r.Threads[roomID][threadID] = edu
 }
 
 func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
@@ -37,61 +92,50 @@ func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx
 		if !r.RoomInScope(update.RoomID(), extCtx) {
 			break
 		}
+		if r.onlyOwn() && update.Receipt.UserID != extCtx.UserID {
+			break
+		}
 
 		// a live receipt event happened, send this back
 		if res.Receipts == nil {
-			edu, err := state.PackReceiptsIntoEDU([]internal.Receipt{update.Receipt})
-			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into new edu")
-				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-				return
-			}
-			res.Receipts = &ReceiptsResponse{
-				Rooms: map[string]json.RawMessage{
-					update.RoomID(): edu,
-				},
-			}
-		} else if res.Receipts.Rooms[update.RoomID()] == nil {
-			// we have receipts already, but not for this room
-			edu, err := state.PackReceiptsIntoEDU([]internal.Receipt{update.Receipt})
-			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
-				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-				return
-			}
-			res.Receipts.Rooms[update.RoomID()] = edu
-		} else {
+			res.Receipts = &ReceiptsResponse{}
+		}
+		threadID := r.threadOf(update.Receipt)
+		receipts := []internal.Receipt{update.Receipt}
+		if existing := res.Receipts.edu(update.RoomID(), threadID); existing != nil {
 			// we have receipts already for this room.
 			// aggregate receipts: we need to unpack then repack annoyingly.
-			pub, priv, err := state.UnpackReceiptsFromEDU(update.RoomID(), res.Receipts.Rooms[update.RoomID()])
+			pub, priv, err := state.UnpackReceiptsFromEDU(update.RoomID(), existing)
 			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
+				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to unpack receipts from edu")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 				return
 			}
-			receipts := append(pub, priv...)
 			// add the live one
-			receipts = append(receipts, update.Receipt)
-			edu, err := state.PackReceiptsIntoEDU(receipts)
-			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
-				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-				return
-			}
-			res.Receipts.Rooms[update.RoomID()] = edu
+			receipts = append(append(pub, priv...), update.Receipt)
+		}
+		edu, err := state.PackReceiptsIntoEDU(receipts)
+		if err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
 		}
+		res.Receipts.setEDU(update.RoomID(), threadID, edu)
 	}
 }
 
 func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
 	// grab receipts for all timelines for all the rooms we're going to return
-	rooms := make(map[string]json.RawMessage)
 	interestedRoomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
 	otherReceipts := make(map[string][]internal.Receipt)
 	for roomID, timeline := range extCtx.RoomIDToTimeline {
 		if !r.RoomInScope(roomID, extCtx) {
 			continue
 		}
+		interestedRoomIDs = append(interestedRoomIDs, roomID)
+		if r.onlyOwn() {
+			continue
+		}
 		receipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForEvents(roomID, timeline)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to SelectReceiptsForEvents")
@@ -99,7 +143,6 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 			continue
 		}
 		otherReceipts[roomID] = receipts
-		interestedRoomIDs = append(interestedRoomIDs, roomID)
 	}
 	// single shot query to pull out our own receipts for these rooms to always include our own receipts
 	ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUser(interestedRoomIDs, extCtx.UserID)
@@ -114,16 +157,20 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		otherReceipts[roomID] = append(otherReceipts[roomID], ownRecs...)
 	}
 
+	extRes := &ReceiptsResponse{}
 	for roomID, receipts := range otherReceipts {
-		if len(receipts) == 0 {
-			continue
+		byThread := make(map[string][]internal.Receipt)
+		for _, receipt := range receipts {
+			threadID := r.threadOf(receipt)
+			byThread[threadID] = append(byThread[threadID], receipt)
+		}
+		for threadID, threadReceipts := range byThread {
+			edu, _ := state.PackReceiptsIntoEDU(threadReceipts)
+			extRes.setEDU(roomID, threadID, edu)
 		}
-		rooms[roomID], _ = state.PackReceiptsIntoEDU(receipts)
 	}
 
-	if len(rooms) > 0 {
-		res.Receipts = &ReceiptsResponse{
-			Rooms: rooms,
-		}
+	if len(extRes.Rooms) > 0 || len(extRes.Threads) > 0 {
+		res.Receipts = extRes
 	}
 }
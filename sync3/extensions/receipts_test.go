@@ -78,3 +78,72 @@ func TestLiveReceiptsAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, want)
 	}
 }
+
+func TestLiveReceiptsOnlyOwnAndGroupByThread(t *testing.T) {
+	boolTrue := true
+	ext := &ReceiptsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"*"},
+			Rooms:   []string{"*"},
+		},
+	}
+	ext.ApplyDelta(&ReceiptsRequest{
+		OnlyOwn:       &boolTrue,
+		GroupByThread: &boolTrue,
+	})
+	var res Response
+	extCtx := Context{
+		UserID:             "@me:here",
+		AllSubscribedRooms: []string{roomA},
+	}
+	newUpdate := func(userID, eventID, threadID string) *caches.ReceiptUpdate {
+		return &caches.ReceiptUpdate{
+			Receipt: internal.Receipt{
+				RoomID:   roomA,
+				EventID:  eventID,
+				UserID:   userID,
+				TS:       12345,
+				ThreadID: threadID,
+			},
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomA,
+			},
+		}
+	}
+	unthreaded := newUpdate("@me:here", "$aaa", "")
+	thread1 := newUpdate("@me:here", "$bbb", "$thread1")
+	thread1Again := newUpdate("@me:here", "$ccc", "$thread1")
+	main := newUpdate("@me:here", "$ddd", "main")
+	ext.AppendLive(ctx, &res, extCtx, newUpdate("@someone:here", "$aaa", ""))
+	if res.Receipts != nil {
+		t.Fatalf("got receipts from another user with only_own set: %+v", res.Receipts)
+	}
+	for _, up := range []*caches.ReceiptUpdate{unthreaded, thread1, main, thread1Again, newUpdate("@someone:here", "$eee", "$thread1")} {
+		ext.AppendLive(ctx, &res, extCtx, up)
+	}
+	if res.Receipts == nil {
+		t.Fatalf("receipts response is empty")
+	}
+	eduRoom, err := state.PackReceiptsIntoEDU([]internal.Receipt{unthreaded.Receipt})
+	assertNoError(t, err)
+	eduThread1, err := state.PackReceiptsIntoEDU([]internal.Receipt{thread1.Receipt, thread1Again.Receipt})
+	assertNoError(t, err)
+	eduMain, err := state.PackReceiptsIntoEDU([]internal.Receipt{main.Receipt})
+	assertNoError(t, err)
+	wantRooms := map[string]json.RawMessage{
+		roomA: eduRoom,
+	}
+	if !reflect.DeepEqual(res.Receipts.Rooms, wantRooms) {
+		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, wantRooms)
+	}
+	wantThreads := map[string]map[string]json.RawMessage{
+		roomA: {
+			"$thread1": eduThread1,
+			"main":     eduMain,
+		},
+	}
+	if !reflect.DeepEqual(res.Receipts.Threads, wantThreads) {
+		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Threads, wantThreads)
+	}
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// ConnsForUser describes every connection for this user, for the admin API.
+func (h *SyncLiveHandler) ConnsForUser(userID string) []sync3.ConnInfo {
+	conns := h.ConnMap.ConnsForUser(userID)
+	infos := make([]sync3.ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		infos = append(infos, conn.Info())
+	}
+	return infos
+}
+
+// ExplainList describes why rooms are, or are not, in a list on this connection, for the admin API.
+// Returns false if there is no such connection or list.
+func (h *SyncLiveHandler) ExplainList(connID sync3.ConnID, listKey string) (sync3.ListExplanation, bool) {
+	conn := h.ConnMap.Conn(connID)
+	if conn == nil {
+		return sync3.ListExplanation{}, false
+	}
+	return conn.ExplainList(listKey)
+}
+
+// CloseConns closes every connection for this device. Returns the number of connections closed.
+// Clients will see M_UNKNOWN_POS on their next request.
+func (h *SyncLiveHandler) CloseConns(userID, deviceID string) int {
+	closed := len(h.ConnMap.Conns(userID, deviceID))
+	h.ConnMap.CloseConnsForDevice(userID, deviceID)
+	if h.destroyedConns != nil {
+		h.destroyedConns.Add(float64(closed))
+	}
+	return closed
+}
+
+// HasUserCache returns true if this user has a user cache.
+func (h *SyncLiveHandler) HasUserCache(userID string) bool {
+	_, ok := h.userCaches.Load(userID)
+	return ok
+}
+
+// EvictUserCache removes this user's cache, so it is reloaded from the database when it is next
+// needed. The user's connections are closed as they refer to the old cache. Returns false if the
+// user had no cache.
+func (h *SyncLiveHandler) EvictUserCache(userID string) (evicted bool, closedConns int) {
+	unregistered := h.Dispatcher.UnregisterBulk([]string{userID})
+	for _, userID := range unregistered {
+		h.userCaches.Delete(userID)
+	}
+	closedConns = h.ConnMap.CloseConnsForUsers(unregistered)
+	if h.destroyedConns != nil {
+		h.destroyedConns.Add(float64(closedConns))
+	}
+	logger.Info().Str("user", userID).Int("conns_destroyed", closedConns).Msg("EvictUserCache")
+	return len(unregistered) > 0, closedConns
+}
@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sort"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// SetResponseBudget sets the default budget for responses. Clients can ask for a smaller budget
+// with `response_budget` in the request.
+func (h *SyncLiveHandler) SetResponseBudget(budget sync3.ResponseBudget) {
+	h.responseBudget = budget
+}
+
+// responseBudget returns the budget for the next response.
+func (s *ConnState) responseBudget() sync3.ResponseBudget {
+	budget := s.serverBudget
+	if s.muxedReq != nil && s.muxedReq.ResponseBudget != nil {
+		budget = budget.Min(*s.muxedReq.ResponseBudget)
+	}
+	return budget
+}
+
+// addDeferredRooms adds rooms which were over the budget of previous responses to the builder,
+// if the client can still see them.
+func (s *ConnState) addDeferredRooms(ctx context.Context, builder *RoomsBuilder) {
+	if len(s.deferredRooms) == 0 {
+		return
+	}
+	visible := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	for _, bs := range s.deferredRooms {
+		roomIDs := make([]string, 0, len(bs.RoomIDs))
+		for _, roomID := range bs.RoomIDs {
+			_, inList := visible[roomID]
+			_, subscribed := s.roomSubscriptions[roomID]
+			if inList || subscribed {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+		if len(roomIDs) == 0 {
+			continue
+		}
+		subID := builder.AddSubscription(bs.RoomSubscription)
+		builder.AddRoomsToSubscription(ctx, subID, roomIDs)
+	}
+	s.deferredRooms = nil
+}
+
+// deferRoomsOverBudget removes rooms from builtSubs which exceed the room budget, remembering them
+// so they are sent in the next response.
+func (s *ConnState) deferRoomsOverBudget(ctx context.Context, builtSubs []BuiltSubscription, maxRooms int) []BuiltSubscription {
+	if maxRooms <= 0 {
+		return builtSubs
+	}
+	roomIDs, subIndexes := s.roomsByPriority(builtSubs)
+	if len(roomIDs) <= maxRooms {
+		return builtSubs
+	}
+	within := emptySubscriptions(builtSubs)
+	over := emptySubscriptions(builtSubs)
+	for i, roomID := range roomIDs {
+		if i < maxRooms {
+			within[subIndexes[roomID]].RoomIDs = append(within[subIndexes[roomID]].RoomIDs, roomID)
+		} else {
+			over[subIndexes[roomID]].RoomIDs = append(over[subIndexes[roomID]].RoomIDs, roomID)
+		}
+	}
+	s.deferRooms(over)
+	internal.Logf(ctx, "connstate", "response budget: deferred %d of %d rooms", len(roomIDs)-maxRooms, len(roomIDs))
+	return nonEmptySubscriptions(within)
+}
+
+// deferRoomsOverByteBudget removes rooms from the response which exceed the byte budget, remembering
+// them so they are sent in the next response. At least one room is always sent.
+func (s *ConnState) deferRoomsOverByteBudget(ctx context.Context, rooms map[string]sync3.Room, builtSubs []BuiltSubscription, maxBytes int) {
+	if maxBytes <= 0 {
+		return
+	}
+	roomIDs, subIndexes := s.roomsByPriority(builtSubs)
+	over := emptySubscriptions(builtSubs)
+	total := 0
+	numSent := 0
+	numDeferred := 0
+	for _, roomID := range roomIDs {
+		room, ok := rooms[roomID]
+		if !ok {
+			continue
+		}
+		if numDeferred == 0 {
+			total += estimateRoomBytes(&room)
+			if total <= maxBytes || numSent == 0 {
+				numSent++
+				continue
+			}
+		}
+		// once one room is deferred, the rest are too so rooms are sent in priority order
+		delete(rooms, roomID)
+		over[subIndexes[roomID]].RoomIDs = append(over[subIndexes[roomID]].RoomIDs, roomID)
+		numDeferred++
+	}
+	if numDeferred > 0 {
+		s.deferRooms(over)
+		internal.Logf(ctx, "connstate", "response budget: deferred %d of %d rooms over %d bytes", numDeferred, len(roomIDs), maxBytes)
+	}
+}
+
+// roomOverheadBytes approximates the JSON of the keys of a room and the fields which are not strings
+// or events, e.g the counts and timestamp.
+const roomOverheadBytes = 256
+
+// estimateRoomBytes approximates the size of the room's JSON without marshalling it, as it is
+// marshalled again when the response is written. Most of the size is the events, which are JSON
+// already.
+func estimateRoomBytes(room *sync3.Room) int {
+	size := roomOverheadBytes + len(room.Name) + len(room.AvatarChange) + len(room.PrevBatch)
+	for _, hero := range room.Heroes {
+		size += len(hero.ID) + len(hero.Name) + len(hero.Avatar) + 50
+	}
+	for _, events := range [][]json.RawMessage{room.RequiredState, room.Timeline, room.InviteState, room.KnockState} {
+		for _, ev := range events {
+			size += len(ev) + 1
+		}
+	}
+	return size
+}
+
+func (s *ConnState) deferRooms(builtSubs []BuiltSubscription) {
+	s.deferredRooms = append(s.deferredRooms, nonEmptySubscriptions(builtSubs)...)
+}
+
+// undeferRooms forgets deferred rooms which have now been sent.
+func (s *ConnState) undeferRooms(rooms map[string]sync3.Room) {
+	if len(s.deferredRooms) == 0 || len(rooms) == 0 {
+		return
+	}
+	for i := range s.deferredRooms {
+		roomIDs := s.deferredRooms[i].RoomIDs[:0]
+		for _, roomID := range s.deferredRooms[i].RoomIDs {
+			if _, sent := rooms[roomID]; !sent {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+		s.deferredRooms[i].RoomIDs = roomIDs
+	}
+	s.deferredRooms = nonEmptySubscriptions(s.deferredRooms)
+}
+
+// removeDeferredRooms removes live updates for rooms which are still deferred from the response.
+// The updates are included when the room is sent, as it is loaded at the latest position.
+func (s *ConnState) removeDeferredRooms(response *sync3.Response) {
+	for _, bs := range s.deferredRooms {
+		for _, roomID := range bs.RoomIDs {
+			delete(response.Rooms, roomID)
+		}
+	}
+}
+
+// roomsByPriority returns the rooms in builtSubs with room subscriptions first, then rooms nearest
+// the top of a list. Also returns the index of the subscription for each room.
+func (s *ConnState) roomsByPriority(builtSubs []BuiltSubscription) (roomIDs []string, subIndexes map[string]int) {
+	subIndexes = make(map[string]int)
+	priorities := make(map[string]int)
+	for i, bs := range builtSubs {
+		for _, roomID := range bs.RoomIDs {
+			roomIDs = append(roomIDs, roomID)
+			subIndexes[roomID] = i
+			priorities[roomID] = s.roomPriority(roomID)
+		}
+	}
+	sort.Slice(roomIDs, func(i, j int) bool {
+		pi, pj := priorities[roomIDs[i]], priorities[roomIDs[j]]
+		if pi != pj {
+			return pi < pj
+		}
+		return roomIDs[i] < roomIDs[j]
+	})
+	return roomIDs, subIndexes
+}
+
+func (s *ConnState) roomPriority(roomID string) int {
+	if _, subscribed := s.roomSubscriptions[roomID]; subscribed {
+		return -1
+	}
+	priority := math.MaxInt
+	for listKey := range s.muxedReq.Lists {
+		list := s.lists.Get(listKey)
+		if list == nil {
+			continue
+		}
+		if index, ok := list.IndexOf(roomID); ok && index < priority {
+			priority = index
+		}
+	}
+	return priority
+}
+
+// emptySubscriptions returns the subscriptions in builtSubs without any rooms.
+func emptySubscriptions(builtSubs []BuiltSubscription) []BuiltSubscription {
+	result := make([]BuiltSubscription, len(builtSubs))
+	for i, bs := range builtSubs {
+		result[i].RoomSubscription = bs.RoomSubscription
+	}
+	return result
+}
+
+func nonEmptySubscriptions(builtSubs []BuiltSubscription) []BuiltSubscription {
+	result := builtSubs[:0]
+	for _, bs := range builtSubs {
+		if len(bs.RoomIDs) > 0 {
+			result = append(result, bs)
+		}
+	}
+	return result
+}
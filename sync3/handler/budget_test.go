@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func newBudgetConnState(t *testing.T, roomIDs ...string) *ConnState {
+	t.Helper()
+	s := &ConnState{
+		lists:             sync3.NewInternalRequestLists(),
+		roomSubscriptions: make(map[string]sync3.RoomSubscription),
+		muxedReq: &sync3.Request{
+			Lists: map[string]sync3.RequestList{
+				"a": {
+					Ranges: sync3.SliceRanges{{0, int64(len(roomIDs) - 1)}},
+					Sort:   []string{sync3.SortByRecency},
+				},
+			},
+		},
+	}
+	// rooms earlier in roomIDs are more recent so are sorted first
+	for i, roomID := range roomIDs {
+		s.lists.SetRoom(sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID: roomID,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{"a": uint64(1000 - i)},
+		})
+	}
+	list, _ := s.lists.AssignList(context.Background(), "a", nil, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if err := list.Sort([]string{sync3.SortByRecency}); err != nil {
+		t.Fatalf("Sort: %s", err)
+	}
+	return s
+}
+
+func deferredRoomIDs(s *ConnState) []string {
+	var roomIDs []string
+	for _, bs := range s.deferredRooms {
+		roomIDs = append(roomIDs, bs.RoomIDs...)
+	}
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
+func TestConnStateResponseBudgetRooms(t *testing.T) {
+	ctx := context.Background()
+	s := newBudgetConnState(t, "!a", "!b", "!c", "!d")
+	s.roomSubscriptions["!d"] = sync3.RoomSubscription{TimelineLimit: 5}
+	subA := sync3.RoomSubscription{TimelineLimit: 1}
+	subD := sync3.RoomSubscription{TimelineLimit: 5}
+	builtSubs := []BuiltSubscription{
+		{RoomSubscription: subA, RoomIDs: []string{"!c", "!b", "!a"}},
+		{RoomSubscription: subD, RoomIDs: []string{"!d"}},
+	}
+
+	// room subscriptions come first, then the top of the list
+	got := s.deferRoomsOverBudget(ctx, builtSubs, 2)
+	want := []BuiltSubscription{
+		{RoomSubscription: subA, RoomIDs: []string{"!a"}},
+		{RoomSubscription: subD, RoomIDs: []string{"!d"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("deferRoomsOverBudget: got %+v want %+v", got, want)
+	}
+	if got := deferredRoomIDs(s); !reflect.DeepEqual(got, []string{"!b", "!c"}) {
+		t.Fatalf("deferred rooms: got %v want [!b !c]", got)
+	}
+
+	// deferred rooms are added back with their subscription, unless they are no longer visible
+	s.muxedReq.Lists["a"] = sync3.RequestList{
+		Ranges: sync3.SliceRanges{{0, 1}},
+		Sort:   []string{sync3.SortByRecency},
+	}
+	builder := NewRoomsBuilder()
+	s.addDeferredRooms(ctx, builder)
+	if len(s.deferredRooms) != 0 {
+		t.Fatalf("deferred rooms were not taken: %+v", s.deferredRooms)
+	}
+	want = []BuiltSubscription{
+		{RoomSubscription: subA, RoomIDs: []string{"!b"}},
+	}
+	if got := builder.BuildSubscriptions(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("addDeferredRooms: got %+v want %+v", got, want)
+	}
+
+	// no budget means no rooms are deferred
+	if got := s.deferRoomsOverBudget(ctx, builtSubs, 0); !reflect.DeepEqual(got, builtSubs) {
+		t.Fatalf("deferRoomsOverBudget with no budget: got %+v want %+v", got, builtSubs)
+	}
+}
+
+func TestConnStateResponseBudgetBytes(t *testing.T) {
+	ctx := context.Background()
+	s := newBudgetConnState(t, "!a", "!b", "!c")
+	sub := sync3.RoomSubscription{TimelineLimit: 1}
+	builtSubs := []BuiltSubscription{
+		{RoomSubscription: sub, RoomIDs: []string{"!a", "!b", "!c"}},
+	}
+	newRooms := func() map[string]sync3.Room {
+		return map[string]sync3.Room{
+			"!a": {Name: "A", Initial: true},
+			"!b": {Name: "B", Initial: true},
+			"!c": {Name: "C", Initial: true},
+		}
+	}
+
+	// the first room is always sent, even if it is over budget
+	rooms := newRooms()
+	s.deferRoomsOverByteBudget(ctx, rooms, builtSubs, 1)
+	if got := internal.Keys(rooms); !reflect.DeepEqual(got, []string{"!a"}) {
+		t.Fatalf("rooms: got %v want [!a]", got)
+	}
+	if got := deferredRoomIDs(s); !reflect.DeepEqual(got, []string{"!b", "!c"}) {
+		t.Fatalf("deferred rooms: got %v want [!b !c]", got)
+	}
+
+	// live updates for deferred rooms are removed until the room is sent
+	response := &sync3.Response{Rooms: map[string]sync3.Room{"!a": {}, "!b": {NumLive: 1}}}
+	s.removeDeferredRooms(response)
+	if _, exists := response.Rooms["!b"]; exists {
+		t.Fatalf("live update for deferred room was not removed")
+	}
+	s.undeferRooms(map[string]sync3.Room{"!b": {}})
+	if got := deferredRoomIDs(s); !reflect.DeepEqual(got, []string{"!c"}) {
+		t.Fatalf("deferred rooms after sending !b: got %v want [!c]", got)
+	}
+
+	// a large enough budget sends everything
+	s.deferredRooms = nil
+	rooms = newRooms()
+	s.deferRoomsOverByteBudget(ctx, rooms, builtSubs, 1000)
+	if len(rooms) != 3 || len(s.deferredRooms) != 0 {
+		t.Fatalf("got %d rooms and %d deferred want 3 rooms and none deferred", len(rooms), len(s.deferredRooms))
+	}
+}
+
+func TestEstimateRoomBytes(t *testing.T) {
+	invitedCount := 3
+	room := sync3.Room{
+		Name:          "My room",
+		Heroes:        []internal.Hero{{ID: "@alice:localhost", Name: "Alice"}},
+		RequiredState: []json.RawMessage{json.RawMessage(`{"type":"m.room.create","state_key":"","content":{}}`)},
+		Timeline: []json.RawMessage{
+			json.RawMessage(`{"type":"m.room.message","content":{"body":"hello world"}}`),
+			json.RawMessage(`{"type":"m.room.message","content":{"body":"goodbye world"}}`),
+		},
+		NotificationCount: 12,
+		HighlightCount:    1,
+		JoinedCount:       5,
+		InvitedCount:      &invitedCount,
+		PrevBatch:         "prev_batch_token",
+		NumLive:           2,
+		Timestamp:         1700000000000,
+	}
+	roomJSON, err := json.Marshal(room)
+	if err != nil {
+		t.Fatalf("failed to marshal room: %s", err)
+	}
+	// the estimate should be in the right ballpark, erring on the side of too large
+	got := estimateRoomBytes(&room)
+	if got < len(roomJSON) || got > 2*len(roomJSON) {
+		t.Fatalf("estimateRoomBytes: got %d want roughly %d", got, len(roomJSON))
+	}
+}
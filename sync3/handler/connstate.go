@@ -3,14 +3,18 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 type JoinChecker interface {
@@ -42,6 +46,20 @@ type ConnState struct {
 	anchorLoadPosition int64
 	// roomID -> latest load pos
 	loadPositions map[string]int64
+	// true if this connection has missed live updates and needs to catch up from the caches on the
+	// next request, e.g. because it was restored from a snapshot.
+	needsCatchUp bool
+	// held whilst a request is being processed, except whilst waiting for live updates, so lists can
+	// be explained without waiting for the client's long poll. See ExplainList.
+	listsMu *sync.Mutex
+	// list key -> true if mentions have been calculated for the rooms in this list, see loadMentions.
+	mentionsLoaded map[string]bool
+	// true if rooms the user has left have been added to this connection, see loadLeftRooms.
+	leftRoomsLoaded bool
+	// the default response budget, and rooms which were left out of previous responses as they
+	// were over budget.
+	serverBudget  sync3.ResponseBudget
+	deferredRooms []BuiltSubscription
 
 	txnIDWaiter *TxnIDWaiter
 	live        *connStateLive
@@ -77,10 +95,12 @@ func NewConnState(
 		lazyCache:           NewLazyCache(),
 		setupHistogramVec:   setupHistVec,
 		processHistogramVec: histVec,
+		listsMu:             &sync.Mutex{},
 	}
 	cs.live = &connStateLive{
-		ConnState: cs,
-		updates:   make(chan caches.Update, maxPendingEventUpdates),
+		ConnState:  cs,
+		updates:    make(chan caches.Update, maxPendingEventUpdates),
+		overflowMu: &sync.Mutex{},
 	}
 	cs.txnIDWaiter = NewTxnIDWaiter(
 		userID,
@@ -107,6 +127,13 @@ func NewConnState(
 //   - load() bases its current state based on the latest position, which includes processing of these N events.
 //   - post load() we read N events, processing them a 2nd time.
 func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
+	// room names are calculated as rooms are set, so pick the language first. If a previous load
+	// failed, the language was fixed by the first request.
+	languages := req.PreferredLanguages()
+	if s.muxedReq != nil {
+		languages = s.muxedReq.Language
+	}
+	s.lists.SetRoomNameTranslations(internal.RoomNameTranslationsFor(languages))
 	initialLoadPosition, joinedRooms, joinTimings, loadPositions, err := s.globalCache.LoadJoinedRooms(ctx, s.userID)
 	if err != nil {
 		return err
@@ -123,35 +150,19 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 		internal.AssertWithContext(ctx, "LoadJoinedRooms returned room with timing info", ok)
 		urd.JoinTiming = timing
 
-		interestedEventTimestampsByList := make(map[string]uint64, len(req.Lists))
-		for listKey, listReq := range req.Lists {
-			interestingActivityTs := metadata.LastMessageTimestamp
-			if len(listReq.BumpEventTypes) > 0 {
-				// Use the global cache to find the timestamp of the latest interesting
-				// event we can see. If there is no such event, fall back to the
-				// LastMessageTimestamp.
-				joinEvent := joinTimings[metadata.RoomID]
-				interestingActivityTs = joinEvent.Timestamp
-				for _, eventType := range listReq.BumpEventTypes {
-					timing := metadata.LatestEventsByType[eventType]
-					// we found a later event which we are authorised to see, use it instead
-					if joinEvent.NID < timing.NID && interestingActivityTs < timing.Timestamp {
-						interestingActivityTs = timing.Timestamp
-					}
-				}
-			}
-			interestedEventTimestampsByList[listKey] = interestingActivityTs
-		}
 		rooms[i] = sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
 			UserRoomData:                  urd,
-			LastInterestedEventTimestamps: interestedEventTimestampsByList,
+			LastInterestedEventTimestamps: interestedEventTimestamps(metadata, timing, req.Lists),
 		}
 		i++
 	}
 	invites := s.userCache.Invites()
+	for roomID, urd := range s.userCache.Knocks() {
+		invites[roomID] = urd
+	}
 	for _, urd := range invites {
-		metadata := urd.Invite.RoomMetadata()
+		metadata := urd.StrippedState().RoomMetadata()
 		inviteTimestampsByList := make(map[string]uint64, len(req.Lists))
 		for listKey, _ := range req.Lists {
 			inviteTimestampsByList[listKey] = metadata.LastMessageTimestamp
@@ -170,8 +181,133 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 	return nil
 }
 
+// loadMentions works out whether the user has been mentioned in the rooms which pass the other filters
+// of this list, so the list can filter and sort on it. Rooms with unread highlights are mentioned
+// anyway, so are skipped. The user cache keeps this up-to-date after this point.
+func (s *ConnState) loadMentions(ctx context.Context, listKey string, filters *sync3.RequestFilters) {
+	if s.mentionsLoaded[listKey] {
+		return
+	}
+	if s.mentionsLoaded == nil {
+		s.mentionsLoaded = make(map[string]bool)
+	}
+	s.mentionsLoaded[listKey] = true
+	otherFilters := withoutMentionsFilter(filters)
+	var roomIDs []string
+	for _, roomID := range s.lists.RoomIDs() {
+		r := s.lists.ReadOnlyRoom(roomID)
+		if r.HasHighlight() || (otherFilters != nil && !otherFilters.Include(r, s.lists)) {
+			continue
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	s.userCache.CalculateMentions(ctx, s.anchorLoadPosition, roomIDs)
+	userRoomDatas := s.userCache.LoadRooms(roomIDs...)
+	for _, roomID := range roomIDs {
+		r := *s.lists.ReadOnlyRoom(roomID)
+		r.IsMentioned = userRoomDatas[roomID].IsMentioned
+		// lists which depend on mentions are (re)created after this, so we can ignore the deltas
+		s.lists.SetRoom(r)
+	}
+}
+
+// loadMentionsForRoom works out whether the user has been mentioned in this room if it passes the other
+// filters of a list which has loaded mentions, as it may not have done when the list was loaded e.g. it
+// has since been tagged or made a DM. Updates r.IsMentioned. The user cache skips rooms it is already
+// tracking.
+func (s *ConnState) loadMentionsForRoom(ctx context.Context, loadPos int64, r *sync3.RoomConnMetadata) {
+	if r.HasHighlight() {
+		return
+	}
+	for listKey, list := range s.muxedReq.Lists {
+		if !s.mentionsLoaded[listKey] || !(list.Filters.NeedsMentions() || list.SortsByMentions()) {
+			continue
+		}
+		otherFilters := withoutMentionsFilter(list.Filters)
+		if otherFilters != nil && !otherFilters.Include(r, s.lists) {
+			continue
+		}
+		s.userCache.CalculateMentions(ctx, loadPos, []string{r.RoomID})
+		r.IsMentioned = s.userCache.LoadRoomData(r.RoomID).IsMentioned
+		return
+	}
+}
+
+// withoutMentionsFilter returns a copy of these filters without the is_mentioned filter.
+func withoutMentionsFilter(filters *sync3.RequestFilters) *sync3.RequestFilters {
+	if filters == nil {
+		return nil
+	}
+	f := *filters
+	f.IsMentioned = nil
+	return &f
+}
+
+// loadLeftRooms adds the rooms the user has left to this connection, so they can be shown in lists
+// which include left rooms. Rooms are shown as they were when the user left, so any activity after
+// the leave is not used when sorting.
+func (s *ConnState) loadLeftRooms(ctx context.Context) {
+	if s.leftRoomsLoaded {
+		return
+	}
+	s.leftRoomsLoaded = true
+	leftRooms, leaveTimings, err := s.globalCache.LoadLeftRooms(ctx, s.userID, s.anchorLoadPosition)
+	if err != nil {
+		logger.Err(err).Str("user", s.userID).Msg("failed to load left rooms")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	for roomID, metadata := range leftRooms {
+		if s.lists.ReadOnlyRoom(roomID) != nil {
+			continue // we already know about this room, e.g. we left it on this connection
+		}
+		timing := leaveTimings[roomID]
+		metadata.RemoveHero(s.userID)
+		metadata.LastMessageTimestamp = timing.Timestamp
+		urd := s.userCache.LoadRoomData(roomID)
+		urd.HasLeft = true
+		urd.LeaveTiming = timing
+		leaveTimestamps := make(map[string]uint64, len(s.muxedReq.Lists))
+		for listKey := range s.muxedReq.Lists {
+			leaveTimestamps[listKey] = timing.Timestamp
+		}
+		// lists which include left rooms are (re)created after this, so we can ignore the deltas
+		s.lists.SetRoom(sync3.RoomConnMetadata{
+			RoomMetadata:                  *metadata,
+			UserRoomData:                  urd,
+			LastInterestedEventTimestamps: leaveTimestamps,
+		})
+	}
+}
+
+// interestedEventTimestamps calculates the timestamp of the latest event in this room that each
+// list is interested in, taking into account the bump event types of each list.
+func interestedEventTimestamps(metadata *internal.RoomMetadata, joinEvent internal.EventMetadata, lists map[string]sync3.RequestList) map[string]uint64 {
+	interestedEventTimestampsByList := make(map[string]uint64, len(lists))
+	for listKey, listReq := range lists {
+		interestingActivityTs := metadata.LastMessageTimestamp
+		if len(listReq.BumpEventTypes) > 0 {
+			// Use the global cache to find the timestamp of the latest interesting
+			// event we can see. If there is no such event, fall back to the
+			// LastMessageTimestamp.
+			interestingActivityTs = joinEvent.Timestamp
+			for _, eventType := range listReq.BumpEventTypes {
+				timing := metadata.LatestEventsByType[eventType]
+				// we found a later event which we are authorised to see, use it instead
+				if joinEvent.NID < timing.NID && interestingActivityTs < timing.Timestamp {
+					interestingActivityTs = timing.Timestamp
+				}
+			}
+		}
+		interestedEventTimestampsByList[listKey] = interestingActivityTs
+	}
+	return interestedEventTimestampsByList
+}
+
 // OnIncomingRequest is guaranteed to be called sequentially (it's protected by a mutex in conn.go)
 func (s *ConnState) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool, start time.Time) (*sync3.Response, error) {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
 	if s.anchorLoadPosition <= 0 {
 		// load() needs no ctx so drop it
 		_, region := internal.StartSpan(ctx, "load")
@@ -216,12 +352,25 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	s.buildRoomSubscriptions(reqCtx, builder, delta.Subs, delta.Unsubs)
 	// works out how rooms get moved about but doesn't pull room data
 	respLists := s.buildListSubscriptions(reqCtx, builder, delta.Lists)
+	// rooms which did not fit into previous responses
+	s.addDeferredRooms(reqCtx, builder)
 
 	// pull room data and set changes on the response
+	budget := s.responseBudget()
+	builtSubs := s.deferRoomsOverBudget(reqCtx, builder.BuildSubscriptions(), budget.MaxRooms)
 	response := &sync3.Response{
-		Rooms: s.buildRooms(reqCtx, builder.BuildSubscriptions()), // pull room data
+		Rooms: s.buildRooms(reqCtx, builtSubs), // pull room data
 		Lists: respLists,
 	}
+	s.deferRoomsOverByteBudget(reqCtx, response.Rooms, builtSubs, budget.MaxBytes)
+	overflow := s.live.takeOverflow()
+	if s.needsCatchUp {
+		s.needsCatchUp = false
+		s.live.catchUp(reqCtx, response, nil) // we are catching up on every room anyway
+	} else if overflow != nil {
+		internal.Logf(reqCtx, "connstate", "catching up %d rooms and %d updates", len(overflow.roomIDs), len(overflow.updates))
+		s.live.catchUp(reqCtx, response, overflow.roomIDs)
+	}
 
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
 	// is being notified about (e.g. for room account data)
@@ -235,6 +384,12 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		AllSubscribedRooms: internal.Keys(s.roomSubscriptions),
 		AllLists:           s.muxedReq.ListKeys(),
 	})
+	if overflow != nil {
+		// replay updates which catching up does not cover, e.g receipts and account data
+		for _, up := range overflow.updates {
+			s.live.processUpdate(extCtx, up, response, s.muxedReq.Extensions)
+		}
+	}
 	region.End()
 
 	if response.ListOps() > 0 || len(response.Rooms) > 0 || response.Extensions.HasData(isInitial) {
@@ -250,6 +405,8 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	updateCtx, region := internal.StartSpan(reqCtx, "liveUpdate")
 	s.live.liveUpdate(updateCtx, req, s.muxedReq.Extensions, isInitial, response)
 	region.End()
+	// deferred rooms are sent in full later, so don't send partial updates for them now
+	s.removeDeferredRooms(response)
 
 	// counts are AFTER events are applied, hence after liveUpdate
 	for listKey := range response.Lists {
@@ -269,6 +426,15 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 func (s *ConnState) onIncomingListRequest(ctx context.Context, builder *RoomsBuilder, listKey string, prevReqList, nextReqList *sync3.RequestList) sync3.ResponseList {
 	ctx, span := internal.StartSpan(ctx, "onIncomingListRequest")
 	defer span.End()
+	if nextReqList.Filters.NeedsMentions() || nextReqList.SortsByMentions() {
+		if prevReqList.FiltersChanged(nextReqList) {
+			delete(s.mentionsLoaded, listKey)
+		}
+		s.loadMentions(ctx, listKey, nextReqList.Filters)
+	}
+	if nextReqList.Filters.IncludesLeft() {
+		s.loadLeftRooms(ctx)
+	}
 	roomList, overwritten := s.lists.AssignList(ctx, listKey, nextReqList.Filters, nextReqList.Sort, sync3.DoNotOverwrite)
 
 	if nextReqList.ShouldGetAllRooms() {
@@ -520,6 +686,8 @@ func (s *ConnState) buildRooms(ctx context.Context, builtSubs []BuiltSubscriptio
 			result[roomID] = room
 		}
 	}
+	// e.g. a deferred room moved into a new range whilst live streaming
+	s.undeferRooms(result)
 	return result
 }
 
@@ -564,8 +732,11 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	// has seen 6, as concurrent room updates cause A and B to race. This is why we then go through the
 	// response to this call to assign new load positions for each room.
 	roomMetadatas := s.globalCache.LoadRooms(ctx, roomIDs...)
+	// work out unread counts for rooms the upstream server hasn't sent counts for, before we load the user room data
+	s.userCache.CalculateUnreadCounts(ctx, s.anchorLoadPosition, roomIDs)
 	userRoomDatas := s.userCache.LoadRooms(roomIDs...)
 	timelines := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
+	s.prependPredecessorTimelines(ctx, timelines, roomIDs, int(roomSub.TimelineLimit))
 
 	// 1. Prepare lazy loading data structures, txn IDs.
 	roomToUsersInTimeline := make(map[string][]string, len(timelines))
@@ -587,6 +758,7 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		s.loadPositions[roomID] = latestEvents.LatestNID
 	}
 	roomToTimeline = s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, roomToTimeline)
+	roomToTimeline = s.userCache.AnnotateWithBundledAggregations(ctx, roomToTimeline)
 
 	// 2. Load required state events.
 	rsm := roomSub.RequiredStateMap(s.userID)
@@ -598,12 +770,18 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 
 	internal.Logf(ctx, "connstate", "getInitialRoomData for %d rooms, RequiredStateMap: %#v", len(roomIDs), rsm)
 
-	// Filter out rooms we are only invited to, as we don't need to fetch the state
-	// since we'll be using the invite_state only.
+	// Filter out rooms we are only invited to or knocking on, as we don't need to fetch the state
+	// since we'll be using the invite_state/knock_state only. Rooms we have left are loaded separately
+	// as we must not show state from after the leave.
 	loadRoomIDs := make([]string, 0, len(roomIDs))
+	leaveTimings := make(map[string]internal.EventMetadata)
 	for _, roomID := range roomIDs {
+		if r := s.lists.ReadOnlyRoom(roomID); r != nil && r.HasLeft && r.LeaveTiming.NID > 0 {
+			leaveTimings[roomID] = r.LeaveTiming
+			continue
+		}
 		userRoomData, ok := userRoomDatas[roomID]
-		if !ok || !userRoomData.IsInvite {
+		if !ok || (!userRoomData.IsInvite && !userRoomData.IsKnock) {
 			loadRoomIDs = append(loadRoomIDs, roomID)
 		}
 	}
@@ -615,6 +793,12 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	if roomIDToState == nil { // e.g no required_state
 		roomIDToState = make(map[string][]json.RawMessage)
 	}
+	for roomID, leaveTiming := range leaveTimings {
+		leftState := s.globalCache.LoadRoomState(ctx, []string{roomID}, leaveTiming.NID, rsm, roomToUsersInTimeline)
+		if leftState != nil {
+			roomIDToState[roomID] = leftState[roomID]
+		}
+	}
 
 	// 3. Build sync3.Room structs to return to clients.
 	rooms := make(map[string]sync3.Room, len(roomIDs))
@@ -624,18 +808,26 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			userRoomData = caches.NewUserRoomData()
 		}
 		metadata := roomMetadatas[roomID]
-		var inviteState []json.RawMessage
+		if r := s.lists.ReadOnlyRoom(roomID); r != nil && r.HasLeft && r.LeaveTiming.NID > 0 {
+			// show the room as it was when we left, see loadLeftRooms
+			metadata = r.RoomMetadata.DeepCopy()
+		}
+		var inviteState, knockState []json.RawMessage
 		// handle invites specially as we do not want to leak additional data beyond the invite_state and if
 		// we happen to have this room in the global cache we will do.
 		// Furthermore, rooms the proxy have been invited to for the first time ever will not be in the global cache yet,
 		// which will cause errors below when we try calling functions on a nil metadata.
+		// The same applies to rooms we have knocked on.
 		if userRoomData.IsInvite {
 			metadata = userRoomData.Invite.RoomMetadata()
 			inviteState = userRoomData.Invite.InviteState
+		} else if userRoomData.IsKnock {
+			metadata = userRoomData.Knock.RoomMetadata()
+			knockState = userRoomData.Knock.InviteState
 		}
 		metadata.RemoveHero(s.userID)
 		var requiredState []json.RawMessage
-		if !userRoomData.IsInvite {
+		if !userRoomData.IsInvite && !userRoomData.IsKnock {
 			requiredState = roomIDToState[roomID]
 			if requiredState == nil {
 				requiredState = make([]json.RawMessage, 0)
@@ -671,8 +863,12 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 				}
 			}
 		}
+		// don't leak the timestamp of activity after we left either
+		if leaveTiming, left := leaveTimings[roomID]; left && maxTs > leaveTiming.Timestamp {
+			maxTs = leaveTiming.Timestamp
+		}
 
-		roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+		roomName, calculated := internal.CalculateRoomName(metadata, 5, s.lists.RoomNameTranslations()) // TODO: customisable?
 		room := sync3.Room{
 			Name:              roomName,
 			AvatarChange:      sync3.NewAvatarChange(internal.CalculateAvatar(metadata, userRoomData.IsDM)),
@@ -681,12 +877,14 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			Timeline:          roomToTimeline[roomID],
 			RequiredState:     requiredState,
 			InviteState:       inviteState,
+			KnockState:        knockState,
 			Initial:           true,
 			IsDM:              userRoomData.IsDM,
 			JoinedCount:       metadata.JoinCount,
 			InvitedCount:      &metadata.InviteCount,
 			PrevBatch:         timelines[roomID].PrevBatch,
 			Timestamp:         maxTs,
+			Unread:            userRoomData.Unread(),
 		}
 		if roomSub.IncludeHeroes() && calculated {
 			room.Heroes = metadata.Heroes
@@ -697,6 +895,44 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	return rooms
 }
 
+// prependPredecessorTimelines tops up the timelines of rooms which are shown in place of their
+// predecessors, as the newest room in an upgrade chain has few events of its own to begin with.
+// Events from predecessors are given a room_id so clients can tell them apart, and prev_batch
+// refers to the room of the first event in the timeline.
+func (s *ConnState) prependPredecessorTimelines(ctx context.Context, timelines map[string]state.LatestEvents, roomIDs []string, limit int) {
+	if timelines == nil {
+		return
+	}
+	for _, roomID := range roomIDs {
+		latestEvents, ok := timelines[roomID]
+		if !ok || len(latestEvents.Timeline) >= limit || !s.lists.MergesUpgradedRooms(roomID) {
+			continue
+		}
+		for _, prevRoomID := range s.lists.Predecessors(roomID) {
+			remaining := limit - len(latestEvents.Timeline)
+			if remaining <= 0 {
+				break
+			}
+			prevEvents := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, []string{prevRoomID}, remaining)[prevRoomID]
+			if len(prevEvents.Timeline) == 0 {
+				break // we can't see anything in this room, so we can't see anything before it either
+			}
+			timeline := make([]json.RawMessage, 0, len(prevEvents.Timeline)+len(latestEvents.Timeline))
+			for _, ev := range prevEvents.Timeline {
+				ev, err := sjson.SetBytes(ev, "room_id", prevRoomID)
+				if err != nil {
+					logger.Err(err).Str("room", prevRoomID).Msg("failed to set room_id on predecessor event")
+					continue
+				}
+				timeline = append(timeline, ev)
+			}
+			latestEvents.Timeline = append(timeline, latestEvents.Timeline...)
+			latestEvents.PrevBatch = prevEvents.PrevBatch
+		}
+		timelines[roomID] = latestEvents
+	}
+}
+
 func (s *ConnState) trackSetupDuration(ctx context.Context, dur time.Duration, isInitial bool) {
 	internal.SetRequestContextSetupDuration(ctx, dur)
 	if s.setupHistogramVec == nil {
@@ -730,14 +966,57 @@ func (s *ConnState) Destroy() {
 	}
 }
 
+// Alive is false if the connection could not keep up with live updates and dropped some which it
+// cannot catch up on. Otherwise, connections which cannot keep up catch up on the next request.
 func (s *ConnState) Alive() bool {
-	return !s.live.bufferFull
+	return !s.live.expired()
 }
 
 func (s *ConnState) UserID() string {
 	return s.userID
 }
 
+// InspectBuffer implements sync3.ConnInspector
+func (s *ConnState) InspectBuffer(info *sync3.ConnInfo) {
+	info.BufferedUpdates = len(s.live.updates)
+	info.BufferCapacity = cap(s.live.updates)
+	s.live.overflowMu.Lock()
+	info.Overflowed = s.live.overflow != nil
+	s.live.overflowMu.Unlock()
+}
+
+// Inspect implements sync3.ConnInspector
+func (s *ConnState) Inspect(info *sync3.ConnInfo) {
+	info.Lists = make(map[string]sync3.ListInfo)
+	if s.muxedReq != nil {
+		for listKey, l := range s.muxedReq.Lists {
+			info.Lists[listKey] = sync3.ListInfo{
+				Ranges: append(sync3.SliceRanges(nil), l.Ranges...),
+				Sort:   append([]string(nil), l.Sort...),
+				Count:  s.lists.Count(listKey),
+			}
+		}
+	}
+	info.RoomSubscriptions = internal.Keys(s.roomSubscriptions)
+	sort.Strings(info.RoomSubscriptions)
+}
+
+// ExplainList implements sync3.ConnInspector
+func (s *ConnState) ExplainList(listKey string) (sync3.ListExplanation, bool) {
+	s.listsMu.Lock()
+	defer s.listsMu.Unlock()
+	if s.muxedReq == nil {
+		return sync3.ListExplanation{}, false
+	}
+	reqList, ok := s.muxedReq.Lists[listKey]
+	if !ok {
+		return sync3.ListExplanation{}, false
+	}
+	ex, ok := s.lists.Explain(listKey)
+	ex.Sort = append([]string(nil), reqList.Sort...)
+	return ex, ok
+}
+
 func (s *ConnState) OnUpdate(ctx context.Context, up caches.Update) {
 	// will eventually call s.live.onUpdate
 	s.txnIDWaiter.Ingest(up)
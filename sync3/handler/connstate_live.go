@@ -3,18 +3,25 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
+	"github.com/tidwall/gjson"
 )
 
 // the amount of time to try to insert into a full buffer before giving up.
 // Customisable for testing
 var BufferWaitTime = time.Second * 5
 
+// the maximum number of updates to keep for replaying once the buffer has overflowed. Beyond this
+// the connection is expired. Customisable for testing
+var MaxOverflowUpdates = 1000
+
 // Contains code for processing live updates. Split out from connstate because they concern different
 // code paths. Relies on ConnState for various list/sort/subscription operations.
 type connStateLive struct {
@@ -22,27 +29,114 @@ type connStateLive struct {
 
 	// A channel which the dispatcher uses to send updates to the conn goroutine
 	// Consumed when the conn is read. There is a limit to how many updates we will store before
-	// saying the client is dead and clean up the conn.
-	updates    chan caches.Update
-	bufferFull bool
+	// spilling them into overflow.
+	updates chan caches.Update
+
+	// Set when the updates channel is full. Protected by overflowMu as it is written by the dispatcher
+	// and consumed by the conn goroutine.
+	overflowMu *sync.Mutex
+	overflow   *updateOverflow
+}
+
+// updateOverflow is a compact record of the updates a connection could not buffer. Rather than keeping
+// room and event updates, we remember which rooms were touched and rebuild their delta from the
+// caches on the next request. Other updates, e.g account data and receipts, cannot be rebuilt so are
+// kept and replayed. If there are too many of them, the connection is expired instead.
+type updateOverflow struct {
+	roomIDs map[string]struct{}
+	updates []caches.Update
+	expired bool
+}
+
+func newUpdateOverflow() *updateOverflow {
+	return &updateOverflow{
+		roomIDs: make(map[string]struct{}),
+	}
+}
+
+func (o *updateOverflow) add(up caches.Update) {
+	if o.expired {
+		return
+	}
+	if roomUpdate, ok := up.(caches.RoomUpdate); ok {
+		o.roomIDs[roomUpdate.RoomID()] = struct{}{}
+	}
+	switch up.(type) {
+	case *caches.RoomEventUpdate, *caches.UnreadCountUpdate, *caches.InviteUpdate, *caches.KnockUpdate, *catchUpUpdate:
+		// catching up on the room covers these
+		return
+	case caches.DeviceDataUpdate, caches.DeviceEventsUpdate:
+		// these have no data, so one of each is enough to wake up the extensions
+		for _, existing := range o.updates {
+			if existing == up {
+				return
+			}
+		}
+	}
+	if len(o.updates) >= MaxOverflowUpdates {
+		o.expired = true
+		o.updates = nil
+		return
+	}
+	o.updates = append(o.updates, up)
 }
 
 // Called when there is an update from the user cache. This callback fires when the server gets a new event and determines this connection MAY be
 // interested in it (e.g the client is joined to the room or it's an invite, etc).
 // We need to move this data onto a channel for onIncomingRequest to consume later.
 func (s *connStateLive) onUpdate(up caches.Update) {
-	if s.bufferFull {
+	s.overflowMu.Lock()
+	if s.overflow != nil {
+		s.overflow.add(up)
+		s.overflowMu.Unlock()
 		return
 	}
+	s.overflowMu.Unlock()
 	select {
 	case s.updates <- up:
 	case <-time.After(BufferWaitTime):
 		logger.Warn().Interface("update", up).Str("user", s.userID).Str("device", s.deviceID).Msg(
-			"cannot send update to connection, buffer exceeded. Destroying connection.",
+			"cannot send update to connection, buffer exceeded. Connection will catch up from the database.",
 		)
-		s.bufferFull = true
-		s.Destroy()
+		s.overflowMu.Lock()
+		if s.overflow == nil {
+			s.overflow = newUpdateOverflow()
+		}
+		s.overflow.add(up)
+		s.overflowMu.Unlock()
+	}
+}
+
+// takeOverflow returns the overflow, if any, and resumes buffering updates. Any updates which were
+// buffered before the overflow happened are folded into it, ahead of the updates which overflowed.
+// Expired overflows are never taken, as the connection is about to be closed.
+func (s *connStateLive) takeOverflow() *updateOverflow {
+	s.overflowMu.Lock()
+	overflow := s.overflow
+	if overflow == nil || overflow.expired {
+		s.overflowMu.Unlock()
+		return nil
+	}
+	s.overflow = nil
+	s.overflowMu.Unlock()
+	buffered := newUpdateOverflow()
+	for i := len(s.updates); i > 0; i-- {
+		buffered.add(<-s.updates)
+	}
+	for _, up := range overflow.updates {
+		buffered.add(up)
 	}
+	for roomID := range overflow.roomIDs {
+		buffered.roomIDs[roomID] = struct{}{}
+	}
+	return buffered
+}
+
+// expired returns true if the connection dropped updates which it cannot catch up on.
+func (s *connStateLive) expired() bool {
+	s.overflowMu.Lock()
+	defer s.overflowMu.Unlock()
+	return s.overflow != nil && s.overflow.expired
 }
 
 // live update waits for new data and populates the response given when new data arrives.
@@ -72,16 +166,21 @@ func (s *connStateLive) liveUpdate(
 			return
 		}
 		log.Trace().Str("dur", timeLeftToWait.String()).Msg("liveUpdate: no response data yet; blocking")
+		// the lists can be explained whilst we wait
+		s.listsMu.Unlock()
 		select {
 		case <-ctx.Done(): // client has given up
+			s.listsMu.Lock()
 			log.Trace().Msg("liveUpdate: client gave up, or we killed the connection")
 			internal.Logf(ctx, "liveUpdate", "context cancelled")
 			return
 		case <-time.After(timeLeftToWait): // we've timed out
+			s.listsMu.Lock()
 			log.Trace().Msg("liveUpdate: timed out")
 			internal.Logf(ctx, "liveUpdate", "timed out after %v", timeLeftToWait)
 			return
 		case update := <-s.updates:
+			s.listsMu.Lock()
 			s.processUpdate(ctx, update, response, ex)
 			numProcessedUpdates++
 			// if there's more updates and we don't have lots stacked up already, go ahead and process another
@@ -169,13 +268,18 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 	hasUpdates := s.processUpdatesForSubscriptions(ctx, builder, up)
 
 	// do per-list updates (e.g resorting, adding/removing rooms which no longer match filter)
+	movedOtherRoom := false
 	for _, listDelta := range delta.Lists {
 		listKey := listDelta.ListKey
 		list := s.lists.Get(listKey)
 		reqList := s.muxedReq.Lists[listKey]
 		resList := response.Lists[listKey]
-		updates := s.processLiveUpdateForList(ctx, builder, up, listDelta.Op, &reqList, list, &resList)
-		if updates {
+		updates := s.processLiveUpdateForList(ctx, builder, up, listDelta, &reqList, list, &resList)
+		if updates && listDelta.RoomID != "" {
+			// the list moved a newer room in an upgrade chain, which doesn't mean the client wants
+			// this room's event.
+			movedOtherRoom = true
+		} else if updates {
 			hasUpdates = true
 		}
 		response.Lists[listKey] = resList
@@ -220,6 +324,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 
 		r.HighlightCount = int64(userRoomData.HighlightCount)
 		r.NotificationCount = int64(userRoomData.NotificationCount)
+		r.Unread = userRoomData.Unread()
 		if roomEventUpdate != nil && roomEventUpdate.EventData.Event != nil {
 			r.NumLive++
 			advancedPastEvent := false
@@ -239,6 +344,11 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 				roomIDtoTimeline := s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, map[string][]json.RawMessage{
 					roomEventUpdate.RoomID(): {roomEventUpdate.EventData.Event},
 				})
+				if gjson.GetBytes(roomEventUpdate.EventData.Event, `unsigned.m\.relations.m\.thread`).Exists() {
+					// this thread root was bundled for no user in particular, so whether we participated
+					// in the thread needs recalculating.
+					roomIDtoTimeline = s.userCache.AnnotateWithBundledAggregations(ctx, roomIDtoTimeline)
+				}
 				if len(r.Timeline) == 0 && r.PrevBatch == "" {
 					// attempt to fill in the prev_batch value for this room
 					prevBatch := s.userCache.AttemptToFetchPrevBatch(ctx, roomEventUpdate.RoomID(), roomEventUpdate.EventData)
@@ -273,7 +383,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			if delta.RoomNameChanged {
 				metadata := roomUpdate.GlobalRoomMetadata()
 				metadata.RemoveHero(s.userID)
-				roomName, calculated := internal.CalculateRoomName(metadata, 5) // TODO: customisable?
+				roomName, calculated := internal.CalculateRoomName(metadata, 5, s.lists.RoomNameTranslations()) // TODO: customisable?
 
 				thisRoom.Name = roomName
 
@@ -294,7 +404,7 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			}
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
-		if delta.HighlightCountChanged || delta.NotificationCountChanged {
+		if delta.HighlightCountChanged || delta.NotificationCountChanged || delta.UnreadChanged {
 			if !exists {
 				// we need to make this room exist. Other deltas are caused by events so the room exists,
 				// but highlight/notif counts are silent
@@ -302,10 +412,11 @@ func (s *connStateLive) processLiveUpdate(ctx context.Context, up caches.Update,
 			}
 			thisRoom.NotificationCount = int64(roomUpdate.UserRoomMetadata().NotificationCount)
 			thisRoom.HighlightCount = int64(roomUpdate.UserRoomMetadata().HighlightCount)
+			thisRoom.Unread = roomUpdate.UserRoomMetadata().Unread()
 			response.Rooms[roomUpdate.RoomID()] = thisRoom
 		}
 	}
-	return hasUpdates
+	return hasUpdates || movedOtherRoom
 }
 
 func (s *connStateLive) processUpdatesForSubscriptions(ctx context.Context, builder *RoomsBuilder, up caches.Update) (hasUpdates bool) {
@@ -339,8 +450,12 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 	rup, isRoomUpdate := up.(caches.RoomUpdate)
 	if isRoomUpdate {
 		updateTimestamp := rup.GlobalRoomMetadata().LastMessageTimestamp
+		catchUp, isCatchUpUpdate := up.(*catchUpUpdate)
 		for listKey, list := range s.muxedReq.Lists {
-			if len(list.BumpEventTypes) == 0 {
+			if isCatchUpUpdate {
+				// we may have missed the events which bumped this room, so use the latest ones
+				bumpTimestampInList[listKey] = catchUp.bumpTimestamps[listKey]
+			} else if len(list.BumpEventTypes) == 0 {
 				// If this list hasn't provided BumpEventTypes, bump the room list for all room updates.
 				bumpTimestampInList[listKey] = updateTimestamp
 			} else if isRoomEventUpdate {
@@ -366,11 +481,17 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 		//   - call SetRooms for each room in the difference.
 		// I'm assuming this happens so rarely that we can ignore this for now. PRs
 		// welcome if you a strong opinion to the contrary.
-		delta = s.lists.SetRoom(sync3.RoomConnMetadata{
+		room := sync3.RoomConnMetadata{
 			RoomMetadata:                  *metadata,
 			UserRoomData:                  *rup.UserRoomMetadata(),
 			LastInterestedEventTimestamps: bumpTimestampInList,
-		})
+		}
+		loadPos := s.anchorLoadPosition
+		if isRoomEventUpdate && roomEventUpdate.EventData.NID > loadPos {
+			loadPos = roomEventUpdate.EventData.NID
+		}
+		s.loadMentionsForRoom(ctx, loadPos, &room)
+		delta = s.lists.SetRoom(room)
 	}
 
 	// update the anchor for this new event
@@ -381,7 +502,7 @@ func (s *connStateLive) processGlobalUpdates(ctx context.Context, builder *Rooms
 }
 
 func (s *connStateLive) processLiveUpdateForList(
-	ctx context.Context, builder *RoomsBuilder, up caches.Update, listOp sync3.ListOp,
+	ctx context.Context, builder *RoomsBuilder, up caches.Update, listDelta sync3.RoomListDelta,
 	reqList *sync3.RequestList, intList *sync3.FilteredSortableRooms, resList *sync3.ResponseList,
 ) (hasUpdates bool) {
 	switch update := up.(type) {
@@ -407,8 +528,12 @@ func (s *connStateLive) processLiveUpdateForList(
 	if !ok {
 		return false
 	}
+	roomID := rup.RoomID()
+	if listDelta.RoomID != "" {
+		roomID = listDelta.RoomID
+	}
 	ops, hasUpdates := s.resort(
-		ctx, builder, reqList, intList, rup.RoomID(), listOp,
+		ctx, builder, reqList, intList, roomID, listDelta.Op,
 	)
 	resList.Ops = append(resList.Ops, ops...)
 
@@ -458,6 +583,143 @@ func (s *connStateLive) resort(
 	return ops, hasUpdates
 }
 
+// catchUpUpdate is a RoomUpdate built from the current contents of the caches, used to bring a
+// connection up to date with changes it did not see as live updates.
+type catchUpUpdate struct {
+	roomID         string
+	globalRoomData *internal.RoomMetadata
+	userRoomData   *caches.UserRoomData
+	// list key -> timestamp of the latest event in this room the list is interested in
+	bumpTimestamps map[string]uint64
+}
+
+func (u *catchUpUpdate) Type() string {
+	return fmt.Sprintf("catchUpUpdate[%s]", u.roomID)
+}
+
+func (u *catchUpUpdate) RoomID() string {
+	return u.roomID
+}
+
+func (u *catchUpUpdate) GlobalRoomMetadata() *internal.RoomMetadata {
+	return u.globalRoomData
+}
+
+func (u *catchUpUpdate) UserRoomMetadata() *caches.UserRoomData {
+	return u.userRoomData
+}
+
+// catchUp brings the connection up to date with the caches when it has missed live updates, e.g.
+// because it was restored from a snapshot. Every room is processed as if it had a live update, which
+// moves rooms around the lists, then visible rooms with new events are sent again as initial rooms
+// with their latest timeline. If roomIDs is non-nil, only those rooms are caught up.
+func (s *connStateLive) catchUp(ctx context.Context, response *sync3.Response, roomIDs map[string]struct{}) {
+	ctx, span := internal.StartSpan(ctx, "catchUp")
+	defer span.End()
+	pos, joinedRooms, joinTimings, latestNIDs, err := s.globalCache.LoadJoinedRooms(ctx, s.userID)
+	if err != nil {
+		logger.Err(err).Str("user", s.userID).Str("device", s.deviceID).Msg("failed to load joined rooms to catch up")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if pos > s.anchorLoadPosition {
+		s.anchorLoadPosition = pos
+	}
+	for listKey := range s.muxedReq.Lists {
+		if _, exists := response.Lists[listKey]; !exists {
+			response.Lists[listKey] = sync3.ResponseList{}
+		}
+	}
+
+	shouldCatchUp := func(roomID string) bool {
+		if roomIDs == nil {
+			return true
+		}
+		_, exists := roomIDs[roomID]
+		return exists
+	}
+
+	updates := make(map[string]*catchUpUpdate, len(joinedRooms))
+	for roomID, metadata := range joinedRooms {
+		if !shouldCatchUp(roomID) {
+			continue
+		}
+		urd := s.userCache.LoadRoomData(roomID)
+		urd.JoinTiming = joinTimings[roomID]
+		updates[roomID] = &catchUpUpdate{
+			roomID:         roomID,
+			globalRoomData: metadata,
+			userRoomData:   &urd,
+			bumpTimestamps: interestedEventTimestamps(metadata, urd.JoinTiming, s.muxedReq.Lists),
+		}
+	}
+	strippedStateRooms := s.userCache.Invites()
+	for roomID, urd := range s.userCache.Knocks() {
+		strippedStateRooms[roomID] = urd
+	}
+	for roomID, urd := range strippedStateRooms {
+		if _, joined := joinedRooms[roomID]; joined || !shouldCatchUp(roomID) {
+			continue
+		}
+		urd := urd
+		metadata := urd.StrippedState().RoomMetadata()
+		bumpTimestamps := make(map[string]uint64, len(s.muxedReq.Lists))
+		for listKey := range s.muxedReq.Lists {
+			bumpTimestamps[listKey] = metadata.LastMessageTimestamp
+		}
+		updates[roomID] = &catchUpUpdate{
+			roomID:         roomID,
+			globalRoomData: metadata,
+			userRoomData:   &urd,
+			bumpTimestamps: bumpTimestamps,
+		}
+	}
+	// any other rooms we know about have since been left
+	for _, roomID := range s.lists.RoomIDs() {
+		existing := s.lists.ReadOnlyRoom(roomID)
+		if _, updated := updates[roomID]; updated || existing.HasLeft || !shouldCatchUp(roomID) {
+			continue
+		}
+		urd := existing.UserRoomData
+		urd.HasLeft = true
+		updates[roomID] = &catchUpUpdate{
+			roomID:         roomID,
+			globalRoomData: existing.RoomMetadata.DeepCopy(),
+			userRoomData:   &urd,
+			bumpTimestamps: existing.LastInterestedEventTimestamps,
+		}
+	}
+	for _, update := range updates {
+		s.processLiveUpdate(ctx, update, response)
+	}
+
+	// send visible rooms with new events again, as we don't know which events the client missed
+	roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+	builder := NewRoomsBuilder()
+	for roomID, latestNID := range latestNIDs {
+		if latestNID <= s.loadPositions[roomID] || !shouldCatchUp(roomID) {
+			continue
+		}
+		if sub, exists := s.roomSubscriptions[roomID]; exists {
+			subID := builder.AddSubscription(sub)
+			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+		}
+		for _, listKey := range roomIDsToLists[roomID] {
+			subID := builder.AddSubscription(s.muxedReq.Lists[listKey].RoomSubscription)
+			builder.AddRoomsToSubscription(ctx, subID, []string{roomID})
+		}
+	}
+	for roomID, room := range s.buildRooms(ctx, builder.BuildSubscriptions()) {
+		response.Rooms[roomID] = room
+	}
+	for roomID, latestNID := range latestNIDs {
+		if latestNID > s.loadPositions[roomID] && shouldCatchUp(roomID) {
+			s.loadPositions[roomID] = latestNID
+		}
+	}
+	internal.Logf(ctx, "connstate", "caught up %d rooms", len(updates))
+}
+
 // shouldIncludeHeroes returns whether the given roomID is in a list or direct
 // subscription which should return heroes.
 func (s *connStateLive) shouldIncludeHeroes(roomID string) bool {
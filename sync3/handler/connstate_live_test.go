@@ -2,10 +2,16 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 func Test_connStateLive_shouldIncludeHeroes(t *testing.T) {
@@ -88,3 +94,158 @@ func Test_connStateLive_shouldIncludeHeroes(t *testing.T) {
 		})
 	}
 }
+
+func Test_connStateLive_overflow(t *testing.T) {
+	bufferWaitTime := BufferWaitTime
+	BufferWaitTime = time.Millisecond
+	defer func() {
+		BufferWaitTime = bufferWaitTime
+	}()
+	live := &connStateLive{
+		ConnState:  &ConnState{},
+		updates:    make(chan caches.Update, 1),
+		overflowMu: &sync.Mutex{},
+	}
+	eventUpdate := func(roomID string, nid int64) caches.Update {
+		return &caches.RoomEventUpdate{
+			RoomUpdate: &catchUpUpdate{roomID: roomID},
+			EventData:  &caches.EventData{RoomID: roomID, NID: nid},
+		}
+	}
+	if overflow := live.takeOverflow(); overflow != nil {
+		t.Fatalf("takeOverflow: got %+v want nil", overflow)
+	}
+
+	accountData := &caches.AccountDataUpdate{}
+	live.onUpdate(eventUpdate("!a", 10))
+	live.onUpdate(eventUpdate("!b", 12))
+	live.onUpdate(accountData)
+	live.onUpdate(caches.DeviceDataUpdate{})
+	live.onUpdate(caches.DeviceDataUpdate{})
+	live.onUpdate(eventUpdate("!c", 11))
+	if len(live.updates) != 1 {
+		t.Fatalf("got %d buffered updates, want 1", len(live.updates))
+	}
+
+	// the buffered update is folded into the overflow
+	overflow := live.takeOverflow()
+	if overflow == nil {
+		t.Fatalf("takeOverflow: got nil want overflow")
+	}
+	// event updates are caught up on, but other updates are kept to be replayed
+	if len(overflow.updates) != 2 || overflow.updates[0] != accountData || overflow.updates[1] != (caches.DeviceDataUpdate{}) {
+		t.Errorf("overflow.updates: got %v want [account data, device data]", overflow.updates)
+	}
+	for _, roomID := range []string{"!a", "!b", "!c"} {
+		if _, exists := overflow.roomIDs[roomID]; !exists {
+			t.Errorf("overflow.roomIDs: missing %s, got %v", roomID, overflow.roomIDs)
+		}
+	}
+	if len(live.updates) != 0 {
+		t.Errorf("got %d buffered updates, want 0", len(live.updates))
+	}
+
+	// updates are buffered again after the overflow is taken
+	live.onUpdate(eventUpdate("!a", 13))
+	if len(live.updates) != 1 {
+		t.Fatalf("got %d buffered updates, want 1", len(live.updates))
+	}
+	if overflow := live.takeOverflow(); overflow != nil {
+		t.Fatalf("takeOverflow: got %+v want nil", overflow)
+	}
+	if live.expired() {
+		t.Fatalf("expired: got true want false")
+	}
+
+	// the connection expires if too many updates which cannot be caught up on overflow
+	maxOverflowUpdates := MaxOverflowUpdates
+	MaxOverflowUpdates = 2
+	defer func() {
+		MaxOverflowUpdates = maxOverflowUpdates
+	}()
+	for i := 0; i < 3; i++ {
+		live.onUpdate(&caches.AccountDataUpdate{})
+	}
+	if !live.expired() {
+		t.Fatalf("expired: got false want true")
+	}
+	if overflow := live.takeOverflow(); overflow != nil {
+		t.Fatalf("takeOverflow: got %+v want nil for an expired connection", overflow)
+	}
+}
+
+type participatedStore struct {
+	NopUserCacheStore
+	calls int
+}
+
+func (s *participatedStore) BundledAggregations(userID string, eventIDToSender map[string]string) (map[string]json.RawMessage, error) {
+	s.calls++
+	result := make(map[string]json.RawMessage)
+	for eventID := range eventIDToSender {
+		result[eventID] = json.RawMessage(`{"m.thread":{"count":1,"current_user_participated":true}}`)
+	}
+	return result, nil
+}
+
+// Test that live thread roots have current_user_participated calculated for the syncing user, as
+// they are bundled for no user in particular when they arrive.
+func TestConnStateLiveThreadParticipation(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateLiveThreadParticipation_alice:localhost"
+	room := newRoomMetadata("!a:localhost", 100)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{room.RoomID: room})
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.Startup(map[string][]string{room.RoomID: {userID}})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{room.RoomID: &room},
+			map[string]internal.EventMetadata{room.RoomID: {NID: 1, Timestamp: 1}}, nil, nil
+	}
+	store := &participatedStore{}
+	userCache := caches.NewUserCache(userID, globalCache, store, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	dispatcher.Register(context.Background(), userCache.UserID, userCache)
+	dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, globalCache)
+	cs := NewConnState(userID, "yep", userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:   []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{{0, 9}}),
+		}},
+	}
+	if _, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now()); err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	initialCalls := store.calls
+
+	// events which are not thread roots are not bundled again
+	dispatcher.OnNewEvent(context.Background(), room.RoomID, testutils.NewEvent(t, "m.room.message", "@bob:localhost", map[string]interface{}{"body": "hi"}), 2)
+	if _, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now()); err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if store.calls != initialCalls {
+		t.Errorf("BundledAggregations: got %d calls want %d", store.calls, initialCalls)
+	}
+
+	root := testutils.NewEvent(t, "m.room.message", "@bob:localhost", map[string]interface{}{"body": "root"}, testutils.WithUnsigned(map[string]interface{}{
+		"m.relations": map[string]interface{}{
+			"m.thread": map[string]interface{}{"count": 1, "current_user_participated": false},
+		},
+	}))
+	dispatcher.OnNewEvent(context.Background(), room.RoomID, root, 3)
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	timeline := res.Rooms[room.RoomID].Timeline
+	if len(timeline) != 1 {
+		t.Fatalf("got %d timeline events want 1", len(timeline))
+	}
+	if !gjson.GetBytes(timeline[0], `unsigned.m\.relations.m\.thread.current_user_participated`).Bool() {
+		t.Errorf("current_user_participated was not recalculated: %s", string(timeline[0]))
+	}
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// connStateSnapshot is the serialised form of a ConnState. It contains everything needed to carry
+// on a connection after the proxy restarts. Anything which changed after the snapshot was taken is
+// recalculated from the caches when the connection is restored, see connStateLive.catchUp.
+type connStateSnapshot struct {
+	MuxedReq           *sync3.Request                    `json:"muxed_req"`
+	RoomSubscriptions  map[string]sync3.RoomSubscription `json:"room_subscriptions"`
+	AnchorLoadPosition int64                             `json:"anchor_load_position"`
+	LoadPositions      map[string]int64                  `json:"load_positions"`
+	Lists              sync3.ListsSnapshot               `json:"lists"`
+	LazyMembers        map[string][]string               `json:"lazy_members"` // room_id -> user IDs
+	DeferredRooms      []BuiltSubscription               `json:"deferred_rooms,omitempty"`
+}
+
+// Snapshot implements sync3.ConnSnapshotter. Extension positions are part of the muxed request.
+func (s *ConnState) Snapshot() (json.RawMessage, error) {
+	lists := s.lists.Snapshot()
+	for i := range lists.Rooms {
+		// invite and knock data is reloaded from the user cache when the connection is restored
+		lists.Rooms[i].Invite = nil
+		lists.Rooms[i].Knock = nil
+	}
+	return json.Marshal(connStateSnapshot{
+		MuxedReq:           s.muxedReq,
+		RoomSubscriptions:  s.roomSubscriptions,
+		AnchorLoadPosition: s.anchorLoadPosition,
+		LoadPositions:      s.loadPositions,
+		Lists:              lists,
+		LazyMembers:        s.lazyCache.members(),
+		DeferredRooms:      s.deferredRooms,
+	})
+}
+
+// restore the state of a newly created ConnState from a snapshot. The connection will catch up on
+// anything it missed since the snapshot was taken on the next request.
+func (s *ConnState) restore(data json.RawMessage) error {
+	var snapshot connStateSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("failed to unmarshal conn state snapshot: %w", err)
+	}
+	if snapshot.AnchorLoadPosition <= 0 || snapshot.MuxedReq == nil {
+		return fmt.Errorf("conn state snapshot was taken before the connection was loaded")
+	}
+	s.muxedReq = snapshot.MuxedReq
+	s.anchorLoadPosition = snapshot.AnchorLoadPosition
+	for roomID, sub := range snapshot.RoomSubscriptions {
+		s.roomSubscriptions[roomID] = sub
+	}
+	for roomID, pos := range snapshot.LoadPositions {
+		s.loadPositions[roomID] = pos
+	}
+	s.lists = sync3.NewInternalRequestListsFromSnapshot(snapshot.Lists, s.muxedReq.Lists)
+	s.lists.SetRoomNameTranslations(internal.RoomNameTranslationsFor(s.muxedReq.Language))
+	for roomID, userIDs := range snapshot.LazyMembers {
+		s.lazyCache.rooms[roomID] = struct{}{}
+		s.lazyCache.Add(roomID, userIDs...)
+	}
+	s.deferredRooms = snapshot.DeferredRooms
+	s.needsCatchUp = true
+	return nil
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib/spec"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Check that a ConnState restored from a snapshot carries on from where the old one left off, and
+// catches up on rooms which changed in the meantime.
+func TestConnStateSnapshotRestore(t *testing.T) {
+	connID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateSnapshotRestore_alice:localhost"
+	deviceID := "yep"
+	timestampNow := spec.Timestamp(1632131678061).Time()
+	// initial sort order B, C, A
+	roomA := newRoomMetadata("!a:localhost", spec.AsTimestamp(timestampNow.Add(-8*time.Second)))
+	roomB := newRoomMetadata("!b:localhost", spec.AsTimestamp(timestampNow))
+	roomC := newRoomMetadata("!c:localhost", spec.AsTimestamp(timestampNow.Add(-4*time.Second)))
+	loadPositions := map[string]int64{
+		roomA.RoomID: 1,
+		roomB.RoomID: 1,
+		roomC.RoomID: 1,
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+	pos := int64(1)
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (int64, map[string]*internal.RoomMetadata, map[string]internal.EventMetadata, map[string]int64, error) {
+		a, b, c := roomA, roomB, roomC
+		return pos, map[string]*internal.RoomMetadata{
+			roomA.RoomID: &a,
+			roomB.RoomID: &b,
+			roomC.RoomID: &c,
+		}, map[string]internal.EventMetadata{
+			roomA.RoomID: {NID: 1, Timestamp: 1},
+			roomB.RoomID: {NID: 1, Timestamp: 1},
+			roomC.RoomID: {NID: 1, Timestamp: 1},
+		}, loadPositions, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		result := make(map[string]state.LatestEvents)
+		for _, roomID := range roomIDs {
+			result[roomID] = state.LatestEvents{
+				Timeline:  []json.RawMessage{[]byte(`{}`)},
+				LatestNID: loadPositions[roomID],
+			}
+		}
+		return result
+	}
+	req := &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort: []string{sync3.SortByRecency},
+			Ranges: sync3.SliceRanges([][2]int64{
+				{0, 1},
+			}),
+		}},
+	}
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	res, err := cs.OnIncomingRequest(context.Background(), connID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Rooms: map[string]sync3.Room{
+			roomB.RoomID: {Initial: true},
+			roomC.RoomID: {Initial: true},
+		},
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpRange{
+						Operation: "SYNC",
+						Range:     [2]int64{0, 1},
+						RoomIDs:   []string{roomB.RoomID, roomC.RoomID},
+					},
+				},
+			},
+		},
+	})
+	snapshot, err := cs.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %s", err)
+	}
+	cs.Destroy()
+
+	// whilst the proxy was down, room A got a new message
+	pos = 2
+	loadPositions[roomA.RoomID] = 2
+	roomA.LastMessageTimestamp = uint64(spec.AsTimestamp(timestampNow.Add(time.Second)))
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomA.RoomID: roomA,
+		roomB.RoomID: roomB,
+		roomC.RoomID: roomC,
+	})
+
+	restored := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	if err = restored.restore(snapshot); err != nil {
+		t.Fatalf("restore returned error: %s", err)
+	}
+	res, err = restored.OnIncomingRequest(context.Background(), connID, req, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	checkResponse(t, true, res, &sync3.Response{
+		Rooms: map[string]sync3.Room{
+			roomA.RoomID: {Initial: true},
+		},
+		Lists: map[string]sync3.ResponseList{
+			"a": {
+				Count: 3,
+				Ops: []sync3.ResponseOp{
+					&sync3.ResponseOpSingle{
+						Operation: "DELETE",
+						Index:     intPtr(1),
+					},
+					&sync3.ResponseOpSingle{
+						Operation: "INSERT",
+						Index:     intPtr(0),
+						RoomID:    roomA.RoomID,
+					},
+				},
+			},
+		},
+	})
+
+	// snapshots taken before the connection is loaded cannot be restored
+	empty := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	snapshot, err = empty.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot returned error: %s", err)
+	}
+	if err = NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0).restore(snapshot); err == nil {
+		t.Fatalf("restore of an unloaded snapshot succeeded, want error")
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/sync3/extensions"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 type joinChecker struct{}
@@ -38,9 +39,22 @@ type NopUserCacheStore struct{}
 func (s *NopUserCacheStore) GetClosestPrevBatch(roomID string, eventNID int64) (prevBatch string) {
 	return
 }
+func (s *NopUserCacheStore) BundledAggregations(userID string, eventIDToSender map[string]string) (map[string]json.RawMessage, error) {
+	return nil, nil
+}
 func (s *NopUserCacheStore) LatestEventsInRooms(userID string, roomIDs []string, to int64, limit int) (map[string]*state.LatestEvents, error) {
 	return nil, nil
 }
+func (s *NopUserCacheStore) UnreadEvents(userID string, roomIDs []string, to int64, limit int) (map[string][]state.Event, error) {
+	result := make(map[string][]state.Event, len(roomIDs))
+	for _, roomID := range roomIDs {
+		result[roomID] = nil
+	}
+	return result, nil
+}
+func (s *NopUserCacheStore) RoomStateAfterEventPosition(ctx context.Context, roomIDs []string, pos int64, eventTypesToStateKeys map[string][]string) (map[string][]state.Event, error) {
+	return nil, nil
+}
 
 type NopJoinTracker struct{}
 
@@ -806,3 +820,342 @@ func serialise(t *testing.T, thing interface{}) string {
 func intPtr(val int) *int {
 	return &val
 }
+
+// Test that lists which merge upgraded rooms show the newest room in place of the old room, sorted
+// by the activity in the old room, with a timeline which includes the old room's events.
+func TestConnStateMergeUpgradedRooms(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMergeUpgradedRooms_alice:localhost"
+	deviceID := "yep"
+	oldRoom := newRoomMetadata("!old:localhost", 300)
+	newRoom := newRoomMetadata("!new:localhost", 100)
+	otherRoom := newRoomMetadata("!other:localhost", 200)
+	oldRoom.UpgradedRoomID = &newRoom.RoomID
+	newRoom.PredecessorRoomID = &oldRoom.RoomID
+	timelines := map[string][]json.RawMessage{
+		oldRoom.RoomID: {
+			testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "old 1"}),
+			testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "old 2"}),
+			testutils.NewStateEvent(t, "m.room.tombstone", "", userID, map[string]interface{}{"replacement_room": newRoom.RoomID}),
+		},
+		newRoom.RoomID: {
+			testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "new"}),
+		},
+		otherRoom.RoomID: {
+			testutils.NewEvent(t, "m.room.message", userID, map[string]interface{}{"body": "other"}),
+		},
+	}
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		oldRoom.RoomID:   oldRoom,
+		newRoom.RoomID:   newRoom,
+		otherRoom.RoomID: otherRoom,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				oldRoom.RoomID:   &oldRoom,
+				newRoom.RoomID:   &newRoom,
+				otherRoom.RoomID: &otherRoom,
+			}, map[string]internal.EventMetadata{
+				oldRoom.RoomID:   {NID: 1, Timestamp: 1},
+				newRoom.RoomID:   {NID: 2, Timestamp: 2},
+				otherRoom.RoomID: {NID: 3, Timestamp: 3},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]state.LatestEvents {
+		result := make(map[string]state.LatestEvents)
+		for _, roomID := range roomIDs {
+			timeline := timelines[roomID]
+			if len(timeline) > maxTimelineEvents {
+				timeline = timeline[len(timeline)-maxTimelineEvents:]
+			}
+			result[roomID] = state.LatestEvents{
+				Timeline:  timeline,
+				PrevBatch: "prev_" + roomID,
+			}
+		}
+		return result
+	}
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	merge := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 3,
+			},
+			Sort:    []string{sync3.SortByRecency},
+			Ranges:  sync3.SliceRanges([][2]int64{{0, 9}}),
+			Filters: &sync3.RequestFilters{MergeUpgradedRooms: &merge},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	op, ok := res.Lists["a"].Ops[0].(*sync3.ResponseOpRange)
+	if !ok || !reflect.DeepEqual(op.RoomIDs, []string{newRoom.RoomID, otherRoom.RoomID}) {
+		t.Fatalf("got ops %s, want SYNC of the new room then the other room", serialise(t, res.Lists["a"].Ops))
+	}
+	if _, exists := res.Rooms[oldRoom.RoomID]; exists {
+		t.Errorf("old room was returned")
+	}
+	room := res.Rooms[newRoom.RoomID]
+	if len(room.Timeline) != 3 {
+		t.Fatalf("got %d timeline events, want 3", len(room.Timeline))
+	}
+	for i, ev := range room.Timeline[:2] {
+		if got := gjson.GetBytes(ev, "room_id").Str; got != oldRoom.RoomID {
+			t.Errorf("timeline event %d: got room_id %q want %q", i, got, oldRoom.RoomID)
+		}
+	}
+	if got := gjson.GetBytes(room.Timeline[2], "content.body").Str; got != "new" {
+		t.Errorf("last timeline event: got body %q want new", got)
+	}
+	if room.PrevBatch != "prev_"+oldRoom.RoomID {
+		t.Errorf("got prev_batch %q want the old room's", room.PrevBatch)
+	}
+}
+
+type unreadEventsStore struct {
+	NopUserCacheStore
+	roomIDs []string
+}
+
+func (s *unreadEventsStore) UnreadEvents(userID string, roomIDs []string, to int64, limit int) (map[string][]state.Event, error) {
+	s.roomIDs = append(s.roomIDs, roomIDs...)
+	return nil, nil
+}
+
+// Test that mentions are only calculated for rooms which pass the list's other filters.
+func TestConnStateMentionsOnlyForFilteredRooms(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMentionsOnlyForFilteredRooms_alice:localhost"
+	deviceID := "yep"
+	encryptedRoom := newRoomMetadata("!encrypted:localhost", 100)
+	encryptedRoom.Encrypted = true
+	plainRoom := newRoomMetadata("!plain:localhost", 200)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		encryptedRoom.RoomID: encryptedRoom,
+		plainRoom.RoomID:     plainRoom,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				encryptedRoom.RoomID: &encryptedRoom,
+				plainRoom.RoomID:     &plainRoom,
+			}, map[string]internal.EventMetadata{
+				encryptedRoom.RoomID: {NID: 1, Timestamp: 1},
+				plainRoom.RoomID:     {NID: 2, Timestamp: 2},
+			}, nil, nil
+	}
+	store := &unreadEventsStore{}
+	userCache := caches.NewUserCache(userID, globalCache, store, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	encrypted := true
+	mentioned := false
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:    []string{sync3.SortByRecency},
+			Ranges:  sync3.SliceRanges([][2]int64{{0, 9}}),
+			Filters: &sync3.RequestFilters{IsEncrypted: &encrypted, IsMentioned: &mentioned},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if !reflect.DeepEqual(store.roomIDs, []string{encryptedRoom.RoomID}) {
+		t.Errorf("calculated mentions for %v, want only %s", store.roomIDs, encryptedRoom.RoomID)
+	}
+	if res.Lists["a"].Count != 1 {
+		t.Errorf("got count %d want 1", res.Lists["a"].Count)
+	}
+}
+
+type mentionsStore struct {
+	NopUserCacheStore
+	mention json.RawMessage
+}
+
+func (s *mentionsStore) UnreadEvents(userID string, roomIDs []string, to int64, limit int) (map[string][]state.Event, error) {
+	result := make(map[string][]state.Event, len(roomIDs))
+	for _, roomID := range roomIDs {
+		result[roomID] = []state.Event{{JSON: s.mention}}
+	}
+	return result, nil
+}
+
+// Test that mentions are calculated for rooms which start to pass the list's other filters later.
+func TestConnStateMentionsForRoomsEnteringList(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateMentionsForRoomsEnteringList_alice:localhost"
+	deviceID := "yep"
+	room := newRoomMetadata("!a:localhost", 100)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		room.RoomID: room,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				room.RoomID: &room,
+			}, map[string]internal.EventMetadata{
+				room.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	store := &mentionsStore{
+		mention: json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","sender":"@bob:localhost","content":{"body":"hi","m.mentions":{"user_ids":["%s"]}}}`, userID)),
+	}
+	userCache := caches.NewUserCache(userID, globalCache, store, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	mentioned := true
+	newRequest := func() *sync3.Request {
+		return &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:    []string{sync3.SortByRecency},
+				Ranges:  sync3.SliceRanges([][2]int64{{0, 9}}),
+				Filters: &sync3.RequestFilters{Tags: []string{"m.favourite"}, IsMentioned: &mentioned},
+			}},
+		}
+	}
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, newRequest(), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["a"].Count != 0 {
+		t.Fatalf("got count %d want 0", res.Lists["a"].Count)
+	}
+
+	// favouriting the room means it passes the other filters, so it should be checked for mentions
+	userCache.OnAccountData(context.Background(), []state.AccountData{{
+		UserID: userID,
+		RoomID: room.RoomID,
+		Type:   "m.tag",
+		Data:   []byte(`{"type":"m.tag","content":{"tags":{"m.favourite":{}}}}`),
+	}})
+	res, err = cs.OnIncomingRequest(context.Background(), ConnID, newRequest(), false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["a"].Count != 1 {
+		t.Errorf("got count %d want 1", res.Lists["a"].Count)
+	}
+}
+
+// Test that left rooms are shown and filtered as they were when the user left, not as they are now.
+func TestConnStateLeftRoomsUseStateAtLeave(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateLeftRoomsUseStateAtLeave_alice:localhost"
+	deviceID := "yep"
+	room := newRoomMetadata("!left:localhost", 100)
+	room.NameEvent = "New Name"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		room.RoomID: room,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 10, map[string]*internal.RoomMetadata{}, map[string]internal.EventMetadata{}, nil, nil
+	}
+	globalCache.LoadLeftRoomsOverride = func(userID string) (leftRooms map[string]*internal.RoomMetadata, leaveTimings map[string]internal.EventMetadata, err error) {
+		// the room was renamed after alice left
+		leftRoom := room.DeepCopy()
+		leftRoom.NameEvent = "Old Name"
+		return map[string]*internal.RoomMetadata{
+				room.RoomID: leftRoom,
+			}, map[string]internal.EventMetadata{
+				room.RoomID: {NID: 5, Timestamp: 50},
+			}, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	isLeft := true
+	res, err := cs.OnIncomingRequest(context.Background(), ConnID, &sync3.Request{
+		Lists: map[string]sync3.RequestList{"a": {
+			Sort:    []string{sync3.SortByRecency},
+			Ranges:  sync3.SliceRanges([][2]int64{{0, 9}}),
+			Filters: &sync3.RequestFilters{IsLeft: &isLeft, RoomNameFilter: "old"},
+			RoomSubscription: sync3.RoomSubscription{
+				TimelineLimit: 1,
+			},
+		}},
+	}, false, time.Now())
+	if err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+	if res.Lists["a"].Count != 1 {
+		t.Fatalf("got count %d want 1", res.Lists["a"].Count)
+	}
+	if got := res.Rooms[room.RoomID].Name; got != "Old Name" {
+		t.Errorf("got name %q want the name when the user left", got)
+	}
+}
+
+// Test that lists can be explained whilst the client is long polling.
+func TestConnStateExplainListDuringLongPoll(t *testing.T) {
+	ConnID := sync3.ConnID{
+		DeviceID: "d",
+	}
+	userID := "@TestConnStateExplainListDuringLongPoll_alice:localhost"
+	deviceID := "yep"
+	room := newRoomMetadata("!a:localhost", 100)
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		room.RoomID: room,
+	})
+	globalCache.LoadJoinedRoomsOverride = func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, loadPositions map[string]int64, err error) {
+		return 1, map[string]*internal.RoomMetadata{
+				room.RoomID: &room,
+			}, map[string]internal.EventMetadata{
+				room.RoomID: {NID: 1, Timestamp: 1},
+			}, nil, nil
+	}
+	userCache := caches.NewUserCache(userID, globalCache, &NopUserCacheStore{}, &NopTransactionFetcher{}, &joinChecker{})
+	userCache.LazyLoadTimelinesOverride = mockLazyRoomOverride
+	cs := NewConnState(userID, deviceID, userCache, globalCache, &NopExtensionHandler{}, &NopJoinTracker{}, nil, nil, 1000, 0)
+	newRequest := func() *sync3.Request {
+		return &sync3.Request{
+			Lists: map[string]sync3.RequestList{"a": {
+				Sort:   []string{sync3.SortByRecency},
+				Ranges: sync3.SliceRanges([][2]int64{{0, 9}}),
+			}},
+		}
+	}
+	if _, err := cs.OnIncomingRequest(context.Background(), ConnID, newRequest(), false, time.Now()); err != nil {
+		t.Fatalf("OnIncomingRequest returned error : %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := newRequest()
+		req.SetTimeoutMSecs(10000)
+		cs.OnIncomingRequest(ctx, ConnID, req, false, time.Now())
+	}()
+	time.Sleep(50 * time.Millisecond) // let the request start long polling
+
+	explained := make(chan sync3.ListExplanation, 1)
+	go func() {
+		ex, _ := cs.ExplainList("a")
+		explained <- ex
+	}()
+	select {
+	case ex := <-explained:
+		if len(ex.Rooms) != 1 {
+			t.Errorf("ExplainList: got %d rooms want 1", len(ex.Rooms))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("ExplainList waited for the long poll")
+	}
+	cancel()
+	<-done
+}
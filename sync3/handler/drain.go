@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Drain prepares the handler for shutdown. New connections are rejected, outstanding requests
+// return immediately with the data they have, and later requests on existing connections do not
+// wait for new data. /ready reports that the proxy is not ready, so load balancers stop sending
+// requests here.
+func (h *SyncLiveHandler) Drain() {
+	h.draining.Store(true)
+	numConns := h.ConnMap.CancelOutstandingRequests()
+	logger.Info().Int("num_conns", numConns).Msg("draining connections")
+}
+
+// checkDraining rejects new connections whilst draining. Clients should retry, which will make
+// the connection on another instance of the proxy or after this one restarts.
+func (h *SyncLiveHandler) checkDraining() *internal.HandlerError {
+	if !h.draining.Load() {
+		return nil
+	}
+	return &internal.HandlerError{
+		StatusCode: http.StatusServiceUnavailable,
+		Err:        fmt.Errorf("proxy is shutting down"),
+	}
+}
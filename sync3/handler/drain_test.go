@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestDrain(t *testing.T) {
+	h := &SyncLiveHandler{
+		ConnMap:    sync3.NewConnMap(false, time.Minute),
+		Dispatcher: sync3.NewDispatcher(),
+	}
+	defer h.ConnMap.Teardown()
+	if herr := h.checkDraining(); herr != nil {
+		t.Fatalf("checkDraining: got %v before draining", herr)
+	}
+	assertReady(t, h, 0, 0)
+
+	h.Drain()
+	herr := h.checkDraining()
+	if herr == nil || herr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("checkDraining: got %v want HTTP 503", herr)
+	}
+	w := httptest.NewRecorder()
+	h.ServeReady(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("ServeReady: got status %d want 503 whilst draining", w.Code)
+	}
+	var got struct {
+		Ready bool `json:"ready"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("ServeReady: invalid JSON: %s", err)
+	}
+	if got.Ready {
+		t.Fatalf("ServeReady: got ready whilst draining")
+	}
+}
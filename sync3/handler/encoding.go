@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeCBOR = "application/cbor"
+	encodingGzip    = "gzip"
+	encodingZstd    = "zstd"
+)
+
+// encoders are expensive to create, especially zstd, so they are reused between responses.
+var (
+	gzipWriters = sync.Pool{
+		New: func() interface{} { return gzip.NewWriter(nil) },
+	}
+	zstdWriters = sync.Pool{
+		New: func() interface{} {
+			// only errors with invalid options
+			w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return w
+		},
+	}
+)
+
+// responseEncoding is the encoding of a response body, negotiated with the Accept and
+// Accept-Encoding headers of the request.
+type responseEncoding struct {
+	contentType     string
+	contentEncoding string // empty for no compression
+}
+
+func negotiateEncoding(req *http.Request) responseEncoding {
+	enc := responseEncoding{
+		contentType: contentTypeJSON,
+	}
+	accept := parseQualityValues(req.Header.Values("Accept"))
+	if q, ok := accept[contentTypeCBOR]; ok && q > 0 && q >= accept[contentTypeJSON] {
+		enc.contentType = contentTypeCBOR
+	}
+	// prefer zstd as it is faster and smaller, unless the client prefers gzip
+	acceptEncoding := parseQualityValues(req.Header.Values("Accept-Encoding"))
+	zstdQ, gzipQ := acceptEncoding[encodingZstd], acceptEncoding[encodingGzip]
+	if zstdQ > 0 && zstdQ >= gzipQ {
+		enc.contentEncoding = encodingZstd
+	} else if gzipQ > 0 {
+		enc.contentEncoding = encodingGzip
+	}
+	return enc
+}
+
+// parseQualityValues parses headers like `Accept-Encoding: gzip;q=0.5, zstd` into a map of
+// value to quality. Values without a quality have a quality of 1.
+func parseQualityValues(headers []string) map[string]float64 {
+	result := make(map[string]float64)
+	for _, header := range headers {
+		for _, part := range strings.Split(header, ",") {
+			params := strings.Split(part, ";")
+			value := strings.ToLower(strings.TrimSpace(params[0]))
+			if value == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || strings.TrimSpace(k) != "q" {
+					continue
+				}
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = parsed
+				}
+			}
+			result[value] = q
+		}
+	}
+	return result
+}
+
+// writeResponse writes the response in the encoding negotiated with the client.
+func (h *SyncLiveHandler) writeResponse(w http.ResponseWriter, req *http.Request, resp *sync3.Response) error {
+	enc := negotiateEncoding(req)
+	w.Header().Set("Content-Type", enc.contentType)
+	w.Header().Add("Vary", "Accept, Accept-Encoding")
+	if enc.contentEncoding != "" {
+		w.Header().Set("Content-Encoding", enc.contentEncoding)
+	}
+	w.WriteHeader(200)
+
+	wire := &countingWriter{w: w}
+	var body io.Writer = wire
+	var closeBody func() error
+	switch enc.contentEncoding {
+	case encodingGzip:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		gw.Reset(wire)
+		defer gzipWriters.Put(gw)
+		body, closeBody = gw, gw.Close
+	case encodingZstd:
+		zw := zstdWriters.Get().(*zstd.Encoder)
+		zw.Reset(wire)
+		defer zstdWriters.Put(zw)
+		body, closeBody = zw, zw.Close
+	}
+	jsonSize, err := encodeResponse(body, enc.contentType, resp)
+	if closeBody != nil {
+		if closeErr := closeBody(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if h.responseBytes != nil {
+		h.responseBytes.WithLabelValues(enc.contentType, enc.contentEncoding).Add(float64(wire.n))
+		h.responseJSONBytes.WithLabelValues(enc.contentType, enc.contentEncoding).Add(float64(jsonSize))
+	}
+	return nil
+}
+
+// encodeResponse writes the response as this content type. Returns the size of the response as JSON.
+func encodeResponse(w io.Writer, contentType string, resp *sync3.Response) (jsonSize int64, err error) {
+	if contentType != contentTypeCBOR {
+		cw := &countingWriter{w: w}
+		err = json.NewEncoder(cw).Encode(resp)
+		return cw.n, err
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return 0, err
+	}
+	cborData, err := jsonToCBOR(data)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(cborData)
+	return int64(len(data)), err
+}
+
+// jsonToCBOR converts JSON to CBOR. Responses are converted rather than marshalled as CBOR directly
+// because events are held as raw JSON, which would be marshalled as byte strings.
+func jsonToCBOR(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON: %w", err)
+	}
+	return cbor.Marshal(convertJSONNumbers(v))
+}
+
+// convertJSONNumbers replaces json.Numbers with integers where possible, else floats.
+func convertJSONNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range val {
+			val[k] = convertJSONNumbers(elem)
+		}
+	case []interface{}:
+		for i, elem := range val {
+			val[i] = convertJSONNumbers(elem)
+		}
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	}
+	return v
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
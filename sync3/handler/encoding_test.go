@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		accept         string
+		acceptEncoding string
+		want           responseEncoding
+	}{
+		{
+			want: responseEncoding{contentType: contentTypeJSON},
+		},
+		{
+			accept: "*/*", acceptEncoding: "identity",
+			want: responseEncoding{contentType: contentTypeJSON},
+		},
+		{
+			accept: "application/cbor", acceptEncoding: "gzip, deflate",
+			want: responseEncoding{contentType: contentTypeCBOR, contentEncoding: encodingGzip},
+		},
+		{
+			accept: "application/json, application/cbor;q=0.5", acceptEncoding: "gzip, zstd",
+			want: responseEncoding{contentType: contentTypeJSON, contentEncoding: encodingZstd},
+		},
+		{
+			accept: "application/json;q=0.5, application/cbor", acceptEncoding: "gzip, zstd;q=0.1",
+			want: responseEncoding{contentType: contentTypeCBOR, contentEncoding: encodingGzip},
+		},
+		{
+			accept: "application/cbor;q=0", acceptEncoding: "zstd;q=0, gzip;q=0",
+			want: responseEncoding{contentType: contentTypeJSON},
+		},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/sync", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		if got := negotiateEncoding(req); got != tc.want {
+			t.Errorf("Accept: %q Accept-Encoding: %q got %+v want %+v", tc.accept, tc.acceptEncoding, got, tc.want)
+		}
+	}
+}
+
+func TestWriteResponseEncodings(t *testing.T) {
+	resp := &sync3.Response{
+		Pos: "5",
+		Rooms: map[string]sync3.Room{
+			"!a:localhost": {
+				Name:     "A",
+				Timeline: []json.RawMessage{json.RawMessage(`{"type":"m.room.message","origin_server_ts":1700000000000,"content":{"body":"hi"}}`)},
+			},
+		},
+	}
+	h := &SyncLiveHandler{}
+	for _, accept := range []string{contentTypeJSON, contentTypeCBOR} {
+		for _, acceptEncoding := range []string{"", encodingGzip, encodingZstd} {
+			req := httptest.NewRequest("POST", "/sync", nil)
+			req.Header.Set("Accept", accept)
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+			w := httptest.NewRecorder()
+			if err := h.writeResponse(w, req, resp); err != nil {
+				t.Fatalf("%s %s: writeResponse: %s", accept, acceptEncoding, err)
+			}
+			if got := w.Header().Get("Content-Type"); got != accept {
+				t.Errorf("%s %s: got Content-Type %s", accept, acceptEncoding, got)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != acceptEncoding {
+				t.Errorf("%s %s: got Content-Encoding %s", accept, acceptEncoding, got)
+			}
+
+			var body io.Reader = w.Body
+			switch acceptEncoding {
+			case encodingGzip:
+				gr, err := gzip.NewReader(body)
+				if err != nil {
+					t.Fatalf("%s %s: gzip.NewReader: %s", accept, acceptEncoding, err)
+				}
+				body = gr
+			case encodingZstd:
+				zr, err := zstd.NewReader(body)
+				if err != nil {
+					t.Fatalf("%s %s: zstd.NewReader: %s", accept, acceptEncoding, err)
+				}
+				defer zr.Close()
+				body = zr
+			}
+			data, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("%s %s: failed to read body: %s", accept, acceptEncoding, err)
+			}
+
+			var got struct {
+				Pos   string `json:"pos"`
+				Rooms map[string]struct {
+					Timeline []struct {
+						Type           string `json:"type"`
+						OriginServerTS int64  `json:"origin_server_ts"`
+					} `json:"timeline"`
+				} `json:"rooms"`
+			}
+			if accept == contentTypeCBOR {
+				err = cbor.Unmarshal(data, &got)
+			} else {
+				err = json.Unmarshal(data, &got)
+			}
+			if err != nil {
+				t.Fatalf("%s %s: failed to decode body: %s", accept, acceptEncoding, err)
+			}
+			timeline := got.Rooms["!a:localhost"].Timeline
+			if got.Pos != "5" || len(timeline) != 1 || timeline[0].Type != "m.room.message" || timeline[0].OriginServerTS != 1700000000000 {
+				t.Errorf("%s %s: got %+v", accept, acceptEncoding, got)
+			}
+		}
+	}
+}
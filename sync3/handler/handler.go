@@ -12,6 +12,7 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -59,6 +60,20 @@ type SyncLiveHandler struct {
 	GlobalCache            *caches.GlobalCache
 	maxPendingEventUpdates int
 	maxTransactionIDDelay  time.Duration
+	// only connection snapshots taken before this time are restored, as later snapshots are for
+	// connections in this process.
+	startTime time.Time
+	// true if started with StartupLazy, in which case rooms are loaded as users connect. totalRooms
+	// is the number of rooms known at startup, used to report warm-up progress.
+	lazy       bool
+	totalRooms int
+	// quotas applied to each user, see SetLimits
+	limits      Limits
+	rateLimiter *rateLimiter
+	// the default budget for each response, see SetResponseBudget
+	responseBudget sync3.ResponseBudget
+	// true once Drain has been called
+	draining atomic.Bool
 
 	setupHistVec *prometheus.HistogramVec
 	histVec      *prometheus.HistogramVec
@@ -68,6 +83,10 @@ type SyncLiveHandler struct {
 	// TODO: could make this a CounterVec labelled by reason, to track expiry due
 	//       to update buffer filling, expiry due to inactivity, etc.
 	destroyedConns prometheus.Counter
+	limitedReqs    *prometheus.CounterVec
+	// bytes of response bodies as sent, and as they would have been as uncompressed JSON
+	responseBytes     *prometheus.CounterVec
+	responseJSONBytes *prometheus.CounterVec
 }
 
 func NewSync3Handler(
@@ -86,7 +105,10 @@ func NewSync3Handler(
 		GlobalCache:            caches.NewGlobalCache(store),
 		maxPendingEventUpdates: maxPendingEventUpdates,
 		maxTransactionIDDelay:  maxTransactionIDDelay,
+		startTime:              time.Now(),
 	}
+	sh.ConnMap.SetSnapshotCallback(sh.storeConnSnapshot)
+	sh.ConnMap.SetCloseCallback(sh.deleteConnSnapshot)
 	sh.Extensions = &extensions.Handler{
 		Store:       store,
 		E2EEFetcher: sh,
@@ -113,6 +135,23 @@ func (h *SyncLiveHandler) Startup(storeSnapshot *state.StartupSnapshot) error {
 	if err := h.GlobalCache.Startup(storeSnapshot.GlobalMetadata); err != nil {
 		return fmt.Errorf("failed to populate global cache: %s", err)
 	}
+	h.totalRooms = len(storeSnapshot.GlobalMetadata)
+	return nil
+}
+
+// StartupLazy is an alternative to Startup which does not load a snapshot of every room. Instead,
+// the rooms a user is in are loaded when their user cache is first created, and other rooms are
+// loaded when events arrive in them.
+func (h *SyncLiveHandler) StartupLazy() error {
+	totalRooms, err := h.Storage.NumRooms()
+	if err != nil {
+		return fmt.Errorf("failed to count rooms: %s", err)
+	}
+	h.Dispatcher.StartupLazy(h.Storage.RoomMembershipsAfterEventPosition)
+	h.Dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, h.GlobalCache)
+	h.GlobalCache.StartupLazy()
+	h.lazy = true
+	h.totalRooms = totalRooms
 	return nil
 }
 
@@ -135,6 +174,7 @@ func (h *SyncLiveHandler) Teardown() {
 	h.V2Sub.Teardown()
 	h.EnsurePoller.Teardown()
 	h.ConnMap.Teardown()
+	h.GlobalCache.Teardown()
 	if h.setupHistVec != nil {
 		prometheus.Unregister(h.setupHistVec)
 	}
@@ -147,6 +187,15 @@ func (h *SyncLiveHandler) Teardown() {
 	if h.destroyedConns != nil {
 		prometheus.Unregister(h.destroyedConns)
 	}
+	if h.limitedReqs != nil {
+		prometheus.Unregister(h.limitedReqs)
+	}
+	if h.responseBytes != nil {
+		prometheus.Unregister(h.responseBytes)
+	}
+	if h.responseJSONBytes != nil {
+		prometheus.Unregister(h.responseJSONBytes)
+	}
 }
 
 func (h *SyncLiveHandler) addPrometheusMetrics() {
@@ -176,11 +225,32 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Name:      "destroyed_conns",
 		Help:      "Counter of conns that were destroyed.",
 	})
+	h.limitedReqs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "limited_requests",
+		Help:      "Counter of requests rejected with M_LIMIT_EXCEEDED, labelled by the limit exceeded.",
+	}, []string{"limit"})
+	h.responseBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "response_bytes",
+		Help:      "Bytes of response bodies sent, labelled by content type and encoding.",
+	}, []string{"content_type", "content_encoding"})
+	h.responseJSONBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "response_json_bytes",
+		Help:      "Bytes the response bodies in response_bytes would have been as uncompressed JSON. The difference is the bytes saved.",
+	}, []string{"content_type", "content_encoding"})
 
 	prometheus.MustRegister(h.setupHistVec)
 	prometheus.MustRegister(h.histVec)
 	prometheus.MustRegister(h.slowReqs)
 	prometheus.MustRegister(h.destroyedConns)
+	prometheus.MustRegister(h.limitedReqs)
+	prometheus.MustRegister(h.responseBytes)
+	prometheus.MustRegister(h.responseJSONBytes)
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -256,6 +326,9 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			}
 		}
 	}
+	if herr := h.checkRequestLimits(&requestBody); herr != nil {
+		return herr
+	}
 
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
 		if herr.StatusCode >= 500 {
@@ -291,7 +364,13 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		timeout = int(timeout64)
 	}
 
+	if h.draining.Load() {
+		// don't hold up shutdown waiting for new data
+		timeout = 0
+	}
+
 	requestBody.SetTimeoutMSecs(timeout)
+	requestBody.SetAcceptLanguage(req.Header.Get("Accept-Language"))
 	log.Trace().Int("timeout", timeout).Msg("recv")
 
 	resp, herr := conn.OnIncomingRequest(req.Context(), &requestBody, start)
@@ -318,9 +397,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		numChangedDevices, numLeftDevices, requestBody.ConnID, len(requestBody.Lists), len(requestBody.RoomSubscriptions), len(requestBody.UnsubscribeRooms),
 	)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(200)
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
+	if err := h.writeResponse(w, req, resp); err != nil {
 		herr = &internal.HandlerError{
 			StatusCode: 500,
 			Err:        err,
@@ -335,7 +412,7 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 			herr.StatusCode = 499
 		}
 
-		logErrorOrWarning("failed to JSON-encode result", herr)
+		logErrorOrWarning("failed to encode result", herr)
 		return herr
 	}
 	return nil
@@ -349,34 +426,9 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	req = req.WithContext(ctx)
 	defer task.End()
 	var conn *sync3.Conn
-	// Extract an access token
-	accessToken, err := internal.ExtractAccessToken(req)
-	if err != nil || accessToken == "" {
-		hlog.FromRequest(req).Warn().Err(err).Msg("failed to get access token from request")
-		return req, nil, &internal.HandlerError{
-			StatusCode: http.StatusUnauthorized,
-			Err:        err,
-		}
-	}
-
-	// Try to lookup a record of this token
-	var token *sync2.Token
-	token, err = h.V2Store.TokensTable.Token(accessToken)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
-			newToken, herr := h.identifyUnknownAccessToken(req.Context(), accessToken, hlog.FromRequest(req))
-			if herr != nil {
-				return req, nil, herr
-			}
-			token = newToken
-		} else {
-			hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
-			return req, nil, &internal.HandlerError{
-				StatusCode: http.StatusInternalServerError,
-				Err:        err,
-			}
-		}
+	token, herr := h.identifyToken(req)
+	if herr != nil {
+		return req, nil, herr
 	}
 	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagUserID, token.UserID))
 	req = req.WithContext(internal.SetAttributeOnContext(req.Context(), internal.OTLPTagDeviceID, token.DeviceID))
@@ -388,8 +440,13 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	req = req.WithContext(internal.AssociateUserIDWithRequest(req.Context(), token.UserID, token.DeviceID))
 	internal.Logf(req.Context(), "setupConnection", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
 
+	if herr := h.checkRateLimit(token.UserID); herr != nil {
+		log.Warn().Err(herr).Msg("rate limited")
+		return req, nil, herr
+	}
+
 	// Record the fact that we've recieved a request from this token
-	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
+	err := h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
 	if err != nil {
 		// Not fatal---log and continue.
 		log.Warn().Err(err).Msg("Unable to update last seen timestamp")
@@ -409,23 +466,30 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 			log.Trace().Str("conn", conn.ConnID.String()).Msg("reusing conn")
 			return req, conn, nil
 		}
+		if herr := h.checkDraining(); herr != nil {
+			return req, nil, herr
+		}
+		// the connection may have been snapshotted before the proxy restarted
+		conn, herr := h.restoreConnection(req.Context(), cancel, connID, token, log)
+		if herr != nil {
+			return req, nil, herr
+		}
+		if conn != nil {
+			return req, conn, nil
+		}
 		// conn doesn't exist, we probably nuked it.
 		return req, nil, internal.ExpiredSessionError()
 	}
 
-	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
-	log.Trace().Any("pid", pid).Msg("checking poller exists and is running")
-	expiredToken := h.EnsurePoller.EnsurePolling(req.Context(), pid, token.AccessTokenHash)
-	if expiredToken {
-		log.Error().Msg("EnsurePolling failed, returning 401")
-		// Assumption: the only way that EnsurePolling fails is if the access token is invalid.
-		return req, nil, &internal.HandlerError{
-			StatusCode: http.StatusUnauthorized,
-			ErrCode:    "M_UNKNOWN_TOKEN",
-			Err:        fmt.Errorf("EnsurePolling failed: access token invalid or invalidated"),
-		}
+	if herr := h.checkDraining(); herr != nil {
+		return req, nil, herr
+	}
+	if herr := h.checkConnLimit(connID); herr != nil {
+		return req, nil, herr
+	}
+	if herr := h.ensurePolling(req.Context(), token, log); herr != nil {
+		return req, nil, herr
 	}
-	log.Trace().Msg("poller exists and is running")
 	// this may take a while so if the client has given up (e.g timed out) by this point, just stop.
 	// We'll be quicker next time as the poller will already exist.
 	if req.Context().Err() != nil {
@@ -454,12 +518,137 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, cancel context.Canc
 	// to check for an existing connection though, as it's possible for the client to call /sync
 	// twice for a new connection.
 	conn = h.ConnMap.CreateConn(connID, cancel, func() sync3.ConnHandler {
-		return NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs := NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs.serverBudget = h.responseBudget
+		return cs
 	})
 	log.Info().Msg("created new connection")
 	return req, conn, nil
 }
 
+// identifyToken looks up the access token in this request, asking the homeserver who owns it if
+// it is a token we haven't seen before.
+func (h *SyncLiveHandler) identifyToken(req *http.Request) (*sync2.Token, *internal.HandlerError) {
+	accessToken, err := internal.ExtractAccessToken(req)
+	if err != nil || accessToken == "" {
+		hlog.FromRequest(req).Warn().Err(err).Msg("failed to get access token from request")
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			Err:        err,
+		}
+	}
+
+	// Try to lookup a record of this token
+	token, err := h.V2Store.TokensTable.Token(accessToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			hlog.FromRequest(req).Info().Msg("Received connection from unknown access token, querying with homeserver")
+			return h.identifyUnknownAccessToken(req.Context(), accessToken, hlog.FromRequest(req))
+		}
+		hlog.FromRequest(req).Err(err).Msg("Failed to lookup access token")
+		return nil, &internal.HandlerError{
+			StatusCode: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	return token, nil
+}
+
+// ensurePolling makes sure there is a poller running for this token's device.
+func (h *SyncLiveHandler) ensurePolling(ctx context.Context, token *sync2.Token, log zerolog.Logger) *internal.HandlerError {
+	pid := sync2.PollerID{UserID: token.UserID, DeviceID: token.DeviceID}
+	log.Trace().Any("pid", pid).Msg("checking poller exists and is running")
+	expiredToken := h.EnsurePoller.EnsurePolling(ctx, pid, token.AccessTokenHash)
+	if expiredToken {
+		log.Error().Msg("EnsurePolling failed, returning 401")
+		// Assumption: the only way that EnsurePolling fails is if the access token is invalid.
+		return &internal.HandlerError{
+			StatusCode: http.StatusUnauthorized,
+			ErrCode:    "M_UNKNOWN_TOKEN",
+			Err:        fmt.Errorf("EnsurePolling failed: access token invalid or invalidated"),
+		}
+	}
+	log.Trace().Msg("poller exists and is running")
+	return nil
+}
+
+// restoreConnection recreates a connection from a snapshot taken before the proxy started. Returns
+// nil if there is no such snapshot. Snapshots are only restored once.
+func (h *SyncLiveHandler) restoreConnection(ctx context.Context, cancel context.CancelFunc, connID sync3.ConnID, token *sync2.Token, log zerolog.Logger) (*sync3.Conn, *internal.HandlerError) {
+	snapshot, err := h.Storage.ConnSnapshotsTable.Select(connID.UserID, connID.DeviceID, connID.CID, h.startTime)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load conn snapshot")
+		return nil, nil
+	}
+	if snapshot == nil {
+		return nil, nil
+	}
+	if err = h.Storage.ConnSnapshotsTable.Delete(connID.UserID, connID.DeviceID, connID.CID); err != nil {
+		log.Warn().Err(err).Msg("failed to delete conn snapshot")
+	}
+	if herr := h.ensurePolling(ctx, token, log); herr != nil {
+		return nil, herr
+	}
+	userCache, err := h.userCache(token.UserID)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load user cache")
+		return nil, &internal.HandlerError{
+			StatusCode: 500,
+			Err:        err,
+		}
+	}
+	defer h.ConnMap.UpdateMetrics()
+	conn, err := h.ConnMap.RestoreConn(connID, cancel, snapshot.Data, func(handlerData json.RawMessage) (sync3.ConnHandler, error) {
+		cs := NewConnState(token.UserID, token.DeviceID, userCache, h.GlobalCache, h.Extensions, h.Dispatcher, h.setupHistVec, h.histVec, h.maxPendingEventUpdates, h.maxTransactionIDDelay)
+		cs.serverBudget = h.responseBudget
+		if err := cs.restore(handlerData); err != nil {
+			cs.Destroy()
+			return nil, err
+		}
+		return cs, nil
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to restore conn from snapshot")
+		return nil, nil
+	}
+	log.Info().Int64("pos", snapshot.Pos).Msg("restored connection from snapshot")
+	return conn, nil
+}
+
+// storeConnSnapshot persists a connection snapshot so that it can be restored after a restart.
+func (h *SyncLiveHandler) storeConnSnapshot(cid sync3.ConnID, pos int64, data []byte) {
+	err := h.Storage.ConnSnapshotsTable.Upsert(state.ConnSnapshot{
+		UserID:   cid.UserID,
+		DeviceID: cid.DeviceID,
+		ConnID:   cid.CID,
+		Pos:      pos,
+		Data:     data,
+	})
+	if err != nil {
+		logger.Warn().Err(err).Str("conn", cid.String()).Msg("failed to store conn snapshot")
+	}
+}
+
+// deleteConnSnapshot deletes the snapshot of a connection which has been closed, as it can no
+// longer be restored.
+func (h *SyncLiveHandler) deleteConnSnapshot(cid sync3.ConnID) {
+	if err := h.Storage.ConnSnapshotsTable.Delete(cid.UserID, cid.DeviceID, cid.CID); err != nil {
+		logger.Warn().Err(err).Str("conn", cid.String()).Msg("failed to delete conn snapshot")
+	}
+}
+
+// SnapshotConnections stores snapshots of every connection, so that clients can carry on using
+// their connections after the proxy restarts. Any outstanding requests are cancelled.
+func (h *SyncLiveHandler) SnapshotConnections() {
+	start := time.Now()
+	numConns := 0
+	h.ConnMap.SnapshotConns(func(cid sync3.ConnID, pos int64, data []byte) {
+		h.storeConnSnapshot(cid, pos, data)
+		numConns++
+	})
+	logger.Info().Int("num_conns", numConns).Str("duration", time.Since(start).String()).Msg("snapshotted connections")
+}
+
 func (h *SyncLiveHandler) identifyUnknownAccessToken(ctx context.Context, accessToken string, logger *zerolog.Logger) (*sync2.Token, *internal.HandlerError) {
 	// We don't recognise the given accessToken. Ask the homeserver who owns it.
 	userID, deviceID, err := h.V2.WhoAmI(ctx, accessToken)
@@ -528,6 +717,11 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	if ok {
 		return c.(*caches.UserCache), nil
 	}
+	if h.lazy {
+		if err := h.warmRoomsForUser(userID); err != nil {
+			return nil, err
+		}
+	}
 	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h, h.Dispatcher)
 	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
 	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
@@ -536,6 +730,12 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to load unread counts: %s", err)
 	}
+	// rooms with zero counts still have upstream counts, so mark them as such to avoid calculating them ourselves
+	unreadRoomIDs, err := h.Storage.UnreadTable.SelectRoomsWithCountsForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rooms with unread counts: %s", err)
+	}
+	uc.OnUpstreamUnreadCounts(unreadRoomIDs)
 	// select the DM account data event and set DM room status
 	directEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.direct"})
 	if err != nil {
@@ -545,6 +745,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), []state.AccountData{directEvent[0]})
 	}
 
+	// select the push rules account data event so we can calculate unread counts when the upstream server doesn't
+	pushRulesEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.push_rules"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load push rules for user %s: %w", userID, err)
+	}
+	if len(pushRulesEvent) == 1 {
+		uc.OnAccountData(context.Background(), []state.AccountData{pushRulesEvent[0]})
+	}
+
 	// select the ignored users account data event and set ignored user list
 	ignoreEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.ignored_user_list"})
 	if err != nil {
@@ -563,6 +772,17 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), tagEvents)
 	}
 
+	// select rooms which have been manually marked as unread, older clients may only set the unstable type
+	for _, evType := range []string{caches.UnstableMarkedUnreadEventType, caches.MarkedUnreadEventType} {
+		markedUnreadEvents, err := h.Storage.RoomAccountDatasWithType(userID, evType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %s", evType, err)
+		}
+		if len(markedUnreadEvents) > 0 {
+			uc.OnAccountData(context.Background(), markedUnreadEvents)
+		}
+	}
+
 	// select outstanding invites
 	invites, err := h.Storage.InvitesTable.SelectAllInvitesForUser(userID)
 	if err != nil {
@@ -572,6 +792,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnInvite(context.Background(), roomID, inviteState)
 	}
 
+	// select outstanding knocks, after invites so accepted knocks are ignored
+	knocks, err := h.Storage.KnocksTable.SelectAllKnocksForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outstanding knocks for user: %s", err)
+	}
+	for roomID, knockState := range knocks {
+		uc.OnKnock(context.Background(), roomID, knockState)
+	}
+
 	// use LoadOrStore here else we can race as 2 brand new /sync conns can both get to this point
 	// at the same time
 	actualUC, loaded := h.userCaches.LoadOrStore(userID, uc)
@@ -651,7 +880,10 @@ func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 	ctx, task := internal.StartTask(context.Background(), "Accumulate")
 	defer task.End()
 	// note: events is sorted in ascending NID order, event if p.EventNIDs isn't.
-	events, err := h.Storage.EventNIDs(p.EventNIDs)
+	// Aggregations are bundled once here rather than per-connection. New events are rarely related
+	// to by the time they are seen, so this is usually a no-op. Thread participation is corrected
+	// per-user by connections, see connStateLive.processLiveUpdate.
+	events, aggregations, err := h.Storage.EventNIDsWithBundledAggregations(p.EventNIDs)
 	if err != nil {
 		logger.Err(err).Str("room", p.RoomID).Msg("Accumulate: failed to EventNIDs")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
@@ -661,6 +893,9 @@ func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 		return
 	}
 	internal.Logf(ctx, "room", fmt.Sprintf("%s: %d events", p.RoomID, len(events)))
+	events = caches.ApplyBundledAggregations(ctx, aggregations, map[string][]json.RawMessage{
+		p.RoomID: events,
+	})[p.RoomID]
 	// we have new events, notify active connections
 	for i := range events {
 		h.Dispatcher.OnNewEvent(ctx, p.RoomID, events[i], p.EventNIDs[i])
@@ -743,6 +978,22 @@ func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 	userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState)
 }
 
+func (h *SyncLiveHandler) OnKnock(p *pubsub.V2KnockRoom) {
+	ctx, task := internal.StartTask(context.Background(), "OnKnock")
+	defer task.End()
+	userCache, ok := h.userCaches.Load(p.UserID)
+	if !ok {
+		return
+	}
+	knockState, err := h.Storage.KnocksTable.SelectKnockState(p.UserID, p.RoomID)
+	if err != nil {
+		logger.Err(err).Str("user", p.UserID).Str("room", p.RoomID).Msg("failed to get knock state")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	userCache.(*caches.UserCache).OnKnock(ctx, p.RoomID, knockState)
+}
+
 func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
 	ctx, task := internal.StartTask(context.Background(), "OnLeftRoom")
 	defer task.End()
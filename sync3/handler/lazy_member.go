@@ -1,5 +1,7 @@
 package handler
 
+import "strings"
+
 type LazyCache struct {
 	cache map[string]struct{}
 	rooms map[string]struct{}
@@ -42,3 +44,16 @@ func (lc *LazyCache) AddUser(roomID, userID string) bool {
 	lc.cache[key] = struct{}{}
 	return true
 }
+
+// members returns the users loaded in each lazy loaded room.
+func (lc *LazyCache) members() map[string][]string {
+	result := make(map[string][]string, len(lc.rooms))
+	for roomID := range lc.rooms {
+		result[roomID] = []string{}
+	}
+	for key := range lc.cache {
+		roomID, userID, _ := strings.Cut(key, " | ")
+		result[roomID] = append(result[roomID], userID)
+	}
+	return result
+}
@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+// Limits are quotas which stop a single client from loading the whole server. Each limit applies
+// per user (or per device for MaxConnsPerDevice). A zero value means no limit.
+type Limits struct {
+	// RequestsPerSecond is the sustained rate of requests a user can make.
+	RequestsPerSecond float64
+	// RequestBurst is the number of requests a user can make at once before being rate limited.
+	// Defaults to RequestsPerSecond, rounded up.
+	RequestBurst int
+	// MaxConnsPerDevice is the number of conn_ids a device can have at once.
+	MaxConnsPerDevice int
+	// MaxLists is the number of lists in a request.
+	MaxLists int
+	// MaxRangeWidth is the number of rooms a single list range can cover.
+	MaxRangeWidth int64
+}
+
+// SetLimits enforces these limits on subsequent requests.
+func (h *SyncLiveHandler) SetLimits(limits Limits) {
+	h.limits = limits
+	h.rateLimiter = nil
+	if limits.RequestsPerSecond > 0 {
+		h.rateLimiter = newRateLimiter(limits.RequestsPerSecond, limits.RequestBurst)
+	}
+}
+
+// checkRequestLimits checks the shape of the request against the limits.
+func (h *SyncLiveHandler) checkRequestLimits(req *sync3.Request) *internal.HandlerError {
+	if h.limits.MaxLists > 0 && len(req.Lists) > h.limits.MaxLists {
+		return h.limitExceeded("lists", 0, fmt.Errorf("too many lists: %d > %d", len(req.Lists), h.limits.MaxLists))
+	}
+	if h.limits.MaxRangeWidth > 0 {
+		for listKey, l := range req.Lists {
+			for _, r := range l.Ranges {
+				if r[1] < r[0] {
+					continue // rejected as an invalid range
+				}
+				// compare the distance between the ends as r[1]-r[0]+1 can overflow. Unsigned
+				// arithmetic gives the right distance even if r[0] is negative.
+				if uint64(r[1])-uint64(r[0]) >= uint64(h.limits.MaxRangeWidth) {
+					return h.limitExceeded("range_width", 0, fmt.Errorf("list[%v] range %v is too wide: more than %d rooms", listKey, r, h.limits.MaxRangeWidth))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkRateLimit consumes a request from this user's allowance.
+func (h *SyncLiveHandler) checkRateLimit(userID string) *internal.HandlerError {
+	if h.rateLimiter == nil {
+		return nil
+	}
+	if retryAfter := h.rateLimiter.take(userID, time.Now()); retryAfter > 0 {
+		return h.limitExceeded("requests", retryAfter, fmt.Errorf("too many requests"))
+	}
+	return nil
+}
+
+// checkConnLimit checks that this device can make a new connection.
+func (h *SyncLiveHandler) checkConnLimit(connID sync3.ConnID) *internal.HandlerError {
+	if h.limits.MaxConnsPerDevice <= 0 {
+		return nil
+	}
+	conns := h.ConnMap.Conns(connID.UserID, connID.DeviceID)
+	if len(conns) < h.limits.MaxConnsPerDevice {
+		return nil
+	}
+	for _, conn := range conns {
+		if conn.ConnID == connID {
+			return nil // the connection is being replaced
+		}
+	}
+	return h.limitExceeded("conns", 0, fmt.Errorf("too many connections for this device: %d", len(conns)))
+}
+
+// limitExceeded returns an M_LIMIT_EXCEEDED error and counts the rejection. If retryAfter is 0,
+// retrying will not help so no retry_after_ms is sent.
+func (h *SyncLiveHandler) limitExceeded(limit string, retryAfter time.Duration, err error) *internal.HandlerError {
+	if h.limitedReqs != nil {
+		h.limitedReqs.WithLabelValues(limit).Inc()
+	}
+	return &internal.HandlerError{
+		StatusCode:   429,
+		Err:          err,
+		ErrCode:      "M_LIMIT_EXCEEDED",
+		RetryAfterMs: retryAfter.Milliseconds(),
+	}
+}
+
+// rateLimiter is a token bucket per user.
+type rateLimiter struct {
+	mu          sync.Mutex
+	rate        float64 // tokens per second
+	burst       float64
+	buckets     map[string]*tokenBucket
+	lastCleanup time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take removes a token from this user's bucket. Returns 0 if there was a token, else how long
+// until there will be one.
+func (r *rateLimiter) take(userID string, now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cleanup(now)
+	b, ok := r.buckets[userID]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[userID] = b
+	}
+	b.tokens = math.Min(r.burst, b.tokens+now.Sub(b.last).Seconds()*r.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	wait := time.Duration((1 - b.tokens) / r.rate * float64(time.Second))
+	if wait < time.Millisecond {
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// cleanup removes buckets which have refilled, as they are the same as a new bucket. Must hold mu.
+func (r *rateLimiter) cleanup(now time.Time) {
+	if now.Sub(r.lastCleanup) < time.Minute {
+		return
+	}
+	r.lastCleanup = now
+	for userID, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, userID)
+		}
+	}
+}
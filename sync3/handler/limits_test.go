@@ -0,0 +1,126 @@
+package handler
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Now()
+	r := newRateLimiter(2, 3)
+	for i := 0; i < 3; i++ {
+		if wait := r.take("@alice:localhost", start); wait != 0 {
+			t.Fatalf("request %d: got wait %v want 0 as it is within the burst", i, wait)
+		}
+	}
+	if wait := r.take("@alice:localhost", start); wait != 500*time.Millisecond {
+		t.Fatalf("got wait %v want 500ms", wait)
+	}
+	// other users are unaffected
+	if wait := r.take("@bob:localhost", start); wait != 0 {
+		t.Fatalf("bob: got wait %v want 0", wait)
+	}
+	// tokens refill over time
+	if wait := r.take("@alice:localhost", start.Add(500*time.Millisecond)); wait != 0 {
+		t.Fatalf("got wait %v want 0 after refilling", wait)
+	}
+	if wait := r.take("@alice:localhost", start.Add(600*time.Millisecond)); wait != 400*time.Millisecond {
+		t.Fatalf("got wait %v want 400ms", wait)
+	}
+	// full buckets are cleaned up
+	r.take("@bob:localhost", start.Add(time.Hour))
+	if len(r.buckets) != 1 {
+		t.Fatalf("got %d buckets want 1", len(r.buckets))
+	}
+}
+
+func TestCheckRequestLimits(t *testing.T) {
+	h := &SyncLiveHandler{}
+	h.SetLimits(Limits{MaxLists: 2, MaxRangeWidth: 20})
+	testCases := []struct {
+		name      string
+		lists     map[string]sync3.RequestList
+		wantError bool
+	}{
+		{
+			name: "within limits",
+			lists: map[string]sync3.RequestList{
+				"a": {Ranges: sync3.SliceRanges{{0, 19}}},
+				"b": {Ranges: sync3.SliceRanges{{0, 9}, {100, 119}}},
+			},
+		},
+		{
+			name: "too many lists",
+			lists: map[string]sync3.RequestList{
+				"a": {}, "b": {}, "c": {},
+			},
+			wantError: true,
+		},
+		{
+			name: "range too wide",
+			lists: map[string]sync3.RequestList{
+				"a": {Ranges: sync3.SliceRanges{{0, 9}, {10, 30}}},
+			},
+			wantError: true,
+		},
+		{
+			name: "range width overflows",
+			lists: map[string]sync3.RequestList{
+				"a": {Ranges: sync3.SliceRanges{{0, math.MaxInt64}}},
+			},
+			wantError: true,
+		},
+		{
+			name: "range width overflows with negative start",
+			lists: map[string]sync3.RequestList{
+				"a": {Ranges: sync3.SliceRanges{{math.MinInt64, math.MaxInt64}}},
+			},
+			wantError: true,
+		},
+	}
+	for _, tc := range testCases {
+		herr := h.checkRequestLimits(&sync3.Request{Lists: tc.lists})
+		if !tc.wantError {
+			if herr != nil {
+				t.Errorf("%s: got error %v want none", tc.name, herr)
+			}
+			continue
+		}
+		if herr == nil {
+			t.Errorf("%s: got no error want M_LIMIT_EXCEEDED", tc.name)
+			continue
+		}
+		if herr.StatusCode != 429 || herr.ErrCode != "M_LIMIT_EXCEEDED" {
+			t.Errorf("%s: got HTTP %d %s want HTTP 429 M_LIMIT_EXCEEDED", tc.name, herr.StatusCode, herr.ErrCode)
+		}
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	h := &SyncLiveHandler{}
+	if herr := h.checkRateLimit("@alice:localhost"); herr != nil {
+		t.Fatalf("got error %v with no limits", herr)
+	}
+	h.SetLimits(Limits{RequestsPerSecond: 0.1})
+	if herr := h.checkRateLimit("@alice:localhost"); herr != nil {
+		t.Fatalf("got error %v for the first request", herr)
+	}
+	herr := h.checkRateLimit("@alice:localhost")
+	if herr == nil {
+		t.Fatalf("got no error for the second request")
+	}
+	var body struct {
+		ErrCode      string `json:"errcode"`
+		RetryAfterMs int64  `json:"retry_after_ms"`
+	}
+	if err := json.Unmarshal(herr.JSON(), &body); err != nil {
+		t.Fatalf("invalid error JSON: %s", err)
+	}
+	if body.ErrCode != "M_LIMIT_EXCEEDED" || body.RetryAfterMs <= 9000 || body.RetryAfterMs > 10000 {
+		t.Fatalf("got %+v want M_LIMIT_EXCEEDED with retry_after_ms of about 10s", body)
+	}
+}
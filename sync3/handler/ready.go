@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// warmRoomsForUser loads the members of every room this user is joined to, so the dispatcher can
+// route events in those rooms to the user's cache. Only needed when started with StartupLazy.
+//
+// Rooms are loaded at the latest position in the database. Events after this position which are
+// dispatched whilst we are loading are applied on top, and rooms which are already warm are not
+// reloaded.
+func (h *SyncLiveHandler) warmRoomsForUser(userID string) error {
+	pos, err := h.Storage.LatestEventNID()
+	if err != nil {
+		return fmt.Errorf("failed to load latest event position: %s", err)
+	}
+	joinTimings, err := h.Storage.JoinedRoomsAfterPosition(userID, pos)
+	if err != nil {
+		return fmt.Errorf("failed to load joined rooms for user %s: %s", userID, err)
+	}
+	if err = h.Dispatcher.WarmRooms(context.Background(), internal.Keys(joinTimings), pos); err != nil {
+		return fmt.Errorf("failed to warm rooms for user %s: %s", userID, err)
+	}
+	return nil
+}
+
+// WarmUpProgress returns the number of rooms loaded into memory and the total number of rooms.
+// Every room is loaded unless the handler was started with StartupLazy.
+func (h *SyncLiveHandler) WarmUpProgress() (warmRooms, totalRooms int) {
+	if !h.lazy {
+		return h.totalRooms, h.totalRooms
+	}
+	warmRooms = h.Dispatcher.NumWarmRooms()
+	// rooms created since startup are warm but are not included in the total
+	if warmRooms > h.totalRooms {
+		return warmRooms, warmRooms
+	}
+	return warmRooms, h.totalRooms
+}
+
+// ServeReady is an http.HandlerFunc which reports whether the proxy is ready to serve requests,
+// along with how many rooms have been loaded. The proxy is ready as soon as it has started, even
+// if rooms are still being loaded lazily, until it is drained.
+func (h *SyncLiveHandler) ServeReady(w http.ResponseWriter, req *http.Request) {
+	warmRooms, totalRooms := h.WarmUpProgress()
+	ready := !h.draining.Load()
+	w.Header().Set("Content-Type", "application/json")
+	if ready {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Ready      bool `json:"ready"`
+		Lazy       bool `json:"lazy"`
+		WarmRooms  int  `json:"warm_rooms"`
+		TotalRooms int  `json:"total_rooms"`
+	}{
+		Ready:      ready,
+		Lazy:       h.lazy,
+		WarmRooms:  warmRooms,
+		TotalRooms: totalRooms,
+	})
+}
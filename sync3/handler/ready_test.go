@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+func TestServeReadyLazy(t *testing.T) {
+	ctx := context.Background()
+	type load struct {
+		roomIDs []string
+		pos     int64
+	}
+	var loads []load
+	dispatcher := sync3.NewDispatcher()
+	dispatcher.StartupLazy(func(ctx context.Context, roomIDs []string, pos int64) (joined, invited map[string][]string, err error) {
+		loads = append(loads, load{roomIDs: roomIDs, pos: pos})
+		return map[string][]string{}, map[string][]string{}, nil
+	})
+	h := &SyncLiveHandler{
+		Dispatcher: dispatcher,
+		lazy:       true,
+		totalRooms: 3,
+	}
+	assertReady(t, h, 0, 3)
+
+	// rooms are only loaded once
+	if err := dispatcher.WarmRooms(ctx, []string{"!a:localhost", "!b:localhost"}, 10); err != nil {
+		t.Fatalf("WarmRooms: %s", err)
+	}
+	if err := dispatcher.WarmRooms(ctx, []string{"!a:localhost"}, 11); err != nil {
+		t.Fatalf("WarmRooms: %s", err)
+	}
+	assertReady(t, h, 2, 3)
+
+	// new events load the room at the position before the event
+	dispatcher.OnNewEvent(ctx, "!c:localhost", json.RawMessage(`{
+		"type":"m.room.message","sender":"@alice:localhost","event_id":"$c","content":{"body":"hi"}
+	}`), 12)
+	assertReady(t, h, 3, 3)
+
+	// new rooms are not loaded, and grow the total
+	dispatcher.OnNewInitialRoomState(ctx, "!d:localhost", nil)
+	assertReady(t, h, 4, 4)
+
+	wantLoads := []load{
+		{roomIDs: []string{"!a:localhost", "!b:localhost"}, pos: 10},
+		{roomIDs: []string{"!c:localhost"}, pos: 11},
+	}
+	if !reflect.DeepEqual(loads, wantLoads) {
+		t.Fatalf("loaded memberships: got %+v want %+v", loads, wantLoads)
+	}
+}
+
+func TestServeReadyEager(t *testing.T) {
+	h := &SyncLiveHandler{
+		Dispatcher: sync3.NewDispatcher(),
+		totalRooms: 5,
+	}
+	assertReady(t, h, 5, 5)
+}
+
+func assertReady(t *testing.T, h *SyncLiveHandler, wantWarm, wantTotal int) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeReady(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != 200 {
+		t.Fatalf("ServeReady: got status %d want 200", w.Code)
+	}
+	var got struct {
+		Ready      bool `json:"ready"`
+		Lazy       bool `json:"lazy"`
+		WarmRooms  int  `json:"warm_rooms"`
+		TotalRooms int  `json:"total_rooms"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("ServeReady: invalid JSON: %s", err)
+	}
+	if !got.Ready || got.Lazy != h.lazy || got.WarmRooms != wantWarm || got.TotalRooms != wantTotal {
+		t.Fatalf("ServeReady: got %+v want warm=%d total=%d lazy=%v", got, wantWarm, wantTotal, h.lazy)
+	}
+}
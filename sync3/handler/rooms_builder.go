@@ -128,6 +128,6 @@ func subKey(subIDs ...int) string {
 }
 
 type BuiltSubscription struct {
-	RoomSubscription sync3.RoomSubscription
-	RoomIDs          []string
+	RoomSubscription sync3.RoomSubscription `json:"room_subscription"`
+	RoomIDs          []string               `json:"room_ids"`
 }
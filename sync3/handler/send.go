@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/rs/zerolog/hlog"
+	"github.com/tidwall/gjson"
+)
+
+// ServeSend is an http.HandlerFunc which forwards requests to the /send and /state endpoints to the
+// homeserver. When an event is sent with a transaction ID, the transaction ID is recorded as soon
+// as the homeserver responds. This means the event can be sent to the sender's connections with
+// its transaction ID immediately, rather than waiting for the sender's poller to see it.
+func (h *SyncLiveHandler) ServeSend(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if herr := h.serveSend(w, req); herr != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(herr.StatusCode)
+		w.Write(herr.JSON())
+	}
+}
+
+func (h *SyncLiveHandler) serveSend(w http.ResponseWriter, req *http.Request) *internal.HandlerError {
+	roomID, txnID, ok := parseSendPath(req.URL.EscapedPath())
+	if !ok {
+		return &internal.HandlerError{
+			StatusCode: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown send path %s", req.URL.EscapedPath()),
+			ErrCode:    "M_UNRECOGNIZED",
+		}
+	}
+	token, herr := h.identifyToken(req)
+	if herr != nil {
+		return herr
+	}
+	accessToken, _ := internal.ExtractAccessToken(req)
+	defer req.Body.Close()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return &internal.HandlerError{
+			StatusCode: http.StatusBadRequest,
+			Err:        err,
+		}
+	}
+	statusCode, respBody, err := h.V2.SendEvent(req.Context(), accessToken, req.URL.RequestURI(), body)
+	if err != nil {
+		hlog.FromRequest(req).Warn().Err(err).Str("room", roomID).Msg("failed to forward send request")
+		return &internal.HandlerError{
+			StatusCode: http.StatusBadGateway,
+			Err:        err,
+		}
+	}
+	if statusCode == http.StatusOK && txnID != "" {
+		if eventID := gjson.GetBytes(respBody, "event_id").Str; eventID != "" {
+			h.recordTransactionID(req.Context(), token.UserID, token.DeviceID, roomID, eventID, txnID)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(respBody)
+	return nil
+}
+
+// recordTransactionID stores the transaction ID of an event sent by this device, and releases the
+// event to the sender's connections if it arrived before the homeserver responded.
+func (h *SyncLiveHandler) recordTransactionID(ctx context.Context, userID, deviceID, roomID, eventID, txnID string) {
+	err := h.Storage.TransactionsTable.Insert(userID, deviceID, map[string]string{eventID: txnID})
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("device", deviceID).Str("event", eventID).Msg("failed to persist txn ID for sent event")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	h.Dispatcher.RememberTransactionID(eventID, txnID)
+
+	var nids map[string]int64
+	err = sqlutil.WithTransaction(h.Storage.DB, func(txn *sqlx.Tx) error {
+		nids, err = h.Storage.EventsTable.SelectNIDsByIDs(txn, []string{eventID})
+		return err
+	})
+	if err != nil {
+		logger.Err(err).Str("event", eventID).Msg("failed to select nid for sent event")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if nid, ok := nids[eventID]; ok {
+		h.ConnMap.ClearUpdateQueues(userID, roomID, nid)
+	}
+}
+
+// parseSendPath returns the room ID and transaction ID from the escaped path of a request to
+// /rooms/{roomID}/send/{eventType}/{txnID} or /rooms/{roomID}/state/{eventType}/{stateKey}. The
+// transaction ID is empty for /state requests, as state events do not have one.
+func parseSendPath(escapedPath string) (roomID, txnID string, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(escapedPath, "/"), "/")
+	// _matrix client {version} rooms {roomID} {send|state} {eventType} ...
+	if len(parts) < 7 || parts[0] != "_matrix" || parts[1] != "client" || parts[3] != "rooms" || parts[6] == "" {
+		return "", "", false
+	}
+	roomID, err := url.PathUnescape(parts[4])
+	if err != nil || roomID == "" {
+		return "", "", false
+	}
+	switch parts[5] {
+	case "send":
+		if len(parts) != 8 {
+			return "", "", false
+		}
+		txnID, err = url.PathUnescape(parts[7])
+		if err != nil || txnID == "" {
+			return "", "", false
+		}
+		return roomID, txnID, true
+	case "state":
+		// the state key is optional
+		if len(parts) > 8 {
+			return "", "", false
+		}
+		return roomID, "", true
+	}
+	return "", "", false
+}
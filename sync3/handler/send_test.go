@@ -0,0 +1,77 @@
+package handler
+
+import "testing"
+
+func TestParseSendPath(t *testing.T) {
+	testCases := []struct {
+		name       string
+		path       string
+		wantOK     bool
+		wantRoomID string
+		wantTxnID  string
+	}{
+		{
+			name:       "send",
+			path:       "/_matrix/client/v3/rooms/!foo:bar/send/m.room.message/txn1",
+			wantOK:     true,
+			wantRoomID: "!foo:bar",
+			wantTxnID:  "txn1",
+		},
+		{
+			name:       "send with escaped room ID and txn ID",
+			path:       "/_matrix/client/r0/rooms/%21foo%3Abar/send/m.room.message/txn%2F1",
+			wantOK:     true,
+			wantRoomID: "!foo:bar",
+			wantTxnID:  "txn/1",
+		},
+		{
+			name:       "state with state key",
+			path:       "/_matrix/client/v3/rooms/!foo:bar/state/m.room.member/@alice:bar",
+			wantOK:     true,
+			wantRoomID: "!foo:bar",
+		},
+		{
+			name:       "state without state key",
+			path:       "/_matrix/client/v3/rooms/!foo:bar/state/m.room.name",
+			wantOK:     true,
+			wantRoomID: "!foo:bar",
+		},
+		{
+			name: "send without txn ID",
+			path: "/_matrix/client/v3/rooms/!foo:bar/send/m.room.message",
+		},
+		{
+			name: "send with empty txn ID",
+			path: "/_matrix/client/v3/rooms/!foo:bar/send/m.room.message/",
+		},
+		{
+			name: "send with trailing segments",
+			path: "/_matrix/client/v3/rooms/!foo:bar/send/m.room.message/txn1/extra",
+		},
+		{
+			name: "state with trailing segments",
+			path: "/_matrix/client/v3/rooms/!foo:bar/state/m.room.member/@alice:bar/extra",
+		},
+		{
+			name: "redact",
+			path: "/_matrix/client/v3/rooms/!foo:bar/redact/$event/txn1",
+		},
+		{
+			name: "not a room path",
+			path: "/_matrix/client/v3/sync",
+		},
+	}
+	for _, tc := range testCases {
+		roomID, txnID, ok := parseSendPath(tc.path)
+		if ok != tc.wantOK {
+			t.Errorf("%s: got ok=%v want %v", tc.name, ok, tc.wantOK)
+			continue
+		}
+		if roomID != tc.wantRoomID {
+			t.Errorf("%s: got room ID %q want %q", tc.name, roomID, tc.wantRoomID)
+		}
+		if txnID != tc.wantTxnID {
+			t.Errorf("%s: got txn ID %q want %q", tc.name, txnID, tc.wantTxnID)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 type OverwriteVal bool
@@ -29,6 +30,9 @@ var (
 type RoomListDelta struct {
 	ListKey string
 	Op      ListOp
+	// RoomID is the room which should be moved, if it is not the room which was set. This happens
+	// when activity in an old room moves the newest room in lists which merge upgraded rooms.
+	RoomID string
 }
 
 type RoomDelta struct {
@@ -38,6 +42,7 @@ type RoomDelta struct {
 	InviteCountChanged       bool
 	NotificationCountChanged bool
 	HighlightCountChanged    bool
+	UnreadChanged            bool
 	Lists                    []RoomListDelta
 }
 
@@ -47,6 +52,8 @@ type RoomDelta struct {
 type InternalRequestLists struct {
 	allRooms map[string]*RoomConnMetadata
 	lists    map[string]*FilteredSortableRooms
+	// nil means the English room names
+	roomNameTranslations *internal.RoomNameTranslations
 }
 
 func NewInternalRequestLists() *InternalRequestLists {
@@ -56,6 +63,65 @@ func NewInternalRequestLists() *InternalRequestLists {
 	}
 }
 
+// ListsSnapshot is a serialisable copy of InternalRequestLists.
+type ListsSnapshot struct {
+	Rooms []RoomConnMetadata  `json:"rooms"`
+	Lists map[string][]string `json:"lists"` // list key -> sorted room IDs
+}
+
+// NewInternalRequestListsFromSnapshot restores lists from a snapshot. The request lists must be the
+// lists which were in use when the snapshot was taken, so the same filters are applied. Lists are
+// restored in the order they were snapshotted without being resorted.
+func NewInternalRequestListsFromSnapshot(snapshot ListsSnapshot, reqLists map[string]RequestList) *InternalRequestLists {
+	s := &InternalRequestLists{
+		allRooms: make(map[string]*RoomConnMetadata, len(snapshot.Rooms)),
+		lists:    make(map[string]*FilteredSortableRooms, len(snapshot.Lists)),
+	}
+	for i := range snapshot.Rooms {
+		r := snapshot.Rooms[i]
+		if r.LastInterestedEventTimestamps == nil {
+			r.LastInterestedEventTimestamps = make(map[string]uint64)
+		}
+		s.allRooms[r.RoomID] = &r
+	}
+	for listKey, roomIDs := range snapshot.Lists {
+		filter := reqLists[listKey].Filters
+		if filter == nil {
+			filter = &RequestFilters{}
+		}
+		sortedRoomIDs := make([]string, 0, len(roomIDs))
+		for _, roomID := range roomIDs {
+			if _, exists := s.allRooms[roomID]; exists {
+				sortedRoomIDs = append(sortedRoomIDs, roomID)
+			}
+		}
+		list := &FilteredSortableRooms{
+			SortableRooms: NewSortableRooms(s, listKey, sortedRoomIDs),
+			filter:        filter,
+		}
+		for i, roomID := range sortedRoomIDs {
+			list.roomIDToIndex[roomID] = i
+		}
+		s.lists[listKey] = list
+	}
+	return s
+}
+
+// Snapshot returns a copy of all rooms and the current order of each list.
+func (s *InternalRequestLists) Snapshot() ListsSnapshot {
+	snapshot := ListsSnapshot{
+		Rooms: make([]RoomConnMetadata, 0, len(s.allRooms)),
+		Lists: make(map[string][]string, len(s.lists)),
+	}
+	for _, r := range s.allRooms {
+		snapshot.Rooms = append(snapshot.Rooms, *r)
+	}
+	for listKey, list := range s.lists {
+		snapshot.Lists[listKey] = list.RoomIDs()
+	}
+	return snapshot
+}
+
 func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 	existing, exists := s.allRooms[r.RoomID]
 	if exists {
@@ -65,12 +131,13 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		if existing.HighlightCount != r.HighlightCount {
 			delta.HighlightCountChanged = true
 		}
+		delta.UnreadChanged = !sameUnread(existing.Unread(), r.Unread())
 		delta.InviteCountChanged = !existing.SameInviteCount(&r.RoomMetadata)
 		delta.JoinCountChanged = !existing.SameJoinCount(&r.RoomMetadata)
 		delta.RoomNameChanged = !existing.SameRoomName(&r.RoomMetadata)
 		if delta.RoomNameChanged {
 			// update the canonical name to allow room name sorting to continue to work
-			roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
+			roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5, s.roomNameTranslations)
 			r.CanonicalisedName = strings.ToLower(
 				strings.Trim(roomName, "#!():_@"),
 			)
@@ -110,7 +177,7 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 		}
 	} else {
 		// set the canonical name to allow room name sorting to work
-		roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
+		roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5, s.roomNameTranslations)
 		r.CanonicalisedName = strings.ToLower(
 			strings.Trim(roomName, "#!():_@"),
 		)
@@ -124,9 +191,6 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 	for listKey, list := range s.lists {
 		_, alreadyExists := list.roomIDToIndex[r.RoomID]
 		shouldExist := list.filter.Include(&r, s)
-		if shouldExist && r.HasLeft {
-			shouldExist = false
-		}
 		// weird nesting ensures we handle all 4 cases
 		if alreadyExists {
 			if shouldExist { // could be a change
@@ -148,10 +212,37 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 				})
 			} // else it doesn't exist and it shouldn't exist, so do nothing e.g room isn't relevant to this list
 		}
+		if !shouldExist && r.UpgradedRoomID != nil && list.mergeUpgradedRooms {
+			// the newest room is sorted using activity in this room, so may need to move
+			if newestRoomID := successor(s, r.RoomID); newestRoomID != r.RoomID {
+				if _, exists := list.roomIDToIndex[newestRoomID]; exists {
+					delta.Lists = append(delta.Lists, RoomListDelta{
+						ListKey: listKey,
+						Op:      ListOpChange,
+						RoomID:  newestRoomID,
+					})
+				}
+			}
+		}
 	}
 	return delta
 }
 
+// Predecessors returns the rooms known to this connection which the given room replaced, newest first.
+func (s *InternalRequestLists) Predecessors(roomID string) []string {
+	return predecessors(s, roomID)
+}
+
+// MergesUpgradedRooms returns true if the room is in any list which merges upgraded rooms.
+func (s *InternalRequestLists) MergesUpgradedRooms(roomID string) bool {
+	for _, list := range s.lists {
+		if _, exists := list.roomIDToIndex[roomID]; exists && list.mergeUpgradedRooms {
+			return true
+		}
+	}
+	return false
+}
+
 // Remove a room from all lists e.g retired an invite, left a room
 func (s *InternalRequestLists) RemoveRoom(roomID string) {
 	delete(s.allRooms, roomID)
@@ -165,6 +256,26 @@ func (s *InternalRequestLists) DeleteList(listKey string) {
 	}
 }
 
+// RoomIDs returns the IDs of all rooms known to this connection, in no particular order.
+func (s *InternalRequestLists) RoomIDs() []string {
+	roomIDs := make([]string, 0, len(s.allRooms))
+	for roomID := range s.allRooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+// SetRoomNameTranslations sets the translations to calculate room names with. Room names are
+// calculated when rooms are set, so this must be called before any rooms are set.
+func (s *InternalRequestLists) SetRoomNameTranslations(translations *internal.RoomNameTranslations) {
+	s.roomNameTranslations = translations
+}
+
+// RoomNameTranslations returns the translations to calculate room names with.
+func (s *InternalRequestLists) RoomNameTranslations() *internal.RoomNameTranslations {
+	return s.roomNameTranslations
+}
+
 // Returns the underlying RoomConnMetadata object. Returns a shared pointer, not a copy.
 // It is only safe to read this data, never to write.
 func (s *InternalRequestLists) ReadOnlyRoom(roomID string) *RoomConnMetadata {
@@ -260,3 +371,10 @@ func (s *InternalRequestLists) Count(listKey string) int {
 func (s *InternalRequestLists) Len() int {
 	return len(s.lists)
 }
+
+func sameUnread(a, b *caches.UnreadCounts) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
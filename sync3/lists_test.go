@@ -3,6 +3,7 @@ package sync3_test
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -49,3 +50,383 @@ func addRooms(list *sync3.InternalRequestLists, n int) {
 		})
 	}
 }
+
+func TestInternalRequestListsExplain(t *testing.T) {
+	ctx := context.Background()
+	list := sync3.NewInternalRequestLists()
+	tombstone := "!new:localhost"
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:    "!dm:localhost",
+			NameEvent: "DM",
+		},
+		UserRoomData: caches.UserRoomData{
+			IsDM:              true,
+			NotificationCount: 2,
+		},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 200},
+	})
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:    "!group:localhost",
+			NameEvent: "Group",
+		},
+		UserRoomData: caches.UserRoomData{
+			HighlightCount: 1,
+		},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 300},
+	})
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:         "!old:localhost",
+			NameEvent:      "Old",
+			UpgradedRoomID: &tombstone,
+		},
+		UserRoomData: caches.UserRoomData{
+			IsDM: true,
+		},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 100},
+	})
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:    tombstone,
+			NameEvent: "New",
+		},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 400},
+	})
+	isDM := true
+	list.AssignList(ctx, "a", &sync3.RequestFilters{IsDM: &isDM}, []string{sync3.SortByRecency}, sync3.Overwrite)
+
+	if _, ok := list.Explain("b"); ok {
+		t.Fatalf("Explain: got an explanation for an unknown list")
+	}
+	ex, ok := list.Explain("a")
+	if !ok {
+		t.Fatalf("Explain: no explanation for list a")
+	}
+	if ex.Count != 1 || len(ex.Rooms) != 4 {
+		t.Fatalf("Explain: got count %d with %d rooms, want count 1 with 4 rooms", ex.Count, len(ex.Rooms))
+	}
+	want := []struct {
+		roomID   string
+		included bool
+		index    int
+		clauses  []sync3.FilterClause
+		ts       uint64
+		level    string
+	}{
+		{
+			roomID: "!dm:localhost", included: true, index: 0, ts: 200, level: "notification",
+			clauses: []sync3.FilterClause{{Clause: "is_dm", Included: true}},
+		},
+		{
+			roomID: "!group:localhost", included: false, index: -1, ts: 300, level: "highlight",
+			clauses: []sync3.FilterClause{{Clause: "is_dm", Included: false}},
+		},
+		{
+			roomID: tombstone, included: false, index: -1, ts: 400, level: "none",
+			clauses: []sync3.FilterClause{{Clause: "is_dm", Included: false}},
+		},
+		{
+			roomID: "!old:localhost", included: false, index: -1, ts: 100, level: "none",
+			clauses: []sync3.FilterClause{{Clause: "upgraded", Included: false}},
+		},
+	}
+	for i, w := range want {
+		got := ex.Rooms[i]
+		if got.RoomID != w.roomID || got.Included != w.included || got.Index != w.index {
+			t.Errorf("room %d: got %s included=%v index=%d want %s included=%v index=%d",
+				i, got.RoomID, got.Included, got.Index, w.roomID, w.included, w.index)
+		}
+		if !reflect.DeepEqual(got.Clauses, w.clauses) {
+			t.Errorf("room %s: got clauses %+v want %+v", got.RoomID, got.Clauses, w.clauses)
+		}
+		if got.LastInterestedEventTimestamp != w.ts || got.NotificationLevel != w.level {
+			t.Errorf("room %s: got ts=%d level=%s want ts=%d level=%s",
+				got.RoomID, got.LastInterestedEventTimestamp, got.NotificationLevel, w.ts, w.level)
+		}
+	}
+}
+
+func TestInternalRequestListsMentions(t *testing.T) {
+	ctx := context.Background()
+	list := sync3.NewInternalRequestLists()
+	roomHighlight := "!highlight:localhost"
+	roomMentioned := "!mentioned:localhost"
+	roomQuiet := "!quiet:localhost"
+	rooms := []sync3.RoomConnMetadata{
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomHighlight},
+			UserRoomData:                  caches.UserRoomData{HighlightCount: 1, NotificationCount: 1},
+			LastInterestedEventTimestamps: map[string]uint64{"mentions": 100, "highlights": 100},
+		},
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomMentioned},
+			UserRoomData:                  caches.UserRoomData{IsMentioned: true},
+			LastInterestedEventTimestamps: map[string]uint64{"mentions": 200, "highlights": 200},
+		},
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomQuiet},
+			LastInterestedEventTimestamps: map[string]uint64{"mentions": 300, "highlights": 300},
+		},
+	}
+	for _, r := range rooms {
+		list.SetRoom(r)
+	}
+	yes := true
+	mentions, _ := list.AssignList(ctx, "mentions", &sync3.RequestFilters{IsMentioned: &yes}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	highlights, _ := list.AssignList(ctx, "highlights", &sync3.RequestFilters{HasHighlight: &yes}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if got := mentions.RoomIDs(); !reflect.DeepEqual(got, []string{roomMentioned, roomHighlight}) {
+		t.Errorf("is_mentioned: got %v", got)
+	}
+	if got := highlights.RoomIDs(); !reflect.DeepEqual(got, []string{roomHighlight}) {
+		t.Errorf("has_highlight: got %v", got)
+	}
+
+	// reading the room removes it from the mentions list
+	read := rooms[1]
+	read.IsMentioned = false
+	delta := list.SetRoom(read)
+	if len(delta.Lists) != 1 || delta.Lists[0].ListKey != "mentions" || delta.Lists[0].Op != sync3.ListOpDel {
+		t.Errorf("SetRoom: got list deltas %+v, want a single removal from mentions", delta.Lists)
+	}
+
+	// highlights from local unread counts are used when there are no upstream counts
+	local := rooms[2]
+	local.LocalUnread = &caches.UnreadCounts{NotificationCount: 1, HighlightCount: 1}
+	delta = list.SetRoom(local)
+	if len(delta.Lists) != 2 || !delta.UnreadChanged {
+		t.Errorf("SetRoom: got delta %+v, want additions to both lists", delta)
+	}
+}
+
+func TestInternalRequestListsUnread(t *testing.T) {
+	ctx := context.Background()
+	list := sync3.NewInternalRequestLists()
+	roomNotifs := "!notifs:localhost"
+	roomMarked := "!marked:localhost"
+	roomRead := "!read:localhost"
+	rooms := []sync3.RoomConnMetadata{
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomNotifs},
+			UserRoomData:                  caches.UserRoomData{NotificationCount: 2, HasUnreadCounts: true},
+			LastInterestedEventTimestamps: map[string]uint64{"a": 100},
+		},
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomMarked},
+			UserRoomData:                  caches.UserRoomData{IsMarkedUnread: true, HasUnreadCounts: true},
+			LastInterestedEventTimestamps: map[string]uint64{"a": 200},
+		},
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomRead},
+			UserRoomData:                  caches.UserRoomData{HasUnreadCounts: true},
+			LastInterestedEventTimestamps: map[string]uint64{"a": 300},
+		},
+	}
+	for _, r := range rooms {
+		list.SetRoom(r)
+	}
+	yes := true
+	unread, _ := list.AssignList(ctx, "a", &sync3.RequestFilters{IsUnread: &yes}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if got := unread.RoomIDs(); !reflect.DeepEqual(got, []string{roomMarked, roomNotifs}) {
+		t.Errorf("is_unread: got %v", got)
+	}
+
+	// marking the read room as unread adds it to the list
+	marked := rooms[2]
+	marked.IsMarkedUnread = true
+	delta := list.SetRoom(marked)
+	if len(delta.Lists) != 1 || delta.Lists[0].Op != sync3.ListOpAdd {
+		t.Errorf("SetRoom: got list deltas %+v, want an addition", delta.Lists)
+	}
+	// reading the room with notifications removes it from the list
+	read := rooms[0]
+	read.NotificationCount = 0
+	delta = list.SetRoom(read)
+	if len(delta.Lists) != 1 || delta.Lists[0].Op != sync3.ListOpDel {
+		t.Errorf("SetRoom: got list deltas %+v, want a removal", delta.Lists)
+	}
+}
+
+func TestInternalRequestListsLeft(t *testing.T) {
+	ctx := context.Background()
+	list := sync3.NewInternalRequestLists()
+	roomJoined := "!joined:localhost"
+	roomLeft := "!left:localhost"
+	roomLeftUnknown := "!left-unknown:localhost"
+	rooms := []sync3.RoomConnMetadata{
+		{
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomJoined},
+			LastInterestedEventTimestamps: map[string]uint64{"a": 100, "b": 100, "c": 100},
+		},
+		{
+			RoomMetadata: internal.RoomMetadata{RoomID: roomLeft},
+			UserRoomData: caches.UserRoomData{
+				HasLeft:     true,
+				LeaveTiming: internal.EventMetadata{NID: 5, Timestamp: 200},
+			},
+			LastInterestedEventTimestamps: map[string]uint64{"a": 200, "b": 200, "c": 200},
+		},
+		{
+			// we don't know when we left this room, so cannot show it
+			RoomMetadata:                  internal.RoomMetadata{RoomID: roomLeftUnknown},
+			UserRoomData:                  caches.UserRoomData{HasLeft: true},
+			LastInterestedEventTimestamps: map[string]uint64{"a": 300, "b": 300, "c": 300},
+		},
+	}
+	for _, r := range rooms {
+		list.SetRoom(r)
+	}
+	yes := true
+	testCases := []struct {
+		listKey string
+		filters *sync3.RequestFilters
+		want    []string
+	}{
+		{listKey: "a", filters: &sync3.RequestFilters{}, want: []string{roomJoined}},
+		{listKey: "b", filters: &sync3.RequestFilters{IsLeft: &yes}, want: []string{roomLeft}},
+		{listKey: "c", filters: &sync3.RequestFilters{IncludeLeft: &yes}, want: []string{roomLeft, roomJoined}},
+	}
+	for _, tc := range testCases {
+		got, _ := list.AssignList(ctx, tc.listKey, tc.filters, []string{sync3.SortByRecency}, sync3.Overwrite)
+		if !reflect.DeepEqual(got.RoomIDs(), tc.want) {
+			t.Errorf("list %s: got %v want %v", tc.listKey, got.RoomIDs(), tc.want)
+		}
+	}
+
+	// leaving the joined room removes it from the default list and adds it to the is_left list
+	left := rooms[0]
+	left.HasLeft = true
+	left.LeaveTiming = internal.EventMetadata{NID: 10, Timestamp: 400}
+	delta := list.SetRoom(left)
+	gotOps := make(map[string]sync3.ListOp)
+	for _, ld := range delta.Lists {
+		gotOps[ld.ListKey] = ld.Op
+	}
+	wantOps := map[string]sync3.ListOp{"a": sync3.ListOpDel, "b": sync3.ListOpAdd, "c": sync3.ListOpChange}
+	if !reflect.DeepEqual(gotOps, wantOps) {
+		t.Errorf("SetRoom: got list ops %v want %v", gotOps, wantOps)
+	}
+}
+
+func TestInternalRequestListsKnock(t *testing.T) {
+	ctx := context.Background()
+	list := sync3.NewInternalRequestLists()
+	roomJoined := "!joined:localhost"
+	roomKnock := "!knock:localhost"
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomJoined},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 100, "b": 100, "c": 100},
+	})
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomKnock},
+		UserRoomData:                  caches.UserRoomData{IsKnock: true},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 200, "b": 200, "c": 200},
+	})
+	yes := true
+	no := false
+	testCases := []struct {
+		listKey string
+		filters *sync3.RequestFilters
+		want    []string
+	}{
+		// knocks are only included when asked for
+		{listKey: "a", filters: &sync3.RequestFilters{}, want: []string{roomJoined}},
+		{listKey: "b", filters: &sync3.RequestFilters{IsKnock: &yes}, want: []string{roomKnock}},
+		{listKey: "c", filters: &sync3.RequestFilters{IsKnock: &no}, want: []string{roomJoined}},
+	}
+	for _, tc := range testCases {
+		got, _ := list.AssignList(ctx, tc.listKey, tc.filters, []string{sync3.SortByRecency}, sync3.Overwrite)
+		if !reflect.DeepEqual(got.RoomIDs(), tc.want) {
+			t.Errorf("list %s: got %v want %v", tc.listKey, got.RoomIDs(), tc.want)
+		}
+	}
+}
+
+func TestInternalRequestListsMergeUpgradedRooms(t *testing.T) {
+	ctx := context.Background()
+	list := sync3.NewInternalRequestLists()
+	roomOld := "!old:localhost"
+	roomNew := "!new:localhost"
+	roomOther := "!other:localhost"
+	roomSpoof := "!spoof:localhost"
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomOld, UpgradedRoomID: &roomNew},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 500, "b": 500},
+	})
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomNew, PredecessorRoomID: &roomOld},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 100, "b": 100},
+	})
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomOther},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 300, "b": 300},
+	})
+	// claims to replace the other room, which was never upgraded, so must not inherit its activity
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomSpoof, PredecessorRoomID: &roomOther},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 50, "b": 50},
+	})
+	yes := true
+	got, _ := list.AssignList(ctx, "a", &sync3.RequestFilters{MergeUpgradedRooms: &yes}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if want := []string{roomNew, roomOther, roomSpoof}; !reflect.DeepEqual(got.RoomIDs(), want) {
+		t.Errorf("merged list: got %v want %v", got.RoomIDs(), want)
+	}
+	got, _ = list.AssignList(ctx, "b", &sync3.RequestFilters{}, []string{sync3.SortByRecency}, sync3.Overwrite)
+	if want := []string{roomOther, roomNew, roomSpoof}; !reflect.DeepEqual(got.RoomIDs(), want) {
+		t.Errorf("unmerged list: got %v want %v", got.RoomIDs(), want)
+	}
+	if got := list.Predecessors(roomNew); !reflect.DeepEqual(got, []string{roomOld}) {
+		t.Errorf("Predecessors: got %v want %v", got, []string{roomOld})
+	}
+
+	// activity in the old room moves the new room in the merged list only
+	delta := list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomOld, UpgradedRoomID: &roomNew},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 600, "b": 600},
+	})
+	want := []sync3.RoomListDelta{{ListKey: "a", Op: sync3.ListOpChange, RoomID: roomNew}}
+	if !reflect.DeepEqual(delta.Lists, want) {
+		t.Errorf("SetRoom: got deltas %+v want %+v", delta.Lists, want)
+	}
+}
+
+func TestInternalRequestListsRoomNameTranslations(t *testing.T) {
+	ctx := context.Background()
+	internal.RegisterRoomNameTranslations("de", internal.RoomNameTranslations{
+		EmptyRoom: "Leerer Raum",
+		And:       " und ",
+	})
+	list := sync3.NewInternalRequestLists()
+	list.SetRoomNameTranslations(internal.RoomNameTranslationsFor("de"))
+	roomEmpty := "!empty:localhost"
+	roomHeroes := "!heroes:localhost"
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata:                  internal.RoomMetadata{RoomID: roomEmpty, JoinCount: 1},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 100, "b": 100, "c": 100},
+	})
+	list.SetRoom(sync3.RoomConnMetadata{
+		RoomMetadata: internal.RoomMetadata{
+			RoomID:    roomHeroes,
+			JoinCount: 3,
+			Heroes:    []internal.Hero{{ID: "@alice:localhost", Name: "Alice"}, {ID: "@bob:localhost", Name: "Bob"}},
+		},
+		LastInterestedEventTimestamps: map[string]uint64{"a": 200, "b": 200, "c": 200},
+	})
+	testCases := []struct {
+		listKey string
+		filters *sync3.RequestFilters
+		want    []string
+	}{
+		// room_name_like matches the translated name
+		{listKey: "a", filters: &sync3.RequestFilters{RoomNameFilter: "leerer"}, want: []string{roomEmpty}},
+		{listKey: "b", filters: &sync3.RequestFilters{RoomNameFilter: "empty"}, want: []string{}},
+		{listKey: "c", filters: &sync3.RequestFilters{RoomNameFilter: "alice und"}, want: []string{roomHeroes}},
+	}
+	for _, tc := range testCases {
+		got, _ := list.AssignList(ctx, tc.listKey, tc.filters, []string{sync3.SortByRecency}, sync3.Overwrite)
+		if !reflect.DeepEqual(got.RoomIDs(), tc.want) {
+			t.Errorf("list %s: got %v want %v", tc.listKey, got.RoomIDs(), tc.want)
+		}
+	}
+}
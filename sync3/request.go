@@ -16,7 +16,9 @@ var (
 	SortByNotificationLevel = "by_notification_level"
 	SortByNotificationCount = "by_notification_count" // deprecated
 	SortByHighlightCount    = "by_highlight_count"    // deprecated
-	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel}
+	SortByMentions          = "by_mentions"
+	SortByUnread            = "by_unread"
+	SortBy                  = []string{SortByHighlightCount, SortByName, SortByNotificationCount, SortByRecency, SortByNotificationLevel, SortByMentions, SortByUnread}
 
 	Wildcard     = "*"
 	StateKeyLazy = "$LAZY"
@@ -33,10 +35,45 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// sticky, the budget applies until it is changed
+	ResponseBudget *ResponseBudget `json:"response_budget,omitempty"`
+	// The languages to calculate room names in, in the format of an Accept-Language header. If unset,
+	// the Accept-Language header is used. Fixed when the connection is made, as room names are
+	// calculated when rooms are loaded.
+	Language string `json:"language,omitempty"`
 
 	// set via query params or inferred
-	pos          int64
-	timeoutMSecs int
+	pos            int64
+	timeoutMSecs   int
+	acceptLanguage string
+}
+
+// ResponseBudget limits how much room data is sent in a single response. Rooms over the budget are
+// sent in the following responses, nearest the top of the lists first. List operations are not
+// affected, so a room may appear in a list before its data is sent.
+type ResponseBudget struct {
+	// The maximum number of rooms in `rooms`. 0 means no limit.
+	MaxRooms int `json:"max_rooms,omitempty"`
+	// The approximate maximum size in bytes of the JSON in `rooms`. 0 means no limit.
+	MaxBytes int `json:"max_bytes,omitempty"`
+}
+
+// Min returns the tighter of the two budgets for each limit.
+func (b ResponseBudget) Min(other ResponseBudget) ResponseBudget {
+	return ResponseBudget{
+		MaxRooms: minNonZero(b.MaxRooms, other.MaxRooms),
+		MaxBytes: minNonZero(b.MaxBytes, other.MaxBytes),
+	}
+}
+
+func minNonZero(a, b int) int {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 || a < b {
+		return a
+	}
+	return b
 }
 
 func (r *Request) Validate() error {
@@ -63,6 +100,16 @@ func (rl *RequestList) ShouldGetAllRooms() bool {
 	return rl.SlowGetAllRooms != nil && *rl.SlowGetAllRooms
 }
 
+// SortsByMentions returns true if this list is sorted by whether the user has been mentioned.
+func (rl *RequestList) SortsByMentions() bool {
+	for _, sortBy := range rl.Sort {
+		if sortBy == SortByMentions {
+			return true
+		}
+	}
+	return false
+}
+
 func (rl *RequestList) SortOrderChanged(next *RequestList) bool {
 	prevLen := 0
 	if rl != nil {
@@ -269,6 +316,18 @@ func (r *Request) TimeoutMSecs() int {
 func (r *Request) SetTimeoutMSecs(timeout int) {
 	r.timeoutMSecs = timeout
 }
+func (r *Request) SetAcceptLanguage(acceptLanguage string) {
+	r.acceptLanguage = acceptLanguage
+}
+
+// PreferredLanguages returns the languages the client would like room names in, preferring the
+// language in the request body over the Accept-Language header.
+func (r *Request) PreferredLanguages() string {
+	if r.Language != "" {
+		return r.Language
+	}
+	return r.acceptLanguage
+}
 
 // Same determines if the given request would produce the same output as the other
 // if given the same input data.
@@ -316,6 +375,7 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		nextReq.Extensions.InterpretAsInitial()
 		result = &Request{
 			Extensions: nextReq.Extensions,
+			Language:   nextReq.PreferredLanguages(),
 		}
 		r = &Request{}
 	} else {
@@ -323,11 +383,16 @@ func (r *Request) ApplyDelta(nextReq *Request) (result *Request, delta *RequestD
 		// Go is ew in that this can't be represented in a nicer way
 		result = &Request{
 			Extensions: r.Extensions.ApplyDelta(&nextReq.Extensions),
+			Language:   r.Language,
 		}
 	}
 	// conn ID isn't sticky, always use the nextReq value. This is only useful for logging,
 	// as the conn ID is used primarily in conn_map.go
 	result.ConnID = nextReq.ConnID
+	result.ResponseBudget = nextReq.ResponseBudget
+	if result.ResponseBudget == nil {
+		result.ResponseBudget = r.ResponseBudget
+	}
 
 	listKeys := make(set)
 	for k := range nextReq.Lists {
@@ -490,48 +555,136 @@ type RequestFilters struct {
 	IsDM           *bool     `json:"is_dm"`
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
+	IsKnock        *bool     `json:"is_knock"`
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
 	RoomNameFilter string    `json:"room_name_like"`
 	Tags           []string  `json:"tags"`
 	NotTags        []string  `json:"not_tags"`
+	HasHighlight   *bool     `json:"has_highlight"`
+	IsMentioned    *bool     `json:"is_mentioned"` // m.mentions or highlights since the last read receipt
+	IsUnread       *bool     `json:"is_unread"`    // notifications or m.marked_unread
+	IsLeft         *bool     `json:"is_left"`
+	IncludeLeft    *bool     `json:"include_left"` // include left rooms as well as joined/invited rooms
+	// MergeUpgradedRooms shows an upgraded room and its predecessors as a single entry: the newest
+	// room, sorted by the latest activity in any room in the chain. Its initial timeline includes
+	// events from the predecessors if the newest room has too few events, in which case those events
+	// have a room_id and prev_batch refers to the room of the first event.
+	MergeUpgradedRooms *bool `json:"merge_upgraded_rooms"`
 
 	// TODO options to control which events should be live-streamed e.g not_types, types from sync v2
 }
 
+// IncludesLeft returns true if rooms the user has left can be included in the list.
+func (rf *RequestFilters) IncludesLeft() bool {
+	if rf == nil {
+		return false
+	}
+	return (rf.IsLeft != nil && *rf.IsLeft) || (rf.IncludeLeft != nil && *rf.IncludeLeft)
+}
+
+// MergesUpgradedRooms returns true if upgraded rooms should be merged into a single list entry.
+func (rf *RequestFilters) MergesUpgradedRooms() bool {
+	return rf != nil && rf.MergeUpgradedRooms != nil && *rf.MergeUpgradedRooms
+}
+
+// NeedsMentions returns true if these filters need to know whether the user has been mentioned in
+// each room, which must be calculated with caches.UserCache.CalculateMentions.
+func (rf *RequestFilters) NeedsMentions() bool {
+	return rf != nil && rf.IsMentioned != nil
+}
+
 func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
+	return rf.include(r, finder, nil)
+}
+
+// FilterClause is the outcome of a single filter clause for a room, see RequestFilters.Explain.
+type FilterClause struct {
+	Clause   string `json:"clause"`
+	Included bool   `json:"included"`
+}
+
+// Explain returns the clauses which were checked to decide whether to include this room, in the
+// order they were checked. The room is included if the last clause included it, or if no clauses
+// were checked.
+func (rf *RequestFilters) Explain(r *RoomConnMetadata, finder RoomFinder) []FilterClause {
+	clauses := []FilterClause{}
+	rf.include(r, finder, func(clause string, included bool) {
+		clauses = append(clauses, FilterClause{Clause: clause, Included: included})
+	})
+	return clauses
+}
+
+// include is the implementation of Include and Explain. If explain is non-nil, it is called
+// with the outcome of each clause which is checked.
+func (rf *RequestFilters) include(r *RoomConnMetadata, finder RoomFinder, explain func(clause string, included bool)) bool {
+	check := func(clause string, included bool) bool {
+		if explain != nil {
+			explain(clause, included)
+		}
+		return included
+	}
+	// rooms we have left are excluded unless asked for. We need to know when we left to show the room
+	// as it was at that point.
+	if r.HasLeft && !check("left", rf.IncludesLeft() && r.LeaveTiming.NID > 0) {
+		return false
+	}
+	if rf.IsLeft != nil && !check("is_left", *rf.IsLeft == r.HasLeft) {
+		return false
+	}
 	// we always exclude old rooms from lists, but may include them in the `rooms` section if they opt-in
 	if r.UpgradedRoomID != nil {
 		// should we exclude this room? If we have _joined_ the successor room then yes because
 		// this room must therefore be old, else no.
 		nextRoom := finder.ReadOnlyRoom(*r.UpgradedRoomID)
-		if nextRoom != nil && !nextRoom.HasLeft && !nextRoom.IsInvite {
+		if !check("upgraded", nextRoom == nil || nextRoom.HasLeft || nextRoom.IsInvite || nextRoom.IsKnock) {
 			return false
 		}
 	}
-	if rf.IsEncrypted != nil && *rf.IsEncrypted != r.Encrypted {
+	if rf.IsEncrypted != nil && !check("is_encrypted", *rf.IsEncrypted == r.Encrypted) {
+		return false
+	}
+	if rf.IsTombstoned != nil && !check("is_tombstoned", *rf.IsTombstoned == (r.UpgradedRoomID != nil)) {
+		return false
+	}
+	if rf.IsDM != nil && !check("is_dm", *rf.IsDM == r.IsDM) {
+		return false
+	}
+	if rf.IsInvite != nil && !check("is_invite", *rf.IsInvite == r.IsInvite) {
 		return false
 	}
-	if rf.IsTombstoned != nil && *rf.IsTombstoned != (r.UpgradedRoomID != nil) {
+	// rooms we have knocked on are only shown to clients which ask for them, as they are unlikely to
+	// know what to do with a room which only has knock_state.
+	if (r.IsKnock || rf.IsKnock != nil) && !check("is_knock", rf.IsKnock != nil && *rf.IsKnock == r.IsKnock) {
 		return false
 	}
-	if rf.IsDM != nil && *rf.IsDM != r.IsDM {
+	if rf.HasHighlight != nil && !check("has_highlight", *rf.HasHighlight == r.HasHighlight()) {
 		return false
 	}
-	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
+	if rf.IsMentioned != nil && !check("is_mentioned", *rf.IsMentioned == r.Mentioned()) {
 		return false
 	}
-	roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5)
-	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter)) {
+	if rf.IsUnread != nil && !check("is_unread", *rf.IsUnread == r.IsUnread()) {
 		return false
 	}
+	if rf.RoomNameFilter != "" {
+		roomName, _ := internal.CalculateRoomName(&r.RoomMetadata, 5, finder.RoomNameTranslations())
+		if !check("room_name_like", strings.Contains(strings.ToLower(roomName), strings.ToLower(rf.RoomNameFilter))) {
+			return false
+		}
+	}
 	if len(rf.NotTags) > 0 {
+		tagExists := false
 		for _, t := range rf.NotTags {
 			if _, ok := r.Tags[t]; ok {
-				return false
+				tagExists = true
+				break
 			}
 		}
+		if !check("not_tags", !tagExists) {
+			return false
+		}
 	}
 	if len(rf.Tags) > 0 {
 		tagExists := false
@@ -541,26 +694,28 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 				break
 			}
 		}
-		if !tagExists {
+		if !check("tags", tagExists) {
 			return false
 		}
 	}
 	// read not_room_types first as it takes priority
-	if nullableStringExists(rf.NotRoomTypes, r.RoomType) {
+	if len(rf.NotRoomTypes) > 0 && !check("not_room_types", !nullableStringExists(rf.NotRoomTypes, r.RoomType)) {
 		return false // explicitly excluded
 	}
 	if len(rf.RoomTypes) > 0 {
 		// either explicitly included or implicitly excluded
-		return nullableStringExists(rf.RoomTypes, r.RoomType)
+		return check("room_types", nullableStringExists(rf.RoomTypes, r.RoomType))
 	}
 	if len(rf.Spaces) > 0 {
 		// ensure this room is a member of one of these spaces
+		inSpace := false
 		for _, s := range rf.Spaces {
 			if _, ok := r.UserRoomData.Spaces[s]; ok {
-				return true
+				inSpace = true
+				break
 			}
 		}
-		return false
+		return check("spaces", inSpace)
 	}
 	return true
 }
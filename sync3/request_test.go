@@ -748,6 +748,27 @@ func TestRequestApplyDeltas(t *testing.T) {
 	}
 }
 
+func TestRequestApplyDeltaLanguage(t *testing.T) {
+	first := &Request{}
+	first.SetAcceptLanguage("de-CH, de;q=0.9")
+	req, _ := (*Request)(nil).ApplyDelta(first)
+	if req.Language != "de-CH, de;q=0.9" {
+		t.Fatalf("initial request: got language %q want the Accept-Language header", req.Language)
+	}
+	// the language is fixed when the connection is made
+	req, _ = req.ApplyDelta(&Request{Language: "fr"})
+	if req.Language != "de-CH, de;q=0.9" {
+		t.Fatalf("later request: got language %q want it unchanged", req.Language)
+	}
+	// the request field is preferred over the header
+	first = &Request{Language: "fr"}
+	first.SetAcceptLanguage("de")
+	req, _ = (*Request)(nil).ApplyDelta(first)
+	if req.Language != "fr" {
+		t.Fatalf("initial request: got language %q want fr", req.Language)
+	}
+}
+
 func TestRequestListDiffs(t *testing.T) {
 	boolTrue := true
 	boolFalse := false
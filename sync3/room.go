@@ -15,6 +15,7 @@ type Room struct {
 	RequiredState     []json.RawMessage `json:"required_state,omitempty"`
 	Timeline          []json.RawMessage `json:"timeline,omitempty"`
 	InviteState       []json.RawMessage `json:"invite_state,omitempty"`
+	KnockState        []json.RawMessage `json:"knock_state,omitempty"`
 	NotificationCount int64             `json:"notification_count"`
 	HighlightCount    int64             `json:"highlight_count"`
 	Initial           bool              `json:"initial,omitempty"`
@@ -24,6 +25,10 @@ type Room struct {
 	PrevBatch         string            `json:"prev_batch,omitempty"`
 	NumLive           int               `json:"num_live,omitempty"`
 	Timestamp         uint64            `json:"timestamp,omitempty"`
+
+	// Unread are the unread counts for the room, which are calculated by the proxy if the
+	// upstream server has not sent any. Omitted if the counts are unknown.
+	Unread *caches.UnreadCounts `json:"unread,omitempty"`
 }
 
 // RoomConnMetadata represents a room as seen by one specific connection (hence one
@@ -56,6 +61,12 @@ type RoomConnMetadata struct {
 	LastInterestedEventTimestamps map[string]uint64
 }
 
+// Mentioned returns true if the user has been mentioned in this room since their last read receipt,
+// either explicitly via m.mentions or by an event which highlights them.
+func (r *RoomConnMetadata) Mentioned() bool {
+	return r.IsMentioned || r.HasHighlight()
+}
+
 // SameRoomAvatar checks if the fields relevant for room avatars have changed between the two metadatas.
 // Returns true if there are no changes.
 func (r *RoomConnMetadata) SameRoomAvatar(next *RoomConnMetadata) bool {
@@ -9,6 +9,8 @@ import (
 
 type RoomFinder interface {
 	ReadOnlyRoom(roomID string) *RoomConnMetadata
+	// RoomNameTranslations returns the translations to calculate room names with.
+	RoomNameTranslations() *internal.RoomNameTranslations
 }
 
 // SortableRooms represents a list of rooms which can be sorted and updated. Maintains mappings of
@@ -18,6 +20,8 @@ type SortableRooms struct {
 	listKey       string
 	roomIDs       []string
 	roomIDToIndex map[string]int // room_id -> index in rooms
+	// if true, rooms are sorted by recency using the latest activity across the room and its predecessors
+	mergeUpgradedRooms bool
 }
 
 func NewSortableRooms(finder RoomFinder, listKey string, rooms []string) *SortableRooms {
@@ -102,6 +106,10 @@ func (s *SortableRooms) Sort(sortBy []string) error {
 			comparators = append(comparators, s.comparatorSortByRecency)
 		case SortByNotificationLevel:
 			comparators = append(comparators, s.comparatorSortByNotificationLevel)
+		case SortByMentions:
+			comparators = append(comparators, s.comparatorSortByMentions)
+		case SortByUnread:
+			comparators = append(comparators, s.comparatorSortByUnread)
 		default:
 			return fmt.Errorf("unknown sort order: %s", sort)
 		}
@@ -147,8 +155,8 @@ func (s *SortableRooms) comparatorSortByName(i, j int) int {
 
 func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
-	tsRi := ri.GetLastInterestedEventTimestamp(s.listKey)
-	tsRj := rj.GetLastInterestedEventTimestamp(s.listKey)
+	tsRi := s.lastInterestedEventTimestamp(ri)
+	tsRj := s.lastInterestedEventTimestamp(rj)
 	if tsRi == tsRj {
 		return 0
 	}
@@ -158,6 +166,61 @@ func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	return -1
 }
 
+func (s *SortableRooms) lastInterestedEventTimestamp(r *RoomConnMetadata) uint64 {
+	ts := r.GetLastInterestedEventTimestamp(s.listKey)
+	if !s.mergeUpgradedRooms {
+		return ts
+	}
+	for _, prevRoomID := range predecessors(s.finder, r.RoomID) {
+		if prevTs := s.finder.ReadOnlyRoom(prevRoomID).GetLastInterestedEventTimestamp(s.listKey); prevTs > ts {
+			ts = prevTs
+		}
+	}
+	return ts
+}
+
+// predecessors returns the rooms this room replaced, newest first. Only rooms which were upgraded
+// to their successor are included, so a room cannot claim to replace an arbitrary room.
+func predecessors(finder RoomFinder, roomID string) (roomIDs []string) {
+	r := finder.ReadOnlyRoom(roomID)
+	visited := map[string]struct{}{roomID: {}}
+	for r != nil && r.PredecessorRoomID != nil {
+		prevRoomID := *r.PredecessorRoomID
+		if _, seen := visited[prevRoomID]; seen {
+			break
+		}
+		visited[prevRoomID] = struct{}{}
+		prevRoom := finder.ReadOnlyRoom(prevRoomID)
+		if prevRoom == nil || prevRoom.UpgradedRoomID == nil || *prevRoom.UpgradedRoomID != r.RoomID {
+			break
+		}
+		roomIDs = append(roomIDs, prevRoomID)
+		r = prevRoom
+	}
+	return roomIDs
+}
+
+// successor returns the newest room which replaced this room, or the room itself if it has not been
+// upgraded. This is the inverse of predecessors.
+func successor(finder RoomFinder, roomID string) string {
+	visited := map[string]struct{}{roomID: {}}
+	r := finder.ReadOnlyRoom(roomID)
+	for r != nil && r.UpgradedRoomID != nil {
+		nextRoomID := *r.UpgradedRoomID
+		if _, seen := visited[nextRoomID]; seen {
+			break
+		}
+		visited[nextRoomID] = struct{}{}
+		nextRoom := finder.ReadOnlyRoom(nextRoomID)
+		if nextRoom == nil || nextRoom.PredecessorRoomID == nil || *nextRoom.PredecessorRoomID != r.RoomID {
+			break
+		}
+		roomID = nextRoomID
+		r = nextRoom
+	}
+	return roomID
+}
+
 func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
 	if ri.HighlightCount == rj.HighlightCount {
@@ -202,6 +265,30 @@ func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
 	return 0
 }
 
+func (s *SortableRooms) comparatorSortByMentions(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	mi, mj := ri.Mentioned(), rj.Mentioned()
+	if mi == mj {
+		return 0
+	}
+	if mi {
+		return 1
+	}
+	return -1
+}
+
+func (s *SortableRooms) comparatorSortByUnread(i, j int) int {
+	ri, rj := s.resolveRooms(i, j)
+	ui, uj := ri.IsUnread(), rj.IsUnread()
+	if ui == uj {
+		return 0
+	}
+	if ui {
+		return 1
+	}
+	return -1
+}
+
 func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
 	ri, rj := s.resolveRooms(i, j)
 	if ri.NotificationCount == rj.NotificationCount {
@@ -231,8 +318,10 @@ func NewFilteredSortableRooms(finder RoomFinder, listKey string, roomIDs []strin
 			filteredRooms = append(filteredRooms, roomID)
 		}
 	}
+	sortableRooms := NewSortableRooms(finder, listKey, filteredRooms)
+	sortableRooms.mergeUpgradedRooms = filter.MergesUpgradedRooms()
 	return &FilteredSortableRooms{
-		SortableRooms: NewSortableRooms(finder, listKey, filteredRooms),
+		SortableRooms: sortableRooms,
 		filter:        filter,
 	}
 }
@@ -18,6 +18,10 @@ func (f finder) ReadOnlyRoom(roomID string) *RoomConnMetadata {
 	return f.rooms[roomID]
 }
 
+func (f finder) RoomNameTranslations() *internal.RoomNameTranslations {
+	return nil
+}
+
 func newFinder(rooms []*RoomConnMetadata) finder {
 	m := make(map[string]*RoomConnMetadata)
 	ids := make([]string, len(rooms))
@@ -88,12 +92,16 @@ func TestSortBySingleOperation(t *testing.T) {
 	// highlight: 1,3,4,2
 	// notif: 1,3,2,4
 	// level+recency: 3,4,1,2 as 3,4,1 have highlights then sorted by recency
+	// mentions+name: 4,1,3,2 as 4,1,3 have highlights then sorted by name
+	// unread+recency: 3,4,2,1 as all rooms have notifications
 	wantMap := map[string][]string{
 		SortByName:              {room4, room1, room2, room3},
 		SortByRecency:           {room3, room4, room2, room1},
 		SortByHighlightCount:    {room1, room3, room4, room2},
 		SortByNotificationCount: {room1, room3, room2, room4},
 		SortByNotificationLevel + " " + SortByRecency: {room3, room4, room1, room2},
+		SortByMentions + " " + SortByName:             {room4, room1, room3, room2},
+		SortByUnread + " " + SortByRecency:            {room3, room4, room2, room1},
 	}
 	f := newFinder(rooms)
 	sr := NewSortableRooms(f, listKey, f.roomIDs)
@@ -0,0 +1,138 @@
+package syncv3
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
+)
+
+func TestAdminAPI(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	admin := httptest.NewServer(syncv3.NewAdminHandler(v3.h2, v3.handler, "admin_secret"))
+	defer admin.Close()
+
+	doAdminRequest := func(method, path, secret string) (int, gjson.Result) {
+		t.Helper()
+		req, err := http.NewRequest(method, admin.URL+path, nil)
+		if err != nil {
+			t.Fatalf("failed to make admin request: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+		res, err := admin.Client().Do(req)
+		if err != nil {
+			t.Fatalf("failed to do admin request: %s", err)
+		}
+		defer res.Body.Close()
+		var body json.RawMessage
+		json.NewDecoder(res.Body).Decode(&body)
+		return res.StatusCode, gjson.ParseBytes(body)
+	}
+
+	roomID := "!admin:localhost"
+	v2.addAccountWithDeviceID(alice, "A", aliceToken)
+	v2.queueResponse(aliceToken, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: createRoomState(t, alice, time.Now()),
+			}),
+		},
+		NextBatch: "admin_since",
+	})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Lists: map[string]sync3.RequestList{
+			"a": {
+				Ranges: sync3.SliceRanges{{0, 10}},
+				Sort:   []string{sync3.SortByRecency},
+			},
+		},
+	})
+
+	t.Log("Requests without the admin secret are rejected.")
+	if code, _ := doAdminRequest("GET", "/admin/v1/users/"+alice, "wrong"); code != 401 {
+		t.Fatalf("got HTTP %d want 401", code)
+	}
+
+	t.Log("Alice's device, connection and poller are listed.")
+	code, user := doAdminRequest("GET", "/admin/v1/users/"+alice, "admin_secret")
+	if code != 200 {
+		t.Fatalf("got HTTP %d want 200: %v", code, user.Raw)
+	}
+	if got := user.Get("devices.#.device_id").String(); got != `["A"]` {
+		t.Errorf("devices: got %v want [A]", got)
+	}
+	if got := user.Get("conns.#").Int(); got != 1 {
+		t.Fatalf("conns: got %d want 1: %v", got, user.Raw)
+	}
+	if got := user.Get("conns.0.lists.a.ranges").Raw; got != "[[0,10]]" {
+		t.Errorf("conns.0.lists.a.ranges: got %v want [[0,10]]", got)
+	}
+	if got := user.Get("conns.0.lists.a.count").Int(); got != 1 {
+		t.Errorf("conns.0.lists.a.count: got %d want 1", got)
+	}
+	if got := user.Get("pollers.0.since").Str; got != "admin_since" {
+		t.Errorf("pollers.0.since: got %v want admin_since", got)
+	}
+	if !user.Get("has_user_cache").Bool() {
+		t.Errorf("has_user_cache: got false want true")
+	}
+
+	t.Log("The placement of rooms in Alice's list can be explained.")
+	code, ex := doAdminRequest("GET", "/admin/v1/users/"+alice+"/devices/A/lists/a/explain", "admin_secret")
+	if code != 200 {
+		t.Fatalf("explain: got HTTP %d want 200: %v", code, ex.Raw)
+	}
+	if got := ex.Get("rooms.#.room_id").String(); got != `["`+roomID+`"]` {
+		t.Errorf("explain rooms: got %v want [%s]", got, roomID)
+	}
+	if !ex.Get("rooms.0.included").Bool() || ex.Get("rooms.0.index").Int() != 0 {
+		t.Errorf("explain: got %v want room included at index 0", ex.Get("rooms.0").Raw)
+	}
+	if ex.Get("rooms.0.last_interested_event_timestamp").Uint() == 0 {
+		t.Errorf("explain: missing timestamp: %v", ex.Get("rooms.0").Raw)
+	}
+	if code, _ := doAdminRequest("GET", "/admin/v1/users/"+alice+"/devices/A/lists/b/explain", "admin_secret"); code != 404 {
+		t.Errorf("explain unknown list: got HTTP %d want 404", code)
+	}
+	if code, _ := doAdminRequest("GET", "/admin/v1/users/"+alice+"/devices/A/lists/a/explain?conn_id=other", "admin_secret"); code != 404 {
+		t.Errorf("explain unknown conn: got HTTP %d want 404", code)
+	}
+
+	t.Log("Closing Alice's connections expires her session.")
+	code, closed := doAdminRequest("POST", "/admin/v1/users/"+alice+"/devices/A/close_conns", "admin_secret")
+	if code != 200 || closed.Get("closed").Int() != 1 {
+		t.Fatalf("close_conns: got HTTP %d %v want 1 closed", code, closed.Raw)
+	}
+	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, res.Pos, sync3.Request{})
+	if code != 400 || gjson.GetBytes(body, "errcode").Str != "M_UNKNOWN_POS" {
+		t.Fatalf("got HTTP %d %s want M_UNKNOWN_POS", code, string(body))
+	}
+
+	t.Log("Evicting Alice's user cache removes it.")
+	v3.mustDoV3Request(t, aliceToken, sync3.Request{})
+	code, evicted := doAdminRequest("POST", "/admin/v1/users/"+alice+"/evict_cache", "admin_secret")
+	if code != 200 || !evicted.Get("evicted").Bool() {
+		t.Fatalf("evict_cache: got HTTP %d %v want evicted", code, evicted.Raw)
+	}
+	if v3.handler.HasUserCache(alice) {
+		t.Errorf("user cache still exists after eviction")
+	}
+
+	t.Log("Restarting a poller which doesn't exist fails.")
+	if code, _ := doAdminRequest("POST", "/admin/v1/users/"+alice+"/devices/B/restart_poller", "admin_secret"); code != 400 {
+		t.Errorf("restart_poller: got HTTP %d want 400", code)
+	}
+}
@@ -567,7 +567,9 @@ func TestSessionExpiry(t *testing.T) {
 	}
 }
 
-func TestSessionExpiryOnBufferFill(t *testing.T) {
+// Test that a connection which cannot buffer all of its updates catches up on the next request
+// rather than being expired.
+func TestBufferFillCatchesUp(t *testing.T) {
 	roomID := "!doesnt:matter"
 	maxPendingEventUpdates := 3
 	pqString := testutils.PrepareDBConnectionString()
@@ -601,7 +603,7 @@ func TestSessionExpiryOnBufferFill(t *testing.T) {
 		},
 	}))
 
-	// inject maxPendingEventUpdates+1 events to expire the session
+	// inject maxPendingEventUpdates+1 events to fill the buffer
 	events := make([]json.RawMessage, maxPendingEventUpdates+1)
 	for i := range events {
 		events[i] = testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
@@ -619,25 +621,33 @@ func TestSessionExpiryOnBufferFill(t *testing.T) {
 	})
 	v2.waitUntilEmpty(t, aliceToken)
 
-	_, body, code := v3.doV3Request(t, context.Background(), aliceToken, res.Pos, sync3.Request{})
-	if code != 400 {
-		t.Errorf("got HTTP %d want 400", code)
-	}
-	if gjson.ParseBytes(body).Get("errcode").Str != "M_UNKNOWN_POS" {
-		t.Errorf("got %v want errcode=M_UNKNOWN_POS", string(body))
-	}
+	// the connection should still be alive, and send the room again with the latest event
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
+	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
+		roomID: {
+			m.MatchRoomInitial(true),
+			m.MatchRoomTimelineMostRecent(1, events),
+		},
+	}))
 
-	// make sure we can sync from fresh (regression for when we deadlocked after this point)
-	res = v3.mustDoV3Request(t, aliceToken, sync3.Request{
-		RoomSubscriptions: map[string]sync3.RoomSubscription{
-			roomID: {
-				TimelineLimit: 1,
-			},
+	// make sure we keep getting live updates after catching up
+	event := testutils.NewEvent(t, "m.room.message", alice, map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "after catching up",
+	})
+	v2.queueResponse(alice, sync2.SyncResponse{
+		Rooms: sync2.SyncRoomsResponse{
+			Join: v2JoinTimeline(roomEvents{
+				roomID: roomID,
+				events: []json.RawMessage{event},
+			}),
 		},
 	})
+	v2.waitUntilEmpty(t, aliceToken)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, sync3.Request{})
 	m.MatchResponse(t, res, m.MatchRoomSubscriptionsStrict(map[string][]m.RoomMatcher{
 		roomID: {
-			m.MatchJoinCount(1),
+			m.MatchRoomTimeline([]json.RawMessage{event}),
 		},
 	}))
 }
@@ -22,6 +22,7 @@ import (
 	_ "github.com/matrix-org/sliding-sync/state/migrations"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync2/handler2"
+	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/pressly/goose/v3"
 	"github.com/rs/zerolog"
@@ -41,7 +42,8 @@ type Opts struct {
 	AddPrometheusMetrics bool
 	// The max number of events the client is eligible to read (unfiltered) which we are willing to
 	// buffer on this connection. Too large and we consume lots of memory. Too small and busy accounts
-	// will trip the connection knifing. Customisable as tests might want to test filling the buffer.
+	// will have to catch up from the database, which makes their next response slower. Customisable as
+	// tests might want to test filling the buffer.
 	MaxPendingEventUpdates int
 	// if true, publishing messages will block until the consumer has consumed it.
 	// Assumes a single producer and a single consumer.
@@ -53,6 +55,28 @@ type Opts struct {
 
 	DBMaxConns        int
 	DBConnMaxIdleTime time.Duration
+	// DBReplicaURI is an optional postgres connection string for a read replica of the
+	// database. If set, heavy read-only queries are sent to the replica when it has caught up.
+	DBReplicaURI string
+	// EventSecret optionally enables encryption of event JSON at rest.
+	EventSecret string
+	// PreviousEventSecrets are secrets which used to encrypt events before EventSecret was rotated.
+	// Events encrypted with them remain readable.
+	PreviousEventSecrets []string
+	// PreviousSecrets are secrets which used to encrypt access tokens before the secret was rotated.
+	// Tokens encrypted with them remain usable, and are re-encrypted with the current secret on startup.
+	PreviousSecrets []string
+	// GlobalCacheMaxRooms is the maximum number of rooms to hold metadata for in memory. Rooms with
+	// connected users are always held in memory. 0 means all rooms are held in memory.
+	GlobalCacheMaxRooms int
+	// LazyStartup skips loading every room on startup, so requests can be served immediately.
+	// Rooms are loaded as users connect and as events arrive instead.
+	LazyStartup bool
+	// Limits are quotas on the requests each user can make. The zero value means no limits.
+	Limits handler.Limits
+	// ResponseBudget limits the room data in each response, sending the rest in later responses.
+	// Clients can ask for a smaller budget. The zero value means no limit.
+	ResponseBudget sync3.ResponseBudget
 
 	// HTTPTimeout is used for "normal" HTTP requests
 	HTTPTimeout time.Duration
@@ -86,6 +110,19 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 	}
 }
 
+func setDBLimits(db *sqlx.DB, opts Opts) {
+	if opts.DBMaxConns > 0 {
+		// https://github.com/go-sql-driver/mysql#important-settings
+		// "db.SetMaxIdleConns() is recommended to be set same to db.SetMaxOpenConns(). When it is smaller
+		// than SetMaxOpenConns(), connections can be opened and closed much more frequently than you expect."
+		db.SetMaxOpenConns(opts.DBMaxConns)
+		db.SetMaxIdleConns(opts.DBMaxConns)
+	}
+	if opts.DBConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(opts.DBConnMaxIdleTime)
+	}
+}
+
 // Setup the proxy
 func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
 	// Setup shared DB and HTTP client
@@ -104,18 +141,36 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		logger.Panic().Err(err).Str("uri", postgresURI).Msg("failed to open SQL DB")
 	}
 
-	if opts.DBMaxConns > 0 {
-		// https://github.com/go-sql-driver/mysql#important-settings
-		// "db.SetMaxIdleConns() is recommended to be set same to db.SetMaxOpenConns(). When it is smaller
-		// than SetMaxOpenConns(), connections can be opened and closed much more frequently than you expect."
-		db.SetMaxOpenConns(opts.DBMaxConns)
-		db.SetMaxIdleConns(opts.DBMaxConns)
+	setDBLimits(db, opts)
+	store := state.NewStorageWithDB(db, opts.AddPrometheusMetrics)
+	if opts.DBReplicaURI != "" {
+		replicaDB, err := sqlx.Open("postgres", opts.DBReplicaURI)
+		if err != nil {
+			sentry.CaptureException(err)
+			logger.Panic().Err(err).Msg("failed to open SQL DB replica")
+		}
+		setDBLimits(replicaDB, opts)
+		store.UseReadReplica(replicaDB)
+		logger.Info().Msg("routing read-only queries to DB replica")
 	}
-	if opts.DBConnMaxIdleTime > 0 {
-		db.SetConnMaxIdleTime(opts.DBConnMaxIdleTime)
+	if opts.EventSecret != "" {
+		eventCipher, err := state.NewEventCipher(opts.EventSecret, opts.PreviousEventSecrets...)
+		if err != nil {
+			logger.Panic().Err(err).Msg("failed to set up event encryption")
+		}
+		store.UseEventCipher(eventCipher)
+		logger.Info().Int("num_previous_secrets", len(opts.PreviousEventSecrets)).Msg("encrypting events at rest")
+		// encrypt events stored before encryption was enabled or the secret was rotated
+		go func() {
+			total, err := store.ReencryptEvents(1000)
+			if err != nil {
+				logger.Err(err).Int64("reencrypted", total).Msg("failed to encrypt stored events with the current events secret")
+				return
+			}
+			logger.Info().Int64("reencrypted", total).Msg("encrypted stored events with the current events secret, previous events secrets can now be removed")
+		}()
 	}
-	store := state.NewStorageWithDB(db, opts.AddPrometheusMetrics)
-	storev2 := sync2.NewStoreWithDB(db, secret)
+	storev2 := sync2.NewStoreWithDB(db, secret, opts.PreviousSecrets...)
 
 	// Automatically execute migrations
 	goose.SetBaseFS(EmbedMigrations)
@@ -124,6 +179,27 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 		logger.Panic().Err(err).Msg("failed to execute migrations")
 	}
 
+	// index the relations of events stored before relations were indexed
+	go func() {
+		total, err := store.BackfillRelations(1000)
+		if err != nil {
+			logger.Err(err).Int64("backfilled", total).Msg("failed to backfill event relations")
+			return
+		}
+		logger.Info().Int64("backfilled", total).Msg("backfilled event relations")
+	}()
+
+	if len(opts.PreviousSecrets) > 0 {
+		go func() {
+			total, err := storev2.TokensTable.ReencryptTokens()
+			if err != nil {
+				logger.Err(err).Int("reencrypted", total).Msg("failed to re-encrypt access tokens with the current secret")
+				return
+			}
+			logger.Info().Int("reencrypted", total).Msg("re-encrypted access tokens with the current secret, previous secrets can now be removed")
+		}()
+	}
+
 	bufferSize := 50
 	deviceDataUpdateFrequency := time.Second
 	if opts.TestingSynchronousPubsub {
@@ -148,12 +224,24 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if err != nil {
 		panic(err)
 	}
-	storeSnapshot, err := store.GlobalSnapshot()
-	if err != nil {
-		panic(err)
+	if opts.GlobalCacheMaxRooms > 0 {
+		h3.GlobalCache.SetMaxRooms(opts.GlobalCacheMaxRooms, h3.Dispatcher.HasReceiversInRoom, opts.AddPrometheusMetrics)
+	}
+	h3.SetLimits(opts.Limits)
+	h3.SetResponseBudget(opts.ResponseBudget)
+	if opts.LazyStartup {
+		if err = h3.StartupLazy(); err != nil {
+			panic(err)
+		}
+		logger.Info().Msg("started lazily, rooms will be loaded on demand")
+	} else {
+		storeSnapshot, err := store.GlobalSnapshot()
+		if err != nil {
+			panic(err)
+		}
+		logger.Info().Msg("retrieved global snapshot from database")
+		h3.Startup(&storeSnapshot)
 	}
-	logger.Info().Msg("retrieved global snapshot from database")
-	h3.Startup(&storeSnapshot)
 
 	// begin consuming from these positions
 	h2.Listen()
@@ -161,12 +249,20 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	return h2, h3
 }
 
-// RunSyncV3Server is the main entry point to the server
-func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) {
+// RunSyncV3Server is the main entry point to the server. Requests are served in the background until
+// Shutdown is called on the returned server. If send is set, requests to send events are routed to it.
+func RunSyncV3Server(h, ready, send http.Handler, bindAddr, destV2Server, tlsCert, tlsKey string) *http.Server {
 	// HTTP path routing
 	r := mux.NewRouter()
 	r.Handle("/_matrix/client/v3/sync", allowCORS(h))
 	r.Handle("/_matrix/client/unstable/org.matrix.msc3575/sync", allowCORS(h))
+	if ready != nil {
+		r.Handle("/ready", ready)
+	}
+	if send != nil {
+		r.PathPrefix("/_matrix/client/{version}/rooms/{roomID}/send/").Methods("PUT", "OPTIONS").Handler(allowCORS(send))
+		r.PathPrefix("/_matrix/client/{version}/rooms/{roomID}/state/").Methods("PUT", "OPTIONS").Handler(allowCORS(send))
+	}
 
 	serverJSON, _ := json.Marshal(struct {
 		Server  string `json:"server"`
@@ -217,26 +313,32 @@ func RunSyncV3Server(h http.Handler, bindAddr, destV2Server, tlsCert, tlsKey str
 		final: r,
 	}
 
-	// Block forever
-	var err error
-	if internal.IsUnixSocket(bindAddr) {
-		logger.Info().Msgf("listening on unix socket %s", bindAddr)
-		listener := unixSocketListener(bindAddr)
-		err = http.Serve(listener, srv)
-	} else {
-		if tlsCert != "" && tlsKey != "" {
-			logger.Info().Msgf("listening TLS on %s", bindAddr)
-			err = http.ListenAndServeTLS(bindAddr, tlsCert, tlsKey, srv)
+	httpServer := &http.Server{
+		Addr:    bindAddr,
+		Handler: srv,
+	}
+	go func() {
+		var err error
+		if internal.IsUnixSocket(bindAddr) {
+			logger.Info().Msgf("listening on unix socket %s", bindAddr)
+			listener := unixSocketListener(bindAddr)
+			err = httpServer.Serve(listener)
 		} else {
-			logger.Info().Msgf("listening on %s", bindAddr)
-			err = http.ListenAndServe(bindAddr, srv)
+			if tlsCert != "" && tlsKey != "" {
+				logger.Info().Msgf("listening TLS on %s", bindAddr)
+				err = httpServer.ListenAndServeTLS(tlsCert, tlsKey)
+			} else {
+				logger.Info().Msgf("listening on %s", bindAddr)
+				err = httpServer.ListenAndServe()
+			}
 		}
-	}
-	if err != nil {
-		sentry.CaptureException(err)
-		// TODO: Fatal() calls os.Exit. Will that give time for sentry.Flush() to run?
-		logger.Fatal().Err(err).Msg("failed to listen and serve")
-	}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			sentry.CaptureException(err)
+			// TODO: Fatal() calls os.Exit. Will that give time for sentry.Flush() to run?
+			logger.Fatal().Err(err).Msg("failed to listen and serve")
+		}
+	}()
+	return httpServer
 }
 
 func unixSocketListener(bindAddr string) net.Listener {